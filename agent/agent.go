@@ -0,0 +1,268 @@
+// Package agent implements a signing agent that holds identity keys in a
+// separate process, in the style of ssh-agent.
+//
+// The agent listens on a Unix socket. Clients list the public keys it holds
+// and ask it to sign data or for the box keys derived from them; private
+// keys never leave the agent.
+package agent
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
+)
+
+// SocketEnv is the environment variable that holds the path of the agent socket.
+const SocketEnv = "MURCOTT_AUTH_SOCK"
+
+type request struct {
+	Op     string `msgpack:"op"`
+	Digest []byte `msgpack:"digest"`
+	Data   []byte `msgpack:"data"`
+}
+
+type response struct {
+	Keys  []utils.PublicKey `msgpack:"keys"`
+	Sign  utils.Signature   `msgpack:"sign"`
+	Box   []byte            `msgpack:"box"`
+	Error string            `msgpack:"error"`
+}
+
+// Agent holds private keys and signs data on behalf of its clients.
+type Agent struct {
+	keys  []*utils.PrivateKey
+	mutex sync.RWMutex
+}
+
+// NewAgent generates an Agent with the given keys.
+func NewAgent(keys ...*utils.PrivateKey) *Agent {
+	return &Agent{keys: keys}
+}
+
+// Add adds a key to the agent.
+func (a *Agent) Add(key *utils.PrivateKey) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.keys = append(a.keys, key)
+}
+
+// Listen creates a Unix socket at the given path that only the current user can access.
+// The socket is created in a private directory and moved to the path once its
+// mode has been set, so that no other user can connect in between.
+func Listen(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".agent")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed from the path it is moved to.
+	l.SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, 0600)
+	if err == nil {
+		os.Remove(path)
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &listener{UnixListener: l, path: path}, nil
+}
+
+type listener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *listener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// Serve accepts connections on the listener and serves requests until the listener is closed.
+func (a *Agent) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go a.serveConn(conn)
+	}
+}
+
+func (a *Agent) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var req request
+		err := msgpack.NewDecoder(conn).Decode(&req)
+		if err != nil {
+			return
+		}
+		err = msgpack.NewEncoder(conn).Encode(a.handle(req))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (a *Agent) handle(req request) response {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	switch req.Op {
+	case "list":
+		var res response
+		for _, k := range a.keys {
+			res.Keys = append(res.Keys, k.PublicKey)
+		}
+		return res
+	case "sign":
+		for _, k := range a.keys {
+			d := k.Digest()
+			if string(d[:]) == string(req.Digest) {
+				sign := k.Sign(req.Data)
+				if sign == nil {
+					return response{Error: "cannot sign data"}
+				}
+				return response{Sign: *sign}
+			}
+		}
+		return response{Error: "key not found"}
+	case "boxkey":
+		for _, k := range a.keys {
+			d := k.Digest()
+			if string(d[:]) == string(req.Digest) {
+				box, err := k.BoxKey()
+				if err != nil {
+					return response{Error: err.Error()}
+				}
+				return response{Box: box.Bytes()}
+			}
+		}
+		return response{Error: "key not found"}
+	}
+	return response{Error: "unknown operation"}
+}
+
+// Client is a connection to an Agent.
+type Client struct {
+	conn  net.Conn
+	mutex sync.Mutex
+}
+
+// Dial connects to the agent listening on the given Unix socket.
+// If path is empty, the path is taken from SocketEnv.
+func Dial(path string) (*Client, error) {
+	if path == "" {
+		path = os.Getenv(SocketEnv)
+	}
+	if path == "" {
+		return nil, errors.New(SocketEnv + " is not set")
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn}, nil
+}
+
+func (c *Client) call(req request) (response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	err := msgpack.NewEncoder(c.conn).Encode(req)
+	if err != nil {
+		return response{}, err
+	}
+	var res response
+	err = msgpack.NewDecoder(c.conn).Decode(&res)
+	if err != nil {
+		return response{}, err
+	}
+	if res.Error != "" {
+		return response{}, errors.New(res.Error)
+	}
+	return res, nil
+}
+
+// Keys returns the public keys held by the agent.
+func (c *Client) Keys() ([]utils.PublicKey, error) {
+	res, err := c.call(request{Op: "list"})
+	if err != nil {
+		return nil, err
+	}
+	return res.Keys, nil
+}
+
+// Sign asks the agent to sign data with the private key of the given public key.
+func (c *Client) Sign(key *utils.PublicKey, data []byte) (*utils.Signature, error) {
+	d := key.Digest()
+	res, err := c.call(request{Op: "sign", Digest: d[:], Data: data})
+	if err != nil {
+		return nil, err
+	}
+	return &res.Sign, nil
+}
+
+// BoxKey asks the agent for the box key derived from the private key of the given public key.
+func (c *Client) BoxKey(key *utils.PublicKey) (*ecdh.PrivateKey, error) {
+	d := key.Digest()
+	res, err := c.call(request{Op: "boxkey", Digest: d[:]})
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(res.Box)
+}
+
+// Signer returns a utils.Signer for the first key held by the agent.
+func (c *Client) Signer() (*Signer, error) {
+	keys, err := c.Keys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("agent has no keys")
+	}
+	return &Signer{client: c, key: keys[0]}, nil
+}
+
+// Close closes the connection to the agent.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Signer signs data with a key held by an agent.
+type Signer struct {
+	client *Client
+	key    utils.PublicKey
+}
+
+// Public returns the public key of the identity.
+func (s *Signer) Public() *utils.PublicKey {
+	return &s.key
+}
+
+// Sign returns a signature of data, or nil if the agent cannot be reached.
+func (s *Signer) Sign(data []byte) *utils.Signature {
+	sign, err := s.client.Sign(&s.key, data)
+	if err != nil {
+		return nil
+	}
+	return sign
+}
+
+// BoxKey returns the box key of the identity, which is derived by the agent.
+func (s *Signer) BoxKey() (*ecdh.PrivateKey, error) {
+	return s.client.BoxKey(&s.key)
+}
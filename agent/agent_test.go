@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/h2so5/murcott/internal"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestAgentSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "murcott-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key1 := utils.GeneratePrivateKey()
+	key2 := utils.GenerateEd25519PrivateKey()
+	a := NewAgent(key1, key2)
+
+	path := filepath.Join(dir, "agent.sock")
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go a.Serve(l)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("the socket should be accessible only by the user: %v", fi.Mode())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("the temporary directory should be removed")
+	}
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	keys, err := c.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("wrong number of keys: %d; expects %d", len(keys), 2)
+	}
+
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	for i, k := range []*utils.PrivateKey{key1, key2} {
+		if keys[i].Digest().Cmp(k.Digest()) != 0 {
+			t.Errorf("keys[%d] has wrong digest", i)
+		}
+		sign, err := c.Sign(&keys[i], data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !k.Verify(data, sign) {
+			t.Errorf("varification failed")
+		}
+	}
+
+	if _, err := c.Sign(&utils.GeneratePrivateKey().PublicKey, data); err == nil {
+		t.Errorf("signing with an unknown key should fail")
+	}
+
+	s, err := c.Signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, err := s.BoxKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, _ := key1.BoxKey(); !box.Equal(expected) {
+		t.Errorf("the agent should return the box key derived from the key")
+	}
+
+	packet := internal.Packet{
+		Dst:     utils.NewRandomNodeID([4]byte{1, 1, 1, 1}),
+		Src:     s.Public().NodeID([4]byte{1, 1, 1, 1}),
+		Type:    "dht",
+		Payload: []byte("payload"),
+	}
+	if err := packet.Sign(s); err != nil {
+		t.Fatal(err)
+	}
+	if !packet.Verify(&key1.PublicKey) {
+		t.Errorf("varification failed")
+	}
+}
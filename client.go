@@ -2,6 +2,9 @@
 package murcott
 
 import (
+	"crypto/ecdh"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/h2so5/murcott/client"
@@ -15,18 +18,80 @@ type Client struct {
 	node          *node.Node
 	msgHandler    messageHandler
 	statusHandler statusHandler
+	succHandler   successionHandler
+	revHandler    revocationHandler
+	keyHandler    keyChangeHandler
+	subHandler    subscriptionHandler
 	status        client.UserStatus
 	profile       client.UserProfile
+	key           utils.Signer
+	boxKey        *ecdh.PrivateKey
+	boxRecord     *utils.BoxKeyRecord
 	id            utils.NodeID
 	Roster        *client.Roster
 	Logger        *log.Logger
+	storage       client.Storage
+	index         *client.SearchIndex
+
+	// seen holds the IDs of received chat messages to drop retransmissions.
+	seen      map[string]time.Time
+	seenMutex sync.Mutex
+	exit      chan struct{}
+
+	// boxKeys caches the box key records of other identities.
+	boxKeys  map[string]utils.BoxKeyRecord
+	boxMutex sync.Mutex
+
+	// versionWarned holds the identities warned about by checkKeyVersion.
+	versionWarned map[string]bool
+	keyMutex      sync.Mutex
+
+	convs       *client.Conversations
+	convHandler func(data []byte)
+
+	msgStatuses      *client.MessageStatuses
+	msgStatusHandler messageStatusHandler
+	noReadReceipts   bool
+
+	policy         client.MessagePolicy
+	requests       *client.RequestInbox
+	requestHandler messageRequestHandler
+	subRequests    *client.SubscriptionInbox
+
+	typing        *client.TypingCoalescer
+	typingTimers  map[string]*time.Timer
+	typingMutex   sync.Mutex
+	typingHandler typingHandler
+
+	groups          map[utils.Namespace]*client.Group
+	senderKeys      map[utils.Namespace]*groupKeys
+	pending         []pendingGroupMessage
+	causal          map[utils.Namespace]*client.CausalBuffer
+	deliverMutex    sync.Mutex
+	groupMutex      sync.Mutex
+	groupMsgHandler groupMessageHandler
+	groupHandler    groupHandler
 }
 
 type messageHandler func(src utils.NodeID, msg client.ChatMessage)
 type statusHandler func(src utils.NodeID, status client.UserStatus)
+type successionHandler func(old utils.NodeID, next utils.NodeID)
+type revocationHandler func(id utils.NodeID, reason string)
+type keyChangeHandler func(prev utils.NodeID, id utils.NodeID, verified bool)
 
-// NewClient generates a Client with the given PrivateKey.
-func NewClient(key *utils.PrivateKey, config utils.Config) (*Client, error) {
+// Retransmission of chat messages until they are acknowledged.
+const (
+	retryInterval = 2 * time.Second
+	maxAttempts   = 5
+	seenTimeout   = 10 * time.Minute
+)
+
+// maxSuccessionHops limits how many succession statements are followed
+// when an identity has been rotated more than once.
+const maxSuccessionHops = 8
+
+// NewClient generates a Client with the given Signer, such as a PrivateKey.
+func NewClient(key utils.Signer, config utils.Config) (*Client, error) {
 	logger := log.NewLogger()
 
 	node, err := node.NewNode(key, logger, config)
@@ -36,28 +101,133 @@ func NewClient(key *utils.PrivateKey, config utils.Config) (*Client, error) {
 
 	node.RegisterMessageType("chat", client.ChatMessage{})
 	node.RegisterMessageType("ack", client.MessageAck{})
+	node.RegisterMessageType("delivery-receipt", client.DeliveryReceipt{})
+	node.RegisterMessageType("read-receipt", client.ReadReceipt{})
+	node.RegisterMessageType("typing", client.TypingNotification{})
+	node.RegisterMessageType("sealed", client.SealedMessage{})
+	node.RegisterMessageType("boxkey-req", client.BoxKeyRequest{})
+	node.RegisterMessageType("boxkey-res", client.BoxKeyResponse{})
 	node.RegisterMessageType("profile-req", client.UserProfileRequest{})
 	node.RegisterMessageType("profile-res", client.UserProfileResponse{})
 	node.RegisterMessageType("presence", client.UserPresence{})
+	node.RegisterMessageType("subscribe", client.SubscriptionRequest{})
+	node.RegisterMessageType("subscription", client.SubscriptionResponse{})
+	node.RegisterMessageType("succession", client.KeySuccession{})
+	node.RegisterMessageType("revocation", client.KeyRevocation{})
+	node.RegisterMessageType("group-chat", client.GroupChatMessage{})
+	node.RegisterMessageType("group-join", client.GroupJoin{})
+	node.RegisterMessageType("group-op", client.GroupOperation{})
+	node.RegisterMessageType("group-update", client.GroupUpdate{})
+	node.RegisterMessageType("sender-key", client.SealedSenderKey{})
+	node.RegisterMessageType("sender-key-req", client.SenderKeyRequest{})
+
+	// The box key is derived from the identity key so that messages stored in
+	// the mailbox can be read after a restart. Signers that cannot derive it
+	// get a key that lasts as long as the client.
+	var boxKey *ecdh.PrivateKey
+	if k, ok := key.(utils.BoxKeyer); ok {
+		boxKey, err = k.BoxKey()
+	} else {
+		boxKey, err = utils.GenerateBoxKey()
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	c := &Client{
-		node:   node,
-		status: client.UserStatus{Type: client.StatusOffline},
-		id:     utils.NewNodeID([4]byte{1, 1, 1, 1}, key.Digest()),
-		Roster: &client.Roster{},
-		Logger: logger,
+		node:    node,
+		boxKey:  boxKey,
+		status:  client.UserStatus{Type: client.StatusOffline},
+		key:     key,
+		id:      key.Public().NodeID([4]byte{1, 1, 1, 1}),
+		Roster:  &client.Roster{},
+		Logger:  logger,
+		seen:    make(map[string]time.Time),
+		exit:    make(chan struct{}),
+		boxKeys: make(map[string]utils.BoxKeyRecord),
+		convs:   client.NewConversations(),
+		groups:  make(map[utils.Namespace]*client.Group),
+
+		versionWarned: make(map[string]bool),
+
+		msgStatuses:  client.NewMessageStatuses(),
+		requests:     client.NewRequestInbox(),
+		subRequests:  client.NewSubscriptionInbox(),
+		typing:       client.NewTypingCoalescer(),
+		typingTimers: make(map[string]*time.Timer),
+		senderKeys:   make(map[utils.Namespace]*groupKeys),
+		causal:       make(map[utils.Namespace]*client.CausalBuffer),
 	}
 
+	c.Roster.HandleChanges(func(entries []client.RosterEntry) {
+		c.blockedChanged(entries)
+		c.saveRoster(entries)
+	})
+
 	c.node.Handle(func(src utils.NodeID, msg interface{}) interface{} {
+		if src.NS != c.id.NS {
+			return c.handleGroup(src, msg)
+		}
+		// Blocked identities get no acknowledgement, receipt or presence.
+		if c.node.IsBlocked(src) {
+			return nil
+		}
+		if e, ok := c.Roster.Entry(src); ok && e.Key == nil {
+			go c.pinKey(src)
+		} else if !ok {
+			go c.checkKeyVersion(src)
+		}
 		switch msg.(type) {
 		case client.ChatMessage:
-			if c.msgHandler != nil {
-				c.msgHandler(src, msg.(client.ChatMessage))
+			// Chat messages are accepted only sealed, so that a relay cannot
+			// pass off content that the sender has not signed.
+			c.Logger.Error("unsealed message from %s dropped", src.String())
+		case client.SealedMessage:
+			sender, m, err := c.open(msg.(client.SealedMessage).Data)
+			if err != nil {
+				// The sender may have an outdated box key.
+				c.Logger.Error("sealed message from %s: %v", src.String(), err)
+				if r, err := c.boxKeyRecord(); err == nil {
+					return client.BoxKeyResponse{Record: *r}
+				}
+				return nil
+			}
+			if c.node.IsRevoked(sender) {
+				return nil
+			}
+			c.receiveTyping(sender, client.Paused)
+			if !c.admit(sender, m) {
+				return nil
+			}
+			return client.MessageAck{ID: m.ID}
+		case client.DeliveryReceipt:
+			c.receiveReceipt(src, msg.(client.DeliveryReceipt).IDs, client.MessageDelivered)
+		case client.ReadReceipt:
+			c.receiveReceipt(src, msg.(client.ReadReceipt).IDs, client.MessageRead)
+		case client.TypingNotification:
+			if c.isAllowed(src) {
+				c.receiveTyping(src, msg.(client.TypingNotification).State)
+			}
+		case client.SealedSenderKey:
+			err := c.receiveSenderKey(msg.(client.SealedSenderKey))
+			if err != nil {
+				c.Logger.Error("sender key from %s: %v", src.String(), err)
+				return nil
 			}
 			return client.MessageAck{}
+		case client.SenderKeyRequest:
+			c.answerSenderKeyRequest(src, msg.(client.SenderKeyRequest).Group)
+		case client.BoxKeyRequest:
+			if r, err := c.boxKeyRecord(); err == nil {
+				return client.BoxKeyResponse{Record: *r}
+			}
 		case client.UserProfileRequest:
 			return client.UserProfileResponse{Profile: c.profile}
 		case client.UserPresence:
+			// Presence is shared only with approved contacts.
+			if !c.isSubscribed(src) {
+				return nil
+			}
 			p := msg.(client.UserPresence)
 			if c.statusHandler != nil {
 				c.statusHandler(src, p.Status)
@@ -65,6 +235,17 @@ func NewClient(key *utils.PrivateKey, config utils.Config) (*Client, error) {
 			if !p.Ack {
 				c.node.Send(src, client.UserPresence{Status: c.status, Ack: true}, nil)
 			}
+		case client.SubscriptionRequest:
+			c.receiveSubscriptionRequest(src, msg.(client.SubscriptionRequest))
+		case client.SubscriptionResponse:
+			c.receiveSubscriptionResponse(src, msg.(client.SubscriptionResponse))
+		case client.KeySuccession:
+			s := msg.(client.KeySuccession).Statement
+			// Revocations of the old key are looked up in the DHT.
+			go c.applySuccession(&s)
+		case client.KeyRevocation:
+			r := msg.(client.KeyRevocation).Certificate
+			c.applyRevocation(&r)
 		}
 		return nil
 	})
@@ -74,6 +255,7 @@ func NewClient(key *utils.PrivateKey, config utils.Config) (*Client, error) {
 
 // Starts a mainloop in the current goroutine.
 func (c *Client) Run() {
+	go c.runMailbox()
 	c.node.Run()
 }
 
@@ -81,16 +263,146 @@ func (c *Client) Run() {
 func (c *Client) Close() {
 	status := c.status
 	status.Type = client.StatusOffline
-	for _, n := range c.Roster.List() {
+	for _, n := range c.Roster.Subscribed() {
 		c.node.Send(n, client.UserPresence{Status: status, Ack: false}, nil)
 	}
 	time.Sleep(100 * time.Millisecond)
+	close(c.exit)
 	c.node.Close()
 }
 
 // Sends the given message to the destination node.
-func (c *Client) SendMessage(dst utils.NodeID, msg client.ChatMessage) {
-	c.node.Send(dst, msg, func(r interface{}) {})
+// f is called with true when the node has acknowledged the message or the
+// message has been stored in its mailbox, or with false if the message could
+// not be delivered.
+func (c *Client) SendMessage(dst utils.NodeID, msg client.ChatMessage, f func(ok bool)) string {
+	return c.DeliverMessage(dst, msg, func(r client.DeliveryResult) {
+		if f != nil {
+			f(r == client.Delivered || r == client.Stored)
+		}
+	})
+}
+
+// DeliverMessage sends the given message to the destination node and
+// retransmits it until it is acknowledged. If the node does not acknowledge
+// the message, it is stored in the mailbox of the node for offline delivery.
+// The message is signed and encrypted to the box key of the destination, so
+// relays and mailboxes cannot read it; delivery fails if no box key is found.
+// It returns the ID of the message; an ID is assigned if the message has none.
+// f is called once with the result of the delivery. The status of the message
+// is passed to the handler registered by HandleMessageStatuses as it changes.
+func (c *Client) DeliverMessage(dst utils.NodeID, msg client.ChatMessage, f func(client.DeliveryResult)) string {
+	if msg.ID == "" {
+		msg.ID = client.NewMessageID()
+	}
+	c.addMessageStatus(msg.ID, dst)
+	c.storeMessage(client.StoredMessage{Peer: dst, Outgoing: true, Message: msg, Status: client.MessageSent, Time: time.Now()})
+	c.typing.Reset(dst.Digest.String())
+	go func() {
+		r := c.deliver(dst, msg)
+		if r == client.Timeout {
+			err := c.storeMail(dst, msg)
+			if err != nil {
+				c.Logger.Error("%v", err)
+			} else {
+				r = client.Stored
+			}
+		}
+		switch r {
+		case client.Delivered:
+			c.updateMessageStatus(dst, msg.ID, client.MessageDelivered)
+		case client.Stored:
+			c.updateMessageStatus(dst, msg.ID, client.MessageStored)
+		default:
+			c.updateMessageStatus(dst, msg.ID, client.MessageFailed)
+		}
+		if r != client.Delivered {
+			c.Logger.Error("Message %s to %s: %v", msg.ID, dst.String(), r)
+		}
+		if f != nil {
+			f(r)
+		}
+	}()
+	return msg.ID
+}
+
+func (c *Client) deliver(dst utils.NodeID, msg client.ChatMessage) client.DeliveryResult {
+	box, err := c.boxKeyOf(dst)
+	if err != nil {
+		c.Logger.Error("%v", err)
+		return client.Failed
+	}
+
+	acked := make(chan struct{}, 1)
+	rekeyed := make(chan *ecdh.PublicKey, 1)
+	for i := 0; i < maxAttempts; i++ {
+		// A ratchet message can be decrypted only once,
+		// so the message is sealed again for every attempt.
+		data, err := c.seal(box, dst, msg)
+		if err != nil {
+			c.Logger.Error("%v", err)
+			return client.Failed
+		}
+		err = c.node.Send(dst, client.SealedMessage{Data: data}, func(r interface{}) {
+			switch a := r.(type) {
+			case client.MessageAck:
+				if a.ID == msg.ID {
+					select {
+					case acked <- struct{}{}:
+					default:
+					}
+				}
+			case client.BoxKeyResponse:
+				if k, err := c.addBoxKey(dst, &a.Record); err == nil {
+					select {
+					case rekeyed <- k:
+					default:
+					}
+				}
+			}
+		})
+		if err != nil {
+			c.Logger.Error("%v", err)
+			return client.Failed
+		}
+		select {
+		case <-acked:
+			return client.Delivered
+		case box = <-rekeyed:
+		case <-time.After(retryInterval):
+		case <-c.exit:
+			return client.Failed
+		}
+	}
+	return client.Timeout
+}
+
+// isDuplicate reports whether the message has already been received.
+func (c *Client) isDuplicate(src utils.NodeID, id string) bool {
+	if id == "" {
+		return false
+	}
+	c.seenMutex.Lock()
+	defer c.seenMutex.Unlock()
+	now := time.Now()
+	for k, t := range c.seen {
+		if now.Sub(t) > seenTimeout {
+			delete(c.seen, k)
+		}
+	}
+	key := src.Digest.String() + "/" + id
+	if _, ok := c.seen[key]; ok {
+		return true
+	}
+	c.seen[key] = now
+	// Sealed messages are accepted for as long as mailboxes keep them,
+	// which is much longer than they are remembered here.
+	if c.storage != nil {
+		if m, err := c.storage.Message(src, id); err == nil && m != nil {
+			return true
+		}
+	}
+	return false
 }
 
 // HandleMessages registers the given function as a massage handler.
@@ -103,12 +415,235 @@ func (c *Client) HandleStatuses(handler func(src utils.NodeID, status client.Use
 	c.statusHandler = handler
 }
 
+// HandleSuccessions registers the given function as a handler of key successions.
+// The handler is called after a roster entry has been replaced with the new identity.
+func (c *Client) HandleSuccessions(handler func(old utils.NodeID, next utils.NodeID)) {
+	c.succHandler = handler
+}
+
+// PublishSuccession publishes the key succession statement to the DHT
+// and pushes it to the contacts in the roster that are not blocked.
+func (c *Client) PublishSuccession(s *utils.Succession) error {
+	if !s.Verify() {
+		return errors.New("invalid succession statement")
+	}
+	data, err := msgpack.Marshal(s)
+	if err != nil {
+		return err
+	}
+	c.node.StoreValue(utils.SuccessionKey(s.OldID()), string(data))
+	for _, n := range c.Roster.Unblocked() {
+		c.node.Send(n, client.KeySuccession{Statement: *s}, nil)
+	}
+	return nil
+}
+
+// LookupSuccession finds a verified key succession statement of the identity in the DHT.
+func (c *Client) LookupSuccession(id utils.NodeID) *utils.Succession {
+	data := c.node.LoadValue(utils.SuccessionKey(id))
+	if data == nil {
+		return nil
+	}
+	var s utils.Succession
+	if msgpack.Unmarshal([]byte(*data), &s) != nil {
+		return nil
+	}
+	if !s.Verify() || s.OldID().Digest != id.Digest {
+		return nil
+	}
+	return &s
+}
+
+// UpdateRoster looks up key succession statements and revocation certificates
+// of all contacts in the roster. Contacts that have moved to a new identity are
+// replaced, and revoked identities are refused from then on.
+func (c *Client) UpdateRoster() {
+	for _, id := range c.Roster.List() {
+		for i := 0; i < maxSuccessionHops; i++ {
+			s := c.LookupSuccession(id)
+			if s == nil || !c.applySuccession(s) {
+				break
+			}
+			id = s.Next
+		}
+		if r := c.LookupRevocation(id); r != nil {
+			c.applyRevocation(r)
+		}
+	}
+}
+
+func (c *Client) applySuccession(s *utils.Succession) bool {
+	if !s.Verify() {
+		c.Logger.Error("Invalid succession statement")
+		return false
+	}
+	old := s.OldID()
+	// A revoked key may be held by someone else, who could use it to
+	// redirect the contact to their own key.
+	if c.node.IsRevoked(old) {
+		c.Logger.Error("Succession statement of revoked identity: %s", old.String())
+		return false
+	}
+	if r := c.LookupRevocation(old); r != nil {
+		c.applyRevocation(r)
+		c.Logger.Error("Succession statement of revoked identity: %s", old.String())
+		return false
+	}
+	e, _ := c.Roster.Entry(old)
+	if c.Roster.Replace(old, s.Next) != nil {
+		return false
+	}
+	c.Logger.Info("Key succession: %s -> %s", old.String(), s.Next.String())
+	if c.succHandler != nil {
+		c.succHandler(old, s.Next)
+	}
+	c.keyChanged(old, s.Next, e.Verified)
+	return true
+}
+
+// HandleKeyChanges registers the given function as a handler of key changes.
+// The handler is called when the key of a contact in the roster changes;
+// verified reports whether the previous key had been verified.
+func (c *Client) HandleKeyChanges(handler func(prev utils.NodeID, id utils.NodeID, verified bool)) {
+	c.keyHandler = handler
+}
+
+func (c *Client) keyChanged(prev utils.NodeID, id utils.NodeID, verified bool) {
+	c.Logger.Warning("Key of %s has changed; verify the safety number again", id.String())
+	if c.keyHandler != nil {
+		c.keyHandler(prev, id, verified)
+	}
+}
+
+// pinKey pins the key of the contact on first use.
+func (c *Client) pinKey(id utils.NodeID) (*utils.PublicKey, error) {
+	key := c.node.PublicKey(id)
+	if key == nil {
+		return nil, errors.New("cannot get the key of " + id.String())
+	}
+	if _, ok := c.Roster.Entry(id); !ok {
+		return key, nil
+	}
+	return key, c.Roster.Pin(id, key)
+}
+
+// checkKeyVersion warns once if src has the key pinned for a contact under
+// another ID version, since the contact may not have moved to the new ID.
+func (c *Client) checkKeyVersion(src utils.NodeID) {
+	key := c.node.PublicKey(src)
+	if key == nil {
+		return
+	}
+	e, ok := c.Roster.EntryWithKey(key)
+	if !ok {
+		return
+	}
+	c.keyMutex.Lock()
+	warned := c.versionWarned[src.Digest.String()]
+	c.versionWarned[src.Digest.String()] = true
+	c.keyMutex.Unlock()
+	if !warned {
+		c.keyChanged(e.ID, src, e.Verified)
+	}
+}
+
+// SafetyNumber returns the safety number of the contact.
+// Both users see the same number when they have each other's keys, so
+// comparing it in person or over another channel confirms the contact's identity.
+// The key of a contact in the roster is pinned on first use.
+func (c *Client) SafetyNumber(id utils.NodeID) (string, error) {
+	key, err := c.pinKey(id)
+	if err != nil {
+		return "", err
+	}
+	return utils.SafetyNumber(c.key.Public(), key), nil
+}
+
+// VerifyContact marks the contact in the roster as verified.
+// Call it after the safety number has been compared.
+func (c *Client) VerifyContact(id utils.NodeID) error {
+	if _, ok := c.Roster.Entry(id); !ok {
+		return errors.New("not in the roster: " + id.String())
+	}
+	_, err := c.pinKey(id)
+	if err != nil {
+		return err
+	}
+	return c.Roster.SetVerified(id, true)
+}
+
+// HandleRevocations registers the given function as a handler of revoked identities.
+func (c *Client) HandleRevocations(handler func(id utils.NodeID, reason string)) {
+	c.revHandler = handler
+}
+
+// PublishRevocation publishes the revocation certificate to the DHT
+// and pushes it to the contacts in the roster that are not blocked.
+func (c *Client) PublishRevocation(r *utils.Revocation) error {
+	if !r.Verify() {
+		return errors.New("invalid revocation certificate")
+	}
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		return err
+	}
+	id := r.Key.NodeID(c.id.NS)
+	c.node.StoreValue(utils.RevocationKey(id), string(data))
+	for _, n := range c.Roster.Unblocked() {
+		c.node.Send(n, client.KeyRevocation{Certificate: *r}, nil)
+	}
+	return nil
+}
+
+// LookupRevocation finds a verified revocation certificate of the identity in the DHT.
+func (c *Client) LookupRevocation(id utils.NodeID) *utils.Revocation {
+	data := c.node.LoadValue(utils.RevocationKey(id))
+	if data == nil {
+		return nil
+	}
+	var r utils.Revocation
+	if msgpack.Unmarshal([]byte(*data), &r) != nil {
+		return nil
+	}
+	if !r.Verify() || r.Digest() != id.Digest {
+		return nil
+	}
+	return &r
+}
+
+// IsRevoked reports whether the identity is known to be revoked.
+func (c *Client) IsRevoked(id utils.NodeID) bool {
+	return c.node.IsRevoked(id)
+}
+
+func (c *Client) applyRevocation(r *utils.Revocation) {
+	id := r.Key.NodeID(c.id.NS)
+	if c.node.IsRevoked(id) {
+		return
+	}
+	err := c.node.Revoke(r)
+	if err != nil {
+		c.Logger.Error("%v", err)
+		return
+	}
+	if c.revHandler != nil {
+		c.revHandler(id, r.Reason)
+	}
+}
+
 // Requests a user profile to the destination node.
-// If no response is received from the node, RequestProfile tries to load a profile from the cache.
+// If no response is received from the node, RequestProfile tries to load a profile from the storage.
 func (c *Client) RequestProfile(dst utils.NodeID, f func(profile *client.UserProfile)) {
 	c.node.Send(dst, client.UserProfileRequest{}, func(r interface{}) {
 		if p, ok := r.(client.UserProfileResponse); ok {
+			c.saveProfile(dst, p.Profile)
 			f(&p.Profile)
+		} else if c.storage != nil {
+			p, err := c.storage.LoadProfile(dst)
+			if err != nil {
+				c.Logger.Error("storage: %v", err)
+			}
+			f(p)
 		} else {
 			f(nil)
 		}
@@ -125,7 +660,7 @@ func (c *Client) Status() client.UserStatus {
 
 func (c *Client) SetStatus(status client.UserStatus) {
 	c.status = status
-	for _, n := range c.Roster.List() {
+	for _, n := range c.Roster.Subscribed() {
 		c.node.Send(n, client.UserPresence{Status: c.status, Ack: false}, nil)
 	}
 }
@@ -136,6 +671,7 @@ func (c *Client) Profile() client.UserProfile {
 
 func (c *Client) SetProfile(profile client.UserProfile) {
 	c.profile = profile
+	c.saveProfile(c.id, profile)
 }
 
 func (c *Client) Nodes() int {
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"sort"
+	"time"
+)
+
+// VectorClock counts the group messages of each member, by the string of its digest.
+type VectorClock map[string]uint64
+
+// Copy returns a copy of the clock.
+func (v VectorClock) Copy() VectorClock {
+	c := make(VectorClock)
+	for k, n := range v {
+		c[k] = n
+	}
+	return c
+}
+
+// CausalOrder is the position of a group message among the messages of the
+// group. It is set by the sender and travels encrypted with the message.
+type CausalOrder struct {
+	// Clock counts the messages of each member that the sender had
+	// delivered or sent when it sent the message, including the message.
+	Clock VectorClock `msgpack:"clock"`
+	// Lamport orders all the messages of the group consistently with
+	// causality; ties are broken by the digest of the sender.
+	Lamport uint64 `msgpack:"lamport"`
+}
+
+// Before reports whether o happened before p, or if they are concurrent,
+// whether o comes first in the Lamport order. a and b are the digests of
+// the senders.
+func (o CausalOrder) Before(a string, p CausalOrder, b string) bool {
+	if o.Lamport != p.Lamport {
+		return o.Lamport < p.Lamport
+	}
+	return a < b
+}
+
+type causalMessage struct {
+	sender   string
+	order    CausalOrder
+	value    interface{}
+	received time.Time
+}
+
+// Limits of a CausalBuffer. A sender cannot have more messages waiting than
+// maxPendingPerSender, so a message that claims to follow more missing ones is
+// dropped. When maxPending messages are waiting, the first one in order is
+// delivered without waiting any longer.
+const (
+	maxPending          = 1000
+	maxPendingPerSender = 100
+)
+
+// CausalBuffer holds back group messages until the messages they depend on
+// have been delivered, so that a reply is never delivered before the message
+// it replies to. A message that waits longer than the timeout is delivered
+// anyway, since the messages it depends on may have been lost.
+type CausalBuffer struct {
+	self    string
+	clock   VectorClock
+	lamport uint64
+	// pending is kept in the order of CausalOrder.Before.
+	pending []causalMessage
+	senders map[string]int
+	timeout time.Duration
+}
+
+// NewCausalBuffer creates a CausalBuffer of the member self.
+func NewCausalBuffer(self string, timeout time.Duration) *CausalBuffer {
+	return &CausalBuffer{self: self, clock: make(VectorClock), senders: make(map[string]int), timeout: timeout}
+}
+
+// Clock returns the messages delivered or sent so far.
+func (b *CausalBuffer) Clock() VectorClock {
+	return b.clock.Copy()
+}
+
+// SetBaseline sets the messages a new member treats as delivered, so that
+// it does not wait for the messages sent before it joined.
+func (b *CausalBuffer) SetBaseline(clock VectorClock) {
+	for k, n := range clock {
+		if n > b.clock[k] {
+			b.clock[k] = n
+		}
+	}
+}
+
+// Stamp returns the order of a new message sent by the member.
+func (b *CausalBuffer) Stamp() CausalOrder {
+	b.clock[b.self]++
+	b.lamport++
+	return CausalOrder{Clock: b.clock.Copy(), Lamport: b.lamport}
+}
+
+// Add adds a message from the sender and returns the values of the messages
+// that can be delivered now, in causal order. Messages already delivered are
+// dropped, and so are messages beyond the limits of the buffer.
+func (b *CausalBuffer) Add(sender string, order CausalOrder, value interface{}, now time.Time) []interface{} {
+	n := order.Clock[sender]
+	if n <= b.clock[sender] || n-b.clock[sender]-1 > maxPendingPerSender || b.senders[sender] >= maxPendingPerSender {
+		return nil
+	}
+	if len(b.pending) >= maxPending {
+		// Give up waiting for the dependencies of the first message.
+		b.pending[0].received = time.Time{}
+	}
+	m := causalMessage{sender: sender, order: order, value: value, received: now}
+	i := sort.Search(len(b.pending), func(i int) bool {
+		p := b.pending[i]
+		return m.order.Before(m.sender, p.order, p.sender)
+	})
+	b.pending = append(b.pending, causalMessage{})
+	copy(b.pending[i+1:], b.pending[i:])
+	b.pending[i] = m
+	b.senders[sender]++
+	return b.Flush(now)
+}
+
+// Flush returns the values of the messages that can be delivered now,
+// including the ones that have waited longer than the timeout.
+func (b *CausalBuffer) Flush(now time.Time) []interface{} {
+	var values []interface{}
+	for {
+		i := b.next(now)
+		if i < 0 {
+			return values
+		}
+		m := b.pending[i]
+		b.pending = append(b.pending[:i], b.pending[i+1:]...)
+		if b.senders[m.sender]--; b.senders[m.sender] <= 0 {
+			delete(b.senders, m.sender)
+		}
+		if n := m.order.Clock[m.sender]; n <= b.clock[m.sender] {
+			continue
+		} else {
+			b.clock[m.sender] = n
+		}
+		if m.order.Lamport > b.lamport {
+			b.lamport = m.order.Lamport
+		}
+		values = append(values, m.value)
+	}
+}
+
+// next returns the index of the next message to deliver, or -1.
+func (b *CausalBuffer) next(now time.Time) int {
+	for i, m := range b.pending {
+		if b.ready(m) {
+			return i
+		}
+	}
+	// Give up waiting for the oldest message.
+	for i, m := range b.pending {
+		if now.Sub(m.received) >= b.timeout {
+			return i
+		}
+	}
+	return -1
+}
+
+// ready reports whether all the messages the message depends on have been delivered.
+func (b *CausalBuffer) ready(m causalMessage) bool {
+	for k, n := range m.order.Clock {
+		if k == m.sender {
+			if n != b.clock[k]+1 {
+				return false
+			}
+		} else if n > b.clock[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// Pending returns the number of messages held back.
+func (b *CausalBuffer) Pending() int {
+	return len(b.pending)
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCausalBuffer(t *testing.T) {
+	a := NewCausalBuffer("a", time.Second)
+	b := NewCausalBuffer("b", time.Second)
+	c := NewCausalBuffer("c", time.Second)
+	now := time.Now()
+
+	// b replies to a; c receives the reply first.
+	m1 := a.Stamp()
+	if v := b.Add("a", m1, "m1", now); len(v) != 1 {
+		t.Fatalf("m1 should be delivered to b: %v", v)
+	}
+	m2 := b.Stamp()
+	if v := c.Add("b", m2, "m2", now); len(v) != 0 {
+		t.Errorf("m2 should wait for m1: %v", v)
+	}
+	v := c.Add("a", m1, "m1", now)
+	if len(v) != 2 || v[0] != "m1" || v[1] != "m2" {
+		t.Errorf("wrong order: %v; expects [m1 m2]", v)
+	}
+	if v := c.Add("a", m1, "m1", now); len(v) != 0 {
+		t.Errorf("delivered message should be dropped: %v", v)
+	}
+	if !m1.Before("a", m2, "b") || m2.Before("b", m1, "a") {
+		t.Errorf("m1 should come before m2")
+	}
+
+	// A message whose dependency is lost is delivered after the timeout.
+	a.Stamp()
+	m4 := a.Stamp()
+	if v := c.Add("a", m4, "m4", now); len(v) != 0 {
+		t.Errorf("m4 should wait for m3: %v", v)
+	}
+	if v := c.Flush(now.Add(2 * time.Second)); len(v) != 1 || v[0] != "m4" {
+		t.Errorf("m4 should be delivered after the timeout: %v", v)
+	}
+	if c.Pending() != 0 {
+		t.Errorf("no message should be pending")
+	}
+
+	// A new member does not wait for the messages sent before it joined.
+	d := NewCausalBuffer("d", time.Second)
+	d.SetBaseline(c.Clock())
+	m5 := a.Stamp()
+	if v := d.Add("a", m5, "m5", now); len(v) != 1 {
+		t.Errorf("m5 should be delivered to a new member: %v", v)
+	}
+
+	// A message that claims to follow too many missing ones is dropped.
+	far := CausalOrder{Clock: VectorClock{"a": m5.Clock["a"] + maxPendingPerSender + 2}, Lamport: m5.Lamport + 1}
+	if v := d.Add("a", far, "far", now); len(v) != 0 || d.Pending() != 0 {
+		t.Errorf("message too far ahead should be dropped: %v", v)
+	}
+}
+
+func TestCausalBufferLimits(t *testing.T) {
+	b := NewCausalBuffer("b", time.Minute)
+	now := time.Now()
+
+	// Messages that wait for a lost one, at most maxPendingPerSender per sender.
+	for i := 0; i < maxPendingPerSender+10; i++ {
+		order := CausalOrder{Clock: VectorClock{"a": uint64(i + 2)}, Lamport: uint64(i + 2)}
+		b.Add("a", order, i, now)
+	}
+	if b.Pending() != maxPendingPerSender {
+		t.Errorf("wrong number of pending messages: %d; expects %d", b.Pending(), maxPendingPerSender)
+	}
+
+	// Messages of other senders that wait for a lost one fill the buffer.
+	for s := 0; s < maxPending/maxPendingPerSender-1; s++ {
+		sender := fmt.Sprint("s", s)
+		for i := 0; i < maxPendingPerSender; i++ {
+			order := CausalOrder{Clock: VectorClock{sender: uint64(i + 2)}, Lamport: uint64(i + 2)}
+			b.Add(sender, order, i, now)
+		}
+	}
+	if b.Pending() != maxPending {
+		t.Fatalf("wrong number of pending messages: %d; expects %d", b.Pending(), maxPending)
+	}
+	order := CausalOrder{Clock: VectorClock{"c": 2}, Lamport: 1}
+	if v := b.Add("c", order, "c", now); len(v) == 0 {
+		t.Errorf("the first message should be delivered when the buffer is full")
+	}
+	if b.Pending() > maxPending {
+		t.Errorf("too many pending messages: %d; expects at most %d", b.Pending(), maxPending)
+	}
+}
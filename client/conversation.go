@@ -0,0 +1,210 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
+)
+
+// PrekeyLifetime is how long a signed prekey is published before it is rotated.
+const PrekeyLifetime = 7 * 24 * time.Hour
+
+const (
+	// maxPrekeys prekeys are kept, so that a conversation can still be
+	// started with a bundle published before the last rotations.
+	maxPrekeys = 3
+	// maxInits limits the remembered X3DH headers that are refused when replayed.
+	maxInits = 100
+)
+
+// RatchetMessage is a ChatMessage encrypted with the ratchet of a conversation.
+type RatchetMessage struct {
+	Init   X3DHHeader    `msgpack:"init"`
+	Header RatchetHeader `msgpack:"header"`
+	Data   []byte        `msgpack:"data"`
+}
+
+type prekey struct {
+	Key  []byte    `msgpack:"key"`
+	Time time.Time `msgpack:"time"`
+}
+
+type conversationState struct {
+	Prekeys  []prekey            `msgpack:"prekeys"`
+	Ratchets map[string]*Ratchet `msgpack:"ratchets"`
+	Inits    [][]byte            `msgpack:"inits"`
+}
+
+// Conversations holds the signed prekeys of an identity and the double
+// ratchets of its forward-secret conversations with contacts.
+type Conversations struct {
+	state conversationState
+	mutex sync.Mutex
+}
+
+// NewConversations generates an empty Conversations.
+func NewConversations() *Conversations {
+	return &Conversations{
+		state: conversationState{Ratchets: make(map[string]*Ratchet)},
+	}
+}
+
+// Prekey returns the current signed prekey. A new prekey is generated if it
+// is older than PrekeyLifetime; rotated reports whether that has happened.
+func (c *Conversations) Prekey() (key *ecdh.PrivateKey, rotated bool, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if n := len(c.state.Prekeys); n > 0 && time.Since(c.state.Prekeys[n-1].Time) < PrekeyLifetime {
+		key, err := ecdh.X25519().NewPrivateKey(c.state.Prekeys[n-1].Key)
+		return key, false, err
+	}
+	key, err = ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, false, err
+	}
+	c.state.Prekeys = append(c.state.Prekeys, prekey{Key: key.Bytes(), Time: time.Now()})
+	if len(c.state.Prekeys) > maxPrekeys {
+		c.state.Prekeys = c.state.Prekeys[len(c.state.Prekeys)-maxPrekeys:]
+	}
+	return key, true, nil
+}
+
+func (c *Conversations) prekey(pub []byte) (*ecdh.PrivateKey, error) {
+	for _, p := range c.state.Prekeys {
+		key, err := ecdh.X25519().NewPrivateKey(p.Key)
+		if err == nil && bytes.Equal(key.PublicKey().Bytes(), pub) {
+			return key, nil
+		}
+	}
+	return nil, errors.New("unknown prekey")
+}
+
+// Start starts a conversation with id using its prekey bundle.
+// identity is the X25519 identity key of the initiator.
+func (c *Conversations) Start(id utils.NodeID, identity *ecdh.PrivateKey, b *PrekeyBundle) error {
+	if !b.Verify() || b.Key.Digest() != id.Digest {
+		return errors.New("invalid prekey bundle: " + id.String())
+	}
+	sk, ad, h, err := X3DHInitiate(identity, b)
+	if err != nil {
+		return err
+	}
+	r, err := NewSendingRatchet(sk, b.Prekey, ad)
+	if err != nil {
+		return err
+	}
+	r.Init = h
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.state.Ratchets[id.Digest.String()] = r
+	return nil
+}
+
+// Has reports whether there is a conversation with id.
+func (c *Conversations) Has(id utils.NodeID) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.state.Ratchets[id.Digest.String()]
+	return ok
+}
+
+// End forgets the conversation with id.
+func (c *Conversations) End(id utils.NodeID) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.state.Ratchets, id.Digest.String())
+}
+
+// Encrypt encrypts the plaintext for the conversation with id.
+func (c *Conversations) Encrypt(id utils.NodeID, plaintext []byte) (RatchetMessage, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	r, ok := c.state.Ratchets[id.Digest.String()]
+	if !ok {
+		return RatchetMessage{}, errors.New("no conversation with " + id.String())
+	}
+	h, data, err := r.Encrypt(plaintext)
+	if err != nil {
+		return RatchetMessage{}, err
+	}
+	m := RatchetMessage{Header: h, Data: data}
+	if !r.Confirmed {
+		m.Init = r.Init
+	}
+	return m, nil
+}
+
+// Decrypt decrypts a message of the conversation with id. A message that
+// carries an X3DH header starts a new conversation, unless both sides have
+// started one at the same time; then the one started by the smaller NodeID wins.
+func (c *Conversations) Decrypt(self utils.NodeID, id utils.NodeID, identity *ecdh.PrivateKey, m RatchetMessage) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := id.Digest.String()
+	r, ok := c.state.Ratchets[key]
+	if m.Init.IsZero() || (ok && bytes.Equal(r.Init.Ephemeral, m.Init.Ephemeral)) {
+		if !ok {
+			return nil, errors.New("no conversation with " + id.String())
+		}
+		return r.Decrypt(m.Header, m.Data)
+	}
+
+	if ok && !r.Confirmed && !r.Init.IsZero() && self.Digest.Cmp(id.Digest) < 0 {
+		return nil, errors.New("conversation already started with " + id.String())
+	}
+	for _, e := range c.state.Inits {
+		if bytes.Equal(e, m.Init.Ephemeral) {
+			return nil, errors.New("replayed conversation start")
+		}
+	}
+	pk, err := c.prekey(m.Init.Prekey)
+	if err != nil {
+		return nil, err
+	}
+	sk, ad, err := X3DHRespond(identity, pk, m.Init)
+	if err != nil {
+		return nil, err
+	}
+	r = NewReceivingRatchet(sk, pk, ad)
+	r.Init = m.Init
+	plaintext, err := r.Decrypt(m.Header, m.Data)
+	if err != nil {
+		return nil, err
+	}
+	c.state.Ratchets[key] = r
+	c.state.Inits = append(c.state.Inits, m.Init.Ephemeral)
+	if len(c.state.Inits) > maxInits {
+		c.state.Inits = c.state.Inits[len(c.state.Inits)-maxInits:]
+	}
+	return plaintext, nil
+}
+
+// MarshalBinary encodes the prekeys and the ratchets.
+// The result contains secret keys and must be stored securely.
+func (c *Conversations) MarshalBinary() ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return msgpack.Marshal(c.state)
+}
+
+// UnmarshalBinary decodes data encoded by MarshalBinary.
+func (c *Conversations) UnmarshalBinary(data []byte) error {
+	var s conversationState
+	err := msgpack.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	if s.Ratchets == nil {
+		s.Ratchets = make(map[string]*Ratchet)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.state = s
+	return nil
+}
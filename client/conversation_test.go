@@ -0,0 +1,138 @@
+package client
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+type party struct {
+	key      *utils.PrivateKey
+	id       utils.NodeID
+	identity *ecdh.PrivateKey
+	convs    *Conversations
+}
+
+func newParty(t *testing.T) *party {
+	key := utils.GeneratePrivateKey()
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &party{
+		key:      key,
+		id:       key.NodeID(utils.Namespace{1, 1, 1, 1}),
+		identity: identity,
+		convs:    NewConversations(),
+	}
+}
+
+func (p *party) bundle(t *testing.T) *PrekeyBundle {
+	pk, _, err := p.convs.Prekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewPrekeyBundle(p.key, p.identity.PublicKey(), pk.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func (p *party) send(t *testing.T, to *party, text string) RatchetMessage {
+	m, err := p.convs.Encrypt(to.id, []byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func (p *party) receive(t *testing.T, from *party, m RatchetMessage, text string) {
+	data, err := p.convs.Decrypt(p.id, from.id, p.identity, m)
+	if err != nil {
+		t.Fatalf("Decrypt(%q): %v", text, err)
+	}
+	if string(data) != text {
+		t.Errorf("wrong plaintext: %q; expects %q", string(data), text)
+	}
+}
+
+func TestConversation(t *testing.T) {
+	alice := newParty(t)
+	bob := newParty(t)
+
+	b := bob.bundle(t)
+	if err := alice.convs.Start(alice.id, alice.identity, b); err == nil {
+		t.Errorf("Start() with the bundle of another identity should fail")
+	}
+	if err := alice.convs.Start(bob.id, alice.identity, b); err != nil {
+		t.Fatal(err)
+	}
+
+	m1 := alice.send(t, bob, "1")
+	m2 := alice.send(t, bob, "2")
+	m3 := alice.send(t, bob, "3")
+	if m3.Init.IsZero() {
+		t.Errorf("X3DH header should be repeated until the conversation is confirmed")
+	}
+
+	// Out of order delivery.
+	bob.receive(t, alice, m3, "3")
+	bob.receive(t, alice, m1, "1")
+	if _, err := bob.convs.Decrypt(bob.id, alice.id, bob.identity, m1); err == nil {
+		t.Errorf("message should be decrypted only once")
+	}
+
+	r1 := bob.send(t, alice, "r1")
+	if !r1.Init.IsZero() {
+		t.Errorf("responder should not send an X3DH header")
+	}
+	alice.receive(t, bob, r1, "r1")
+	if m := alice.send(t, bob, "4"); !m.Init.IsZero() {
+		t.Errorf("X3DH header should not be sent after the conversation is confirmed")
+	} else {
+		bob.receive(t, alice, m, "4")
+	}
+
+	// Restart from the saved state.
+	data, err := bob.convs.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.convs = NewConversations()
+	if err := bob.convs.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	bob.receive(t, alice, m2, "2")
+	m5 := alice.send(t, bob, "5")
+	bob.receive(t, alice, m5, "5")
+
+	m5.Data[0] ^= 1
+	if _, err := bob.convs.Decrypt(bob.id, alice.id, bob.identity, m5); err == nil {
+		t.Errorf("tampered message should not be decrypted")
+	}
+}
+
+func TestConversationReplay(t *testing.T) {
+	alice := newParty(t)
+	bob := newParty(t)
+
+	if err := alice.convs.Start(bob.id, alice.identity, bob.bundle(t)); err != nil {
+		t.Fatal(err)
+	}
+	m1 := alice.send(t, bob, "1")
+	bob.receive(t, alice, m1, "1")
+
+	// A new conversation replaces the old one, but the old start is refused.
+	if err := alice.convs.Start(bob.id, alice.identity, bob.bundle(t)); err != nil {
+		t.Fatal(err)
+	}
+	m2 := alice.send(t, bob, "2")
+	bob.receive(t, alice, m2, "2")
+	bob.convs.End(alice.id)
+	if _, err := bob.convs.Decrypt(bob.id, alice.id, bob.identity, m1); err == nil {
+		t.Errorf("replayed conversation start should be refused")
+	}
+}
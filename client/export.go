@@ -0,0 +1,253 @@
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// ExportFormat represents the format of exported history.
+type ExportFormat int
+
+const (
+	// ExportJSON writes a JSON object per message, which can be imported.
+	ExportJSON ExportFormat = iota
+	// ExportText writes a plain text transcript.
+	ExportText
+	// ExportHTML writes an HTML transcript.
+	ExportHTML
+)
+
+func (f ExportFormat) String() string {
+	switch f {
+	case ExportJSON:
+		return "json"
+	case ExportText:
+		return "text"
+	case ExportHTML:
+		return "html"
+	}
+	return "unknown"
+}
+
+// ParseExportFormat parses the name of a format returned by String.
+func ParseExportFormat(s string) (ExportFormat, error) {
+	for _, f := range []ExportFormat{ExportJSON, ExportText, ExportHTML} {
+		if f.String() == s {
+			return f, nil
+		}
+	}
+	return 0, errors.New("unknown format: " + s)
+}
+
+type exportedContent struct {
+	Mime string `json:"mime"`
+	// Data that is not valid UTF-8 is encoded in Base64.
+	Data       string `json:"data,omitempty"`
+	DataBase64 string `json:"data_base64,omitempty"`
+}
+
+type exportedMessage struct {
+	ID       string            `json:"id"`
+	Peer     string            `json:"peer"`
+	From     string            `json:"from"`
+	Outgoing bool              `json:"outgoing"`
+	Status   string            `json:"status,omitempty"`
+	Time     time.Time         `json:"time"`
+	Sent     time.Time         `json:"sent"`
+	Contents []exportedContent `json:"contents"`
+}
+
+// sender returns the sender of the message, which is self if it is outgoing.
+func sender(self utils.NodeID, m *StoredMessage) utils.NodeID {
+	if m.Outgoing {
+		return self
+	}
+	return m.Peer
+}
+
+// Export writes the messages, which were sent or received by self, in the format.
+func Export(w io.Writer, self utils.NodeID, msgs []StoredMessage, format ExportFormat) error {
+	switch format {
+	case ExportJSON:
+		return exportJSON(w, self, msgs)
+	case ExportText:
+		return exportText(w, self, msgs)
+	case ExportHTML:
+		return exportHTML(w, self, msgs)
+	}
+	return errors.New("unknown format")
+}
+
+func exportJSON(w io.Writer, self utils.NodeID, msgs []StoredMessage) error {
+	enc := json.NewEncoder(w)
+	for i := range msgs {
+		m := &msgs[i]
+		e := exportedMessage{
+			ID:       m.Message.ID,
+			Peer:     m.Peer.String(),
+			From:     sender(self, m).String(),
+			Outgoing: m.Outgoing,
+			Time:     m.Time,
+			Sent:     m.Message.Time,
+			Contents: []exportedContent{},
+		}
+		if m.Outgoing {
+			e.Status = m.Status.String()
+		}
+		for _, c := range m.Message.Contents {
+			if utf8.ValidString(c.Data) {
+				e.Contents = append(e.Contents, exportedContent{Mime: c.Mime, Data: c.Data})
+			} else {
+				e.Contents = append(e.Contents, exportedContent{Mime: c.Mime, DataBase64: base64.StdEncoding.EncodeToString([]byte(c.Data))})
+			}
+		}
+		err := enc.Encode(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import reads messages written by Export in ExportJSON.
+func Import(r io.Reader) ([]StoredMessage, error) {
+	var msgs []StoredMessage
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxRecordSize)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		m, err := importMessage([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, s.Err()
+}
+
+func importMessage(line []byte) (StoredMessage, error) {
+	var e exportedMessage
+	err := json.Unmarshal(line, &e)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	if e.ID == "" {
+		return StoredMessage{}, errors.New("no message ID")
+	}
+	peer, err := utils.NewNodeIDFromString(e.Peer)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	m := StoredMessage{
+		Peer:     peer,
+		Outgoing: e.Outgoing,
+		Message:  ChatMessage{ID: e.ID, Time: e.Sent},
+		Time:     e.Time,
+	}
+	for _, s := range []MessageStatus{MessageSent, MessageFailed, MessageStored, MessageDelivered, MessageRead} {
+		if s.String() == e.Status {
+			m.Status = s
+		}
+	}
+	for _, c := range e.Contents {
+		data := c.Data
+		if c.DataBase64 != "" {
+			b, err := base64.StdEncoding.DecodeString(c.DataBase64)
+			if err != nil {
+				return StoredMessage{}, err
+			}
+			data = string(b)
+		}
+		m.Message.Contents = append(m.Message.Contents, Content{Mime: c.Mime, Data: data})
+	}
+	return m, nil
+}
+
+// transcriptLine returns the text of a message in a transcript. Contents
+// other than text are shown with their types and sizes.
+func transcriptLine(m *ChatMessage) string {
+	var parts []string
+	for _, c := range m.Contents {
+		if strings.HasPrefix(c.Mime, "text/plain") {
+			parts = append(parts, c.Data)
+		} else if strings.HasPrefix(c.Mime, "text/html") {
+			parts = append(parts, stripTags(c.Data))
+		} else {
+			parts = append(parts, "["+c.Mime+", "+strconv.Itoa(len(c.Data))+" bytes]")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func exportText(w io.Writer, self utils.NodeID, msgs []StoredMessage) error {
+	for i := range msgs {
+		m := &msgs[i]
+		_, err := fmt.Fprintf(w, "[%s] %s: %s\n", m.Time.Format("2006-01-02 15:04:05 -0700"), sender(self, m).String(), transcriptLine(&m.Message))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var transcriptTemplate = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>murcott transcript</title>
+<style>
+body { font-family: sans-serif; }
+.time { color: #888; }
+.from { font-weight: bold; }
+.outgoing .from { color: #36c; }
+</style>
+</head>
+<body>
+<p>Transcript of {{.Self}}</p>
+<table>
+{{range .Messages}}<tr class="{{if .Outgoing}}outgoing{{else}}incoming{{end}}">
+<td class="time">{{.Time}}</td>
+<td class="from">{{.From}}</td>
+<td>{{.Text}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func exportHTML(w io.Writer, self utils.NodeID, msgs []StoredMessage) error {
+	type row struct {
+		Time     string
+		From     string
+		Outgoing bool
+		Text     string
+	}
+	var rows []row
+	for i := range msgs {
+		m := &msgs[i]
+		rows = append(rows, row{
+			Time:     m.Time.Format("2006-01-02 15:04:05 -0700"),
+			From:     sender(self, m).String(),
+			Outgoing: m.Outgoing,
+			Text:     transcriptLine(&m.Message),
+		})
+	}
+	return transcriptTemplate.Execute(w, struct {
+		Self     string
+		Messages []row
+	}{self.String(), rows})
+}
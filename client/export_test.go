@@ -0,0 +1,78 @@
+package client
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestExport(t *testing.T) {
+	ns := utils.Namespace{1, 1, 1, 1}
+	self := utils.GeneratePrivateKey().NodeID(ns)
+	peer := utils.GeneratePrivateKey().NodeID(ns)
+	now := time.Now().Round(time.Second)
+
+	html := NewChatMessage([]Content{
+		{Mime: "text/html", Data: "<b>bold</b> <script>alert(1)</script>"},
+		{Mime: "image/png", Data: "\x89PNG\r\n\x1a\n\xff"},
+	})
+	html.Time = now.Add(-time.Minute)
+	msgs := []StoredMessage{
+		{Peer: peer, Outgoing: true, Message: NewPlainChatMessage("Hello"), Status: MessageRead, Time: now},
+		{Peer: peer, Message: html, Time: now.Add(time.Second)},
+	}
+
+	var b bytes.Buffer
+	if err := Export(&b, self, msgs, ExportJSON); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(b.String(), "\n"); n != 2 {
+		t.Errorf("wrong number of lines: %d; expects 2", n)
+	}
+	imported, err := Import(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != len(msgs) {
+		t.Fatalf("wrong number of messages: %d; expects %d", len(imported), len(msgs))
+	}
+	for i, m := range imported {
+		e := msgs[i]
+		if m.Peer.Digest.Cmp(e.Peer.Digest) != 0 || m.Outgoing != e.Outgoing || m.Status != e.Status ||
+			m.Message.ID != e.Message.ID || !m.Time.Equal(e.Time) || !m.Message.Time.Equal(e.Message.Time) {
+			t.Errorf("wrong message: %v; expects %v", m, e)
+		}
+		if len(m.Message.Contents) != len(e.Message.Contents) {
+			t.Errorf("wrong contents: %v; expects %v", m.Message.Contents, e.Message.Contents)
+			continue
+		}
+		for j, c := range m.Message.Contents {
+			if c != e.Message.Contents[j] {
+				t.Errorf("wrong content: %v; expects %v", c, e.Message.Contents[j])
+			}
+		}
+	}
+	if _, err := Import(strings.NewReader("{\"id\":\"a\",\"peer\":\"x\"}\n")); err == nil {
+		t.Errorf("invalid peers should be refused")
+	}
+
+	b.Reset()
+	if err := Export(&b, self, msgs, ExportText); err != nil {
+		t.Fatal(err)
+	}
+	text := b.String()
+	if !strings.Contains(text, self.String()+": Hello") || !strings.Contains(text, "[image/png, 9 bytes]") {
+		t.Errorf("wrong transcript: %s", text)
+	}
+
+	b.Reset()
+	if err := Export(&b, self, msgs, ExportHTML); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), "<script>") || !strings.Contains(b.String(), peer.String()) {
+		t.Errorf("wrong transcript: %s", b.String())
+	}
+}
@@ -0,0 +1,366 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
+)
+
+// maxRecordSize limits the size of a record in a FileStorage.
+const maxRecordSize = 64 << 20
+
+type statusRecord struct {
+	Peer   utils.NodeID  `msgpack:"peer"`
+	ID     string        `msgpack:"id"`
+	Status MessageStatus `msgpack:"status"`
+}
+
+type profileRecord struct {
+	ID      utils.NodeID `msgpack:"id"`
+	Profile UserProfile  `msgpack:"profile"`
+}
+
+type storageRecord struct {
+	Type    string         `msgpack:"type"`
+	Message *StoredMessage `msgpack:"message"`
+	Status  *statusRecord  `msgpack:"status"`
+	Roster  []RosterEntry  `msgpack:"roster"`
+	Profile *profileRecord `msgpack:"profile"`
+}
+
+// FileStorage is a Storage in a single file. Changes are appended to the
+// file as records and replayed when it is opened, and everything is kept in
+// memory. The file is compacted when it is opened if most of the records
+// have been superseded.
+type FileStorage struct {
+	path     string
+	file     *os.File
+	messages []StoredMessage
+	index    map[string]int
+	roster   []RosterEntry
+	profiles map[string]profileRecord
+	records  int
+	mutex    sync.Mutex
+}
+
+// NewFileStorage opens the storage in the file, creating it if needed.
+func NewFileStorage(path string) (*FileStorage, error) {
+	s := &FileStorage{
+		path:     path,
+		index:    make(map[string]int),
+		profiles: make(map[string]profileRecord),
+	}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if s.records > 2*s.live()+100 {
+		err = s.compact()
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func messageKey(peer utils.NodeID, id string) string {
+	return peer.Digest.String() + "/" + id
+}
+
+// load replays the records in the file. A record cut off by a crash is
+// removed from the end of the file.
+func (s *FileStorage) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		var size [4]byte
+		_, err := io.ReadFull(r, size[:])
+		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			return os.Truncate(s.path, offset)
+		} else if err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n > maxRecordSize {
+			return errors.New("corrupt storage: " + s.path)
+		}
+		data := make([]byte, n)
+		_, err = io.ReadFull(r, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return os.Truncate(s.path, offset)
+		} else if err != nil {
+			return err
+		}
+		var rec storageRecord
+		err = msgpack.Unmarshal(data, &rec)
+		if err != nil {
+			return errors.New("corrupt storage: " + s.path)
+		}
+		s.apply(&rec)
+		s.records++
+		offset += int64(len(size) + len(data))
+	}
+}
+
+func (s *FileStorage) apply(rec *storageRecord) {
+	switch rec.Type {
+	case "message":
+		if rec.Message != nil {
+			s.addMessage(*rec.Message)
+		}
+	case "status":
+		if rec.Status != nil {
+			if i, ok := s.index[messageKey(rec.Status.Peer, rec.Status.ID)]; ok {
+				s.messages[i].Status = rec.Status.Status
+			}
+		}
+	case "roster":
+		s.roster = rec.Roster
+	case "profile":
+		if rec.Profile != nil {
+			s.profiles[rec.Profile.ID.Digest.String()] = *rec.Profile
+		}
+	}
+}
+
+// addMessage inserts m in the order of Time and reports whether it is new.
+func (s *FileStorage) addMessage(m StoredMessage) bool {
+	if m.Message.ID == "" {
+		// Written before IDs were assigned at store time.
+		m.Message.ID = NewMessageID()
+	}
+	key := messageKey(m.Peer, m.Message.ID)
+	if _, ok := s.index[key]; ok {
+		return false
+	}
+	i := sort.Search(len(s.messages), func(i int) bool {
+		return s.messages[i].Time.After(m.Time)
+	})
+	s.messages = append(s.messages, StoredMessage{})
+	copy(s.messages[i+1:], s.messages[i:])
+	s.messages[i] = m
+	for j := i; j < len(s.messages); j++ {
+		s.index[messageKey(s.messages[j].Peer, s.messages[j].Message.ID)] = j
+	}
+	return true
+}
+
+// live returns the number of records needed to write the current state.
+func (s *FileStorage) live() int {
+	n := len(s.messages) + len(s.profiles)
+	if s.roster != nil {
+		n++
+	}
+	return n
+}
+
+func encodeRecord(rec *storageRecord) ([]byte, error) {
+	data, err := msgpack.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRecordSize {
+		return nil, errors.New("record too large")
+	}
+	b := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	return append(b, data...), nil
+}
+
+// compact rewrites the file with the current state.
+func (s *FileStorage) compact() error {
+	var recs []storageRecord
+	for i := range s.messages {
+		recs = append(recs, storageRecord{Type: "message", Message: &s.messages[i]})
+	}
+	if s.roster != nil {
+		recs = append(recs, storageRecord{Type: "roster", Roster: s.roster})
+	}
+	for _, p := range s.profiles {
+		p := p
+		recs = append(recs, storageRecord{Type: "profile", Profile: &p})
+	}
+
+	// A new temporary file, so that a file left over with a looser mode
+	// is never written to.
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = f.Chmod(0600)
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for i := range recs {
+		b, err := encodeRecord(&recs[i])
+		if err == nil {
+			_, err = w.Write(b)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	s.records = len(recs)
+	return os.Rename(tmp, s.path)
+}
+
+// write appends the record to the file and applies it. s.mutex must be held.
+func (s *FileStorage) write(rec *storageRecord) error {
+	if s.file == nil {
+		return errors.New("storage closed")
+	}
+	b, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(b)
+	if err != nil {
+		return err
+	}
+	s.apply(rec)
+	s.records++
+	return nil
+}
+
+func (s *FileStorage) AddMessage(m StoredMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if m.Message.ID == "" {
+		m.Message.ID = NewMessageID()
+	} else if _, ok := s.index[messageKey(m.Peer, m.Message.ID)]; ok {
+		return nil
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	return s.write(&storageRecord{Type: "message", Message: &m})
+}
+
+func (s *FileStorage) UpdateMessageStatus(peer utils.NodeID, id string, status MessageStatus) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.index[messageKey(peer, id)]; !ok {
+		return errors.New("message not found: " + id)
+	}
+	return s.write(&storageRecord{Type: "status", Status: &statusRecord{Peer: peer, ID: id, Status: status}})
+}
+
+func (s *FileStorage) Messages(q HistoryQuery) ([]StoredMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var msgs []StoredMessage
+	skip := q.Offset
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(msgs) >= q.Limit {
+			break
+		}
+		if !q.Match(&s.messages[i]) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		msgs = append(msgs, s.messages[i])
+	}
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, nil
+}
+
+func (s *FileStorage) Message(peer utils.NodeID, id string) (*StoredMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	i, ok := s.index[messageKey(peer, id)]
+	if !ok {
+		return nil, nil
+	}
+	m := s.messages[i]
+	return &m, nil
+}
+
+func (s *FileStorage) SaveRoster(entries []RosterEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if entries == nil {
+		entries = []RosterEntry{}
+	}
+	return s.write(&storageRecord{Type: "roster", Roster: entries})
+}
+
+func (s *FileStorage) LoadRoster() ([]RosterEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]RosterEntry(nil), s.roster...), nil
+}
+
+func (s *FileStorage) SaveProfile(id utils.NodeID, profile UserProfile) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(&storageRecord{Type: "profile", Profile: &profileRecord{ID: id, Profile: profile}})
+}
+
+func (s *FileStorage) LoadProfile(id utils.NodeID) (*UserProfile, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p, ok := s.profiles[id.Digest.String()]
+	if !ok {
+		return nil, nil
+	}
+	return &p.Profile, nil
+}
+
+// Close syncs and closes the file.
+func (s *FileStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if e := s.file.Close(); err == nil {
+		err = e
+	}
+	s.file = nil
+	return err
+}
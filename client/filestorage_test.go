@@ -0,0 +1,180 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "murcott")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.dat")
+
+	s, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns := utils.Namespace{1, 1, 1, 1}
+	alice := utils.GeneratePrivateKey().NodeID(ns)
+	bob := utils.GeneratePrivateKey().NodeID(ns)
+	now := time.Now()
+	var ids []string
+	var msgs []StoredMessage
+	for i := 0; i < 10; i++ {
+		peer := alice
+		if i%2 == 1 {
+			peer = bob
+		}
+		m := StoredMessage{
+			Peer:     peer,
+			Outgoing: i%3 == 0,
+			Message:  NewPlainChatMessage("Hello"),
+			Time:     now.Add(time.Duration(i) * time.Second),
+		}
+		ids = append(ids, m.Message.ID)
+		msgs = append(msgs, m)
+	}
+	// Messages are ordered by time whatever order they are stored in.
+	msgs[4], msgs[8] = msgs[8], msgs[4]
+	for _, m := range msgs {
+		if err := s.AddMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddMessage(StoredMessage{Peer: bob, Message: ChatMessage{ID: ids[5]}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateMessageStatus(alice, ids[0], MessageRead); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateMessageStatus(bob, ids[0], MessageRead); err == nil {
+		t.Errorf("the status of a message to another peer should not be updated")
+	}
+	s.SaveRoster([]RosterEntry{{ID: alice}, {ID: bob, Petname: "Bob", Groups: []string{"Work"}, Subscription: SubscriptionBoth}})
+	s.SaveProfile(alice, UserProfile{Nickname: "alice"})
+
+	check := func(q HistoryQuery, expects []int) {
+		msgs, err := s.Messages(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != len(expects) {
+			t.Errorf("wrong number of messages: %d; expects %d", len(msgs), len(expects))
+			return
+		}
+		for i, m := range msgs {
+			if m.Message.ID != ids[expects[i]] {
+				t.Errorf("wrong message at %d", i)
+			}
+		}
+	}
+	check(HistoryQuery{}, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	check(HistoryQuery{Peer: &bob}, []int{1, 3, 5, 7, 9})
+	check(HistoryQuery{Since: now.Add(2 * time.Second), Until: now.Add(5 * time.Second)}, []int{2, 3, 4})
+	check(HistoryQuery{Limit: 3}, []int{7, 8, 9})
+	check(HistoryQuery{Peer: &alice, Offset: 2, Limit: 2}, []int{2, 4})
+	s.Close()
+
+	// Cut off the last record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	s, err = NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check(HistoryQuery{}, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	msgs, _ = s.Messages(HistoryQuery{Limit: 1, Offset: 9})
+	if len(msgs) != 1 || msgs[0].Status != MessageRead || !msgs[0].Outgoing {
+		t.Errorf("the status should be stored")
+	}
+	if r, _ := s.LoadRoster(); len(r) != 2 || r[1].ID.Digest.Cmp(bob.Digest) != 0 || r[1].Name() != "Bob" || !r[1].InGroup("work") || r[1].Subscription != SubscriptionBoth {
+		t.Errorf("wrong roster: %v", r)
+	}
+	if p, _ := s.LoadProfile(alice); p == nil || p.Nickname != "alice" {
+		t.Errorf("wrong profile: %v", p)
+	}
+	if p, _ := s.LoadProfile(bob); p != nil {
+		t.Errorf("no profile should be stored for bob")
+	}
+	if err := s.AddMessage(StoredMessage{Peer: alice, Message: NewPlainChatMessage("Hi")}); err != nil {
+		t.Errorf("the storage should be writable after a record is cut off: %v", err)
+	}
+
+	// Messages without an ID are not mistaken for each other.
+	since := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		m := NewPlainChatMessage("No ID")
+		m.ID = ""
+		if err := s.AddMessage(StoredMessage{Peer: bob, Message: m, Time: since.Add(time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, _ = s.Messages(HistoryQuery{Peer: &bob, Since: since})
+	if len(msgs) != 2 || msgs[0].Message.ID == "" || msgs[0].Message.ID == msgs[1].Message.ID {
+		t.Errorf("messages without an ID should be stored with new IDs: %v", msgs)
+	}
+}
+
+func TestFileStorageCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "murcott")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.dat")
+
+	s, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := utils.GeneratePrivateKey().NodeID(utils.Namespace{1, 1, 1, 1})
+	m := NewPlainChatMessage("Hello")
+	if err := s.AddMessage(StoredMessage{Peer: peer, Outgoing: true, Message: m}); err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []MessageStatus{MessageDelivered, MessageRead} {
+		for i := 0; i < 100; i++ {
+			if err := s.UpdateMessageStatus(peer, m.ID, status); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s.Close()
+
+	// A file left over where a temporary file used to be is not written to.
+	if err := ioutil.WriteFile(path+".tmp", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.records != s.live() {
+		t.Errorf("the storage should be compacted: %d records; expects %d", s.records, s.live())
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("the storage should be readable only by the user: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(path + ".tmp"); len(data) != 0 {
+		t.Errorf("the storage should not be written to an existing file")
+	}
+	if msgs, _ := s.Messages(HistoryQuery{}); len(msgs) != 1 || msgs[0].Message.ID != m.ID || msgs[0].Status != MessageRead {
+		t.Errorf("wrong messages after compaction: %v", msgs)
+	}
+}
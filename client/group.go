@@ -0,0 +1,98 @@
+package client
+
+import (
+	"crypto/rand"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// Group represents the metadata of a group chat. A group is a namespace of
+// its own; the namespace of ID is the namespace of the group.
+type Group struct {
+	ID utils.NodeID `msgpack:"id"`
+
+	// Name, Topic, Members, Owner, Admins and Banned are computed from Log.
+	// Members holds the identities of the members in the default namespace.
+	Name    string           `msgpack:"name"`
+	Topic   string           `msgpack:"topic"`
+	Members []utils.NodeID   `msgpack:"members"`
+	Owner   utils.NodeID     `msgpack:"owner"`
+	Admins  []utils.NodeID   `msgpack:"admins"`
+	Banned  []utils.NodeID   `msgpack:"banned"`
+	Log     []GroupOperation `msgpack:"log"`
+}
+
+// NewGroupID generates the ID of a new group owned by owner in a random namespace.
+func NewGroupID(owner utils.NodeID) utils.NodeID {
+	var ns utils.Namespace
+	for {
+		rand.Read(ns[:])
+		ok := ns != utils.Namespace{1, 1, 1, 1}
+		// Zero bytes in a namespace match any value.
+		for _, b := range ns {
+			if b == 0 {
+				ok = false
+			}
+		}
+		if ok {
+			return owner.WithNS(ns)
+		}
+	}
+}
+
+// HasMember reports whether id is a member of the group.
+func (g *Group) HasMember(id utils.NodeID) bool {
+	return indexOf(g.Members, id) >= 0
+}
+
+func indexOf(ids []utils.NodeID, id utils.NodeID) int {
+	for i, m := range ids {
+		if m.Digest.Cmp(id.Digest) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddMember adds id to the group and reports whether it was not a member.
+func (g *Group) AddMember(id utils.NodeID) bool {
+	if g.HasMember(id) {
+		return false
+	}
+	g.Members = append(g.Members, id)
+	return true
+}
+
+// RemoveMember removes id from the group and reports whether it was a member.
+func (g *Group) RemoveMember(id utils.NodeID) bool {
+	i := indexOf(g.Members, id)
+	if i < 0 {
+		return false
+	}
+	g.Members = append(g.Members[:i], g.Members[i+1:]...)
+	return true
+}
+
+// GroupChatMessage is a ChatMessage sent to a group, encrypted with the
+// sender key of the sender and signed by its identity key.
+type GroupChatMessage struct {
+	Key        utils.PublicKey `msgpack:"key"`
+	Generation uint32          `msgpack:"generation"`
+	N          uint32          `msgpack:"n"`
+	Data       []byte          `msgpack:"data"`
+	S          utils.Signature `msgpack:"sign"`
+}
+
+// GroupJoin asks the members for the group with an invitation.
+// Members reply with a GroupUpdate if the invitation is valid.
+type GroupJoin struct {
+	Invite GroupInvite `msgpack:"invite"`
+}
+
+// GroupUpdate carries the metadata of a group. The metadata is taken from
+// the log only if it is valid. Clock tells a new member which messages were
+// sent before it joined.
+type GroupUpdate struct {
+	Group Group       `msgpack:"group"`
+	Clock VectorClock `msgpack:"clock"`
+}
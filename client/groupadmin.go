@@ -0,0 +1,479 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+	"github.com/tv42/base58"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Role represents the role of a member in a group.
+type Role int
+
+const (
+	// RoleMember can send messages and leave the group.
+	RoleMember Role = iota
+	// RoleAdmin can also invite, kick, ban and unban members.
+	RoleAdmin
+	// RoleOwner can also change the roles of the members.
+	// There is exactly one owner in a group.
+	RoleOwner
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleMember:
+		return "member"
+	case RoleAdmin:
+		return "admin"
+	case RoleOwner:
+		return "owner"
+	}
+	return "unknown"
+}
+
+// ParseRole parses the string returned by Role.String.
+func ParseRole(str string) (Role, error) {
+	for _, r := range []Role{RoleMember, RoleAdmin, RoleOwner} {
+		if r.String() == str {
+			return r, nil
+		}
+	}
+	return 0, errors.New("unknown role: " + str)
+}
+
+// Types of GroupOperation.
+const (
+	// OpCreate creates the group. It is the first operation and must be
+	// signed by the identity whose digest is the digest of the group ID.
+	OpCreate = "create"
+	// OpJoin adds the signer to the group with an invitation.
+	OpJoin = "join"
+	// OpLeave removes the signer from the group.
+	OpLeave = "leave"
+	// OpKick removes a member with a lower role than the signer.
+	OpKick = "kick"
+	// OpBan removes a member with a lower role than the signer, if any,
+	// and refuses it from joining again.
+	OpBan = "ban"
+	// OpUnban lifts a ban.
+	OpUnban = "unban"
+	// OpRole changes the role of a member. Giving RoleOwner to a member
+	// makes the signer an admin.
+	OpRole = "role"
+	// OpInfo changes the name and the topic of the group.
+	// Only admins and the owner can do it.
+	OpInfo = "info"
+)
+
+// GroupInvite allows anyone who has it to join the group until it expires.
+// It is signed by an admin or the owner of the group.
+type GroupInvite struct {
+	Group   utils.NodeID    `msgpack:"group"`
+	Key     utils.PublicKey `msgpack:"key"`
+	Expires time.Time       `msgpack:"expires"`
+	S       utils.Signature `msgpack:"sign"`
+}
+
+// NewGroupInvite generates a GroupInvite signed by key.
+func NewGroupInvite(key utils.Signer, group utils.NodeID, expires time.Time) (*GroupInvite, error) {
+	i := &GroupInvite{
+		Group:   group,
+		Key:     *key.Public(),
+		Expires: expires,
+	}
+	sign := key.Sign(i.serialize())
+	if sign == nil {
+		return nil, errors.New("cannot sign invitation")
+	}
+	i.S = *sign
+	return i, nil
+}
+
+// GroupInviteFromString decodes the string returned by GroupInvite.String.
+func GroupInviteFromString(str string) (*GroupInvite, error) {
+	b, err := base58.DecodeToBig([]byte(str))
+	if err != nil {
+		return nil, err
+	}
+	var i GroupInvite
+	err = msgpack.Unmarshal(b.Bytes(), &i)
+	if err != nil {
+		return nil, err
+	}
+	if !i.Verify() {
+		return nil, errors.New("wrong signature")
+	}
+	return &i, nil
+}
+
+// String returns the invitation as a base58-encoded byte array.
+func (i *GroupInvite) String() string {
+	data, _ := msgpack.Marshal(i)
+	return string(base58.EncodeBig(nil, big.NewInt(0).SetBytes(data)))
+}
+
+func (i *GroupInvite) serialize() []byte {
+	ary := []interface{}{
+		"group-invite",
+		i.Group.Bytes(),
+		i.Key.NodeID(utils.Namespace{}).Bytes(),
+		i.Expires.Unix(),
+	}
+
+	data, _ := msgpack.Marshal(ary)
+	return data
+}
+
+// Verify reports whether the invitation is signed by its key.
+// It does not check the role of the signer.
+func (i *GroupInvite) Verify() bool {
+	if i.Key.IsZero() {
+		return false
+	}
+	return i.Key.Verify(i.serialize(), &i.S)
+}
+
+// GroupOperation is a signed change to the members or the metadata of a
+// group. The operations form a chain through Prev, the hash of the previous
+// operation, and every member computes the group by applying the chain from OpCreate.
+// Name and Topic are used only by OpInfo.
+type GroupOperation struct {
+	Type   string          `msgpack:"type"`
+	Target utils.NodeID    `msgpack:"target"`
+	Role   Role            `msgpack:"role"`
+	Invite *GroupInvite    `msgpack:"invite"`
+	Name   string          `msgpack:"name"`
+	Topic  string          `msgpack:"topic"`
+	Prev   []byte          `msgpack:"prev"`
+	Time   time.Time       `msgpack:"time"`
+	Key    utils.PublicKey `msgpack:"key"`
+	S      utils.Signature `msgpack:"sign"`
+}
+
+// NewGroupOperation generates a GroupOperation on the group signed by key.
+// Target must be in the default namespace. Invite is used only by OpJoin.
+func NewGroupOperation(key utils.Signer, group utils.NodeID, prev []byte, typ string, target utils.NodeID, role Role, invite *GroupInvite) (*GroupOperation, error) {
+	op := &GroupOperation{
+		Type:   typ,
+		Target: target,
+		Role:   role,
+		Prev:   prev,
+		Time:   time.Now(),
+		Key:    *key.Public(),
+		Invite: invite,
+	}
+	return op, op.sign(key, group)
+}
+
+// NewGroupInfoOperation generates an OpInfo operation on the group signed by key.
+func NewGroupInfoOperation(key utils.Signer, group utils.NodeID, prev []byte, name string, topic string) (*GroupOperation, error) {
+	op := &GroupOperation{
+		Type:   OpInfo,
+		Target: key.Public().NodeID(utils.Namespace{1, 1, 1, 1}),
+		Name:   name,
+		Topic:  topic,
+		Prev:   prev,
+		Time:   time.Now(),
+		Key:    *key.Public(),
+	}
+	return op, op.sign(key, group)
+}
+
+func (op *GroupOperation) sign(key utils.Signer, group utils.NodeID) error {
+	sign := key.Sign(op.serialize(group))
+	if sign == nil {
+		return errors.New("cannot sign group operation")
+	}
+	op.S = *sign
+	return nil
+}
+
+func (op *GroupOperation) serialize(group utils.NodeID) []byte {
+	var invite []byte
+	if op.Invite != nil {
+		invite = op.Invite.serialize()
+	}
+	ary := []interface{}{
+		"group-op",
+		group.Bytes(),
+		op.Type,
+		op.Target.Bytes(),
+		int(op.Role),
+		invite,
+		op.Name,
+		op.Topic,
+		op.Prev,
+		op.Time.Unix(),
+	}
+
+	data, _ := msgpack.Marshal(ary)
+	return data
+}
+
+// Hash returns the hash by which the next operation on the group refers to op.
+func (op *GroupOperation) Hash(group utils.NodeID) []byte {
+	d := op.Key.Digest()
+	h := sha256.Sum256(append(op.serialize(group), d[:]...))
+	return h[:]
+}
+
+// Signer returns the identity of the signer in the default namespace.
+func (op *GroupOperation) Signer() utils.NodeID {
+	return op.Key.NodeID(utils.Namespace{1, 1, 1, 1})
+}
+
+// ReplayGroup verifies the chain of operations and returns the group it results in.
+func ReplayGroup(id utils.NodeID, log []GroupOperation) (*Group, error) {
+	g := &Group{ID: id}
+	for i := range log {
+		if err := g.Apply(log[i]); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Head returns the hash of the last operation, or nil if there is none.
+func (g *Group) Head() []byte {
+	if len(g.Log) == 0 {
+		return nil
+	}
+	return g.Log[len(g.Log)-1].Hash(g.ID)
+}
+
+// Role returns the role of the member.
+func (g *Group) Role(id utils.NodeID) Role {
+	if g.Owner.Digest.Cmp(id.Digest) == 0 {
+		return RoleOwner
+	}
+	if indexOf(g.Admins, id) >= 0 {
+		return RoleAdmin
+	}
+	return RoleMember
+}
+
+// IsBanned reports whether id is banned from the group.
+func (g *Group) IsBanned(id utils.NodeID) bool {
+	return indexOf(g.Banned, id) >= 0
+}
+
+// CheckInvite returns an error unless the invitation is signed by a current
+// admin of the group and has not expired at t.
+func (g *Group) CheckInvite(i *GroupInvite, t time.Time) error {
+	if i.Group.NS != g.ID.NS || i.Group.Digest != g.ID.Digest || !i.Verify() {
+		return errors.New("invalid invitation")
+	}
+	inviter := i.Key.NodeID(utils.Namespace{1, 1, 1, 1})
+	if !g.HasMember(inviter) || g.Role(inviter) < RoleAdmin {
+		return errors.New("invitation not signed by an admin")
+	}
+	if t.After(i.Expires) {
+		return errors.New("invitation expired")
+	}
+	return nil
+}
+
+// Apply verifies the operation against the current members and appends it to the log.
+func (g *Group) Apply(op GroupOperation) error {
+	if !bytes.Equal(op.Prev, g.Head()) {
+		return errors.New("operation does not follow the last one")
+	}
+	if op.Key.IsZero() || !op.Key.Verify(op.serialize(g.ID), &op.S) {
+		return errors.New("wrong signature")
+	}
+	signer := op.Signer()
+	target := op.Target.WithNS(utils.Namespace{1, 1, 1, 1})
+	if op.Type != OpCreate && len(g.Log) == 0 {
+		return errors.New("group not created")
+	}
+	if op.Type != OpCreate && op.Type != OpJoin && !g.HasMember(signer) {
+		return errors.New("signer is not a member")
+	}
+
+	switch op.Type {
+	case OpCreate:
+		if len(g.Log) > 0 {
+			return errors.New("group already created")
+		}
+		if signer.Digest != g.ID.Digest || target.Digest != signer.Digest {
+			return errors.New("group not created by its owner")
+		}
+		g.Owner = signer
+		g.Members = []utils.NodeID{signer}
+	case OpJoin:
+		if target.Digest != signer.Digest {
+			return errors.New("cannot join on behalf of another")
+		}
+		if g.HasMember(signer) {
+			return errors.New("already a member")
+		}
+		if g.IsBanned(signer) {
+			return errors.New("banned from the group")
+		}
+		if op.Invite == nil {
+			return errors.New("no invitation")
+		}
+		if err := g.CheckInvite(op.Invite, op.Time); err != nil {
+			return err
+		}
+		g.AddMember(signer)
+	case OpLeave:
+		if target.Digest != signer.Digest {
+			return errors.New("cannot leave on behalf of another")
+		}
+		if g.Role(signer) == RoleOwner && len(g.Members) > 1 {
+			return errors.New("the owner cannot leave while there are members")
+		}
+		g.removeMember(signer)
+	case OpKick, OpBan:
+		if g.Role(signer) < RoleAdmin {
+			return errors.New("not an admin")
+		}
+		if g.HasMember(target) {
+			if g.Role(target) >= g.Role(signer) {
+				return errors.New("cannot remove a member of the same or higher role")
+			}
+			g.removeMember(target)
+		} else if op.Type == OpKick {
+			return errors.New("not a member")
+		}
+		if op.Type == OpBan && !g.IsBanned(target) {
+			g.Banned = append(g.Banned, target)
+		}
+	case OpUnban:
+		if g.Role(signer) < RoleAdmin {
+			return errors.New("not an admin")
+		}
+		i := indexOf(g.Banned, target)
+		if i < 0 {
+			return errors.New("not banned")
+		}
+		g.Banned = append(g.Banned[:i], g.Banned[i+1:]...)
+	case OpRole:
+		if g.Role(signer) != RoleOwner {
+			return errors.New("not the owner")
+		}
+		if !g.HasMember(target) || target.Digest == signer.Digest {
+			return errors.New("cannot change the role")
+		}
+		if op.Role < RoleMember || op.Role > RoleOwner {
+			return errors.New("unknown role")
+		}
+		if i := indexOf(g.Admins, target); i >= 0 {
+			g.Admins = append(g.Admins[:i], g.Admins[i+1:]...)
+		}
+		switch op.Role {
+		case RoleAdmin:
+			g.Admins = append(g.Admins, target)
+		case RoleOwner:
+			g.Owner = target
+			g.Admins = append(g.Admins, signer)
+		}
+	case OpInfo:
+		if g.Role(signer) < RoleAdmin {
+			return errors.New("not an admin")
+		}
+		g.Name = op.Name
+		g.Topic = op.Topic
+	default:
+		return errors.New("unknown operation: " + op.Type)
+	}
+	g.Log = append(g.Log, op)
+	return nil
+}
+
+func (g *Group) removeMember(id utils.NodeID) {
+	g.RemoveMember(id)
+	if i := indexOf(g.Admins, id); i >= 0 {
+		g.Admins = append(g.Admins[:i], g.Admins[i+1:]...)
+	}
+}
+
+// Better reports whether the log of g should replace the log of h when both
+// are valid. A log that extends the other wins. Logs that have forked are
+// not compared by length, since anyone can make a branch longer: the branch
+// whose first operation was signed by the higher role wins, then the branch
+// that kicks or bans, and the smaller hash of the first operation breaks
+// ties, so that all members agree after concurrent operations.
+func (g *Group) Better(h *Group) bool {
+	n := commonPrefix(g, h)
+	if n == len(h.Log) {
+		return len(g.Log) > n
+	}
+	if n == len(g.Log) {
+		return false
+	}
+	base, err := ReplayGroup(g.ID, g.Log[:n])
+	if err != nil {
+		return false
+	}
+	a, b := g.Log[n], h.Log[n]
+	if ra, rb := base.Role(a.Signer()), base.Role(b.Signer()); ra != rb {
+		return ra > rb
+	}
+	if ra, rb := hasRemoval(g.Log[n:]), hasRemoval(h.Log[n:]); ra != rb {
+		return ra
+	}
+	return bytes.Compare(a.Hash(g.ID), b.Hash(g.ID)) < 0
+}
+
+// CheckUpdate returns an error if the operations of r that g does not have
+// cannot be accepted at now, when they are seen for the first time. Their
+// times are chosen by their signers, so none may be ahead of now by more
+// than skew, and the invitation of a join must not have expired at now
+// unless an admin has signed an operation after the join.
+func (g *Group) CheckUpdate(r *Group, now time.Time, skew time.Duration) error {
+	if len(g.Log) == 0 {
+		// A new member has seen no operation to compare with.
+		return nil
+	}
+	n := commonPrefix(g, r)
+	h, err := ReplayGroup(r.ID, r.Log[:n])
+	if err != nil {
+		return err
+	}
+	admin := make([]bool, len(r.Log))
+	for i := n; i < len(r.Log); i++ {
+		admin[i] = h.Role(r.Log[i].Signer()) >= RoleAdmin
+		if err := h.Apply(r.Log[i]); err != nil {
+			return err
+		}
+	}
+	endorsed := false
+	for i := len(r.Log) - 1; i >= n; i-- {
+		op := &r.Log[i]
+		endorsed = endorsed || admin[i]
+		if op.Time.After(now.Add(skew)) {
+			return errors.New("operation made in the future")
+		}
+		if op.Type == OpJoin && op.Invite != nil && now.After(op.Invite.Expires) && !endorsed {
+			return errors.New("invitation expired")
+		}
+	}
+	return nil
+}
+
+// commonPrefix returns the number of operations at the start of the logs
+// that are the same.
+func commonPrefix(g *Group, h *Group) int {
+	n := 0
+	for n < len(g.Log) && n < len(h.Log) && bytes.Equal(g.Log[n].Hash(g.ID), h.Log[n].Hash(h.ID)) {
+		n++
+	}
+	return n
+}
+
+func hasRemoval(log []GroupOperation) bool {
+	for _, op := range log {
+		if op.Type == OpKick || op.Type == OpBan {
+			return true
+		}
+	}
+	return false
+}
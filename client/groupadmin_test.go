@@ -0,0 +1,179 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestGroupOperations(t *testing.T) {
+	owner := utils.GeneratePrivateKey()
+	admin := utils.GeneratePrivateKey()
+	member := utils.GeneratePrivateKey()
+	id := func(k *utils.PrivateKey) utils.NodeID {
+		return k.Public().NodeID(utils.Namespace{1, 1, 1, 1})
+	}
+
+	g := &Group{ID: NewGroupID(id(owner))}
+	apply := func(key *utils.PrivateKey, typ string, target *utils.PrivateKey, role Role, invite *GroupInvite) error {
+		op, err := NewGroupOperation(key, g.ID, g.Head(), typ, id(target), role, invite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g.Apply(*op)
+	}
+
+	if err := apply(admin, OpCreate, admin, RoleOwner, nil); err == nil {
+		t.Errorf("group should be created only by its owner")
+	}
+	if err := apply(owner, OpCreate, owner, RoleOwner, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	invite, err := NewGroupInvite(owner, g.ID, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, _ := NewGroupInvite(member, g.ID, time.Now().Add(time.Minute))
+	if err := apply(member, OpJoin, member, RoleMember, forged); err == nil {
+		t.Errorf("invitation should be signed by an admin")
+	}
+	expired, _ := NewGroupInvite(owner, g.ID, time.Now().Add(-time.Minute))
+	if err := apply(member, OpJoin, member, RoleMember, expired); err == nil {
+		t.Errorf("invitation should not expire")
+	}
+	for _, k := range []*utils.PrivateKey{admin, member} {
+		if err := apply(k, OpJoin, k, RoleMember, invite); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := apply(admin, OpRole, admin, RoleAdmin, nil); err == nil {
+		t.Errorf("only the owner should change roles")
+	}
+	if err := apply(owner, OpRole, admin, RoleAdmin, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(member, OpKick, admin, RoleMember, nil); err == nil {
+		t.Errorf("a member should not kick")
+	}
+	info := func(key *utils.PrivateKey, name string) error {
+		op, err := NewGroupInfoOperation(key, g.ID, g.Head(), name, "topic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g.Apply(*op)
+	}
+	if err := info(member, "renamed"); err == nil || g.Name != "" {
+		t.Errorf("a member should not change the name")
+	}
+	if err := info(admin, "group"); err != nil || g.Name != "group" || g.Topic != "topic" {
+		t.Errorf("an admin should change the name: %v", err)
+	}
+	if err := apply(admin, OpKick, owner, RoleMember, nil); err == nil {
+		t.Errorf("an admin should not kick the owner")
+	}
+	if err := apply(admin, OpBan, member, RoleMember, nil); err != nil {
+		t.Fatal(err)
+	}
+	if g.HasMember(id(member)) || !g.IsBanned(id(member)) {
+		t.Errorf("member should be banned")
+	}
+	if err := apply(member, OpJoin, member, RoleMember, invite); err == nil {
+		t.Errorf("a banned identity should not join")
+	}
+	if err := apply(owner, OpRole, admin, RoleOwner, nil); err != nil {
+		t.Fatal(err)
+	}
+	if g.Role(id(admin)) != RoleOwner || g.Role(id(owner)) != RoleAdmin {
+		t.Errorf("ownership should be transferred")
+	}
+
+	// Every member computes the same group from the log.
+	r, err := ReplayGroup(g.ID, g.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Members) != 2 || len(r.Banned) != 1 || r.Owner.Digest != g.Owner.Digest || r.Name != g.Name || r.Better(g) || g.Better(r) {
+		t.Errorf("replayed group differs: %v; expects %v", r, g)
+	}
+	log := append([]GroupOperation(nil), g.Log...)
+	log[2].Role = RoleAdmin
+	if _, err := ReplayGroup(g.ID, log); err == nil {
+		t.Errorf("modified log should not be verified")
+	}
+}
+
+func TestGroupFork(t *testing.T) {
+	owner := utils.GeneratePrivateKey()
+	member := utils.GeneratePrivateKey()
+	id := func(k *utils.PrivateKey) utils.NodeID {
+		return k.Public().NodeID(utils.Namespace{1, 1, 1, 1})
+	}
+
+	g := &Group{ID: NewGroupID(id(owner))}
+	sign := func(key *utils.PrivateKey, typ string, target *utils.PrivateKey, invite *GroupInvite, prev []byte, at time.Time) GroupOperation {
+		op := GroupOperation{Type: typ, Target: id(target), Invite: invite, Prev: prev, Time: at, Key: *key.Public()}
+		if err := op.sign(key, g.ID); err != nil {
+			t.Fatal(err)
+		}
+		return op
+	}
+	apply := func(g *Group, op GroupOperation) {
+		if err := g.Apply(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	apply(g, sign(owner, OpCreate, owner, nil, nil, now.Add(-2*time.Hour)))
+	invite, err := NewGroupInvite(owner, g.ID, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply(g, sign(member, OpJoin, member, invite, g.Head(), now.Add(-2*time.Hour)))
+
+	// The member is kicked, and forks the log from before the kick with
+	// joins of throwaway identities, backdated to when the invitation was valid.
+	fork, err := ReplayGroup(g.ID, g.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply(g, sign(owner, OpKick, member, nil, g.Head(), now))
+	for i := 0; i < 3; i++ {
+		k := utils.GeneratePrivateKey()
+		apply(fork, sign(k, OpJoin, k, invite, fork.Head(), now.Add(-2*time.Hour)))
+	}
+	if len(fork.Log) <= len(g.Log) {
+		t.Fatalf("the fork should be longer")
+	}
+	if fork.Better(g) || !g.Better(fork) {
+		t.Errorf("the log with the kick should win over a longer fork")
+	}
+	if err := g.CheckUpdate(fork, now, time.Minute); err == nil {
+		t.Errorf("a join with an expired invitation should not be accepted when first seen")
+	}
+
+	// A member catching up accepts a join whose invitation has expired
+	// since, if an admin has signed an operation after it.
+	k := utils.GeneratePrivateKey()
+	old, _ := ReplayGroup(g.ID, g.Log)
+	apply(g, sign(k, OpJoin, k, invite, g.Head(), now.Add(-2*time.Hour)))
+	if err := old.CheckUpdate(g, now, time.Minute); err == nil {
+		t.Errorf("a join with an expired invitation should not be accepted when first seen")
+	}
+	apply(g, sign(owner, OpKick, k, nil, g.Head(), now))
+	if err := old.CheckUpdate(g, now, time.Minute); err != nil {
+		t.Errorf("a join endorsed by an admin should be accepted: %v", err)
+	}
+	if !g.Better(old) || old.Better(g) {
+		t.Errorf("a log should win over its prefix")
+	}
+
+	future, _ := ReplayGroup(old.ID, old.Log)
+	apply(future, sign(owner, OpBan, member, nil, future.Head(), now.Add(time.Hour)))
+	if err := old.CheckUpdate(future, now, time.Minute); err == nil {
+		t.Errorf("an operation from the future should not be accepted")
+	}
+}
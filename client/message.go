@@ -1,9 +1,13 @@
 package client
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"mime"
 	"time"
+
+	"github.com/h2so5/murcott/utils"
 )
 
 type Content struct {
@@ -12,10 +16,18 @@ type Content struct {
 }
 
 type ChatMessage struct {
+	ID       string    `msgpack:"id"`
 	Contents []Content `msgpack:"contents"`
 	Time     time.Time `msgpack:"time"`
 }
 
+// NewMessageID generates a random message identifier.
+func NewMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
 // NewPlainChatMessage generates a new ChatMessage with a plain text.
 func NewPlainChatMessage(text string) ChatMessage {
 	return NewMimeChatMessage("text/plain", text)
@@ -35,7 +47,7 @@ func NewMimeChatMessage(mimetype string, data string) ChatMessage {
 
 // NewChatMessage generates a new ChatMessage with the given Content array.
 func NewChatMessage(contents []Content) ChatMessage {
-	return ChatMessage{Contents: contents, Time: time.Now()}
+	return ChatMessage{ID: NewMessageID(), Contents: contents, Time: time.Now()}
 }
 
 // Text returns the first text/plain content.
@@ -80,6 +92,53 @@ func (m *ChatMessage) Len() int {
 }
 
 type MessageAck struct {
+	ID string `msgpack:"id"`
+}
+
+// SealedMessage carries a ChatMessage signed by the sender and encrypted to
+// the box key of the recipient, so that relays and mailboxes cannot read it.
+type SealedMessage struct {
+	Data []byte `msgpack:"data"`
+}
+
+// BoxKeyRequest asks a node for its box key.
+type BoxKeyRequest struct {
+}
+
+// BoxKeyResponse carries the box key record of a node. It is also returned
+// in place of an ack when a SealedMessage cannot be opened, so that the
+// sender can seal it again to the current box key.
+type BoxKeyResponse struct {
+	Record utils.BoxKeyRecord `msgpack:"record"`
+}
+
+// DeliveryResult represents the result of sending a ChatMessage.
+type DeliveryResult int
+
+const (
+	// Delivered means that the destination node has acknowledged the message.
+	Delivered DeliveryResult = iota
+	// Failed means that the message could not be sent.
+	Failed
+	// Timeout means that no acknowledgement was received after all retries.
+	Timeout
+	// Stored means that the destination node was not reachable and the
+	// message has been stored in its mailbox for offline delivery.
+	Stored
+)
+
+func (r DeliveryResult) String() string {
+	switch r {
+	case Delivered:
+		return "delivered"
+	case Failed:
+		return "failed"
+	case Timeout:
+		return "timeout"
+	case Stored:
+		return "stored"
+	}
+	return "unknown"
 }
 
 type UserProfileRequest struct {
@@ -93,3 +152,11 @@ type UserPresence struct {
 	Status UserStatus `msgpack:"status"`
 	Ack    bool       `msgpack:"ack"`
 }
+
+type KeySuccession struct {
+	Statement utils.Succession `msgpack:"statement"`
+}
+
+type KeyRevocation struct {
+	Certificate utils.Revocation `msgpack:"certificate"`
+}
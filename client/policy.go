@@ -0,0 +1,203 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// MessagePolicy decides what happens to chat messages from strangers,
+// the identities that are not contacts in the roster.
+type MessagePolicy int
+
+const (
+	// PolicyOpen accepts messages from anyone who is not blocked.
+	PolicyOpen MessagePolicy = iota
+	// PolicyContactsOnly drops messages from strangers without acknowledging them.
+	PolicyContactsOnly
+	// PolicyQuarantine holds messages from strangers in the request inbox
+	// until the user accepts or discards them.
+	PolicyQuarantine
+)
+
+func (p MessagePolicy) String() string {
+	switch p {
+	case PolicyOpen:
+		return "open"
+	case PolicyContactsOnly:
+		return "contacts"
+	case PolicyQuarantine:
+		return "quarantine"
+	}
+	return "unknown"
+}
+
+// ParseMessagePolicy parses the name of a policy returned by String.
+func ParseMessagePolicy(s string) (MessagePolicy, error) {
+	for _, p := range []MessagePolicy{PolicyOpen, PolicyContactsOnly, PolicyQuarantine} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, errors.New("unknown policy: " + s)
+}
+
+// Limits of the request inbox. The oldest messages are dropped first.
+const (
+	maxRequests        = 1000
+	maxRequestsPerPeer = 100
+)
+
+// RequestInbox holds the messages from strangers, oldest first.
+type RequestInbox struct {
+	list  []StoredMessage
+	mutex sync.Mutex
+}
+
+func NewRequestInbox() *RequestInbox {
+	return &RequestInbox{}
+}
+
+// Add holds the message.
+func (r *RequestInbox) Add(m StoredMessage) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := 0
+	for _, e := range r.list {
+		if e.Peer.Digest.Cmp(m.Peer.Digest) == 0 {
+			n++
+		}
+	}
+	if n >= maxRequestsPerPeer {
+		r.take(m.Peer, 1)
+	}
+	r.list = append(r.list, m)
+	if len(r.list) > maxRequests {
+		r.list = r.list[len(r.list)-maxRequests:]
+	}
+}
+
+// Peers returns the senders of the held messages in the order of their first messages.
+func (r *RequestInbox) Peers() []utils.NodeID {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var ids []utils.NodeID
+	seen := make(map[string]bool)
+	for _, m := range r.list {
+		key := m.Peer.Digest.String()
+		if !seen[key] {
+			seen[key] = true
+			ids = append(ids, m.Peer)
+		}
+	}
+	return ids
+}
+
+// Messages returns the held messages from the peer.
+func (r *RequestInbox) Messages(peer utils.NodeID) []StoredMessage {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var msgs []StoredMessage
+	for _, m := range r.list {
+		if m.Peer.Digest.Cmp(peer.Digest) == 0 {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+// Remove removes the held messages from the peer and returns them.
+func (r *RequestInbox) Remove(peer utils.NodeID) []StoredMessage {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.take(peer, -1)
+}
+
+// take removes up to n of the oldest messages from the peer, or all of
+// them if n is negative. r.mutex must be held.
+func (r *RequestInbox) take(peer utils.NodeID, n int) []StoredMessage {
+	var taken []StoredMessage
+	rest := r.list[:0]
+	for _, m := range r.list {
+		if m.Peer.Digest.Cmp(peer.Digest) == 0 && (n < 0 || len(taken) < n) {
+			taken = append(taken, m)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+	r.list = rest
+	return taken
+}
+
+// maxSubscriptionRequests limits the subscription requests waiting for an
+// answer. The oldest ones are dropped first.
+const maxSubscriptionRequests = 100
+
+// PendingSubscription is a subscription request waiting for an answer.
+type PendingSubscription struct {
+	ID      utils.NodeID
+	Message string
+	Time    time.Time
+}
+
+// SubscriptionInbox holds the subscription requests waiting for an answer,
+// oldest first, one for each identity. The identities are added to the
+// roster only when their requests are approved.
+type SubscriptionInbox struct {
+	list  []PendingSubscription
+	mutex sync.Mutex
+}
+
+func NewSubscriptionInbox() *SubscriptionInbox {
+	return &SubscriptionInbox{}
+}
+
+// Add holds the request, replacing an earlier one from the same identity.
+func (r *SubscriptionInbox) Add(p PendingSubscription) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.remove(p.ID)
+	r.list = append(r.list, p)
+	if len(r.list) > maxSubscriptionRequests {
+		r.list = r.list[len(r.list)-maxSubscriptionRequests:]
+	}
+}
+
+// Has reports whether a request from the identity is held.
+func (r *SubscriptionInbox) Has(id utils.NodeID) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, p := range r.list {
+		if p.ID.Digest.Cmp(id.Digest) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Requests returns the held requests, oldest first.
+func (r *SubscriptionInbox) Requests() []PendingSubscription {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]PendingSubscription(nil), r.list...)
+}
+
+// Remove removes the request from the identity and reports whether it was held.
+func (r *SubscriptionInbox) Remove(id utils.NodeID) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.remove(id)
+}
+
+// remove removes the request from the identity. r.mutex must be held.
+func (r *SubscriptionInbox) remove(id utils.NodeID) bool {
+	for i, p := range r.list {
+		if p.ID.Digest.Cmp(id.Digest) == 0 {
+			r.list = append(r.list[:i], r.list[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
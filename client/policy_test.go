@@ -0,0 +1,76 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestMessagePolicy(t *testing.T) {
+	for _, p := range []MessagePolicy{PolicyOpen, PolicyContactsOnly, PolicyQuarantine} {
+		if q, err := ParseMessagePolicy(p.String()); err != nil || q != p {
+			t.Errorf("wrong policy: %v; expects %v", q, p)
+		}
+	}
+	if _, err := ParseMessagePolicy("closed"); err == nil {
+		t.Errorf("unknown policies should be refused")
+	}
+}
+
+func TestRequestInbox(t *testing.T) {
+	ns := utils.Namespace{1, 1, 1, 1}
+	alice := utils.GeneratePrivateKey().NodeID(ns)
+	bob := utils.GeneratePrivateKey().NodeID(ns)
+
+	r := NewRequestInbox()
+	r.Add(StoredMessage{Peer: bob, Message: NewPlainChatMessage("1")})
+	r.Add(StoredMessage{Peer: alice, Message: NewPlainChatMessage("2")})
+	r.Add(StoredMessage{Peer: bob, Message: NewPlainChatMessage("3")})
+
+	if p := r.Peers(); len(p) != 2 || p[0].Digest.Cmp(bob.Digest) != 0 || p[1].Digest.Cmp(alice.Digest) != 0 {
+		t.Errorf("wrong peers: %v", p)
+	}
+	if m := r.Messages(bob); len(m) != 2 || m[0].Message.Text() != "1" || m[1].Message.Text() != "3" {
+		t.Errorf("wrong messages: %v", m)
+	}
+	if m := r.Remove(bob); len(m) != 2 {
+		t.Errorf("wrong number of removed messages: %d; expects 2", len(m))
+	}
+	if m := r.Messages(bob); len(m) != 0 {
+		t.Errorf("messages should be removed: %v", m)
+	}
+
+	for i := 0; i < maxRequestsPerPeer+1; i++ {
+		r.Add(StoredMessage{Peer: bob, Message: NewPlainChatMessage("")})
+	}
+	if m := r.Messages(bob); len(m) != maxRequestsPerPeer {
+		t.Errorf("wrong number of messages: %d; expects %d", len(m), maxRequestsPerPeer)
+	}
+	if m := r.Messages(alice); len(m) != 1 {
+		t.Errorf("messages from other peers should be kept")
+	}
+}
+
+func TestSubscriptionInbox(t *testing.T) {
+	ns := utils.Namespace{1, 1, 1, 1}
+	alice := utils.GeneratePrivateKey().NodeID(ns)
+	bob := utils.GeneratePrivateKey().NodeID(ns)
+
+	r := NewSubscriptionInbox()
+	r.Add(PendingSubscription{ID: bob, Message: "1"})
+	r.Add(PendingSubscription{ID: alice, Message: "2"})
+	r.Add(PendingSubscription{ID: bob, Message: "3"})
+	if p := r.Requests(); len(p) != 2 || p[0].ID.Digest.Cmp(alice.Digest) != 0 || p[1].Message != "3" {
+		t.Errorf("wrong requests: %v", p)
+	}
+	if !r.Remove(bob) || r.Has(bob) || r.Remove(bob) {
+		t.Errorf("the request should be removed once")
+	}
+
+	for i := 0; i < maxSubscriptionRequests; i++ {
+		r.Add(PendingSubscription{ID: utils.GeneratePrivateKey().NodeID(ns)})
+	}
+	if p := r.Requests(); len(p) != maxSubscriptionRequests || r.Has(alice) {
+		t.Errorf("the oldest request should be dropped: %d", len(p))
+	}
+}
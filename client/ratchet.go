@@ -0,0 +1,264 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/crypto/hkdf"
+)
+
+// MaxSkip is the maximum number of message keys kept for messages
+// that have not arrived yet.
+const MaxSkip = 1000
+
+// RatchetHeader is sent in clear (inside the sealed envelope) with every
+// ratchet message.
+type RatchetHeader struct {
+	DH []byte `msgpack:"dh"`
+	PN uint32 `msgpack:"pn"`
+	N  uint32 `msgpack:"n"`
+}
+
+type skippedKey struct {
+	DH  []byte `msgpack:"dh"`
+	N   uint32 `msgpack:"n"`
+	Key []byte `msgpack:"key"`
+}
+
+// Ratchet is the state of a double ratchet with one contact.
+// See https://signal.org/docs/specifications/doubleratchet/.
+type Ratchet struct {
+	DHs     []byte       `msgpack:"dhs"`
+	DHr     []byte       `msgpack:"dhr"`
+	RK      []byte       `msgpack:"rk"`
+	CKs     []byte       `msgpack:"cks"`
+	CKr     []byte       `msgpack:"ckr"`
+	Ns      uint32       `msgpack:"ns"`
+	Nr      uint32       `msgpack:"nr"`
+	PN      uint32       `msgpack:"pn"`
+	AD      []byte       `msgpack:"ad"`
+	Skipped []skippedKey `msgpack:"skipped"`
+
+	// Init is the X3DH header that started the ratchet. The initiator
+	// repeats it until the first reply confirms the ratchet.
+	Init      X3DHHeader `msgpack:"init"`
+	Confirmed bool       `msgpack:"confirmed"`
+}
+
+// NewSendingRatchet starts a ratchet as the initiator with the shared secret
+// and the ratchet key of the responder.
+func NewSendingRatchet(sk []byte, remote []byte, ad []byte) (*Ratchet, error) {
+	pub, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	rk, ck := kdfRK(sk, dh)
+	return &Ratchet{
+		DHs: priv.Bytes(),
+		DHr: remote,
+		RK:  rk,
+		CKs: ck,
+		AD:  ad,
+	}, nil
+}
+
+// NewReceivingRatchet starts a ratchet as the responder with the shared
+// secret and the ratchet key whose public part the initiator has used.
+func NewReceivingRatchet(sk []byte, own *ecdh.PrivateKey, ad []byte) *Ratchet {
+	return &Ratchet{
+		DHs:       own.Bytes(),
+		RK:        sk,
+		AD:        ad,
+		Confirmed: true,
+	}
+}
+
+func kdfRK(rk, dh []byte) ([]byte, []byte) {
+	out := make([]byte, 64)
+	io.ReadFull(hkdf.New(sha256.New, dh, rk, []byte("murcott ratchet")), out)
+	return out[:32], out[32:]
+}
+
+func kdfCK(ck []byte) ([]byte, []byte) {
+	m := hmac.New(sha256.New, ck)
+	m.Write([]byte{1})
+	mk := m.Sum(nil)
+	m = hmac.New(sha256.New, ck)
+	m.Write([]byte{2})
+	return m.Sum(nil), mk
+}
+
+func messageCipher(mk []byte) (cipher.AEAD, []byte, error) {
+	out := make([]byte, 32+12)
+	_, err := io.ReadFull(hkdf.New(sha256.New, mk, nil, []byte("murcott message key")), out)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(out[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, out[32:], nil
+}
+
+func (r *Ratchet) associatedData(h RatchetHeader) []byte {
+	data, _ := msgpack.Marshal(h)
+	return append(append([]byte{}, r.AD...), data...)
+}
+
+func (r *Ratchet) publicKey() ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(r.DHs)
+	if err != nil {
+		return nil, err
+	}
+	return priv.PublicKey().Bytes(), nil
+}
+
+// Encrypt encrypts the plaintext with the next sending message key.
+func (r *Ratchet) Encrypt(plaintext []byte) (RatchetHeader, []byte, error) {
+	if len(r.CKs) == 0 {
+		return RatchetHeader{}, nil, errors.New("ratchet not ready to send")
+	}
+	pub, err := r.publicKey()
+	if err != nil {
+		return RatchetHeader{}, nil, err
+	}
+	ck, mk := kdfCK(r.CKs)
+	h := RatchetHeader{DH: pub, PN: r.PN, N: r.Ns}
+	aead, nonce, err := messageCipher(mk)
+	if err != nil {
+		return RatchetHeader{}, nil, err
+	}
+	r.CKs = ck
+	r.Ns++
+	return h, aead.Seal(nil, nonce, plaintext, r.associatedData(h)), nil
+}
+
+// Decrypt decrypts a message. Messages may arrive out of order; the keys of
+// skipped messages are kept until they arrive. The state is left unchanged
+// if the message cannot be decrypted.
+func (r *Ratchet) Decrypt(h RatchetHeader, ciphertext []byte) ([]byte, error) {
+	for i, s := range r.Skipped {
+		if s.N == h.N && bytes.Equal(s.DH, h.DH) {
+			plaintext, err := r.open(s.Key, h, ciphertext)
+			if err != nil {
+				return nil, err
+			}
+			r.Skipped = append(r.Skipped[:i:i], r.Skipped[i+1:]...)
+			return plaintext, nil
+		}
+	}
+
+	s := r.clone()
+	if !bytes.Equal(h.DH, s.DHr) {
+		if err := s.skip(h.PN); err != nil {
+			return nil, err
+		}
+		if err := s.step(h.DH); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.skip(h.N); err != nil {
+		return nil, err
+	}
+	ck, mk := kdfCK(s.CKr)
+	plaintext, err := s.open(mk, h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.CKr = ck
+	s.Nr++
+	s.Confirmed = true
+	*r = *s
+	return plaintext, nil
+}
+
+func (r *Ratchet) open(mk []byte, h RatchetHeader, ciphertext []byte) ([]byte, error) {
+	aead, nonce, err := messageCipher(mk)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, r.associatedData(h))
+}
+
+func (r *Ratchet) clone() *Ratchet {
+	s := *r
+	s.Skipped = append([]skippedKey(nil), r.Skipped...)
+	return &s
+}
+
+// skip stores the keys of the messages in the receiving chain up to n.
+func (r *Ratchet) skip(n uint32) error {
+	if len(r.CKr) == 0 {
+		return nil
+	}
+	if n < r.Nr {
+		return errors.New("message key already used")
+	}
+	if n-r.Nr > MaxSkip {
+		return errors.New("too many skipped messages")
+	}
+	for r.Nr < n {
+		var mk []byte
+		r.CKr, mk = kdfCK(r.CKr)
+		r.Skipped = append(r.Skipped, skippedKey{DH: r.DHr, N: r.Nr, Key: mk})
+		r.Nr++
+	}
+	if len(r.Skipped) > MaxSkip {
+		r.Skipped = r.Skipped[len(r.Skipped)-MaxSkip:]
+	}
+	return nil
+}
+
+// step performs a DH ratchet step with the new ratchet key of the contact.
+func (r *Ratchet) step(remote []byte) error {
+	pub, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return err
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(r.DHs)
+	if err != nil {
+		return err
+	}
+	dh, err := priv.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	r.PN = r.Ns
+	r.Ns = 0
+	r.Nr = 0
+	r.DHr = remote
+	r.RK, r.CKr = kdfRK(r.RK, dh)
+
+	priv, err = ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	dh, err = priv.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	r.DHs = priv.Bytes()
+	r.RK, r.CKs = kdfRK(r.RK, dh)
+	return nil
+}
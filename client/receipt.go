@@ -0,0 +1,163 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
+)
+
+// maxMessageStatuses limits the remembered statuses; the oldest ones are
+// forgotten first.
+const maxMessageStatuses = 10000
+
+// DeliveryReceipt tells the sender that the messages have been received.
+// It is sent for messages fetched from the mailbox, which are not acknowledged.
+type DeliveryReceipt struct {
+	IDs []string `msgpack:"ids"`
+}
+
+// ReadReceipt tells the sender that the messages have been read.
+type ReadReceipt struct {
+	IDs []string `msgpack:"ids"`
+}
+
+// MessageStatus represents the status of a sent ChatMessage.
+// A status only moves forward, in the order of the constants.
+type MessageStatus int
+
+const (
+	// MessageSent means that the message is being sent.
+	MessageSent MessageStatus = iota
+	// MessageFailed means that the message could not be delivered.
+	MessageFailed
+	// MessageStored means that the message has been stored in the mailbox
+	// of the destination.
+	MessageStored
+	// MessageDelivered means that the destination has received the message.
+	MessageDelivered
+	// MessageRead means that the destination has read the message.
+	MessageRead
+)
+
+func (s MessageStatus) String() string {
+	switch s {
+	case MessageSent:
+		return "sent"
+	case MessageFailed:
+		return "failed"
+	case MessageStored:
+		return "stored"
+	case MessageDelivered:
+		return "delivered"
+	case MessageRead:
+		return "read"
+	}
+	return "unknown"
+}
+
+// MessageRecord holds the status of a sent message.
+type MessageRecord struct {
+	Dst    utils.NodeID  `msgpack:"dst"`
+	Status MessageStatus `msgpack:"status"`
+	Time   time.Time     `msgpack:"time"`
+}
+
+// MessageStatuses holds the statuses of sent messages by their IDs.
+type MessageStatuses struct {
+	records map[string]MessageRecord
+	mutex   sync.Mutex
+}
+
+// NewMessageStatuses generates an empty MessageStatuses.
+func NewMessageStatuses() *MessageStatuses {
+	return &MessageStatuses{records: make(map[string]MessageRecord)}
+}
+
+// Add records a message sent to dst.
+func (s *MessageStatuses) Add(id string, dst utils.NodeID) MessageRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r := MessageRecord{Dst: dst, Status: MessageSent, Time: time.Now()}
+	s.records[id] = r
+	s.prune()
+	return r
+}
+
+func (s *MessageStatuses) prune() {
+	for len(s.records) > maxMessageStatuses {
+		var oldest string
+		for id, r := range s.records {
+			if oldest == "" || r.Time.Before(s.records[oldest].Time) {
+				oldest = id
+			}
+		}
+		delete(s.records, oldest)
+	}
+}
+
+// Update sets the status of the message sent to src and reports whether it
+// has changed. Statuses of messages to other identities and statuses
+// that go back are ignored.
+func (s *MessageStatuses) Update(src utils.NodeID, id string, status MessageStatus) (MessageRecord, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r, ok := s.records[id]
+	if !ok || r.Dst.Digest.Cmp(src.Digest) != 0 || status <= r.Status {
+		return r, false
+	}
+	r.Status = status
+	r.Time = time.Now()
+	s.records[id] = r
+	return r, true
+}
+
+// Get returns the record of the message.
+func (s *MessageStatuses) Get(id string) (MessageRecord, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r, ok := s.records[id]
+	return r, ok
+}
+
+// Load adds the statuses of the recent outgoing messages in the storage.
+func (s *MessageStatuses) Load(st Storage) error {
+	msgs, err := st.Messages(HistoryQuery{Limit: maxMessageStatuses})
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, m := range msgs {
+		if m.Outgoing {
+			s.records[m.Message.ID] = MessageRecord{Dst: m.Peer, Status: m.Status, Time: m.Time}
+		}
+	}
+	s.prune()
+	return nil
+}
+
+// MarshalBinary encodes the records.
+func (s *MessageStatuses) MarshalBinary() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return msgpack.Marshal(s.records)
+}
+
+// UnmarshalBinary decodes data encoded by MarshalBinary.
+func (s *MessageStatuses) UnmarshalBinary(data []byte) error {
+	var records map[string]MessageRecord
+	err := msgpack.Unmarshal(data, &records)
+	if err != nil {
+		return err
+	}
+	if records == nil {
+		records = make(map[string]MessageRecord)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = records
+	s.prune()
+	return nil
+}
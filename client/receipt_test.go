@@ -0,0 +1,44 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestMessageStatuses(t *testing.T) {
+	ns := utils.Namespace{1, 1, 1, 1}
+	dst := utils.GeneratePrivateKey().NodeID(ns)
+	other := utils.GeneratePrivateKey().NodeID(ns)
+
+	s := NewMessageStatuses()
+	s.Add("a", dst)
+	if r, ok := s.Get("a"); !ok || r.Status != MessageSent {
+		t.Errorf("wrong status: %v; expects %v", r.Status, MessageSent)
+	}
+	if _, ok := s.Update(other, "a", MessageRead); ok {
+		t.Errorf("other identities should not update the status")
+	}
+	if _, ok := s.Update(dst, "b", MessageRead); ok {
+		t.Errorf("unknown messages should not be updated")
+	}
+	if _, ok := s.Update(dst, "a", MessageRead); !ok {
+		t.Errorf("the status should be updated")
+	}
+	if _, ok := s.Update(dst, "a", MessageDelivered); ok {
+		t.Errorf("the status should not go back")
+	}
+
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := NewMessageStatuses()
+	if err := s2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	r, ok := s2.Get("a")
+	if !ok || r.Status != MessageRead || r.Dst.Digest.Cmp(dst.Digest) != 0 {
+		t.Errorf("wrong record: %v", r)
+	}
+}
@@ -2,34 +2,385 @@ package client
 
 import (
 	"errors"
+	"strings"
+	"sync"
 
 	"github.com/h2so5/murcott/utils"
 )
 
+// Subscription represents whether a contact and the user share their presence.
+type Subscription int
+
+const (
+	// SubscriptionNone means that presence is not shared.
+	SubscriptionNone Subscription = iota
+	// SubscriptionPending means that the user has asked the contact and is
+	// waiting for the answer.
+	SubscriptionPending
+	// SubscriptionRequested means that the contact has asked the user, who
+	// has not answered yet. Requests are held in a SubscriptionInbox, not
+	// in the roster.
+	SubscriptionRequested
+	// SubscriptionBoth means that the contact and the user share their presence.
+	SubscriptionBoth
+)
+
+func (s Subscription) String() string {
+	switch s {
+	case SubscriptionNone:
+		return "none"
+	case SubscriptionPending:
+		return "pending"
+	case SubscriptionRequested:
+		return "requested"
+	case SubscriptionBoth:
+		return "both"
+	}
+	return "unknown"
+}
+
+// SubscriptionRequest asks a node to share presence with the sender.
+type SubscriptionRequest struct {
+	Message string `msgpack:"message"`
+}
+
+// SubscriptionResponse answers a SubscriptionRequest. A response that is
+// not approved also cancels an approved subscription.
+type SubscriptionResponse struct {
+	Approved bool `msgpack:"approved"`
+}
+
+// RosterEntry represents a contact and the key pinned for it.
+type RosterEntry struct {
+	ID utils.NodeID
+
+	// Key is pinned on first use. It is nil until the contact's key is seen.
+	Key *utils.PublicKey
+
+	// Verified is set when the user has confirmed the safety number of the contact.
+	Verified bool
+
+	// Petname, Groups and Notes are set by the user and never sent.
+	Petname string
+	Groups  []string
+	Notes   string
+
+	Subscription Subscription
+
+	// Blocked is set when the user refuses to talk to the contact.
+	Blocked bool
+}
+
+// Name returns the petname of the contact, or its ID if it has none.
+func (e *RosterEntry) Name() string {
+	if e.Petname != "" {
+		return e.Petname
+	}
+	return e.ID.String()
+}
+
+// InGroup reports whether the contact is in the group.
+func (e *RosterEntry) InGroup(group string) bool {
+	for _, g := range e.Groups {
+		if strings.EqualFold(g, group) {
+			return true
+		}
+	}
+	return false
+}
+
 // Roster represents a contact list.
 type Roster struct {
-	list []utils.NodeID
+	list    []RosterEntry
+	mutex   sync.RWMutex
+	handler func(entries []RosterEntry)
 }
 
 func (r *Roster) List() []utils.NodeID {
-	return append([]utils.NodeID(nil), r.list...)
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var ids []utils.NodeID
+	for _, e := range r.list {
+		ids = append(ids, e.ID)
+	}
+	return ids
 }
 
-func (r *Roster) Add(id utils.NodeID) {
-	for _, n := range r.list {
-		if n.Digest.Cmp(id.Digest) == 0 {
-			return
+// Unblocked returns the contacts that are not blocked.
+func (r *Roster) Unblocked() []utils.NodeID {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var ids []utils.NodeID
+	for _, e := range r.list {
+		if !e.Blocked {
+			ids = append(ids, e.ID)
+		}
+	}
+	return ids
+}
+
+// Subscribed returns the contacts that share their presence with the user.
+func (r *Roster) Subscribed() []utils.NodeID {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var ids []utils.NodeID
+	for _, e := range r.list {
+		if e.Subscription == SubscriptionBoth && !e.Blocked {
+			ids = append(ids, e.ID)
+		}
+	}
+	return ids
+}
+
+// Blocked returns the blocked contacts.
+func (r *Roster) Blocked() []utils.NodeID {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var ids []utils.NodeID
+	for _, e := range r.list {
+		if e.Blocked {
+			ids = append(ids, e.ID)
+		}
+	}
+	return ids
+}
+
+// IsContact reports whether the identity is a contact: it is in the roster,
+// is not blocked, and has not only asked for a subscription.
+func (r *Roster) IsContact(id utils.NodeID) bool {
+	e, ok := r.Entry(id)
+	return ok && !e.Blocked && e.Subscription != SubscriptionRequested
+}
+
+// Group returns the entries of the contacts in the group.
+func (r *Roster) Group(group string) []RosterEntry {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var entries []RosterEntry
+	for _, e := range r.list {
+		if e.InGroup(group) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Entries returns a copy of the entries in the roster.
+func (r *Roster) Entries() []RosterEntry {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]RosterEntry(nil), r.list...)
+}
+
+// Entry returns the entry of the contact.
+func (r *Roster) Entry(id utils.NodeID) (RosterEntry, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if i := r.index(id); i >= 0 {
+		return r.list[i], true
+	}
+	return RosterEntry{}, false
+}
+
+func (r *Roster) index(id utils.NodeID) int {
+	for i, e := range r.list {
+		if e.ID.Digest.Cmp(id.Digest) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// HandleChanges registers the given function to be called with the entries
+// whenever the roster changes, so that it can be saved.
+func (r *Roster) HandleChanges(handler func(entries []RosterEntry)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.handler = handler
+}
+
+// changed calls the handler. r.mutex must not be held.
+func (r *Roster) changed() {
+	r.mutex.RLock()
+	h := r.handler
+	entries := append([]RosterEntry(nil), r.list...)
+	r.mutex.RUnlock()
+	if h != nil {
+		h(entries)
+	}
+}
+
+// update applies f to the entry of the contact.
+func (r *Roster) update(id utils.NodeID, f func(e *RosterEntry) error) error {
+	r.mutex.Lock()
+	i := r.index(id)
+	if i < 0 {
+		r.mutex.Unlock()
+		return errors.New("item not found")
+	}
+	e := r.list[i]
+	err := f(&e)
+	if err == nil {
+		r.list[i] = e
+	}
+	r.mutex.Unlock()
+	if err == nil {
+		r.changed()
+	}
+	return err
+}
+
+// Load adds the entries that are not in the roster, such as the ones loaded from a Storage.
+func (r *Roster) Load(entries []RosterEntry) {
+	r.mutex.Lock()
+	for _, e := range entries {
+		if r.index(e.ID) < 0 {
+			r.list = append(r.list, e)
 		}
 	}
-	r.list = append(r.list, id)
+	r.mutex.Unlock()
+	r.changed()
+}
+
+func (r *Roster) Add(id utils.NodeID) {
+	r.mutex.Lock()
+	added := r.index(id) < 0
+	if added {
+		r.list = append(r.list, RosterEntry{ID: id})
+	}
+	r.mutex.Unlock()
+	if added {
+		r.changed()
+	}
 }
 
 func (r *Roster) Remove(id utils.NodeID) error {
-	for i, n := range r.list {
-		if n.Digest.Cmp(id.Digest) == 0 {
-			r.list = append(r.list[:i], r.list[i+1:]...)
-			return nil
+	r.mutex.Lock()
+	i := r.index(id)
+	if i >= 0 {
+		r.list = append(r.list[:i], r.list[i+1:]...)
+	}
+	r.mutex.Unlock()
+	if i < 0 {
+		return errors.New("item not found")
+	}
+	r.changed()
+	return nil
+}
+
+// Replace replaces old with next, keeping its position in the list.
+// The new entry has no pinned key and is not verified; the metadata and the
+// subscription are kept.
+func (r *Roster) Replace(old utils.NodeID, next utils.NodeID) error {
+	r.mutex.Lock()
+	i := r.index(old)
+	if i < 0 {
+		r.mutex.Unlock()
+		return errors.New("item not found")
+	}
+	e := r.list[i]
+	r.list = append(r.list[:i], r.list[i+1:]...)
+	if r.index(next) < 0 {
+		e.ID, e.Key, e.Verified = next, nil, false
+		r.list = append(r.list[:i], append([]RosterEntry{e}, r.list[i:]...)...)
+	}
+	r.mutex.Unlock()
+	r.changed()
+	return nil
+}
+
+// Pin pins the key of the contact if no key has been pinned yet.
+// The key must be the one the ID of the contact is derived from.
+func (r *Roster) Pin(id utils.NodeID, key *utils.PublicKey) error {
+	if key.Digest() != id.Digest {
+		return errors.New("key does not match " + id.String())
+	}
+	r.mutex.Lock()
+	i := r.index(id)
+	if i < 0 {
+		r.mutex.Unlock()
+		return errors.New("item not found")
+	}
+	if r.list[i].Key != nil {
+		r.mutex.Unlock()
+		return nil
+	}
+	k := *key
+	r.list[i].Key = &k
+	r.mutex.Unlock()
+	r.changed()
+	return nil
+}
+
+// EntryWithKey returns the entry whose pinned key is key under any IDVersion.
+func (r *Roster) EntryWithKey(key *utils.PublicKey) (RosterEntry, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, e := range r.list {
+		if e.Key != nil && e.Key.SameKey(key) {
+			return e, true
 		}
 	}
-	return errors.New("item not found")
+	return RosterEntry{}, false
+}
+
+// Unpin forgets the pinned key of the contact and clears its verified flag.
+func (r *Roster) Unpin(id utils.NodeID) error {
+	return r.update(id, func(e *RosterEntry) error {
+		e.Key = nil
+		e.Verified = false
+		return nil
+	})
+}
+
+// SetVerified sets the verified flag of the contact.
+// A contact can only be verified after its key has been pinned.
+func (r *Roster) SetVerified(id utils.NodeID, verified bool) error {
+	return r.update(id, func(e *RosterEntry) error {
+		if verified && e.Key == nil {
+			return errors.New("key not pinned")
+		}
+		e.Verified = verified
+		return nil
+	})
+}
+
+// SetPetname sets the name the user gives to the contact.
+func (r *Roster) SetPetname(id utils.NodeID, petname string) error {
+	return r.update(id, func(e *RosterEntry) error {
+		e.Petname = petname
+		return nil
+	})
+}
+
+// SetGroups sets the groups, or tags, of the contact.
+func (r *Roster) SetGroups(id utils.NodeID, groups []string) error {
+	return r.update(id, func(e *RosterEntry) error {
+		e.Groups = append([]string(nil), groups...)
+		return nil
+	})
+}
+
+// SetNotes sets the notes of the user about the contact.
+func (r *Roster) SetNotes(id utils.NodeID, notes string) error {
+	return r.update(id, func(e *RosterEntry) error {
+		e.Notes = notes
+		return nil
+	})
+}
+
+// SetSubscription sets the subscription state of the contact.
+func (r *Roster) SetSubscription(id utils.NodeID, s Subscription) error {
+	return r.update(id, func(e *RosterEntry) error {
+		e.Subscription = s
+		return nil
+	})
+}
+
+// SetBlocked sets the blocked flag of the contact.
+func (r *Roster) SetBlocked(id utils.NodeID, blocked bool) error {
+	return r.update(id, func(e *RosterEntry) error {
+		e.Blocked = blocked
+		return nil
+	})
 }
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestRosterPin(t *testing.T) {
+	ns := utils.Namespace{1, 1, 1, 1}
+	key := utils.GeneratePrivateKey()
+	id := key.NodeID(ns)
+
+	var r Roster
+	r.Add(id)
+
+	if r.SetVerified(id, true) == nil {
+		t.Errorf("SetVerified() should fail before the key is pinned")
+	}
+	if err := r.Pin(id, key.Public()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Pin(id, key.Public()); err != nil {
+		t.Errorf("Pin() with the same key should succeed: %v", err)
+	}
+	if err := r.Pin(id, utils.GeneratePrivateKey().Public()); err == nil {
+		t.Errorf("Pin() with a key that does not match the ID should fail")
+	}
+	legacy, err := key.WithVersion(utils.IDVersionSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := r.EntryWithKey(legacy.Public()); !ok || e.ID.Digest != id.Digest {
+		t.Errorf("the entry should be found by its key under another ID version")
+	}
+	if _, ok := r.EntryWithKey(utils.GeneratePrivateKey().Public()); ok {
+		t.Errorf("no entry should be found for another key")
+	}
+	if err := r.SetVerified(id, true); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := r.Entry(id); !ok || !e.Verified || !e.Key.Equal(key.Public()) {
+		t.Errorf("wrong entry: %v", e)
+	}
+
+	next := utils.GenerateEd25519PrivateKey().NodeID(ns)
+	if err := r.Replace(id, next); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Entry(id); ok {
+		t.Errorf("old entry should be removed")
+	}
+	if e, ok := r.Entry(next); !ok || e.Verified || e.Key != nil {
+		t.Errorf("new entry should be unverified without a key: %v", e)
+	}
+}
+
+func TestRosterMetadata(t *testing.T) {
+	ns := utils.Namespace{1, 1, 1, 1}
+	id := utils.GeneratePrivateKey().NodeID(ns)
+	other := utils.GeneratePrivateKey().NodeID(ns)
+
+	var r Roster
+	changes := 0
+	r.HandleChanges(func(entries []RosterEntry) {
+		changes++
+	})
+	r.Add(id)
+	r.Add(id)
+	r.Add(other)
+	if changes != 2 {
+		t.Errorf("wrong number of changes: %d; expects 2", changes)
+	}
+
+	if e, _ := r.Entry(id); e.Name() != id.String() {
+		t.Errorf("wrong name: %s; expects %s", e.Name(), id.String())
+	}
+	r.SetPetname(id, "Alice")
+	r.SetGroups(id, []string{"Friends", "Work"})
+	r.SetNotes(id, "Met at the conference")
+	r.SetSubscription(id, SubscriptionBoth)
+	if r.SetPetname(utils.GeneratePrivateKey().NodeID(ns), "Bob") == nil {
+		t.Errorf("SetPetname() should fail for unknown contacts")
+	}
+
+	e, _ := r.Entry(id)
+	if e.Name() != "Alice" || e.Notes != "Met at the conference" || !e.InGroup("friends") || e.InGroup("family") {
+		t.Errorf("wrong entry: %v", e)
+	}
+	if g := r.Group("work"); len(g) != 1 || g[0].ID.Digest.Cmp(id.Digest) != 0 {
+		t.Errorf("wrong group: %v", g)
+	}
+	if s := r.Subscribed(); len(s) != 1 || s[0].Digest.Cmp(id.Digest) != 0 {
+		t.Errorf("wrong subscribed contacts: %v", s)
+	}
+
+	next := utils.GenerateEd25519PrivateKey().NodeID(ns)
+	r.Replace(id, next)
+	if e, _ := r.Entry(next); e.Name() != "Alice" || e.Subscription != SubscriptionBoth {
+		t.Errorf("metadata should be kept: %v", e)
+	}
+	if changes != 7 {
+		t.Errorf("wrong number of changes: %d; expects 7", changes)
+	}
+}
+
+func TestRosterBlock(t *testing.T) {
+	ns := utils.Namespace{1, 1, 1, 1}
+	id := utils.GeneratePrivateKey().NodeID(ns)
+	stranger := utils.GeneratePrivateKey().NodeID(ns)
+
+	var r Roster
+	r.Add(id)
+	r.SetSubscription(id, SubscriptionBoth)
+	if !r.IsContact(id) || r.IsContact(stranger) {
+		t.Errorf("only entries in the roster should be contacts")
+	}
+
+	r.SetBlocked(id, true)
+	if r.IsContact(id) {
+		t.Errorf("blocked entries should not be contacts")
+	}
+	if b := r.Blocked(); len(b) != 1 || b[0].Digest.Cmp(id.Digest) != 0 {
+		t.Errorf("wrong blocked contacts: %v", b)
+	}
+	if s := r.Subscribed(); len(s) != 0 {
+		t.Errorf("blocked entries should not be subscribed: %v", s)
+	}
+	if u := r.Unblocked(); len(u) != 0 {
+		t.Errorf("blocked entries should not be listed as unblocked: %v", u)
+	}
+
+	r.Add(stranger)
+	if u := r.Unblocked(); len(u) != 1 || u[0].Digest.Cmp(stranger.Digest) != 0 {
+		t.Errorf("wrong unblocked contacts: %v", u)
+	}
+	r.SetSubscription(stranger, SubscriptionRequested)
+	if r.IsContact(stranger) {
+		t.Errorf("entries that have only asked for a subscription should not be contacts")
+	}
+}
@@ -0,0 +1,300 @@
+package client
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// snippetWidth is how many characters of context a snippet has on each side
+// of the match.
+const snippetWidth = 30
+
+// SearchQuery selects stored messages by their text.
+type SearchQuery struct {
+	// Text holds words and "quoted phrases", all of which must be found in
+	// a message. Case is ignored.
+	Text string
+
+	// Peer, Since and Until are the same as in HistoryQuery.
+	Peer  *utils.NodeID
+	Since time.Time
+	Until time.Time
+
+	// Limit limits the number of results if it is positive.
+	Limit int
+}
+
+// SearchResult is a message found by a search, with a snippet of its text
+// around the match.
+type SearchResult struct {
+	Message StoredMessage
+	Snippet string
+}
+
+// SearchHit identifies a message found in a SearchIndex.
+type SearchHit struct {
+	Peer utils.NodeID
+	ID   string
+	Time time.Time
+}
+
+type token struct {
+	term       string
+	start, end int
+}
+
+// isIdeograph reports whether r is written without spaces between words;
+// such characters are indexed one by one.
+func isIdeograph(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Thai)
+}
+
+// tokenize splits the text into lower-case words and ideographs.
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		if isIdeograph(r) {
+			if start >= 0 {
+				tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+				start = -1
+			}
+			n := i + utf8.RuneLen(r)
+			tokens = append(tokens, token{text[i:n], i, n})
+		} else if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+// stripTags returns the text of the html.
+func stripTags(s string) string {
+	var b strings.Builder
+	tag := false
+	for _, r := range s {
+		switch {
+		case r == '<':
+			tag = true
+		case r == '>' && tag:
+			tag = false
+			b.WriteRune(' ')
+		case !tag:
+			b.WriteRune(r)
+		}
+	}
+	return html.UnescapeString(b.String())
+}
+
+// SearchText returns the text of the text/plain and text/html contents of
+// the message, which is what is searched.
+func SearchText(m *ChatMessage) string {
+	var texts []string
+	for _, c := range m.Contents {
+		if strings.HasPrefix(c.Mime, "text/plain") {
+			texts = append(texts, c.Data)
+		} else if strings.HasPrefix(c.Mime, "text/html") {
+			texts = append(texts, stripTags(c.Data))
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// parseSearch splits the query into phrases. A word that consists of more
+// than one token, such as a word in ideographs, is a phrase too.
+func parseSearch(text string) [][]string {
+	var phrases [][]string
+	add := func(s string) {
+		var p []string
+		for _, t := range tokenize(s) {
+			p = append(p, t.term)
+		}
+		if len(p) > 0 {
+			phrases = append(phrases, p)
+		}
+	}
+	for i, part := range strings.Split(text, "\"") {
+		if i%2 == 1 {
+			add(part)
+			continue
+		}
+		for _, w := range strings.Fields(part) {
+			add(w)
+		}
+	}
+	return phrases
+}
+
+// findPhrase returns the index of the first token at which the phrase
+// starts, or -1.
+func findPhrase(tokens []token, phrase []string) int {
+	for i := 0; i+len(phrase) <= len(tokens); i++ {
+		ok := true
+		for j, term := range phrase {
+			if tokens[i+j].term != term {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// Snippet returns the text of the message around the first match of the query.
+func Snippet(m *ChatMessage, query string) string {
+	text := SearchText(m)
+	tokens := tokenize(text)
+	start, end := 0, 0
+	for _, p := range parseSearch(query) {
+		if i := findPhrase(tokens, p); i >= 0 {
+			start, end = tokens[i].start, tokens[i+len(p)-1].end
+			break
+		}
+	}
+	from, to := start, end
+	for n := 0; n < snippetWidth && from > 0; n++ {
+		_, size := utf8.DecodeLastRuneInString(text[:from])
+		from -= size
+	}
+	for n := 0; n < snippetWidth && to < len(text); n++ {
+		_, size := utf8.DecodeRuneInString(text[to:])
+		to += size
+	}
+	s := strings.Join(strings.Fields(text[from:to]), " ")
+	if from > 0 {
+		s = "…" + s
+	}
+	if to < len(text) {
+		s += "…"
+	}
+	return s
+}
+
+type posting struct {
+	doc       int
+	positions []int
+}
+
+// SearchIndex is an inverted index of the text of stored messages.
+type SearchIndex struct {
+	postings map[string][]posting
+	docs     []SearchHit
+	keys     map[string]bool
+	mutex    sync.RWMutex
+}
+
+// NewSearchIndex generates an empty SearchIndex.
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		postings: make(map[string][]posting),
+		keys:     make(map[string]bool),
+	}
+}
+
+// Add indexes the message unless it has already been indexed.
+func (x *SearchIndex) Add(m *StoredMessage) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	key := messageKey(m.Peer, m.Message.ID)
+	if x.keys[key] {
+		return
+	}
+	x.keys[key] = true
+	doc := len(x.docs)
+	x.docs = append(x.docs, SearchHit{Peer: m.Peer, ID: m.Message.ID, Time: m.Time})
+
+	positions := make(map[string][]int)
+	for i, t := range tokenize(SearchText(&m.Message)) {
+		positions[t.term] = append(positions[t.term], i)
+	}
+	for term, p := range positions {
+		x.postings[term] = append(x.postings[term], posting{doc: doc, positions: p})
+	}
+}
+
+// matchPhrase returns the documents that contain the phrase.
+func (x *SearchIndex) matchPhrase(phrase []string) map[int]bool {
+	docs := make(map[int]bool)
+	lists := make([]map[int][]int, len(phrase))
+	for i, term := range phrase {
+		lists[i] = make(map[int][]int)
+		for _, p := range x.postings[term] {
+			lists[i][p.doc] = p.positions
+		}
+	}
+	for doc, first := range lists[0] {
+		for _, pos := range first {
+			ok := true
+			for i := 1; i < len(phrase) && ok; i++ {
+				ok = false
+				for _, q := range lists[i][doc] {
+					if q == pos+i {
+						ok = true
+						break
+					}
+				}
+			}
+			if ok {
+				docs[doc] = true
+				break
+			}
+		}
+	}
+	return docs
+}
+
+// Search returns the messages that match the query, newest first.
+func (x *SearchIndex) Search(q SearchQuery) []SearchHit {
+	phrases := parseSearch(q.Text)
+	if len(phrases) == 0 {
+		return nil
+	}
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	docs := x.matchPhrase(phrases[0])
+	for _, p := range phrases[1:] {
+		if len(docs) == 0 {
+			break
+		}
+		m := x.matchPhrase(p)
+		for doc := range docs {
+			if !m[doc] {
+				delete(docs, doc)
+			}
+		}
+	}
+
+	h := HistoryQuery{Peer: q.Peer, Since: q.Since, Until: q.Until}
+	var hits []SearchHit
+	for doc := range docs {
+		d := x.docs[doc]
+		if h.Match(&StoredMessage{Peer: d.Peer, Time: d.Time}) {
+			hits = append(hits, d)
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].Time.After(hits[j].Time)
+	})
+	if q.Limit > 0 && len(hits) > q.Limit {
+		hits = hits[:q.Limit]
+	}
+	return hits
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestSearchIndex(t *testing.T) {
+	ns := utils.Namespace{1, 1, 1, 1}
+	alice := utils.GeneratePrivateKey().NodeID(ns)
+	bob := utils.GeneratePrivateKey().NodeID(ns)
+	now := time.Now()
+
+	messages := []StoredMessage{
+		{Peer: alice, Message: NewPlainChatMessage("The quick brown fox jumps over the lazy dog")},
+		{Peer: bob, Message: NewHTMLChatMessage("<b>Quick</b> &amp; brown <i>fox</i>")},
+		{Peer: alice, Message: NewPlainChatMessage("brown quick fox")},
+		{Peer: bob, Message: NewPlainChatMessage("明日は東京に行きます")},
+		{Peer: alice, Message: NewPlainChatMessage("Tokyo, tomorrow!")},
+	}
+	x := NewSearchIndex()
+	for i := range messages {
+		messages[i].Time = now.Add(time.Duration(i) * time.Second)
+		x.Add(&messages[i])
+	}
+	x.Add(&messages[0])
+
+	check := func(q SearchQuery, expects []int) {
+		hits := x.Search(q)
+		if len(hits) != len(expects) {
+			t.Errorf("%q: wrong number of results: %d; expects %d", q.Text, len(hits), len(expects))
+			return
+		}
+		for i, h := range hits {
+			if h.ID != messages[expects[i]].Message.ID {
+				t.Errorf("%q: wrong result at %d", q.Text, i)
+			}
+		}
+	}
+	check(SearchQuery{Text: "fox"}, []int{2, 1, 0})
+	check(SearchQuery{Text: "QUICK Fox"}, []int{2, 1, 0})
+	check(SearchQuery{Text: "\"quick brown\""}, []int{1, 0})
+	check(SearchQuery{Text: "\"brown quick\" fox"}, []int{2})
+	check(SearchQuery{Text: "amp"}, nil)
+	check(SearchQuery{Text: "b"}, nil)
+	check(SearchQuery{Text: "東京"}, []int{3})
+	check(SearchQuery{Text: "京東"}, nil)
+	check(SearchQuery{Text: "fox", Peer: &alice}, []int{2, 0})
+	check(SearchQuery{Text: "fox", Since: now.Add(time.Second)}, []int{2, 1})
+	check(SearchQuery{Text: "fox", Until: now.Add(time.Second)}, []int{0})
+	check(SearchQuery{Text: "fox", Limit: 1}, []int{2})
+	check(SearchQuery{Text: ""}, nil)
+
+	if s := Snippet(&messages[1].Message, "fox"); s != "Quick & brown fox" {
+		t.Errorf("wrong snippet: %q", s)
+	}
+	m := NewPlainChatMessage("Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua.")
+	if s := Snippet(&m, "tempor"); s != "…ipiscing elit, sed do eiusmod tempor incididunt ut labore et dolor…" {
+		t.Errorf("wrong snippet: %q", s)
+	}
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/h2so5/murcott/utils"
+	"golang.org/x/crypto/hkdf"
+)
+
+// SenderKey is the key with which a member encrypts its messages to a group.
+// It is distributed to the other members pairwise, so a message is encrypted
+// only once however many members the group has. A new generation is
+// generated whenever a member leaves, so that it cannot read new messages.
+type SenderKey struct {
+	Generation uint32 `msgpack:"generation"`
+	Key        []byte `msgpack:"key"`
+	N          uint32 `msgpack:"n"`
+}
+
+// NewSenderKey generates a random sender key of the generation.
+func NewSenderKey(generation uint32) (*SenderKey, error) {
+	k := &SenderKey{Generation: generation, Key: make([]byte, 32)}
+	_, err := rand.Read(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *SenderKey) cipher(n uint32) (cipher.AEAD, []byte, error) {
+	info := make([]byte, len("murcott sender key")+4)
+	binary.BigEndian.PutUint32(info[copy(info, "murcott sender key"):], n)
+	out := make([]byte, 32+12)
+	_, err := io.ReadFull(hkdf.New(sha256.New, k.Key, nil, info), out)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(out[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, out[32:], nil
+}
+
+// Encrypt encrypts the plaintext with the next message key and returns its number.
+func (k *SenderKey) Encrypt(ad []byte, plaintext []byte) (uint32, []byte, error) {
+	n := k.N
+	aead, nonce, err := k.cipher(n)
+	if err != nil {
+		return 0, nil, err
+	}
+	k.N++
+	return n, aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+// Decrypt decrypts the message encrypted with the message key of number n.
+func (k *SenderKey) Decrypt(ad []byte, n uint32, data []byte) ([]byte, error) {
+	aead, nonce, err := k.cipher(n)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, data, ad)
+	if err != nil {
+		return nil, errors.New("cannot decrypt group message")
+	}
+	return plaintext, nil
+}
+
+// SealedSenderKey carries a sender key signed by the member and encrypted to
+// the box key of the recipient.
+type SealedSenderKey struct {
+	Data []byte `msgpack:"data"`
+}
+
+// SenderKeyRequest asks a member for its current sender key of the group.
+type SenderKeyRequest struct {
+	Group utils.NodeID `msgpack:"group"`
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSenderKey(t *testing.T) {
+	k, err := NewSenderKey(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad := []byte("group")
+	msg := []byte("The quick brown fox jumps over the lazy dog")
+
+	n1, data1, err := k.Encrypt(ad, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, data2, err := k.Encrypt(ad, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1 == n2 || bytes.Equal(data1, data2) {
+		t.Errorf("each message should be encrypted with a different key")
+	}
+
+	// Messages can be decrypted in any order.
+	for _, m := range []struct {
+		n    uint32
+		data []byte
+	}{{n2, data2}, {n1, data1}} {
+		p, err := k.Decrypt(ad, m.n, m.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, msg) {
+			t.Errorf("wrong plaintext: %q; expects %q", p, msg)
+		}
+	}
+
+	if _, err := k.Decrypt([]byte("other"), n1, data1); err == nil {
+		t.Errorf("message with wrong associated data should not be decrypted")
+	}
+	k2, _ := NewSenderKey(2)
+	if _, err := k2.Decrypt(ad, n1, data1); err == nil {
+		t.Errorf("message should not be decrypted with another sender key")
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// StoredMessage is a ChatMessage sent to or received from Peer.
+type StoredMessage struct {
+	Peer     utils.NodeID `msgpack:"peer"`
+	Outgoing bool         `msgpack:"outgoing"`
+	Message  ChatMessage  `msgpack:"message"`
+
+	// Status is the status of an outgoing message.
+	Status MessageStatus `msgpack:"status"`
+
+	// Time is when the message was sent or received. The time claimed by
+	// the sender is Message.Time.
+	Time time.Time `msgpack:"time"`
+}
+
+// HistoryQuery selects stored messages. The zero value selects all of them.
+type HistoryQuery struct {
+	// Peer selects the messages sent to or received from the identity.
+	Peer *utils.NodeID
+
+	// Since and Until select the messages stored in [Since, Until).
+	Since time.Time
+	Until time.Time
+
+	// Offset skips the newest messages, and Limit limits the number of
+	// messages if it is positive, so that older pages can be loaded.
+	Offset int
+	Limit  int
+}
+
+// Match reports whether m is selected by the query, ignoring Offset and Limit.
+func (q *HistoryQuery) Match(m *StoredMessage) bool {
+	if q.Peer != nil && q.Peer.Digest.Cmp(m.Peer.Digest) != 0 {
+		return false
+	}
+	if !q.Since.IsZero() && m.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !m.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Storage keeps the persistent data of a client: the messages it has sent
+// and received, the roster and the profiles.
+type Storage interface {
+	// AddMessage stores a message. A message with the same peer and ID as a
+	// stored one is ignored; a message without an ID is given a new one.
+	AddMessage(m StoredMessage) error
+
+	// UpdateMessageStatus sets the status of an outgoing message.
+	UpdateMessageStatus(peer utils.NodeID, id string, status MessageStatus) error
+
+	// Messages returns the messages selected by the query, oldest first.
+	Messages(q HistoryQuery) ([]StoredMessage, error)
+
+	// Message returns the message with the peer and ID, or nil if it is not stored.
+	Message(peer utils.NodeID, id string) (*StoredMessage, error)
+
+	SaveRoster(entries []RosterEntry) error
+	LoadRoster() ([]RosterEntry, error)
+
+	// LoadProfile returns nil if no profile of the identity has been saved.
+	SaveProfile(id utils.NodeID, profile UserProfile) error
+	LoadProfile(id utils.NodeID) (*UserProfile, error)
+
+	Close() error
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// TypingInterval is how often a composing notification is repeated
+	// while the user keeps typing.
+	TypingInterval = 5 * time.Second
+	// TypingTimeout is how long a composing notification lasts on the
+	// receiver, in case the paused notification is lost.
+	TypingTimeout = 2 * TypingInterval
+)
+
+// TypingState represents whether a contact is composing a message.
+type TypingState int
+
+const (
+	// Paused means that the contact has stopped typing.
+	Paused TypingState = iota
+	// Composing means that the contact is typing a message.
+	Composing
+)
+
+func (s TypingState) String() string {
+	switch s {
+	case Paused:
+		return "paused"
+	case Composing:
+		return "composing"
+	}
+	return "unknown"
+}
+
+// TypingNotification tells a contact whether the user is composing a message.
+// It is neither acknowledged nor stored in the mailbox.
+type TypingNotification struct {
+	State TypingState `msgpack:"state"`
+}
+
+// TypingCoalescer decides which typing notifications are sent, so that
+// a notification is not sent for every keystroke.
+type TypingCoalescer struct {
+	sent  map[string]time.Time
+	mutex sync.Mutex
+}
+
+// NewTypingCoalescer generates an empty TypingCoalescer.
+func NewTypingCoalescer() *TypingCoalescer {
+	return &TypingCoalescer{sent: make(map[string]time.Time)}
+}
+
+// Update records the state of the user in the chat with dst and reports
+// whether a notification should be sent. Composing is sent when the user
+// starts typing and then once every TypingInterval; Paused is sent only
+// after Composing.
+func (t *TypingCoalescer) Update(dst string, state TypingState, now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	last, composing := t.sent[dst]
+	if state == Paused {
+		delete(t.sent, dst)
+		return composing
+	}
+	if composing && now.Sub(last) < TypingInterval {
+		return false
+	}
+	t.sent[dst] = now
+	return true
+}
+
+// Reset forgets the state of the chat with dst. A message that has been sent
+// ends composing on the receiver, so Paused need not be sent.
+func (t *TypingCoalescer) Reset(dst string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.sent, dst)
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypingCoalescer(t *testing.T) {
+	c := NewTypingCoalescer()
+	now := time.Now()
+
+	if c.Update("a", Paused, now) {
+		t.Errorf("Paused should not be sent before Composing")
+	}
+	if !c.Update("a", Composing, now) {
+		t.Errorf("Composing should be sent when the user starts typing")
+	}
+	for i := 1; i < 10; i++ {
+		if c.Update("a", Composing, now.Add(time.Duration(i)*TypingInterval/10)) {
+			t.Errorf("Composing should not be sent again within TypingInterval")
+		}
+	}
+	if !c.Update("b", Composing, now) {
+		t.Errorf("chats should be independent")
+	}
+	if !c.Update("a", Composing, now.Add(TypingInterval)) {
+		t.Errorf("Composing should be sent again after TypingInterval")
+	}
+	if !c.Update("a", Paused, now) {
+		t.Errorf("Paused should be sent after Composing")
+	}
+	if c.Update("a", Paused, now) {
+		t.Errorf("Paused should be sent once")
+	}
+
+	c.Reset("b")
+	if c.Update("b", Paused, now) {
+		t.Errorf("Paused should not be sent after Reset")
+	}
+}
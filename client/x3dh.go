@@ -0,0 +1,165 @@
+package client
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/crypto/hkdf"
+)
+
+// PrekeyBundle publishes the X25519 identity key (the box key) and the
+// current signed prekey of an identity for the X3DH key agreement.
+// One-time prekeys are not used because the DHT cannot hand each one out once.
+type PrekeyBundle struct {
+	Key      utils.PublicKey `msgpack:"key"`
+	Identity []byte          `msgpack:"identity"`
+	Prekey   []byte          `msgpack:"prekey"`
+	Time     time.Time       `msgpack:"time"`
+	S        utils.Signature `msgpack:"sign"`
+}
+
+// NewPrekeyBundle generates a PrekeyBundle signed by key.
+func NewPrekeyBundle(key utils.Signer, identity *ecdh.PublicKey, prekey *ecdh.PublicKey) (*PrekeyBundle, error) {
+	b := &PrekeyBundle{
+		Key:      *key.Public(),
+		Identity: identity.Bytes(),
+		Prekey:   prekey.Bytes(),
+		Time:     time.Now(),
+	}
+	sign := key.Sign(b.serialize())
+	if sign == nil {
+		return nil, errors.New("cannot sign prekey bundle")
+	}
+	b.S = *sign
+	return b, nil
+}
+
+func (b *PrekeyBundle) serialize() []byte {
+	ary := []interface{}{
+		"prekey",
+		b.Key.NodeID(utils.Namespace{}).Bytes(),
+		b.Identity,
+		b.Prekey,
+		b.Time.Unix(),
+	}
+
+	data, _ := msgpack.Marshal(ary)
+	return data
+}
+
+// Verify reports whether the bundle is signed by its identity key.
+func (b *PrekeyBundle) Verify() bool {
+	if b.Key.IsZero() {
+		return false
+	}
+	return b.Key.Verify(b.serialize(), &b.S)
+}
+
+// PrekeyBundleKey returns the DHT key under which the prekey bundle
+// of the identity is published.
+func PrekeyBundleKey(id utils.NodeID) string {
+	return "prekey:" + id.Digest.String()
+}
+
+// X3DHHeader is sent by the initiator of a ratchet so that the responder
+// can compute the same shared secret.
+type X3DHHeader struct {
+	Identity  []byte `msgpack:"identity"`
+	Ephemeral []byte `msgpack:"ephemeral"`
+	Prekey    []byte `msgpack:"prekey"`
+}
+
+// IsZero reports whether the header is empty.
+func (h X3DHHeader) IsZero() bool {
+	return len(h.Ephemeral) == 0
+}
+
+func x3dhSecret(dh ...[]byte) ([]byte, error) {
+	ikm := make([]byte, 32)
+	for i := range ikm {
+		ikm[i] = 0xff
+	}
+	for _, d := range dh {
+		ikm = append(ikm, d...)
+	}
+	sk := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, ikm, make([]byte, 32), []byte("murcott x3dh")), sk)
+	return sk, err
+}
+
+// X3DHInitiate computes the shared secret and the associated data with the
+// bundle of the responder. The bundle must have been verified.
+func X3DHInitiate(identity *ecdh.PrivateKey, b *PrekeyBundle) ([]byte, []byte, X3DHHeader, error) {
+	ik, err := ecdh.X25519().NewPublicKey(b.Identity)
+	if err != nil {
+		return nil, nil, X3DHHeader{}, err
+	}
+	spk, err := ecdh.X25519().NewPublicKey(b.Prekey)
+	if err != nil {
+		return nil, nil, X3DHHeader{}, err
+	}
+	ek, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, X3DHHeader{}, err
+	}
+	dh1, err := identity.ECDH(spk)
+	if err != nil {
+		return nil, nil, X3DHHeader{}, err
+	}
+	dh2, err := ek.ECDH(ik)
+	if err != nil {
+		return nil, nil, X3DHHeader{}, err
+	}
+	dh3, err := ek.ECDH(spk)
+	if err != nil {
+		return nil, nil, X3DHHeader{}, err
+	}
+	sk, err := x3dhSecret(dh1, dh2, dh3)
+	if err != nil {
+		return nil, nil, X3DHHeader{}, err
+	}
+	h := X3DHHeader{
+		Identity:  identity.PublicKey().Bytes(),
+		Ephemeral: ek.PublicKey().Bytes(),
+		Prekey:    b.Prekey,
+	}
+	ad := append(identity.PublicKey().Bytes(), b.Identity...)
+	return sk, ad, h, nil
+}
+
+// X3DHRespond computes the shared secret and the associated data from the
+// header of the initiator and the prekey it has used.
+func X3DHRespond(identity *ecdh.PrivateKey, prekey *ecdh.PrivateKey, h X3DHHeader) ([]byte, []byte, error) {
+	ik, err := ecdh.X25519().NewPublicKey(h.Identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	ek, err := ecdh.X25519().NewPublicKey(h.Ephemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh1, err := prekey.ECDH(ik)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh2, err := identity.ECDH(ek)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh3, err := prekey.ECDH(ek)
+	if err != nil {
+		return nil, nil, err
+	}
+	sk, err := x3dhSecret(dh1, dh2, dh3)
+	if err != nil {
+		return nil, nil, err
+	}
+	ad := append(append([]byte{}, h.Identity...), identity.PublicKey().Bytes()...)
+	return sk, ad, nil
+}
@@ -3,16 +3,24 @@
 package murcott
 
 import (
+	"bytes"
 	"encoding/base64"
 	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/h2so5/murcott/client"
+	"github.com/h2so5/murcott/dht"
 	"github.com/h2so5/murcott/log"
 	"github.com/h2so5/murcott/node"
 	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
 )
 
 var namespace = [4]byte{1, 1, 1, 1}
@@ -68,6 +76,834 @@ func TestClientMessage(t *testing.T) {
 	client2.Close()
 }
 
+func TestClientMessageDuplicate(t *testing.T) {
+	key1 := utils.GeneratePrivateKey()
+	key2 := utils.GeneratePrivateKey()
+	client1, err := NewClient(key1, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2, err := NewClient(key2, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan client.ChatMessage, 2)
+	delivered := make(chan client.DeliveryResult, 2)
+	plainmsg := client.NewPlainChatMessage("Hello")
+
+	client2.HandleMessages(func(src utils.NodeID, msg client.ChatMessage) {
+		received <- msg
+	})
+
+	go client1.Run()
+	go client2.Run()
+
+	dst := utils.NewNodeID(namespace, key2.Digest())
+	for i := 0; i < 2; i++ {
+		id := client1.DeliverMessage(dst, plainmsg, func(r client.DeliveryResult) {
+			delivered <- r
+		})
+		if id != plainmsg.ID {
+			t.Errorf("wrong message id: %s; expects %s", id, plainmsg.ID)
+		}
+		if r := <-delivered; r != client.Delivered {
+			t.Errorf("wrong delivery result: %v; expects %v", r, client.Delivered)
+		}
+	}
+
+	if m := <-received; m.ID != plainmsg.ID {
+		t.Errorf("wrong message id: %s; expects %s", m.ID, plainmsg.ID)
+	}
+	select {
+	case <-received:
+		t.Errorf("duplicated message should be dropped")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	client1.Close()
+	client2.Close()
+}
+
+func TestClientReceipts(t *testing.T) {
+	key1 := utils.GeneratePrivateKey()
+	key2 := utils.GeneratePrivateKey()
+	client1, err := NewClient(key1, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2, err := NewClient(key2, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type status struct {
+		id     string
+		status client.MessageStatus
+	}
+	statuses := make(chan status, 10)
+	client1.HandleMessageStatuses(func(id string, dst utils.NodeID, s client.MessageStatus) {
+		if dst.Digest.Cmp(key2.Digest()) != 0 {
+			t.Errorf("wrong destination id")
+		}
+		statuses <- status{id, s}
+	})
+	received := make(chan string, 10)
+	client2.HandleMessages(func(src utils.NodeID, msg client.ChatMessage) {
+		received <- msg.ID
+	})
+
+	go client1.Run()
+	go client2.Run()
+
+	expect := func(id string, s client.MessageStatus) {
+		select {
+		case st := <-statuses:
+			if st.id != id || st.status != s {
+				t.Errorf("wrong status: %s %v; expects %s %v", st.id, st.status, id, s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("status %v should be passed", s)
+		}
+	}
+
+	dst := utils.NewNodeID(namespace, key2.Digest())
+	id := client1.DeliverMessage(dst, client.NewPlainChatMessage("Hello"), nil)
+	expect(id, client.MessageSent)
+	expect(id, client.MessageDelivered)
+	if err := client2.MarkRead(client1.ID(), <-received); err != nil {
+		t.Fatal(err)
+	}
+	expect(id, client.MessageRead)
+	if s, ok := client1.MessageStatus(id); !ok || s != client.MessageRead {
+		t.Errorf("wrong status: %v; expects %v", s, client.MessageRead)
+	}
+
+	client2.SetReadReceipts(false)
+	id = client1.DeliverMessage(dst, client.NewPlainChatMessage("Hello"), nil)
+	expect(id, client.MessageSent)
+	expect(id, client.MessageDelivered)
+	client2.MarkRead(client1.ID(), <-received)
+	select {
+	case st := <-statuses:
+		t.Errorf("read receipts should not be sent: %v", st.status)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	client1.Close()
+	client2.Close()
+}
+
+func TestClientTyping(t *testing.T) {
+	key1 := utils.GeneratePrivateKey()
+	key2 := utils.GeneratePrivateKey()
+	client1, err := NewClient(key1, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2, err := NewClient(key2, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states := make(chan client.TypingState, 10)
+	client2.HandleTyping(func(src utils.NodeID, state client.TypingState) {
+		if src.Digest.Cmp(key1.Digest()) != 0 {
+			t.Errorf("wrong source id")
+		}
+		states <- state
+	})
+
+	go client1.Run()
+	go client2.Run()
+	time.Sleep(500 * time.Millisecond)
+
+	expect := func(state client.TypingState) {
+		select {
+		case s := <-states:
+			if s != state {
+				t.Errorf("wrong state: %v; expects %v", s, state)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("state %v should be passed", state)
+		}
+	}
+
+	dst := utils.NewNodeID(namespace, key2.Digest())
+	for i := 0; i < 5; i++ {
+		if err := client1.SetTyping(dst, client.Composing); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(client.Composing)
+	client1.SetTyping(dst, client.Paused)
+	expect(client.Paused)
+
+	client1.SetTyping(dst, client.Composing)
+	expect(client.Composing)
+	client1.SendMessage(dst, client.NewPlainChatMessage("Hello"), nil)
+	expect(client.Paused)
+	select {
+	case s := <-states:
+		t.Errorf("state should be passed once: %v", s)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	client1.Close()
+	client2.Close()
+}
+
+func TestClientStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "murcott")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key1 := utils.GeneratePrivateKey()
+	key2 := utils.GeneratePrivateKey()
+	var storages []*client.FileStorage
+	var clients []*Client
+	for i, key := range []*utils.PrivateKey{key1, key2} {
+		s, err := client.NewFileStorage(filepath.Join(dir, strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewClient(key, utils.DefaultConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SetStorage(s); err != nil {
+			t.Fatal(err)
+		}
+		storages = append(storages, s)
+		clients = append(clients, c)
+		go c.Run()
+	}
+	client1, client2 := clients[0], clients[1]
+
+	dst := utils.NewNodeID(namespace, key2.Digest())
+	client1.Roster.Add(dst)
+	client1.SetProfile(client.UserProfile{Nickname: "alice"})
+	delivered := make(chan client.DeliveryResult)
+	id := client1.DeliverMessage(dst, client.NewPlainChatMessage("Hello"), func(r client.DeliveryResult) {
+		delivered <- r
+	})
+	if r := <-delivered; r != client.Delivered {
+		t.Fatalf("wrong result: %v", r)
+	}
+
+	for _, c := range clients {
+		msgs, err := c.History(client.HistoryQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 1 || msgs[0].Message.ID != id || msgs[0].Outgoing != (c == client1) {
+			t.Errorf("wrong history: %v", msgs)
+		}
+	}
+	if msgs, _ := client2.History(client.HistoryQuery{Peer: &dst}); len(msgs) != 0 {
+		t.Errorf("no message should be stored for %s", dst.String())
+	}
+	results, err := client2.Search(client.SearchQuery{Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Message.Message.ID != id || results[0].Snippet != "Hello" {
+		t.Errorf("wrong search results: %v", results)
+	}
+	// Stored messages are duplicates after they have been forgotten.
+	client2.seenMutex.Lock()
+	client2.seen = make(map[string]time.Time)
+	client2.seenMutex.Unlock()
+	if !client2.isDuplicate(client1.ID(), id) {
+		t.Errorf("stored message should be a duplicate")
+	}
+	for i, c := range clients {
+		c.Close()
+		storages[i].Close()
+	}
+
+	// Everything is loaded after a restart.
+	s, err := client.NewFileStorage(filepath.Join(dir, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := NewClient(key1, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetStorage(s); err != nil {
+		t.Fatal(err)
+	}
+	go c.Run()
+	defer c.Close()
+	if _, ok := c.Roster.Entry(dst); !ok {
+		t.Errorf("the roster should be loaded")
+	}
+	if p := c.Profile(); p.Nickname != "alice" {
+		t.Errorf("wrong profile: %v", p)
+	}
+	if st, ok := c.MessageStatus(id); !ok || st != client.MessageDelivered {
+		t.Errorf("wrong status: %v; expects %v", st, client.MessageDelivered)
+	}
+	msgs, err := c.History(client.HistoryQuery{Peer: &dst})
+	if err != nil || len(msgs) != 1 || msgs[0].Status != client.MessageDelivered {
+		t.Errorf("wrong history: %v", msgs)
+	}
+
+	var exported bytes.Buffer
+	if err := c.ExportHistory(&exported, client.HistoryQuery{}, client.ExportJSON); err != nil {
+		t.Fatal(err)
+	}
+	data := exported.Bytes()
+	if n, err := c.ImportHistory(bytes.NewReader(data)); err != nil || n != 0 {
+		t.Errorf("stored messages should not be imported again: %d %v", n, err)
+	}
+	s2, err := client.NewFileStorage(filepath.Join(dir, "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	c2, err := NewClient(key1, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.SetStorage(s2); err != nil {
+		t.Fatal(err)
+	}
+	go c2.Run()
+	defer c2.Close()
+	if n, err := c2.ImportHistory(bytes.NewReader(data)); err != nil || n != 1 {
+		t.Errorf("wrong number of imported messages: %d %v", n, err)
+	}
+	if results, _ := c2.Search(client.SearchQuery{Text: "hello"}); len(results) != 1 {
+		t.Errorf("imported messages should be searched")
+	}
+}
+
+func TestClientSealedMessage(t *testing.T) {
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+		go c.Run()
+	}
+	client1, client2, client3 := clients[0], clients[1], clients[2]
+
+	r, err := client2.boxKeyRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, err := client1.addBoxKey(client2.ID(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client1.addBoxKey(client3.ID(), r); err == nil {
+		t.Errorf("box key record of another identity should be rejected")
+	}
+
+	plainmsg := client.NewPlainChatMessage("Hello")
+	data, err := client1.seal(box, client2.ID(), plainmsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "Hello") {
+		t.Errorf("sealed message should not contain the plain text")
+	}
+
+	src, m, err := client2.open(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Digest.Cmp(client1.ID().Digest) != 0 {
+		t.Errorf("wrong source id: %s; expects %s", src.String(), client1.ID().String())
+	}
+	if m.ID != plainmsg.ID || m.Text() != plainmsg.Text() {
+		t.Errorf("wrong message: %v; expects %v", m, plainmsg)
+	}
+
+	if _, _, err := client3.open(data); err == nil {
+		t.Errorf("sealed message should not be opened by another identity")
+	}
+	data[len(data)-1] ^= 1
+	if _, _, err := client2.open(data); err == nil {
+		t.Errorf("tampered message should not be opened")
+	}
+
+	m1, _ := msgpack.Marshal(plainmsg)
+	old := time.Now().Add(-dht.MaxMailExpiry - time.Hour).Unix()
+	sign := client1.key.Sign(envelopeSignedData(client2.ID(), m1, false, old))
+	env, _ := msgpack.Marshal(envelope{Key: *client1.key.Public(), Message: m1, Time: old, S: *sign})
+	data, err = utils.SealBox(box, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client2.open(data); err == nil {
+		t.Errorf("envelope older than the mailbox expiry should not be opened")
+	}
+
+	// Unsealed messages are neither received nor acknowledged.
+	received := make(chan client.ChatMessage, 1)
+	client2.HandleMessages(func(src utils.NodeID, msg client.ChatMessage) {
+		received <- msg
+	})
+	acked := make(chan bool, 1)
+	time.Sleep(500 * time.Millisecond)
+	client1.node.Send(client2.ID(), plainmsg, func(r interface{}) {
+		acked <- true
+	})
+	select {
+	case m := <-received:
+		t.Errorf("unsealed message should be dropped: %v", m)
+	case <-acked:
+		t.Errorf("unsealed message should not be acknowledged")
+	case <-time.After(time.Second):
+	}
+
+	// An acknowledgement without the ID of the message does not confirm it.
+	client2.node.Handle(func(src utils.NodeID, msg interface{}) interface{} {
+		return client.MessageAck{}
+	})
+	result := make(chan client.DeliveryResult, 1)
+	go func() {
+		result <- client1.deliver(client2.ID(), client.NewPlainChatMessage("Hello"))
+	}()
+	select {
+	case r := <-result:
+		t.Errorf("message should not be confirmed by an empty acknowledgement: %v", r)
+	case <-time.After(time.Second):
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+func TestClientConversation(t *testing.T) {
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+		go c.Run()
+	}
+	client1, client2 := clients[0], clients[1]
+
+	received1 := make(chan client.ChatMessage, 1)
+	received2 := make(chan client.ChatMessage, 1)
+	client1.HandleMessages(func(src utils.NodeID, msg client.ChatMessage) {
+		received1 <- msg
+	})
+	client2.HandleMessages(func(src utils.NodeID, msg client.ChatMessage) {
+		received2 <- msg
+	})
+	var saved []byte
+	client2.HandleConversationChanges(func(data []byte) {
+		saved = data
+	})
+
+	time.Sleep(500 * time.Millisecond)
+	err := client2.publishPrekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client1.StartConversation(client2.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := make(chan client.DeliveryResult, 2)
+	plainmsg := client.NewPlainChatMessage("Hello")
+	client1.DeliverMessage(client2.ID(), plainmsg, func(r client.DeliveryResult) {
+		delivered <- r
+	})
+	if r := <-delivered; r != client.Delivered {
+		t.Errorf("wrong delivery result: %v; expects %v", r, client.Delivered)
+	}
+	if m := <-received2; m.ID != plainmsg.ID || m.Text() != plainmsg.Text() {
+		t.Errorf("wrong message: %v; expects %v", m, plainmsg)
+	}
+	if !client2.HasConversation(client1.ID()) {
+		t.Errorf("conversation should be started by the first message")
+	}
+
+	reply := client.NewPlainChatMessage("Hi")
+	client2.DeliverMessage(client1.ID(), reply, func(r client.DeliveryResult) {
+		delivered <- r
+	})
+	if r := <-delivered; r != client.Delivered {
+		t.Errorf("wrong delivery result: %v; expects %v", r, client.Delivered)
+	}
+	if m := <-received1; m.ID != reply.ID || m.Text() != reply.Text() {
+		t.Errorf("wrong message: %v; expects %v", m, reply)
+	}
+
+	convs := client.NewConversations()
+	if err := convs.UnmarshalBinary(saved); err != nil {
+		t.Fatal(err)
+	}
+	if !convs.Has(client1.ID()) {
+		t.Errorf("saved state should contain the conversation")
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+func TestClientGroup(t *testing.T) {
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+		go c.Run()
+	}
+	client1, client2, client3 := clients[0], clients[1], clients[2]
+
+	type groupMessage struct {
+		group utils.NodeID
+		src   utils.NodeID
+		msg   client.ChatMessage
+	}
+	received1 := make(chan groupMessage, 10)
+	received3 := make(chan groupMessage, 10)
+	client1.HandleGroupMessages(func(group utils.NodeID, src utils.NodeID, msg client.ChatMessage) {
+		received1 <- groupMessage{group, src, msg}
+	})
+	client3.HandleGroupMessages(func(group utils.NodeID, src utils.NodeID, msg client.ChatMessage) {
+		received3 <- groupMessage{group, src, msg}
+	})
+
+	time.Sleep(500 * time.Millisecond)
+	g, err := client1.CreateGroup("murcott", "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite, err := client1.CreateInvite(g.ID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Client{client2, client3} {
+		if err := c.JoinGroup(invite); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	for _, c := range clients {
+		g2, ok := c.Group(g.ID)
+		if !ok {
+			t.Fatalf("client should be a member of the group")
+		}
+		if g2.Name != g.Name || g2.Topic != g.Topic {
+			t.Errorf("wrong group metadata: %s %s; expects %s %s", g2.Name, g2.Topic, g.Name, g.Topic)
+		}
+		for _, m := range clients {
+			if !g2.HasMember(m.ID()) {
+				t.Errorf("%s should be a member of the group", m.ID().String())
+			}
+		}
+	}
+
+	plainmsg := client.NewPlainChatMessage("Hello")
+	err = client2.SendGroupMessage(g.ID, plainmsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []chan groupMessage{received1, received3} {
+		select {
+		case m := <-ch:
+			if m.group.NS != g.ID.NS {
+				t.Errorf("wrong group: %v; expects %v", m.group.NS, g.ID.NS)
+			}
+			if m.src.Digest.Cmp(client2.ID().Digest) != 0 {
+				t.Errorf("wrong source id")
+			}
+			if m.msg.ID != plainmsg.ID || m.msg.Text() != plainmsg.Text() {
+				t.Errorf("wrong message: %v; expects %v", m.msg, plainmsg)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("group message should be received")
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(received1) > 0 || len(received3) > 0 {
+		t.Errorf("group message should be received once")
+	}
+	if _, _, err := client1.decryptGroupMessage(g.ID, client2.ID(), &client.GroupChatMessage{}); err == nil {
+		t.Errorf("group message without a key should be refused")
+	}
+
+	err = client3.LeaveGroup(g.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if g2, _ := client1.Group(g.ID); g2.HasMember(client3.ID()) {
+		t.Errorf("%s should have left the group", client3.ID().String())
+	}
+
+	// The sender keys are rotated when a member leaves.
+	time.Sleep(100 * time.Millisecond)
+	client1.groupMutex.Lock()
+	gen := client1.senderKeys[g.ID.NS].own.Generation
+	client1.groupMutex.Unlock()
+	if gen != 2 {
+		t.Errorf("wrong sender key generation: %d; expects 2", gen)
+	}
+	received2 := make(chan groupMessage, 10)
+	client2.HandleGroupMessages(func(group utils.NodeID, src utils.NodeID, msg client.ChatMessage) {
+		received2 <- groupMessage{group, src, msg}
+	})
+	plainmsg = client.NewPlainChatMessage("Bye")
+	err = client1.SendGroupMessage(g.ID, plainmsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-received2:
+		if m.msg.ID != plainmsg.ID || m.msg.Text() != plainmsg.Text() {
+			t.Errorf("wrong message: %v; expects %v", m.msg, plainmsg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("group message should be received with the new sender key")
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+func TestClientGroupAdmin(t *testing.T) {
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+		go c.Run()
+	}
+	client1, client2, client3 := clients[0], clients[1], clients[2]
+
+	time.Sleep(500 * time.Millisecond)
+	g, err := client1.CreateGroup("murcott", "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client2.CreateInvite(g.ID, time.Minute); err == nil {
+		t.Errorf("only members should invite")
+	}
+	invite, err := client1.CreateInvite(g.ID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Client{client2, client3} {
+		if err := c.JoinGroup(invite); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	if err := client3.Kick(g.ID, client2.ID()); err == nil {
+		t.Errorf("a member should not kick another")
+	}
+	if err := client1.SetRole(g.ID, client2.ID(), client.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	for _, c := range clients {
+		g2, _ := c.Group(g.ID)
+		if r := g2.Role(client2.ID()); r != client.RoleAdmin {
+			t.Errorf("wrong role: %v; expects %v", r, client.RoleAdmin)
+		}
+		if r := g2.Role(client1.ID()); r != client.RoleOwner {
+			t.Errorf("wrong role: %v; expects %v", r, client.RoleOwner)
+		}
+	}
+	if err := client2.Kick(g.ID, client1.ID()); err == nil {
+		t.Errorf("an admin should not kick the owner")
+	}
+
+	if err := client3.SetGroupInfo(g.ID, "renamed", ""); err == nil {
+		t.Errorf("a member should not change the name")
+	}
+	if err := client2.SetGroupInfo(g.ID, "renamed", "topic"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	for _, c := range clients {
+		if g2, _ := c.Group(g.ID); g2.Name != "renamed" || g2.Topic != "topic" {
+			t.Errorf("wrong group metadata: %s %s; expects renamed topic", g2.Name, g2.Topic)
+		}
+	}
+
+	if err := client2.Ban(g.ID, client3.ID()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	for _, c := range []*Client{client1, client2} {
+		g2, _ := c.Group(g.ID)
+		if g2.HasMember(client3.ID()) || !g2.IsBanned(client3.ID()) {
+			t.Errorf("%s should be banned", client3.ID().String())
+		}
+		if !c.node.IsBanned(client3.key.Public().NodeID(g.ID.NS)) {
+			t.Errorf("packets from %s should be dropped", client3.ID().String())
+		}
+	}
+	if _, ok := client3.Group(g.ID); ok {
+		t.Errorf("%s should have been removed from the group", client3.ID().String())
+	}
+	if err := client3.JoinGroup(invite); err == nil {
+		t.Errorf("a banned identity should not join")
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+func TestClientGroupCausalOrder(t *testing.T) {
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+		go c.Run()
+	}
+	client1, client2, client3 := clients[0], clients[1], clients[2]
+
+	type orderedMessage struct {
+		src   utils.NodeID
+		msg   client.ChatMessage
+		order client.CausalOrder
+	}
+	received := make(chan orderedMessage, 10)
+	client1.HandleOrderedGroupMessages(func(group utils.NodeID, src utils.NodeID, msg client.ChatMessage, order client.CausalOrder) {
+		received <- orderedMessage{src, msg, order}
+	})
+
+	time.Sleep(500 * time.Millisecond)
+	g, err := client1.CreateGroup("murcott", "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite, err := client1.CreateInvite(g.ID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Client{client2, client3} {
+		if err := c.JoinGroup(invite); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// client3 replies as soon as it receives the message of client2.
+	reply := client.NewPlainChatMessage("Reply")
+	client3.HandleGroupMessages(func(group utils.NodeID, src utils.NodeID, msg client.ChatMessage) {
+		go client3.SendGroupMessage(group, reply)
+	})
+	plainmsg := client.NewPlainChatMessage("Hello")
+	if err := client2.SendGroupMessage(g.ID, plainmsg); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []orderedMessage
+	for len(msgs) < 2 {
+		select {
+		case m := <-received:
+			msgs = append(msgs, m)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("group messages should be received")
+		}
+	}
+	if msgs[0].msg.ID != plainmsg.ID || msgs[1].msg.ID != reply.ID {
+		t.Errorf("the reply should be received after the message")
+	}
+	if !msgs[0].order.Before(msgs[0].src.Digest.String(), msgs[1].order, msgs[1].src.Digest.String()) {
+		t.Errorf("wrong causal order: %v %v", msgs[0].order, msgs[1].order)
+	}
+	if n := msgs[1].order.Clock[client2.ID().Digest.String()]; n != 1 {
+		t.Errorf("wrong vector clock: %d; expects 1", n)
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+func TestClientMailbox(t *testing.T) {
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+		go c.Run()
+	}
+	client1, client2 := clients[0], clients[1]
+
+	received := make(chan client.ChatMessage, 2)
+	client2.HandleMessages(func(src utils.NodeID, msg client.ChatMessage) {
+		if src.Digest.Cmp(client1.ID().Digest) != 0 {
+			t.Errorf("wrong source id")
+		}
+		received <- msg
+	})
+
+	time.Sleep(500 * time.Millisecond)
+	err := client2.publishBoxKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainmsg := client.NewPlainChatMessage("Hello")
+	plainmsg.Time = time.Now().Add(-time.Hour)
+	err = client1.storeMail(client2.ID(), plainmsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2.FetchMailbox()
+	select {
+	case m := <-received:
+		if m.ID != plainmsg.ID || m.Text() != plainmsg.Text() {
+			t.Errorf("wrong message: %v; expects %v", m, plainmsg)
+		}
+		if !m.Time.Equal(plainmsg.Time) {
+			t.Errorf("wrong message time: %v; expects %v", m.Time, plainmsg.Time)
+		}
+	default:
+		t.Errorf("message should be fetched from the mailbox")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	client2.FetchMailbox()
+	select {
+	case <-received:
+		t.Errorf("fetched message should be deleted from the mailbox")
+	default:
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
 func TestClientProfile(t *testing.T) {
 	const data = `iVBORw0KGgoAAAANSUhEUgAAACAAAAAgCAIAAAD8GO2jAAADw0lEQVRIx+1WXU
 xTZxjuhTe7UTMSMy6mA5wttJRz+p2/7/yXnpYON3SAP9MRiBFZwtgWxcRE1Bm3sC0jcz+GLLohm8sM
@@ -169,8 +1005,26 @@ func TestClientStatus(t *testing.T) {
 
 	status1 := client.UserStatus{Type: client.StatusActive, Message: ":-("}
 
-	client1.Roster.Add(utils.NewNodeID(namespace, key2.Digest()))
-	client2.Roster.Add(utils.NewNodeID(namespace, key1.Digest()))
+	// Presence is shared only after a subscription has been approved.
+	approved := make(chan bool)
+	client1.HandleSubscriptions(func(id utils.NodeID, state client.Subscription, message string) {
+		approved <- state == client.SubscriptionBoth
+	})
+	client2.HandleSubscriptions(func(id utils.NodeID, state client.Subscription, message string) {
+		client2.ApproveSubscription(id)
+	})
+
+	go client1.Run()
+	go client2.Run()
+
+	if err := client1.Subscribe(utils.NewNodeID(namespace, key2.Digest()), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !<-approved {
+		t.Fatal("subscription should be approved")
+	}
+	// Wait for the presence sent on approval.
+	time.Sleep(200 * time.Millisecond)
 
 	success := make(chan bool)
 
@@ -202,9 +1056,6 @@ func TestClientStatus(t *testing.T) {
 		success <- true
 	})
 
-	go client1.Run()
-	go client2.Run()
-
 	client1.SetStatus(status1)
 
 	for i := 0; i < 2; i++ {
@@ -213,6 +1064,128 @@ func TestClientStatus(t *testing.T) {
 		}
 	}
 
+	// Close sends an offline presence to the roster.
+	client1.HandleStatuses(nil)
+	client2.HandleStatuses(nil)
+
+	client1.Close()
+	client2.Close()
+}
+
+func TestClientSubscription(t *testing.T) {
+	key1 := utils.GeneratePrivateKey()
+	key2 := utils.GeneratePrivateKey()
+	client1, err := NewClient(key1, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2, err := NewClient(key2, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1 := utils.NewNodeID(namespace, key1.Digest())
+	id2 := utils.NewNodeID(namespace, key2.Digest())
+
+	type change struct {
+		state   client.Subscription
+		message string
+	}
+	changes1 := make(chan change, 10)
+	changes2 := make(chan change, 10)
+	client1.HandleSubscriptions(func(id utils.NodeID, state client.Subscription, message string) {
+		changes1 <- change{state, message}
+	})
+	client2.HandleSubscriptions(func(id utils.NodeID, state client.Subscription, message string) {
+		changes2 <- change{state, message}
+	})
+	statuses := make(chan client.UserStatus, 10)
+	client2.HandleStatuses(func(src utils.NodeID, p client.UserStatus) {
+		statuses <- p
+	})
+
+	go client1.Run()
+	go client2.Run()
+
+	expect := func(ch chan change, state client.Subscription, message string) {
+		select {
+		case c := <-ch:
+			if c.state != state || c.message != message {
+				t.Errorf("wrong change: %v %q; expects %v %q", c.state, c.message, state, message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("subscription should change to %v", state)
+		}
+	}
+	state := func(c *Client, id utils.NodeID) client.Subscription {
+		e, _ := c.Roster.Entry(id)
+		return e.Subscription
+	}
+
+	if err := client1.Subscribe(id2, "Hi"); err != nil {
+		t.Fatal(err)
+	}
+	expect(changes2, client.SubscriptionRequested, "Hi")
+	if r := client2.SubscriptionRequests(); len(r) != 1 || r[0].Message != "Hi" {
+		t.Errorf("wrong subscription requests: %v", r)
+	}
+	if _, ok := client2.Roster.Entry(id1); ok {
+		t.Errorf("a request should not be added to the roster before approval")
+	}
+	if err := client2.DenySubscription(id1); err != nil {
+		t.Fatal(err)
+	}
+	expect(changes1, client.SubscriptionNone, "")
+	if _, ok := client2.Roster.Entry(id1); ok || len(client2.SubscriptionRequests()) != 0 {
+		t.Errorf("a denied request should be removed")
+	}
+
+	// Requests from strangers are dropped under PolicyContactsOnly.
+	client2.SetMessagePolicy(client.PolicyContactsOnly)
+	client1.Subscribe(id2, "Hi")
+	select {
+	case c := <-changes2:
+		t.Errorf("a request from a stranger should be dropped: %v", c)
+	case <-time.After(200 * time.Millisecond):
+	}
+	client2.SetMessagePolicy(client.PolicyOpen)
+
+	// Presence from contacts that are not approved is ignored.
+	client1.node.Send(id2, client.UserPresence{Status: client.UserStatus{Type: client.StatusActive}}, nil)
+	select {
+	case <-statuses:
+		t.Errorf("presence should be ignored")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	client1.Subscribe(id2, "Hi again")
+	expect(changes2, client.SubscriptionRequested, "Hi again")
+	if s := state(client1, id2); s != client.SubscriptionPending {
+		t.Errorf("wrong state: %v; expects %v", s, client.SubscriptionPending)
+	}
+	// Subscribing to a contact that has asked approves it.
+	if err := client2.Subscribe(id1, ""); err != nil {
+		t.Fatal(err)
+	}
+	expect(changes1, client.SubscriptionBoth, "")
+	if s := state(client1, id2); s != client.SubscriptionBoth {
+		t.Errorf("wrong state: %v; expects %v", s, client.SubscriptionBoth)
+	}
+	if s := state(client2, id1); s != client.SubscriptionBoth {
+		t.Errorf("wrong state: %v; expects %v", s, client.SubscriptionBoth)
+	}
+	select {
+	case <-statuses:
+	case <-time.After(5 * time.Second):
+		t.Errorf("presence should be shared")
+	}
+
+	if err := client2.Unsubscribe(id1); err != nil {
+		t.Fatal(err)
+	}
+	expect(changes1, client.SubscriptionNone, "")
+
+	client1.HandleStatuses(nil)
+	client2.HandleStatuses(nil)
 	client1.Close()
 	client2.Close()
 }
@@ -285,3 +1258,216 @@ func TestNodeChatMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestClientPolicy(t *testing.T) {
+	key1 := utils.GeneratePrivateKey()
+	key2 := utils.GeneratePrivateKey()
+	client1, err := NewClient(key1, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2, err := NewClient(key2, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1 := utils.NewNodeID(namespace, key1.Digest())
+	id2 := utils.NewNodeID(namespace, key2.Digest())
+
+	msgs := make(chan client.ChatMessage, 10)
+	requests := make(chan client.ChatMessage, 10)
+	client2.HandleMessages(func(src utils.NodeID, msg client.ChatMessage) {
+		msgs <- msg
+	})
+	client2.HandleMessageRequests(func(src utils.NodeID, msg client.ChatMessage) {
+		requests <- msg
+	})
+	client2.SetMessagePolicy(client.PolicyQuarantine)
+
+	go client1.Run()
+	go client2.Run()
+
+	// Messages from strangers are held and acknowledged.
+	delivered := make(chan bool, 1)
+	client1.SendMessage(id2, client.NewPlainChatMessage("Hello"), func(ok bool) {
+		delivered <- ok
+	})
+	select {
+	case m := <-requests:
+		if m.Text() != "Hello" {
+			t.Errorf("wrong message body")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message should be held")
+	}
+	if !<-delivered {
+		t.Errorf("a held message should be acknowledged")
+	}
+	if r := client2.MessageRequests(); len(r) != 1 || r[0].Peer.Digest.Cmp(id1.Digest) != 0 {
+		t.Errorf("wrong requests: %v", r)
+	}
+	select {
+	case <-msgs:
+		t.Errorf("a held message should not be passed to the message handler")
+	default:
+	}
+
+	if err := client2.AcceptRequests(id1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-msgs:
+		if m.Text() != "Hello" {
+			t.Errorf("wrong message body")
+		}
+	default:
+		t.Errorf("an accepted message should be passed to the message handler")
+	}
+	if !client2.Roster.IsContact(id1) || len(client2.MessageRequests()) != 0 {
+		t.Errorf("an accepted sender should be a contact")
+	}
+
+	// Messages from strangers are dropped.
+	client2.SetMessagePolicy(client.PolicyContactsOnly)
+	client2.Roster.Remove(id1)
+	client1.SendMessage(id2, client.NewPlainChatMessage("Again"), nil)
+	select {
+	case <-msgs:
+		t.Errorf("a message from a stranger should be dropped")
+	case <-requests:
+		t.Errorf("a message from a stranger should not be held")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Messages from blocked contacts are dropped whatever the policy is.
+	if err := client2.Block(id1); err != nil {
+		t.Fatal(err)
+	}
+	client2.SetMessagePolicy(client.PolicyOpen)
+	if !client2.IsBlocked(id1) {
+		t.Errorf("client1 should be blocked")
+	}
+	client1.SendMessage(id2, client.NewPlainChatMessage("Blocked"), nil)
+	select {
+	case <-msgs:
+		t.Errorf("a message from a blocked contact should be dropped")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	client1.Close()
+	client2.Close()
+}
+
+func TestClientSuccessionRevoked(t *testing.T) {
+	c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Run()
+	defer c.Close()
+
+	old := utils.GeneratePrivateKey()
+	next := utils.GeneratePrivateKey().NodeID(namespace)
+	c.Roster.Add(old.NodeID(namespace))
+
+	r, err := utils.NewRevocation(old, "compromised")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.applyRevocation(r)
+
+	s, err := utils.NewSuccession(old, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.applySuccession(s) {
+		t.Errorf("a succession statement of a revoked key should be rejected")
+	}
+	if _, ok := c.Roster.Entry(old.NodeID(namespace)); !ok {
+		t.Errorf("the revoked contact should not be replaced")
+	}
+	if _, ok := c.Roster.Entry(next); ok {
+		t.Errorf("the next identity should not be added")
+	}
+
+	other := utils.GeneratePrivateKey()
+	c.Roster.Add(other.NodeID(namespace))
+	s, err = utils.NewSuccession(other, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.applySuccession(s) {
+		t.Errorf("a succession statement of a valid key should be accepted")
+	}
+}
+
+func TestClientKeyChange(t *testing.T) {
+	key1 := utils.GeneratePrivateKey()
+	key2 := utils.GeneratePrivateKey()
+	client1, err := NewClient(key1, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2, err := NewClient(key2, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type change struct {
+		prev, id utils.NodeID
+		verified bool
+	}
+	changes := make(chan change, 10)
+	client1.HandleKeyChanges(func(prev utils.NodeID, id utils.NodeID, verified bool) {
+		changes <- change{prev, id, verified}
+	})
+	expect := func(prev, id utils.NodeID, verified bool) {
+		select {
+		case c := <-changes:
+			if c.prev.Digest != prev.Digest || c.id.Digest != id.Digest || c.verified != verified {
+				t.Errorf("wrong key change: %v; expects %v -> %v", c, prev, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("key change should be reported")
+		}
+	}
+
+	// A contact known under the legacy ID shows up under a new one.
+	legacy, err := key2.WithVersion(utils.IDVersionSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyID := legacy.NodeID(namespace)
+	client1.Roster.Add(legacyID)
+	if err := client1.Roster.Pin(legacyID, legacy.Public()); err != nil {
+		t.Fatal(err)
+	}
+	client1.Roster.SetVerified(legacyID, true)
+
+	go client1.Run()
+	go client2.Run()
+	time.Sleep(500 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		client2.node.Send(client1.ID(), client.TypingNotification{State: client.Composing}, nil)
+	}
+	expect(legacyID, client2.ID(), true)
+	time.Sleep(200 * time.Millisecond)
+	if len(changes) > 0 {
+		t.Errorf("key change should be reported once")
+	}
+
+	// A key succession changes the key of the contact.
+	old := utils.GeneratePrivateKey()
+	next := utils.GeneratePrivateKey().NodeID(namespace)
+	client1.Roster.Add(old.NodeID(namespace))
+	s, err := utils.NewSuccession(old, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client1.applySuccession(s) {
+		t.Fatalf("a succession statement should be accepted")
+	}
+	expect(old.NodeID(namespace), next, false)
+
+	client1.Close()
+	client2.Close()
+}
@@ -0,0 +1,103 @@
+package murcott
+
+import (
+	"errors"
+
+	"github.com/h2so5/murcott/client"
+	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
+)
+
+// publishPrekey rotates the signed prekey if needed and publishes the prekey bundle.
+func (c *Client) publishPrekey() error {
+	pk, rotated, err := c.convs.Prekey()
+	if err != nil {
+		return err
+	}
+	if rotated {
+		c.conversationChanged()
+	}
+	b, err := client.NewPrekeyBundle(c.key, c.boxKey.PublicKey(), pk.PublicKey())
+	if err != nil {
+		return err
+	}
+	data, err := msgpack.Marshal(b)
+	if err != nil {
+		return err
+	}
+	c.node.StoreValue(client.PrekeyBundleKey(c.id), string(data))
+	return nil
+}
+
+// lookupPrekeyBundle finds a verified prekey bundle of the identity in the DHT.
+func (c *Client) lookupPrekeyBundle(id utils.NodeID) *client.PrekeyBundle {
+	data := c.node.LoadValue(client.PrekeyBundleKey(id))
+	if data == nil {
+		return nil
+	}
+	var b client.PrekeyBundle
+	if msgpack.Unmarshal([]byte(*data), &b) != nil {
+		return nil
+	}
+	if !b.Verify() || b.Key.Digest() != id.Digest {
+		return nil
+	}
+	return &b
+}
+
+// StartConversation starts a forward-secret conversation with dst using the
+// prekey bundle it has published in the DHT. From then on, messages to and
+// from dst are encrypted with a double ratchet in addition to the box key.
+func (c *Client) StartConversation(dst utils.NodeID) error {
+	b := c.lookupPrekeyBundle(dst)
+	if b == nil {
+		return errors.New("prekey bundle not found: " + dst.String())
+	}
+	err := c.convs.Start(dst, c.boxKey, b)
+	if err != nil {
+		return err
+	}
+	c.conversationChanged()
+	return nil
+}
+
+// EndConversation forgets the conversation with dst.
+func (c *Client) EndConversation(dst utils.NodeID) {
+	c.convs.End(dst)
+	c.conversationChanged()
+}
+
+// HasConversation reports whether there is a forward-secret conversation with dst.
+// A conversation is also started when a contact starts one with the client.
+func (c *Client) HasConversation(dst utils.NodeID) bool {
+	return c.convs.Has(dst)
+}
+
+// HandleConversationChanges registers the given function to be called with
+// the encoded conversation state whenever it changes. The state must be
+// saved before the handler returns, because a message key is never used
+// twice; pass the saved state to UnmarshalConversations after a restart.
+// The state contains secret keys.
+func (c *Client) HandleConversationChanges(handler func(data []byte)) {
+	c.convHandler = handler
+}
+
+func (c *Client) conversationChanged() {
+	if c.convHandler == nil {
+		return
+	}
+	data, err := c.convs.MarshalBinary()
+	if err != nil {
+		c.Logger.Error("%v", err)
+		return
+	}
+	c.convHandler(data)
+}
+
+func (c *Client) MarshalConversations() ([]byte, error) {
+	return c.convs.MarshalBinary()
+}
+
+func (c *Client) UnmarshalConversations(data []byte) error {
+	return c.convs.UnmarshalBinary(data)
+}
@@ -29,6 +29,8 @@ type DHT struct {
 	kvs      map[string]string
 	kvsMutex sync.RWMutex
 
+	mail *mailStore
+
 	chmap      map[string]chan<- dhtRPCReturn
 	chmapMutex sync.Mutex
 
@@ -57,6 +59,7 @@ func NewDHT(k int, id utils.NodeID, conn net.PacketConn, logger *log.Logger) *DH
 		table:  newNodeTable(k, id),
 		k:      k,
 		kvs:    make(map[string]string),
+		mail:   newMailStore(),
 		chmap:  make(map[string]chan<- dhtRPCReturn),
 		conn:   conn,
 		logger: logger,
@@ -126,6 +129,10 @@ func (p *DHT) ProcessPacket(b []byte, addr net.Addr) {
 			p.sendPacket(c.Src, newRPCReturnCommand(c.ID, args))
 		}
 
+	case "mailbox-put", "mailbox-get", "mailbox-del":
+		p.logger.Info("%s: Receive DHT %s from %s", p.id.String(), c.Method, c.Src.String())
+		p.processMail(c)
+
 	case "": // callback
 		id := string(c.ID)
 		p.chmapMutex.Lock()
@@ -247,16 +254,20 @@ func (p *DHT) LoadValue(key string) *string {
 		endch <- struct{}{}
 	}
 
-	if len(nodes) == 0 {
-		return nil
-	}
-
+	// The local store has been checked; asking this node would time out.
+	requested := map[string]struct{}{p.id.Digest.String(): {}}
+	sent := 0
 	for _, n := range nodes {
-		reqch <- n.ID
+		if _, ok := requested[n.ID.Digest.String()]; !ok {
+			reqch <- n.ID
+			sent++
+		}
+	}
+	if sent == 0 {
+		return nil
 	}
 
 	count := 0
-	requested := make(map[string]struct{})
 
 	for {
 		select {
@@ -281,7 +292,6 @@ func (p *DHT) LoadValue(key string) *string {
 			}
 		case data := <-retch:
 			return data
-		default:
 		}
 	}
 }
@@ -0,0 +1,382 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Limits of mailboxes. Items are stored on the k nodes closest to the mailbox
+// of the recipient until they are deleted by the recipient or expire.
+const (
+	// MaxMailSize is the maximum size of the data of an item.
+	MaxMailSize = 16 * 1024
+	// MaxMailExpiry is the maximum lifetime of an item.
+	MaxMailExpiry = 7 * 24 * time.Hour
+
+	maxMailboxItems   = 100
+	maxMailboxBytes   = 1024 * 1024
+	maxMailStoreBytes = 64 * 1024 * 1024
+
+	// A sender may fill only a part of a mailbox and of the store.
+	maxSenderItems = 20
+	maxSenderBytes = 4 * 1024 * 1024
+
+	// mailReplyBytes keeps a reply to mailbox-get within one datagram.
+	mailReplyBytes = 48 * 1024
+	// mailDeleteWindow is how far the time of a delete request may be off.
+	mailDeleteWindow = 5 * time.Minute
+)
+
+// MailItem is an opaque item stored in a mailbox.
+type MailItem struct {
+	ID      []byte `msgpack:"id"`
+	Data    []byte `msgpack:"data"`
+	Expires int64  `msgpack:"expires"`
+}
+
+// mailEntry is an item with the digest of the key that has signed its put.
+type mailEntry struct {
+	MailItem
+	sender string
+}
+
+// mailStore holds the mailboxes stored on this node.
+type mailStore struct {
+	boxes map[string][]mailEntry
+	size  int
+	// senders holds the number of bytes stored by each sender.
+	senders map[string]int
+	mutex   sync.Mutex
+}
+
+func newMailStore() *mailStore {
+	return &mailStore{boxes: make(map[string][]mailEntry), senders: make(map[string]int)}
+}
+
+// drop accounts for the removal of the entry. m.mutex must be held.
+func (m *mailStore) drop(e mailEntry) {
+	m.size -= len(e.Data)
+	m.senders[e.sender] -= len(e.Data)
+	if m.senders[e.sender] <= 0 {
+		delete(m.senders, e.sender)
+	}
+}
+
+func (m *mailStore) expire(now time.Time) {
+	for owner, items := range m.boxes {
+		var rest []mailEntry
+		for _, i := range items {
+			if now.Unix() < i.Expires {
+				rest = append(rest, i)
+			} else {
+				m.drop(i)
+			}
+		}
+		if len(rest) == 0 {
+			delete(m.boxes, owner)
+		} else {
+			m.boxes[owner] = rest
+		}
+	}
+}
+
+func (m *mailStore) put(owner utils.NodeID, sender utils.PublicKeyDigest, item MailItem) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	m.expire(now)
+
+	if len(item.ID) == 0 || len(item.Data) > MaxMailSize {
+		return errors.New("invalid item")
+	}
+	if max := now.Add(MaxMailExpiry).Unix(); item.Expires > max {
+		item.Expires = max
+	}
+	if item.Expires <= now.Unix() {
+		return errors.New("item expired")
+	}
+
+	key := owner.Digest.String()
+	from := sender.String()
+	items := m.boxes[key]
+	size := 0
+	sent := 0
+	for _, i := range items {
+		if bytes.Equal(i.ID, item.ID) {
+			return nil
+		}
+		size += len(i.Data)
+		if i.sender == from {
+			sent++
+		}
+	}
+	if len(items) >= maxMailboxItems || size+len(item.Data) > maxMailboxBytes {
+		return errors.New("mailbox full")
+	}
+	if sent >= maxSenderItems || m.senders[from]+len(item.Data) > maxSenderBytes {
+		return errors.New("quota exceeded")
+	}
+	if m.size+len(item.Data) > maxMailStoreBytes {
+		return errors.New("storage full")
+	}
+	m.boxes[key] = append(items, mailEntry{MailItem: item, sender: from})
+	m.size += len(item.Data)
+	m.senders[from] += len(item.Data)
+	return nil
+}
+
+// get returns items from offset up to mailReplyBytes and the offset of the rest,
+// or -1 if there are no more items.
+func (m *mailStore) get(owner utils.NodeID, offset int) ([]MailItem, int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire(time.Now())
+
+	items := m.boxes[owner.Digest.String()]
+	var res []MailItem
+	size := 0
+	for i := offset; i < len(items); i++ {
+		if size+len(items[i].Data) > mailReplyBytes && len(res) > 0 {
+			return res, i
+		}
+		res = append(res, items[i].MailItem)
+		size += len(items[i].Data)
+	}
+	return res, -1
+}
+
+func (m *mailStore) remove(owner utils.NodeID, ids [][]byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := owner.Digest.String()
+	var rest []mailEntry
+	for _, i := range m.boxes[key] {
+		found := false
+		for _, id := range ids {
+			if bytes.Equal(i.ID, id) {
+				found = true
+				break
+			}
+		}
+		if found {
+			m.drop(i)
+		} else {
+			rest = append(rest, i)
+		}
+	}
+	if len(rest) == 0 {
+		delete(m.boxes, key)
+	} else {
+		m.boxes[key] = rest
+	}
+}
+
+func mailboxID(ns utils.Namespace, owner utils.NodeID) utils.NodeID {
+	hash := sha1.Sum([]byte("mailbox:" + owner.Digest.String()))
+	return utils.NewNodeID(ns, hash)
+}
+
+func mailPutData(owner utils.NodeID, item MailItem) []byte {
+	ary := []interface{}{
+		"mailbox-put",
+		owner.Digest[:],
+		item.ID,
+		item.Data,
+		item.Expires,
+	}
+
+	data, _ := msgpack.Marshal(ary)
+	return data
+}
+
+func mailDeleteData(owner utils.NodeID, ids [][]byte, t int64) []byte {
+	ary := []interface{}{
+		"mailbox-del",
+		owner.Digest[:],
+		ids,
+		t,
+	}
+
+	data, _ := msgpack.Marshal(ary)
+	return data
+}
+
+func (p *DHT) processMail(c dhtRPCCommand) {
+	var ownerstr string
+	c.getArgs("owner", &ownerstr)
+	owner, err := utils.NewNodeIDFromBytes([]byte(ownerstr))
+	if err != nil {
+		p.logger.Error("%s: %v", c.Method, err)
+		return
+	}
+
+	switch c.Method {
+	case "mailbox-put":
+		var item MailItem
+		var key utils.PublicKey
+		var sign utils.Signature
+		c.getArgs("item", &item)
+		c.getArgs("key", &key)
+		c.getArgs("sign", &sign)
+		args := map[string]interface{}{}
+		// Puts are signed by the sender so that quotas can be kept per sender.
+		if key.IsZero() || !key.Verify(mailPutData(owner, item), &sign) {
+			args["error"] = "wrong signature"
+		} else if err := p.mail.put(owner, key.Digest(), item); err != nil {
+			args["error"] = err.Error()
+		}
+		p.sendPacket(c.Src, newRPCReturnCommand(c.ID, args))
+
+	case "mailbox-get":
+		var offset int
+		c.getArgs("offset", &offset)
+		items, next := p.mail.get(owner, offset)
+		args := map[string]interface{}{
+			"items": items,
+			"next":  next,
+		}
+		p.sendPacket(c.Src, newRPCReturnCommand(c.ID, args))
+
+	case "mailbox-del":
+		var key utils.PublicKey
+		var sign utils.Signature
+		var ids [][]byte
+		var t int64
+		c.getArgs("key", &key)
+		c.getArgs("sign", &sign)
+		c.getArgs("ids", &ids)
+		c.getArgs("time", &t)
+		if key.IsZero() || key.Digest() != owner.Digest {
+			return
+		}
+		if d := time.Since(time.Unix(t, 0)); d > mailDeleteWindow || d < -mailDeleteWindow {
+			return
+		}
+		if key.Verify(mailDeleteData(owner, ids, t), &sign) {
+			p.mail.remove(owner, ids)
+		}
+	}
+}
+
+// StoreMail stores the item in the mailbox of owner on the nodes closest to the mailbox.
+// The request is signed by key, the sender, whose items count against its quota.
+// It returns an error if no node has accepted the item.
+func (p *DHT) StoreMail(key utils.Signer, owner utils.NodeID, item MailItem) error {
+	if len(item.Data) > MaxMailSize {
+		return errors.New("mail too large")
+	}
+	sign := key.Sign(mailPutData(owner, item))
+	if sign == nil {
+		return errors.New("cannot sign request")
+	}
+	nodes := p.FindNearestNode(mailboxID(p.id.NS, owner))
+	c := newRPCCommand("mailbox-put", map[string]interface{}{
+		"owner": string(owner.Bytes()),
+		"item":  item,
+		"key":   *key.Public(),
+		"sign":  *sign,
+	})
+
+	okch := make(chan bool, len(nodes))
+	for _, n := range nodes {
+		go func(id utils.NodeID) {
+			ret, err := p.sendAndWaitPacket(id, c)
+			okch <- err == nil && ret.command.Args["error"] == nil
+		}(n.ID)
+	}
+
+	stored := false
+	for range nodes {
+		if <-okch {
+			stored = true
+		}
+	}
+	if !stored {
+		return errors.New("no node has stored the mail")
+	}
+	return nil
+}
+
+// LoadMail returns the items in the mailbox of owner.
+func (p *DHT) LoadMail(owner utils.NodeID) []MailItem {
+	nodes := p.FindNearestNode(mailboxID(p.id.NS, owner))
+
+	itemch := make(chan []MailItem, len(nodes)+1)
+	for _, n := range nodes {
+		go func(id utils.NodeID) {
+			var res []MailItem
+			for offset := 0; offset >= 0; {
+				c := newRPCCommand("mailbox-get", map[string]interface{}{
+					"owner":  string(owner.Bytes()),
+					"offset": offset,
+				})
+				ret, err := p.sendAndWaitPacket(id, c)
+				if err != nil {
+					break
+				}
+				var items []MailItem
+				next := -1
+				ret.command.getArgs("items", &items)
+				ret.command.getArgs("next", &next)
+				offset = next
+				if len(items) == 0 {
+					break
+				}
+				res = append(res, items...)
+			}
+			itemch <- res
+		}(n.ID)
+	}
+
+	// This node may be one of the nodes closest to the mailbox.
+	var local []MailItem
+	for offset := 0; offset >= 0; {
+		var items []MailItem
+		items, offset = p.mail.get(owner, offset)
+		local = append(local, items...)
+	}
+	itemch <- local
+
+	var res []MailItem
+	found := make(map[string]struct{})
+	for n := 0; n <= len(nodes); n++ {
+		for _, i := range <-itemch {
+			id := hex.EncodeToString(i.ID)
+			if _, ok := found[id]; !ok {
+				found[id] = struct{}{}
+				res = append(res, i)
+			}
+		}
+	}
+	return res
+}
+
+// DeleteMail deletes the items from the mailbox of key.
+// The request is signed so that only the owner can delete items.
+func (p *DHT) DeleteMail(key utils.Signer, ids [][]byte) error {
+	owner := key.Public().NodeID(p.id.NS)
+	t := time.Now().Unix()
+	sign := key.Sign(mailDeleteData(owner, ids, t))
+	if sign == nil {
+		return errors.New("cannot sign request")
+	}
+	c := newRPCCommand("mailbox-del", map[string]interface{}{
+		"owner": string(owner.Bytes()),
+		"key":   *key.Public(),
+		"ids":   ids,
+		"time":  t,
+		"sign":  *sign,
+	})
+	for _, n := range p.FindNearestNode(mailboxID(p.id.NS, owner)) {
+		p.sendPacket(n.ID, c)
+	}
+	p.mail.remove(owner, ids)
+	return nil
+}
@@ -0,0 +1,156 @@
+package dht
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+	"github.com/h2so5/utp"
+)
+
+func TestMailStoreQuota(t *testing.T) {
+	m := newMailStore()
+	owner := utils.NewRandomNodeID(namespace)
+	sender := utils.GeneratePrivateKey().Digest()
+	expires := time.Now().Add(time.Hour).Unix()
+
+	if m.put(owner, sender, MailItem{ID: []byte("x"), Data: make([]byte, MaxMailSize+1), Expires: expires}) == nil {
+		t.Errorf("too large item should be refused")
+	}
+	if m.put(owner, sender, MailItem{ID: []byte("x"), Expires: time.Now().Unix() - 1}) == nil {
+		t.Errorf("expired item should be refused")
+	}
+
+	for i := 0; i < maxSenderItems; i++ {
+		err := m.put(owner, sender, MailItem{ID: []byte(fmt.Sprint(i)), Data: []byte("data"), Expires: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.put(owner, sender, MailItem{ID: []byte("quota"), Data: []byte("data"), Expires: expires}) == nil {
+		t.Errorf("item should be refused when the sender has used its quota")
+	}
+	for i := maxSenderItems; i < maxMailboxItems; i++ {
+		sender := utils.GeneratePrivateKey().Digest()
+		err := m.put(owner, sender, MailItem{ID: []byte(fmt.Sprint(i)), Data: []byte("data"), Expires: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.put(owner, sender, MailItem{ID: []byte("full"), Data: []byte("data"), Expires: expires}) == nil {
+		t.Errorf("item should be refused when the mailbox is full")
+	}
+	if m.put(owner, sender, MailItem{ID: []byte("0"), Data: []byte("data"), Expires: expires}) != nil {
+		t.Errorf("storing the same item again should succeed")
+	}
+
+	items, next := m.get(owner, 0)
+	if len(items) != maxMailboxItems || next != -1 {
+		t.Errorf("get() returns %d items and %d; expects %d and -1", len(items), next, maxMailboxItems)
+	}
+
+	m.remove(owner, [][]byte{[]byte("0"), []byte("1")})
+	items, _ = m.get(owner, 0)
+	if len(items) != maxMailboxItems-2 {
+		t.Errorf("get() returns %d items; expects %d", len(items), maxMailboxItems-2)
+	}
+
+	m.expire(time.Unix(expires, 0))
+	items, _ = m.get(owner, 0)
+	if len(items) != 0 || m.size != 0 || len(m.senders) != 0 {
+		t.Errorf("expired items should be removed")
+	}
+}
+
+func TestDhtMailbox(t *testing.T) {
+	logger := log.NewLogger()
+
+	n := 5
+	var dhts []*DHT
+	var root utils.NodeInfo
+
+	for i := 0; i < n; i++ {
+		id := utils.NewRandomNodeID(namespace)
+		addr, err := utp.ResolveAddr("utp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		utp, err := utp.Listen("utp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uaddr, err := getLoopbackAddr(utp.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := NewDHT(10, id, utp.RawConn, logger)
+		dhts = append(dhts, d)
+		defer d.Close()
+		if i == 0 {
+			root = utils.NodeInfo{ID: id, Addr: uaddr}
+		}
+
+		go func() {
+			var b [102400]byte
+			for {
+				l, addr, err := utp.RawConn.ReadFrom(b[:])
+				if err != nil {
+					return
+				}
+				d.ProcessPacket(b[:l], addr)
+			}
+		}()
+	}
+
+	for _, d := range dhts[1:] {
+		d.AddNode(root)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, d := range dhts {
+		d.FindNearestNode(d.id)
+	}
+
+	key := utils.GeneratePrivateKey()
+	owner := key.NodeID(namespace)
+	item := MailItem{ID: []byte("id"), Data: []byte("data"), Expires: time.Now().Add(time.Hour).Unix()}
+
+	sender := utils.GeneratePrivateKey()
+	forged := forgedSigner{sender, &utils.GeneratePrivateKey().PublicKey}
+	if dhts[1].StoreMail(forged, owner, item) == nil {
+		t.Errorf("put with a wrong signature should be refused")
+	}
+
+	err := dhts[1].StoreMail(sender, owner, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := dhts[2].LoadMail(owner)
+	if len(items) != 1 || string(items[0].Data) != "data" {
+		t.Fatalf("LoadMail() returns %v; expects [%v]", items, item)
+	}
+
+	dhts[2].DeleteMail(utils.GeneratePrivateKey(), [][]byte{item.ID})
+	time.Sleep(100 * time.Millisecond)
+	if len(dhts[3].LoadMail(owner)) != 1 {
+		t.Errorf("item should not be deleted by another key")
+	}
+
+	dhts[2].DeleteMail(key, [][]byte{item.ID})
+	time.Sleep(100 * time.Millisecond)
+	if len(dhts[3].LoadMail(owner)) != 0 {
+		t.Errorf("item should be deleted by the owner")
+	}
+}
+
+// forgedSigner signs with a key other than its public key.
+type forgedSigner struct {
+	*utils.PrivateKey
+	key *utils.PublicKey
+}
+
+func (s forgedSigner) Public() *utils.PublicKey {
+	return s.key
+}
@@ -0,0 +1,358 @@
+package murcott
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/h2so5/murcott/client"
+	"github.com/h2so5/murcott/utils"
+)
+
+// groupJoinTimeout is how long JoinGroup waits for the members of the group to reply.
+const groupJoinTimeout = 5 * time.Second
+
+// maxClockSkew is how far the time of a group operation from a member may
+// be from the local time.
+const maxClockSkew = 5 * time.Minute
+
+type groupMessageHandler func(group utils.NodeID, src utils.NodeID, msg client.ChatMessage, order client.CausalOrder)
+type groupHandler func(group client.Group)
+
+// CreateGroup creates a new group with the client as its owner and only member.
+func (c *Client) CreateGroup(name string, topic string) (client.Group, error) {
+	g := &client.Group{ID: client.NewGroupID(c.id)}
+	op, err := client.NewGroupOperation(c.key, g.ID, nil, client.OpCreate, c.id, client.RoleOwner, nil)
+	if err != nil {
+		return client.Group{}, err
+	}
+	err = g.Apply(*op)
+	if err != nil {
+		return client.Group{}, err
+	}
+	if name != "" || topic != "" {
+		op, err = client.NewGroupInfoOperation(c.key, g.ID, g.Head(), name, topic)
+		if err != nil {
+			return client.Group{}, err
+		}
+		err = g.Apply(*op)
+		if err != nil {
+			return client.Group{}, err
+		}
+	}
+	c.node.Join(c.key.Public().NodeID(g.ID.NS))
+	c.groupMutex.Lock()
+	c.groups[g.ID.NS] = g
+	c.groupMutex.Unlock()
+	return cloneGroup(g), nil
+}
+
+// CreateInvite generates an invitation to the group valid for ttl.
+// Only admins and the owner can invite.
+func (c *Client) CreateInvite(id utils.NodeID, ttl time.Duration) (*client.GroupInvite, error) {
+	g, ok := c.Group(id)
+	if !ok {
+		return nil, errors.New("not a member of the group")
+	}
+	if g.Role(c.id) < client.RoleAdmin {
+		return nil, errors.New("not an admin of the group")
+	}
+	return client.NewGroupInvite(c.key, g.ID, time.Now().Add(ttl))
+}
+
+// JoinGroup joins the group with the invitation. The members reply with the
+// group if the invitation is valid, and the client adds itself to the members.
+// It returns an error if no member of the group replies.
+func (c *Client) JoinGroup(invite *client.GroupInvite) error {
+	if !invite.Verify() {
+		return errors.New("invalid invitation")
+	}
+	id := invite.Group
+	if _, ok := c.Group(id); ok {
+		return nil
+	}
+	c.node.Join(c.key.Public().NodeID(id.NS))
+	c.groupMutex.Lock()
+	c.groups[id.NS] = &client.Group{ID: id}
+	c.groupMutex.Unlock()
+
+	// Ask again every second in case the first members found did not reply.
+	var asked time.Time
+	for t := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		if time.Since(t) > groupJoinTimeout {
+			c.dropGroup(id.NS)
+			return errors.New("no group member replied")
+		}
+		c.groupMutex.Lock()
+		g, ok := c.groups[id.NS]
+		replied := ok && len(g.Log) > 0
+		c.groupMutex.Unlock()
+		if !ok {
+			return errors.New("refused by the group")
+		}
+		if replied {
+			break
+		}
+		if time.Since(asked) > time.Second && len(c.node.GroupNodes(id.NS)) > 0 {
+			c.node.Broadcast(id.NS, client.GroupJoin{Invite: *invite})
+			asked = time.Now()
+		}
+	}
+	return c.groupOperation(id, client.OpJoin, c.id, client.RoleMember, invite)
+}
+
+// LeaveGroup announces to the members that the client leaves the group and leaves it.
+// The owner cannot leave while there are other members.
+func (c *Client) LeaveGroup(id utils.NodeID) error {
+	g, ok := c.Group(id)
+	if !ok {
+		return errors.New("not a member of the group")
+	}
+	if g.HasMember(c.id) {
+		err := c.groupOperation(id, client.OpLeave, c.id, client.RoleMember, nil)
+		if err != nil {
+			return err
+		}
+	}
+	c.dropGroup(id.NS)
+	return nil
+}
+
+// Kick removes the member from the group. The client must be an admin
+// with a higher role than the member.
+func (c *Client) Kick(id utils.NodeID, member utils.NodeID) error {
+	return c.groupOperation(id, client.OpKick, member, client.RoleMember, nil)
+}
+
+// Ban removes the member from the group and refuses it from joining again
+// until it is unbanned. The members stop forwarding its packets in the group.
+func (c *Client) Ban(id utils.NodeID, member utils.NodeID) error {
+	return c.groupOperation(id, client.OpBan, member, client.RoleMember, nil)
+}
+
+// Unban lifts the ban of the identity.
+func (c *Client) Unban(id utils.NodeID, member utils.NodeID) error {
+	return c.groupOperation(id, client.OpUnban, member, client.RoleMember, nil)
+}
+
+// SetRole changes the role of the member. Only the owner can change roles;
+// giving client.RoleOwner to a member transfers the ownership.
+func (c *Client) SetRole(id utils.NodeID, member utils.NodeID, role client.Role) error {
+	return c.groupOperation(id, client.OpRole, member, role, nil)
+}
+
+// groupOperation signs the operation, applies it and sends it to the members.
+func (c *Client) groupOperation(id utils.NodeID, typ string, target utils.NodeID, role client.Role, invite *client.GroupInvite) error {
+	target = target.WithNS(c.id.NS)
+	return c.applyGroupOperation(id, func(g *client.Group) (*client.GroupOperation, error) {
+		return client.NewGroupOperation(c.key, g.ID, g.Head(), typ, target, role, invite)
+	})
+}
+
+// applyGroupOperation applies the operation made by newOp on the current
+// group and sends it to the members.
+func (c *Client) applyGroupOperation(id utils.NodeID, newOp func(g *client.Group) (*client.GroupOperation, error)) error {
+	c.groupMutex.Lock()
+	g, ok := c.groups[id.NS]
+	if !ok {
+		c.groupMutex.Unlock()
+		return errors.New("not a member of the group")
+	}
+	op, err := newOp(g)
+	if err != nil {
+		c.groupMutex.Unlock()
+		return err
+	}
+	old := append([]utils.NodeID(nil), g.Members...)
+	err = g.Apply(*op)
+	g2 := cloneGroup(g)
+	c.groupMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	err = c.node.Broadcast(id.NS, *op)
+	c.groupChanged(old, g2)
+	return err
+}
+
+// groupChanged is called after the log of the group has changed.
+func (c *Client) groupChanged(old []utils.NodeID, g client.Group) {
+	c.node.SetBanned(g.ID.NS, g.Banned)
+	if c.groupHandler != nil {
+		c.groupHandler(g)
+	}
+	for _, m := range old {
+		if g.HasMember(m) {
+			continue
+		}
+		if !g.HasMember(c.id) {
+			// The client has been removed.
+			c.dropGroup(g.ID.NS)
+		} else {
+			// Members who have left must not read new messages.
+			go c.rotateSenderKey(g.ID)
+		}
+		return
+	}
+}
+
+func (c *Client) dropGroup(ns utils.Namespace) {
+	c.groupMutex.Lock()
+	delete(c.groups, ns)
+	delete(c.senderKeys, ns)
+	delete(c.causal, ns)
+	c.groupMutex.Unlock()
+	c.node.Leave(ns)
+}
+
+// SetGroupInfo changes the name and the topic of the group.
+// Only admins and the owner can change them.
+func (c *Client) SetGroupInfo(id utils.NodeID, name string, topic string) error {
+	return c.applyGroupOperation(id, func(g *client.Group) (*client.GroupOperation, error) {
+		return client.NewGroupInfoOperation(c.key, g.ID, g.Head(), name, topic)
+	})
+}
+
+// SendGroupMessage sends the message to the members of the group.
+// The message is encrypted with the sender key of the client, which is sent
+// to each member sealed to its box key.
+func (c *Client) SendGroupMessage(id utils.NodeID, msg client.ChatMessage) error {
+	if _, ok := c.Group(id); !ok {
+		return errors.New("not a member of the group")
+	}
+	if msg.ID == "" {
+		msg.ID = client.NewMessageID()
+	}
+	m, err := c.encryptGroupMessage(id, msg)
+	if err != nil {
+		return err
+	}
+	return c.node.Broadcast(id.NS, *m)
+}
+
+// Group returns a copy of the metadata of the group.
+func (c *Client) Group(id utils.NodeID) (client.Group, bool) {
+	c.groupMutex.Lock()
+	defer c.groupMutex.Unlock()
+	if g, ok := c.groups[id.NS]; ok {
+		return cloneGroup(g), true
+	}
+	return client.Group{}, false
+}
+
+func cloneGroup(g *client.Group) client.Group {
+	g2 := *g
+	g2.Members = append([]utils.NodeID(nil), g.Members...)
+	g2.Admins = append([]utils.NodeID(nil), g.Admins...)
+	g2.Banned = append([]utils.NodeID(nil), g.Banned...)
+	g2.Log = append([]client.GroupOperation(nil), g.Log...)
+	return g2
+}
+
+// Groups returns the groups the client is a member of.
+func (c *Client) Groups() []client.Group {
+	c.groupMutex.Lock()
+	var ids []utils.NodeID
+	for _, g := range c.groups {
+		ids = append(ids, g.ID)
+	}
+	c.groupMutex.Unlock()
+	var groups []client.Group
+	for _, id := range ids {
+		if g, ok := c.Group(id); ok {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// HandleGroupMessages registers the given function as a handler of group messages.
+// Messages are passed in causal order: a message is never passed before one
+// its sender had seen when sending it. msg.Time is the time claimed by the sender.
+func (c *Client) HandleGroupMessages(handler func(group utils.NodeID, src utils.NodeID, msg client.ChatMessage)) {
+	c.groupMsgHandler = func(group utils.NodeID, src utils.NodeID, msg client.ChatMessage, order client.CausalOrder) {
+		handler(group, src, msg)
+	}
+}
+
+// HandleOrderedGroupMessages is like HandleGroupMessages, but also passes the
+// causal order of each message. Sorting by order.Before gives the same order
+// of messages on every member, unlike sorting by the claimed time.
+func (c *Client) HandleOrderedGroupMessages(handler func(group utils.NodeID, src utils.NodeID, msg client.ChatMessage, order client.CausalOrder)) {
+	c.groupMsgHandler = handler
+}
+
+// HandleGroupUpdates registers the given function as a handler of group changes.
+// The handler is called when the metadata or the members of a group change.
+func (c *Client) HandleGroupUpdates(handler func(group client.Group)) {
+	c.groupHandler = handler
+}
+
+// handleGroup handles a message sent within the namespace of a group.
+func (c *Client) handleGroup(src utils.NodeID, msg interface{}) interface{} {
+	if src.Digest.Cmp(c.id.Digest) == 0 {
+		return nil
+	}
+	member := src.WithNS(c.id.NS)
+
+	c.groupMutex.Lock()
+	g, ok := c.groups[src.NS]
+	if !ok {
+		c.groupMutex.Unlock()
+		return nil
+	}
+	isMember := g.HasMember(member)
+	old := append([]utils.NodeID(nil), g.Members...)
+	changed := false
+	reply := false
+	switch msg := msg.(type) {
+	case client.GroupChatMessage:
+		id := g.ID
+		c.groupMutex.Unlock()
+		if isMember {
+			c.receiveGroupMessage(id, member, msg)
+		}
+		return nil
+	case client.GroupJoin:
+		reply = !g.IsBanned(member) && g.CheckInvite(&msg.Invite, time.Now()) == nil
+	case client.GroupOperation:
+		if d := time.Since(msg.Time); d > maxClockSkew || d < -maxClockSkew {
+			c.Logger.Error("group operation from %s: wrong time", src.String())
+		} else if !bytes.Equal(msg.Prev, g.Head()) {
+			// The sender has missed operations or made one concurrently
+			// with another; both adopt the better log after exchanging them.
+			reply = isMember
+		} else if err := g.Apply(msg); err != nil {
+			c.Logger.Error("group operation from %s: %v", src.String(), err)
+		} else {
+			changed = true
+		}
+	case client.GroupUpdate:
+		if r, err := client.ReplayGroup(g.ID, msg.Group.Log); err != nil {
+			c.Logger.Error("group update from %s: %v", src.String(), err)
+		} else if err := g.CheckUpdate(r, time.Now(), maxClockSkew); err != nil {
+			c.Logger.Error("group update from %s: %v", src.String(), err)
+		} else if r.Better(g) {
+			if len(g.Log) == 0 {
+				// Do not wait for the messages sent before the client joined.
+				c.causalBuffer(g.ID.NS).SetBaseline(msg.Clock)
+			}
+			g.Name, g.Topic = r.Name, r.Topic
+			g.Members, g.Owner, g.Admins, g.Banned, g.Log = r.Members, r.Owner, r.Admins, r.Banned, r.Log
+			changed = true
+		} else if g.Better(r) {
+			reply = isMember
+		}
+	}
+	g2 := cloneGroup(g)
+	clock := c.causalBuffer(g.ID.NS).Clock()
+	c.groupMutex.Unlock()
+
+	if changed {
+		c.groupChanged(old, g2)
+	}
+	if reply {
+		return client.GroupUpdate{Group: g2, Clock: clock}
+	}
+	return nil
+}
@@ -0,0 +1,408 @@
+package murcott
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h2so5/murcott/client"
+	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Group messages whose sender key has not arrived yet wait for it.
+const (
+	pendingTimeout = time.Minute
+	maxPending     = 100
+)
+
+// causalTimeout is how long a group message waits for the messages it depends on.
+const causalTimeout = 5 * time.Second
+
+// groupKeys holds the sender keys of a group.
+type groupKeys struct {
+	own *client.SenderKey
+	// keys holds the sender keys of the other members by digest and generation.
+	keys map[string]client.SenderKey
+}
+
+// groupPayload is the plaintext of a GroupChatMessage.
+type groupPayload struct {
+	Message client.ChatMessage `msgpack:"message"`
+	Order   client.CausalOrder `msgpack:"order"`
+}
+
+// orderedGroupMessage is a group message waiting in the causal buffer.
+type orderedGroupMessage struct {
+	group utils.NodeID
+	src   utils.NodeID
+	msg   client.ChatMessage
+	order client.CausalOrder
+}
+
+type pendingGroupMessage struct {
+	group   utils.NodeID
+	src     utils.NodeID
+	msg     client.GroupChatMessage
+	expires time.Time
+}
+
+// senderKeyEnvelope is the content of a SealedSenderKey before it is
+// encrypted to the box key of the recipient.
+type senderKeyEnvelope struct {
+	Key       utils.PublicKey  `msgpack:"key"`
+	Group     utils.NodeID     `msgpack:"group"`
+	SenderKey client.SenderKey `msgpack:"sender_key"`
+	S         utils.Signature  `msgpack:"sign"`
+}
+
+func senderKeySignedData(dst utils.NodeID, group utils.NodeID, k client.SenderKey) []byte {
+	ary := []interface{}{
+		"sender-key",
+		dst.Digest[:],
+		group.Bytes(),
+		k.Generation,
+		k.Key,
+	}
+
+	data, _ := msgpack.Marshal(ary)
+	return data
+}
+
+func groupSignedData(group utils.NodeID, m *client.GroupChatMessage) []byte {
+	ary := []interface{}{
+		"group-chat",
+		group.Bytes(),
+		m.Generation,
+		m.N,
+		m.Data,
+	}
+
+	data, _ := msgpack.Marshal(ary)
+	return data
+}
+
+func groupAssociatedData(group utils.NodeID, src utils.NodeID) []byte {
+	return append(group.Bytes(), src.Digest[:]...)
+}
+
+func senderKeyIndex(src utils.NodeID, generation uint32) string {
+	return src.Digest.String() + "/" + strconv.FormatUint(uint64(generation), 10)
+}
+
+// ownSenderKey returns the current sender key of the client for the group.
+// c.groupMutex must be held.
+func (c *Client) ownSenderKey(ns utils.Namespace) (*client.SenderKey, error) {
+	k, ok := c.senderKeys[ns]
+	if !ok {
+		k = &groupKeys{keys: make(map[string]client.SenderKey)}
+		c.senderKeys[ns] = k
+	}
+	if k.own == nil {
+		own, err := client.NewSenderKey(1)
+		if err != nil {
+			return nil, err
+		}
+		k.own = own
+	}
+	return k.own, nil
+}
+
+// causalBuffer returns the causal buffer of the group. c.groupMutex must be held.
+func (c *Client) causalBuffer(ns utils.Namespace) *client.CausalBuffer {
+	b, ok := c.causal[ns]
+	if !ok {
+		b = client.NewCausalBuffer(c.id.Digest.String(), causalTimeout)
+		c.causal[ns] = b
+	}
+	return b
+}
+
+// encryptGroupMessage stamps the message with its causal order and encrypts
+// it with the sender key of the client.
+func (c *Client) encryptGroupMessage(group utils.NodeID, msg client.ChatMessage) (*client.GroupChatMessage, error) {
+	c.groupMutex.Lock()
+	k, err := c.ownSenderKey(group.NS)
+	if err != nil {
+		c.groupMutex.Unlock()
+		return nil, err
+	}
+	data, err := msgpack.Marshal(groupPayload{Message: msg, Order: c.causalBuffer(group.NS).Stamp()})
+	if err != nil {
+		c.groupMutex.Unlock()
+		return nil, err
+	}
+	n, data, err := k.Encrypt(groupAssociatedData(group, c.id), data)
+	gen := k.Generation
+	c.groupMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &client.GroupChatMessage{Key: *c.key.Public(), Generation: gen, N: n, Data: data}
+	sign := c.key.Sign(groupSignedData(group, m))
+	if sign == nil {
+		return nil, errors.New("cannot sign message")
+	}
+	m.S = *sign
+	return m, nil
+}
+
+// decryptGroupMessage verifies and decrypts a group message. It returns
+// ok == false if the sender key has not been received yet.
+func (c *Client) decryptGroupMessage(group utils.NodeID, src utils.NodeID, m *client.GroupChatMessage) (p groupPayload, ok bool, err error) {
+	if m.Key.IsZero() || m.Key.Digest() != src.Digest || !m.Key.Verify(groupSignedData(group, m), &m.S) {
+		return groupPayload{}, true, errors.New("wrong signature")
+	}
+	c.groupMutex.Lock()
+	var k client.SenderKey
+	if g, found := c.senderKeys[group.NS]; found {
+		k, ok = g.keys[senderKeyIndex(src, m.Generation)]
+	}
+	c.groupMutex.Unlock()
+	if !ok {
+		return groupPayload{}, false, nil
+	}
+	data, err := k.Decrypt(groupAssociatedData(group, src), m.N, m.Data)
+	if err != nil {
+		return groupPayload{}, true, err
+	}
+	err = msgpack.Unmarshal(data, &p)
+	return p, true, err
+}
+
+// receiveGroupMessage passes a group message from the member src to the
+// causal buffer, or keeps it until the sender key arrives and asks the sender for it.
+func (c *Client) receiveGroupMessage(group utils.NodeID, src utils.NodeID, m client.GroupChatMessage) {
+	p, ok, err := c.decryptGroupMessage(group, src, &m)
+	if err != nil {
+		c.Logger.Error("group message from %s: %v", src.String(), err)
+		return
+	}
+	if !ok {
+		c.groupMutex.Lock()
+		asked := false
+		for _, p := range c.pending {
+			if p.group.NS == group.NS && p.src.Digest == src.Digest && p.msg.Generation == m.Generation {
+				asked = true
+			}
+		}
+		if len(c.pending) < maxPending {
+			c.pending = append(c.pending, pendingGroupMessage{group: group, src: src, msg: m, expires: time.Now().Add(pendingTimeout)})
+		}
+		c.groupMutex.Unlock()
+		if !asked {
+			c.node.Send(src, client.SenderKeyRequest{Group: group}, nil)
+		}
+		return
+	}
+	if c.isDuplicate(src, p.Message.ID) {
+		return
+	}
+	c.deliverGroupMessages(group, func(b *client.CausalBuffer) []interface{} {
+		m := orderedGroupMessage{group: group, src: src, msg: p.Message, order: p.Order}
+		return b.Add(src.Digest.String(), p.Order, m, time.Now())
+	})
+}
+
+// deliverGroupMessages passes the messages that next returns from the causal
+// buffer of the group to the handler. If messages are left waiting, it
+// tries again when they time out.
+func (c *Client) deliverGroupMessages(group utils.NodeID, next func(b *client.CausalBuffer) []interface{}) {
+	// Messages are passed to the handler in the order they leave the buffer.
+	c.deliverMutex.Lock()
+	defer c.deliverMutex.Unlock()
+	c.groupMutex.Lock()
+	if _, ok := c.groups[group.NS]; !ok {
+		c.groupMutex.Unlock()
+		return
+	}
+	b := c.causalBuffer(group.NS)
+	values := next(b)
+	waiting := b.Pending() > 0
+	c.groupMutex.Unlock()
+
+	if waiting {
+		time.AfterFunc(causalTimeout, func() {
+			c.deliverGroupMessages(group, func(b *client.CausalBuffer) []interface{} {
+				return b.Flush(time.Now())
+			})
+		})
+	}
+	for _, v := range values {
+		m := v.(orderedGroupMessage)
+		// Messages from blocked members are still ordered, but not shown.
+		if c.groupMsgHandler != nil && !c.node.IsBlocked(m.src) {
+			c.groupMsgHandler(m.group, m.src, m.msg, m.order)
+		}
+	}
+}
+
+// retryPending passes the pending messages of the group whose sender keys have arrived.
+func (c *Client) retryPending(group utils.NodeID) {
+	c.groupMutex.Lock()
+	var retry, rest []pendingGroupMessage
+	now := time.Now()
+	for _, p := range c.pending {
+		if now.After(p.expires) {
+			continue
+		}
+		var ok bool
+		if g, found := c.senderKeys[group.NS]; found && p.group.NS == group.NS {
+			_, ok = g.keys[senderKeyIndex(p.src, p.msg.Generation)]
+		}
+		if ok {
+			retry = append(retry, p)
+		} else {
+			rest = append(rest, p)
+		}
+	}
+	c.pending = rest
+	c.groupMutex.Unlock()
+	for _, p := range retry {
+		c.receiveGroupMessage(group, p.src, p.msg)
+	}
+}
+
+// rotateSenderKey generates a new sender key for the group and sends it to
+// the current members, so that members who have left cannot read new messages.
+func (c *Client) rotateSenderKey(group utils.NodeID) error {
+	c.groupMutex.Lock()
+	g, ok := c.groups[group.NS]
+	if !ok {
+		c.groupMutex.Unlock()
+		return errors.New("not a member of the group")
+	}
+	members := append([]utils.NodeID(nil), g.Members...)
+	old, err := c.ownSenderKey(group.NS)
+	if err != nil {
+		c.groupMutex.Unlock()
+		return err
+	}
+	k, err := client.NewSenderKey(old.Generation + 1)
+	if err != nil {
+		c.groupMutex.Unlock()
+		return err
+	}
+	c.senderKeys[group.NS].own = k
+	key := *k
+	c.groupMutex.Unlock()
+
+	for _, m := range members {
+		if m.Digest != c.id.Digest {
+			go c.sendSenderKey(group, m, key)
+		}
+	}
+	return nil
+}
+
+// sendSenderKey sends the sender key to the member, sealed to its box key,
+// and retransmits it until it is acknowledged.
+func (c *Client) sendSenderKey(group utils.NodeID, dst utils.NodeID, k client.SenderKey) {
+	box, err := c.boxKeyOf(dst)
+	if err != nil {
+		c.Logger.Error("%v", err)
+		return
+	}
+	sign := c.key.Sign(senderKeySignedData(dst, group, k))
+	if sign == nil {
+		c.Logger.Error("cannot sign sender key")
+		return
+	}
+	data, err := msgpack.Marshal(senderKeyEnvelope{Key: *c.key.Public(), Group: group, SenderKey: k, S: *sign})
+	if err != nil {
+		c.Logger.Error("%v", err)
+		return
+	}
+	sealed, err := utils.SealBox(box, data)
+	if err != nil {
+		c.Logger.Error("%v", err)
+		return
+	}
+
+	acked := make(chan struct{}, 1)
+	for i := 0; i < maxAttempts; i++ {
+		err := c.node.Send(dst, client.SealedSenderKey{Data: sealed}, func(r interface{}) {
+			if _, ok := r.(client.MessageAck); ok {
+				select {
+				case acked <- struct{}{}:
+				default:
+				}
+			}
+		})
+		if err != nil {
+			c.Logger.Error("%v", err)
+			return
+		}
+		select {
+		case <-acked:
+			return
+		case <-time.After(retryInterval):
+		case <-c.exit:
+			return
+		}
+	}
+	c.Logger.Error("Sender key to %s: %v", dst.String(), client.Timeout)
+}
+
+// receiveSenderKey stores a sender key sent by a member of the group.
+func (c *Client) receiveSenderKey(m client.SealedSenderKey) error {
+	data, err := utils.OpenBox(c.boxKey, m.Data)
+	if err != nil {
+		return err
+	}
+	var env senderKeyEnvelope
+	err = msgpack.Unmarshal(data, &env)
+	if err != nil {
+		return err
+	}
+	if env.Key.IsZero() || !env.Key.Verify(senderKeySignedData(c.id, env.Group, env.SenderKey), &env.S) {
+		return errors.New("wrong signature")
+	}
+	src := env.Key.NodeID(env.Group.NS)
+
+	c.groupMutex.Lock()
+	g, ok := c.groups[env.Group.NS]
+	if !ok || !g.HasMember(src) {
+		c.groupMutex.Unlock()
+		return errors.New("sender key from a non-member: " + src.String())
+	}
+	if _, err := c.ownSenderKey(env.Group.NS); err != nil {
+		c.groupMutex.Unlock()
+		return err
+	}
+	keys := c.senderKeys[env.Group.NS].keys
+	keys[senderKeyIndex(src, env.SenderKey.Generation)] = env.SenderKey
+	// Keep the previous generation for messages still on their way.
+	prefix := src.Digest.String() + "/"
+	for i, k := range keys {
+		if strings.HasPrefix(i, prefix) && k.Generation+1 < env.SenderKey.Generation {
+			delete(keys, i)
+		}
+	}
+	c.groupMutex.Unlock()
+
+	c.retryPending(env.Group)
+	return nil
+}
+
+// answerSenderKeyRequest sends the current sender key to a member that has asked for it.
+func (c *Client) answerSenderKeyRequest(src utils.NodeID, group utils.NodeID) {
+	member := src.WithNS(c.id.NS)
+	c.groupMutex.Lock()
+	g, ok := c.groups[group.NS]
+	if !ok || !g.HasMember(member) {
+		c.groupMutex.Unlock()
+		return
+	}
+	k, err := c.ownSenderKey(group.NS)
+	if err != nil {
+		c.groupMutex.Unlock()
+		c.Logger.Error("%v", err)
+		return
+	}
+	key := *k
+	c.groupMutex.Unlock()
+	go c.sendSenderKey(group, member, key)
+}
@@ -14,6 +14,9 @@ type Packet struct {
 	Payload []byte          `msgpack:"payload"`
 	S       utils.Signature `msgpack:"sign"`
 	TTL     uint8           `msgpack:"ttl"`
+
+	// ID identifies a group packet among its copies flooded to the group.
+	ID []byte `msgpack:"id"`
 }
 
 func (p *Packet) Serialize() []byte {
@@ -22,13 +25,14 @@ func (p *Packet) Serialize() []byte {
 		p.Src.Bytes(),
 		p.Type,
 		p.Payload,
+		p.ID,
 	}
 
 	data, _ := msgpack.Marshal(ary)
 	return data
 }
 
-func (p *Packet) Sign(key *utils.PrivateKey) error {
+func (p *Packet) Sign(key utils.Signer) error {
 	sign := key.Sign(p.Serialize())
 	if sign == nil {
 		return errors.New("cannot sign packet")
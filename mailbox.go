@@ -0,0 +1,123 @@
+package murcott
+
+import (
+	"errors"
+	"time"
+
+	"github.com/h2so5/murcott/client"
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
+)
+
+// mailboxInterval is how often the mailbox is checked while the client is running.
+const mailboxInterval = time.Minute
+
+// runMailbox publishes the box key and the prekey bundle and fetches the
+// mailbox as soon as the node has joined the network, and then periodically
+// until the client is closed.
+func (c *Client) runMailbox() {
+	for c.Nodes() == 0 {
+		select {
+		case <-c.exit:
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	for {
+		err := c.publishBoxKey()
+		if err != nil {
+			c.Logger.Error("%v", err)
+		}
+		err = c.publishPrekey()
+		if err != nil {
+			c.Logger.Error("%v", err)
+		}
+		c.FetchMailbox()
+		select {
+		case <-c.exit:
+			return
+		case <-time.After(mailboxInterval):
+		}
+	}
+}
+
+func (c *Client) publishBoxKey() error {
+	r, err := c.boxKeyRecord()
+	if err != nil {
+		return err
+	}
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		return err
+	}
+	c.node.StoreValue(utils.BoxKeyRecordKey(c.id), string(data))
+	return nil
+}
+
+// storeMail stores the message in the mailbox of dst, encrypted to its box key.
+func (c *Client) storeMail(dst utils.NodeID, msg client.ChatMessage) error {
+	r := c.lookupBoxKey(dst)
+	if r == nil {
+		return errors.New("box key not found: " + dst.String())
+	}
+	box, err := c.addBoxKey(dst, r)
+	if err != nil {
+		return err
+	}
+	sealed, err := c.seal(box, dst, msg)
+	if err != nil {
+		return err
+	}
+
+	return c.node.StoreMail(dst, dht.MailItem{
+		ID:      []byte(msg.ID),
+		Data:    sealed,
+		Expires: time.Now().Add(dht.MaxMailExpiry).Unix(),
+	})
+}
+
+// FetchMailbox fetches the messages stored in the mailbox while the client
+// was offline, passes them to the message handler and deletes them from the mailbox.
+// Items that cannot be opened are left until they expire, since they may be
+// sealed to a box key that the client does not hold at the moment.
+// It is called automatically while the client is running.
+func (c *Client) FetchMailbox() {
+	items := c.node.LoadMail()
+	if len(items) == 0 {
+		return
+	}
+	var ids [][]byte
+	receipts := make(map[string][]string)
+	senders := make(map[string]utils.NodeID)
+	for _, i := range items {
+		src, msg, err := c.open(i.Data)
+		if err != nil {
+			c.Logger.Error("mailbox: %v", err)
+			continue
+		}
+		ids = append(ids, i.ID)
+		if c.node.IsRevoked(src) {
+			continue
+		}
+		// Refused messages get no delivery receipt.
+		if !c.admit(src, msg) {
+			continue
+		}
+		key := src.Digest.String()
+		receipts[key] = append(receipts[key], msg.ID)
+		senders[key] = src
+	}
+	// Stored messages are not acknowledged, so tell the senders that they
+	// have been delivered.
+	for key, r := range receipts {
+		c.node.Send(senders[key], client.DeliveryReceipt{IDs: r}, nil)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	err := c.node.DeleteMail(ids)
+	if err != nil {
+		c.Logger.Error("mailbox: %v", err)
+	}
+}
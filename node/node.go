@@ -4,7 +4,9 @@ import (
 	"crypto/rand"
 	"errors"
 	"reflect"
+	"time"
 
+	"github.com/h2so5/murcott/dht"
 	"github.com/h2so5/murcott/log"
 	"github.com/h2so5/murcott/router"
 	"github.com/h2so5/murcott/utils"
@@ -19,12 +21,16 @@ type msgpair struct {
 type msghandler struct {
 	id       string
 	callback func(interface{})
+	deadline time.Time
 }
 
+// handlerTimeout is how long a response handler waits before it is called with nil.
+const handlerTimeout = 30 * time.Second
+
 type Node struct {
 	router        *router.Router
 	handler       func(utils.NodeID, interface{}) interface{}
-	idmap         map[string]func(interface{})
+	idmap         map[string]msghandler
 	name2type     map[string]reflect.Type
 	type2name     map[reflect.Type]string
 	register      chan msghandler
@@ -35,7 +41,7 @@ type Node struct {
 	exit          chan struct{}
 }
 
-func NewNode(key *utils.PrivateKey, logger *log.Logger, config utils.Config) (*Node, error) {
+func NewNode(key utils.Signer, logger *log.Logger, config utils.Config) (*Node, error) {
 	router, err := router.NewRouter(key, logger, config)
 	if err != nil {
 		return nil, err
@@ -43,7 +49,7 @@ func NewNode(key *utils.PrivateKey, logger *log.Logger, config utils.Config) (*N
 
 	n := &Node{
 		router:        router,
-		idmap:         make(map[string]func(interface{})),
+		idmap:         make(map[string]msghandler),
 		name2type:     make(map[string]reflect.Type),
 		type2name:     make(map[reflect.Type]string),
 		register:      make(chan msghandler, 2),
@@ -73,6 +79,9 @@ func (p *Node) Run() {
 		}
 	}()
 
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case m := <-msg:
@@ -85,14 +94,22 @@ func (p *Node) Run() {
 			}
 
 		case h := <-p.register:
-			p.idmap[h.id] = h.callback
+			p.idmap[h.id] = h
 
 		case id := <-p.cancelHandler:
 			if h, ok := p.idmap[id]; ok {
-				h(nil)
+				h.callback(nil)
 				delete(p.idmap, id)
 			}
 
+		case now := <-ticker.C:
+			for id, h := range p.idmap {
+				if now.After(h.deadline) {
+					h.callback(nil)
+					delete(p.idmap, id)
+				}
+			}
+
 		case <-p.exit:
 			return
 		}
@@ -122,7 +139,7 @@ func (p *Node) parseCommand(payload []byte, id utils.NodeID, typ reflect.Type) {
 	c.Content = v.Interface()
 	if msgpack.Unmarshal(payload, &c) == nil {
 		if h, ok := p.idmap[c.ID]; ok {
-			h(reflect.Indirect(v).Interface())
+			h.callback(reflect.Indirect(v).Interface())
 			delete(p.idmap, c.ID)
 		} else if p.handler != nil {
 			r := p.handler(id, reflect.Indirect(v).Interface())
@@ -133,45 +150,123 @@ func (p *Node) parseCommand(payload []byte, id utils.NodeID, typ reflect.Type) {
 	}
 }
 
+// Send sends msg to the destination node.
+// If handler is not nil, it is called with the response, or with nil if no
+// response is received in time.
 func (p *Node) Send(dst utils.NodeID, msg interface{}, handler func(interface{})) error {
 	return p.sendWithID(dst, msg, handler, "")
 }
 
 func (p *Node) sendWithID(dst utils.NodeID, msg interface{}, handler func(interface{}), id string) error {
+	if len(id) == 0 && handler != nil {
+		r := make([]byte, 10)
+		rand.Read(r)
+		id = string(r)
+		p.register <- msghandler{id, handler, time.Now().Add(handlerTimeout)}
+	}
+	data, err := p.marshal(msg, id)
+	if err != nil {
+		return err
+	}
+	return p.router.SendMessage(dst, data)
+}
+
+func (p *Node) marshal(msg interface{}, id string) ([]byte, error) {
 	t := struct {
 		Type    string      `msgpack:"type"`
 		Content interface{} `msgpack:"content"`
 		ID      string      `msgpack:"id"`
-	}{Content: msg}
-
-	if len(id) != 0 {
-		t.ID = id
-	} else if handler != nil {
-		r := make([]byte, 10)
-		rand.Read(r)
-		t.ID = string(r)
-		p.register <- msghandler{t.ID, handler}
-	}
+	}{Content: msg, ID: id}
 
 	if n, ok := p.type2name[reflect.TypeOf(msg)]; ok {
 		t.Type = n
 	} else {
-		return errors.New("Unknown message type")
+		return nil, errors.New("Unknown message type")
 	}
 
-	data, err := msgpack.Marshal(t)
+	return msgpack.Marshal(t)
+}
+
+// Join joins the group of the namespace of id, which is the NodeID of this
+// node in that namespace.
+func (p *Node) Join(id utils.NodeID) {
+	p.router.Join(id)
+	p.router.Discover(p.config.Bootstrap())
+}
+
+func (p *Node) Leave(ns utils.Namespace) {
+	p.router.Leave(ns)
+}
+
+// SetBanned replaces the identities banned from the group of the namespace.
+func (p *Node) SetBanned(ns utils.Namespace, ids []utils.NodeID) {
+	p.router.SetBanned(ns, ids)
+}
+
+// IsBanned reports whether the identity is banned from the group of its namespace.
+func (p *Node) IsBanned(id utils.NodeID) bool {
+	return p.router.IsBanned(id)
+}
+
+// SetBlocked replaces the identities whose sessions and messages are refused.
+func (p *Node) SetBlocked(ids []utils.NodeID) {
+	p.router.SetBlocked(ids)
+}
+
+// IsBlocked reports whether the identity is blocked.
+func (p *Node) IsBlocked(id utils.NodeID) bool {
+	return p.router.IsBlocked(id)
+}
+
+func (p *Node) GroupNodes(ns utils.Namespace) []utils.NodeInfo {
+	return p.router.GroupNodes(ns)
+}
+
+// Broadcast sends msg to the group of the namespace.
+func (p *Node) Broadcast(ns utils.Namespace, msg interface{}) error {
+	data, err := p.marshal(msg, "")
 	if err != nil {
 		return err
 	}
-	p.router.SendMessage(dst, data)
-
-	return nil
+	return p.router.Broadcast(ns, data)
 }
 
 func (p *Node) AddNode(info utils.NodeInfo) {
 	p.router.AddNode(info)
 }
 
+func (p *Node) PublicKey(id utils.NodeID) *utils.PublicKey {
+	return p.router.PublicKey(id)
+}
+
+func (p *Node) Revoke(r *utils.Revocation) error {
+	return p.router.Revoke(r)
+}
+
+func (p *Node) IsRevoked(id utils.NodeID) bool {
+	return p.router.IsRevoked(id)
+}
+
+func (p *Node) StoreMail(owner utils.NodeID, item dht.MailItem) error {
+	return p.router.StoreMail(owner, item)
+}
+
+func (p *Node) LoadMail() []dht.MailItem {
+	return p.router.LoadMail()
+}
+
+func (p *Node) DeleteMail(ids [][]byte) error {
+	return p.router.DeleteMail(ids)
+}
+
+func (p *Node) StoreValue(key string, value string) {
+	p.router.StoreValue(key, value)
+}
+
+func (p *Node) LoadValue(key string) *string {
+	return p.router.LoadValue(key)
+}
+
 func (p *Node) KnownNodes() []utils.NodeInfo {
 	return p.router.KnownNodes()
 }
@@ -0,0 +1,121 @@
+package murcott
+
+import (
+	"errors"
+	"time"
+
+	"github.com/h2so5/murcott/client"
+	"github.com/h2so5/murcott/utils"
+)
+
+type messageRequestHandler func(src utils.NodeID, msg client.ChatMessage)
+
+// SetMessagePolicy sets what happens to chat messages from strangers,
+// the identities that are not contacts in the roster. It is PolicyOpen by default.
+func (c *Client) SetMessagePolicy(policy client.MessagePolicy) {
+	c.policy = policy
+}
+
+// MessagePolicy returns the policy set by SetMessagePolicy.
+func (c *Client) MessagePolicy() client.MessagePolicy {
+	return c.policy
+}
+
+// HandleMessageRequests registers the given function to be called when a
+// message from a stranger is held in the request inbox by PolicyQuarantine.
+func (c *Client) HandleMessageRequests(handler func(src utils.NodeID, msg client.ChatMessage)) {
+	c.requestHandler = handler
+}
+
+// MessageRequests returns the messages held in the request inbox, oldest first.
+// They are kept in memory until they are accepted or discarded.
+func (c *Client) MessageRequests() []client.StoredMessage {
+	var msgs []client.StoredMessage
+	for _, id := range c.requests.Peers() {
+		msgs = append(msgs, c.requests.Messages(id)...)
+	}
+	return msgs
+}
+
+// AcceptRequests adds src to the roster and passes its held messages to the
+// message handler, storing them as if they had just been received.
+func (c *Client) AcceptRequests(src utils.NodeID) error {
+	if c.node.IsBlocked(src) {
+		return errors.New("identity blocked: " + src.String())
+	}
+	c.Roster.Add(src)
+	for _, m := range c.requests.Remove(src) {
+		c.storeMessage(m)
+		if c.msgHandler != nil {
+			c.msgHandler(src, m.Message)
+		}
+	}
+	return nil
+}
+
+// DiscardRequests deletes the held messages from src.
+func (c *Client) DiscardRequests(src utils.NodeID) {
+	c.requests.Remove(src)
+}
+
+// Block refuses to talk to the identity. Its sessions are refused by the
+// router, its messages are dropped without acknowledgement, it gets no
+// presence, and the messages and the subscription request held from it are
+// discarded. It is added to the roster to keep the block.
+func (c *Client) Block(id utils.NodeID) error {
+	c.Roster.Add(id)
+	c.Roster.SetSubscription(id, client.SubscriptionNone)
+	c.requests.Remove(id)
+	c.subRequests.Remove(id)
+	return c.Roster.SetBlocked(id, true)
+}
+
+// Unblock lifts the block of the identity. It stays in the roster.
+func (c *Client) Unblock(id utils.NodeID) error {
+	return c.Roster.SetBlocked(id, false)
+}
+
+// IsBlocked reports whether the identity is blocked.
+func (c *Client) IsBlocked(id utils.NodeID) bool {
+	return c.node.IsBlocked(id)
+}
+
+// isAllowed reports whether src may send messages and notifications
+// under the policy.
+func (c *Client) isAllowed(src utils.NodeID) bool {
+	if c.node.IsBlocked(src) {
+		return false
+	}
+	return c.policy == client.PolicyOpen || c.Roster.IsContact(src)
+}
+
+// admit applies the policy to a chat message from src. It reports whether
+// the message has been received or held, and so should be acknowledged.
+func (c *Client) admit(src utils.NodeID, msg client.ChatMessage) bool {
+	if c.isAllowed(src) {
+		c.receiveMessage(src, msg)
+		return true
+	}
+	if c.policy != client.PolicyQuarantine || c.node.IsBlocked(src) {
+		return false
+	}
+	if c.isDuplicate(src, msg.ID) {
+		return true
+	}
+	c.requests.Add(client.StoredMessage{Peer: src, Message: msg, Time: time.Now()})
+	if c.requestHandler != nil {
+		c.requestHandler(src, msg)
+	}
+	return true
+}
+
+// blockedChanged passes the blocked contacts to the router.
+func (c *Client) blockedChanged(entries []client.RosterEntry) {
+	var ids []utils.NodeID
+	for _, e := range entries {
+		if e.Blocked {
+			ids = append(ids, e.ID)
+		}
+	}
+	c.node.SetBlocked(ids)
+}
@@ -0,0 +1,72 @@
+package murcott
+
+import (
+	"github.com/h2so5/murcott/client"
+	"github.com/h2so5/murcott/utils"
+)
+
+type messageStatusHandler func(id string, dst utils.NodeID, status client.MessageStatus)
+
+// HandleMessageStatuses registers the given function to be called whenever
+// the status of a sent message changes. Save the statuses in the handler
+// with MarshalMessageStatuses to keep them after a restart.
+func (c *Client) HandleMessageStatuses(handler func(id string, dst utils.NodeID, status client.MessageStatus)) {
+	c.msgStatusHandler = handler
+}
+
+// MessageStatus returns the status of the sent message.
+func (c *Client) MessageStatus(id string) (client.MessageStatus, bool) {
+	r, ok := c.msgStatuses.Get(id)
+	return r.Status, ok
+}
+
+// SetReadReceipts sets whether MarkRead sends read receipts. They are sent by default.
+func (c *Client) SetReadReceipts(enabled bool) {
+	c.noReadReceipts = !enabled
+}
+
+// MarkRead tells src that the messages have been read,
+// unless read receipts are disabled.
+func (c *Client) MarkRead(src utils.NodeID, ids ...string) error {
+	if c.noReadReceipts || len(ids) == 0 {
+		return nil
+	}
+	return c.node.Send(src, client.ReadReceipt{IDs: ids}, nil)
+}
+
+func (c *Client) addMessageStatus(id string, dst utils.NodeID) {
+	r := c.msgStatuses.Add(id, dst)
+	if c.msgStatusHandler != nil {
+		c.msgStatusHandler(id, dst, r.Status)
+	}
+}
+
+func (c *Client) updateMessageStatus(src utils.NodeID, id string, status client.MessageStatus) {
+	r, ok := c.msgStatuses.Update(src, id, status)
+	if !ok {
+		return
+	}
+	if c.storage != nil {
+		err := c.storage.UpdateMessageStatus(r.Dst, id, status)
+		if err != nil {
+			c.Logger.Error("storage: %v", err)
+		}
+	}
+	if c.msgStatusHandler != nil {
+		c.msgStatusHandler(id, r.Dst, r.Status)
+	}
+}
+
+func (c *Client) receiveReceipt(src utils.NodeID, ids []string, status client.MessageStatus) {
+	for _, id := range ids {
+		c.updateMessageStatus(src, id, status)
+	}
+}
+
+func (c *Client) MarshalMessageStatuses() ([]byte, error) {
+	return c.msgStatuses.MarshalBinary()
+}
+
+func (c *Client) UnmarshalMessageStatuses(data []byte) error {
+	return c.msgStatuses.UnmarshalBinary(data)
+}
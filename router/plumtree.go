@@ -0,0 +1,331 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/internal"
+	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	// plumtreeViewSize is the size of the active view unless GroupFanout is set.
+	plumtreeViewSize = 5
+	// graftTimeout is how long a node waits for an announced packet before
+	// asking the announcer for it.
+	graftTimeout = 500 * time.Millisecond
+	// maintainInterval is how often the active view is refilled.
+	maintainInterval = time.Second
+	// maxStored is how many recent packets are kept to answer grafts.
+	maxStored = 1000
+)
+
+// gossip is the payload of a control packet of plumtree.
+type gossip struct {
+	Type string   `msgpack:"type"`
+	IDs  [][]byte `msgpack:"ids"`
+}
+
+// plumtree disseminates packets along a spanning tree embedded in a small
+// symmetric active view of the group, as in Plumtree over HyParView.
+//
+// Packets are pushed to the eager peers and announced to the lazy ones.
+// A peer that sends a duplicate is made lazy with a prune, so the eager links
+// converge to a tree. A node that hears of a packet it does not receive in
+// time grafts the announcer, which makes it eager again and repairs the tree.
+// Peers that cannot be reached or leave are replaced from the passive view,
+// the rest of the known members.
+type plumtree struct {
+	t    Transport
+	size int
+
+	eager   map[string]utils.NodeID
+	lazy    map[string]utils.NodeID
+	pending map[string]bool
+	seen    *seenCache
+	store   map[string]internal.Packet
+	stored  []string
+	missing map[string][]utils.NodeID
+	closed  bool
+	mutex   sync.Mutex
+
+	exit chan struct{}
+}
+
+func newPlumtree(t Transport, config utils.Config) Strategy {
+	p := &plumtree{
+		t:       t,
+		size:    config.GroupFanout,
+		eager:   make(map[string]utils.NodeID),
+		lazy:    make(map[string]utils.NodeID),
+		pending: make(map[string]bool),
+		seen:    newSeenCache(),
+		store:   make(map[string]internal.Packet),
+		missing: make(map[string][]utils.NodeID),
+		exit:    make(chan struct{}),
+	}
+	if p.size <= 0 {
+		p.size = plumtreeViewSize
+	}
+	go p.run()
+	return p
+}
+
+func (p *plumtree) run() {
+	for {
+		select {
+		case <-time.After(maintainInterval):
+			p.maintain()
+		case <-p.exit:
+			return
+		}
+	}
+}
+
+func (p *plumtree) Broadcast(pkt internal.Packet) error {
+	p.mutex.Lock()
+	p.seen.add(pkt.ID, time.Now())
+	p.keep(pkt)
+	eager, lazy := p.peers()
+	p.mutex.Unlock()
+	if len(eager)+len(lazy) == 0 {
+		// The active view is not ready yet.
+		for _, n := range pick(p.t.Nodes(), p.size) {
+			eager = append(eager, n.ID)
+		}
+	}
+	p.push(pkt, eager, lazy)
+	return nil
+}
+
+func (p *plumtree) Receive(from utils.NodeID, pkt internal.Packet) bool {
+	peer := from.WithNS(p.t.ID().NS)
+	if pkt.Type == "gossip" {
+		var g gossip
+		if msgpack.Unmarshal(pkt.Payload, &g) == nil {
+			p.handle(peer, g)
+		}
+		return false
+	}
+
+	p.mutex.Lock()
+	if !p.seen.add(pkt.ID, time.Now()) {
+		// The packet has arrived by another path; keep only one of them eager.
+		_, ok := p.eager[peer.Digest.String()]
+		p.makeLazy(peer)
+		p.mutex.Unlock()
+		if ok {
+			p.control(peer, "prune", nil)
+		}
+		return false
+	}
+	p.keep(pkt)
+	delete(p.missing, string(pkt.ID))
+	eager, lazy := p.peers(peer, pkt.Src)
+	p.mutex.Unlock()
+	p.push(pkt, eager, lazy)
+	return true
+}
+
+func (p *plumtree) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	eager, lazy := p.peers()
+	p.mutex.Unlock()
+	close(p.exit)
+	for _, id := range append(eager, lazy...) {
+		p.control(id, "disconnect", nil)
+	}
+}
+
+func (p *plumtree) handle(peer utils.NodeID, g gossip) {
+	k := peer.Digest.String()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch g.Type {
+	case "prune":
+		p.makeLazy(peer)
+	case "ihave":
+		if !p.active(peer) {
+			return
+		}
+		for _, id := range g.IDs {
+			if p.seen.has(id) {
+				continue
+			}
+			srcs, ok := p.missing[string(id)]
+			p.missing[string(id)] = append(srcs, peer)
+			if !ok {
+				p.wait(id)
+			}
+		}
+	case "graft":
+		if !p.active(peer) {
+			return
+		}
+		p.makeEager(peer)
+		for _, id := range g.IDs {
+			if pkt, ok := p.store[string(id)]; ok {
+				go p.send(peer, pkt)
+			}
+		}
+	case "neighbor":
+		p.makeEager(peer)
+		go p.control(peer, "accept", nil)
+		if len(p.eager)+len(p.lazy) > 2*p.size {
+			// Make room by dropping another peer at random.
+			for i, id := range p.lazy {
+				delete(p.lazy, i)
+				go p.control(id, "disconnect", nil)
+				break
+			}
+		}
+	case "accept":
+		if p.pending[k] {
+			delete(p.pending, k)
+			p.makeEager(peer)
+		}
+	case "disconnect":
+		delete(p.eager, k)
+		delete(p.lazy, k)
+	}
+}
+
+// wait asks the announcers of the packet for it, one after another, until it arrives.
+// p.mutex must be held.
+func (p *plumtree) wait(id []byte) {
+	time.AfterFunc(graftTimeout, func() {
+		p.mutex.Lock()
+		srcs, ok := p.missing[string(id)]
+		if !ok || len(srcs) == 0 || p.closed {
+			delete(p.missing, string(id))
+			p.mutex.Unlock()
+			return
+		}
+		peer := srcs[0]
+		p.missing[string(id)] = srcs[1:]
+		p.makeEager(peer)
+		p.wait(id)
+		p.mutex.Unlock()
+		p.control(peer, "graft", [][]byte{id})
+	})
+}
+
+// maintain drops the peers that are no longer known and fills the active
+// view with peers from the passive view.
+func (p *plumtree) maintain() {
+	nodes := p.t.Nodes()
+	known := make(map[string]bool)
+	for _, n := range nodes {
+		known[n.ID.Digest.String()] = true
+	}
+
+	p.mutex.Lock()
+	for k := range p.eager {
+		if !known[k] {
+			delete(p.eager, k)
+		}
+	}
+	for k := range p.lazy {
+		if !known[k] {
+			delete(p.lazy, k)
+		}
+	}
+	p.pending = make(map[string]bool)
+	eager, lazy := p.peers()
+	var candidates []utils.NodeInfo
+	if n := p.size - len(eager) - len(lazy); n > 0 {
+		exclude := append(append(eager, lazy...), p.t.ID())
+		candidates = pick(nodes, n, exclude...)
+	}
+	for _, n := range candidates {
+		p.pending[n.ID.Digest.String()] = true
+	}
+	p.mutex.Unlock()
+
+	for _, n := range candidates {
+		p.control(n.ID, "neighbor", nil)
+	}
+}
+
+// peers returns the eager and the lazy peers, leaving out the excluded ones.
+// p.mutex must be held.
+func (p *plumtree) peers(exclude ...utils.NodeID) (eager []utils.NodeID, lazy []utils.NodeID) {
+	excluded := func(id utils.NodeID) bool {
+		for _, e := range exclude {
+			if id.Digest == e.Digest {
+				return true
+			}
+		}
+		return false
+	}
+	for _, id := range p.eager {
+		if !excluded(id) {
+			eager = append(eager, id)
+		}
+	}
+	for _, id := range p.lazy {
+		if !excluded(id) {
+			lazy = append(lazy, id)
+		}
+	}
+	return
+}
+
+// push sends the packet to the eager peers and announces it to the lazy ones.
+func (p *plumtree) push(pkt internal.Packet, eager []utils.NodeID, lazy []utils.NodeID) {
+	for _, id := range eager {
+		go p.send(id, pkt)
+	}
+	for _, id := range lazy {
+		go p.control(id, "ihave", [][]byte{pkt.ID})
+	}
+}
+
+func (p *plumtree) control(dst utils.NodeID, typ string, ids [][]byte) {
+	data, _ := msgpack.Marshal(gossip{Type: typ, IDs: ids})
+	p.send(dst, internal.Packet{Src: p.t.ID(), Type: "gossip", Payload: data})
+}
+
+// send sends the packet to the peer and drops the peer if it cannot be reached.
+func (p *plumtree) send(dst utils.NodeID, pkt internal.Packet) {
+	if p.t.Send(dst, pkt) != nil {
+		p.mutex.Lock()
+		delete(p.eager, dst.Digest.String())
+		delete(p.lazy, dst.Digest.String())
+		p.mutex.Unlock()
+	}
+}
+
+// keep stores the packet to answer grafts. p.mutex must be held.
+func (p *plumtree) keep(pkt internal.Packet) {
+	k := string(pkt.ID)
+	p.store[k] = pkt
+	p.stored = append(p.stored, k)
+	if len(p.stored) > maxStored {
+		delete(p.store, p.stored[0])
+		p.stored = p.stored[1:]
+	}
+}
+
+func (p *plumtree) active(id utils.NodeID) bool {
+	k := id.Digest.String()
+	_, eager := p.eager[k]
+	_, lazy := p.lazy[k]
+	return eager || lazy
+}
+
+func (p *plumtree) makeEager(id utils.NodeID) {
+	k := id.Digest.String()
+	delete(p.lazy, k)
+	p.eager[k] = id
+}
+
+func (p *plumtree) makeLazy(id utils.NodeID) {
+	k := id.Digest.String()
+	if _, ok := p.eager[k]; ok {
+		delete(p.eager, k)
+		p.lazy[k] = id
+	}
+}
@@ -2,10 +2,12 @@ package router
 
 import (
 	"bytes"
+	"crypto/rand"
 	"errors"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/h2so5/murcott/dht"
@@ -13,6 +15,7 @@ import (
 	"github.com/h2so5/murcott/log"
 	"github.com/h2so5/murcott/utils"
 	"github.com/h2so5/utp"
+	"github.com/vmihailenco/msgpack"
 )
 
 type Message struct {
@@ -20,17 +23,54 @@ type Message struct {
 	Payload []byte
 }
 
+type queuedPacket struct {
+	pkt     internal.Packet
+	expires time.Time
+}
+
+// queueTimeout is how long a packet waits for a route to the destination.
+const queueTimeout = time.Minute
+
+// Keys without a revocation certificate in the DHT are not looked up again
+// for revocationCacheTTL. A session holds up to maxHeldPackets messages
+// while the key of the remote node is looked up, and then stops reading
+// until the lookup finishes.
+const (
+	revocationCacheTTL = 10 * time.Minute
+	maxRevocationCache = 10000
+	maxHeldPackets     = 256
+)
+
 type Router struct {
 	dht      map[utils.Namespace]*dht.DHT
 	dhtMutex sync.RWMutex
 
 	listener *utp.Listener
-	key      *utils.PrivateKey
+	key      utils.Signer
 
 	sessions     map[string]*session
+	keys         map[string]utils.PublicKey
 	sessionMutex sync.RWMutex
 
-	queuedPackets []internal.Packet
+	revoked      map[string]utils.Revocation
+	notRevoked   map[string]time.Time
+	revokedMutex sync.RWMutex
+
+	banned      map[utils.Namespace]map[string]bool
+	bannedMutex sync.RWMutex
+
+	blocked      map[string]bool
+	blockedMutex sync.RWMutex
+
+	strategies map[utils.Namespace]Strategy
+	factory    StrategyFactory
+	config     utils.Config
+	ttl        uint8
+
+	// groupPackets counts the group packets received, including duplicates.
+	groupPackets uint64
+
+	queuedPackets []queuedPacket
 
 	logger *log.Logger
 	recv   chan Message
@@ -49,21 +89,34 @@ func getOpenPortConn(config utils.Config) (*utp.Listener, error) {
 	return nil, errors.New("fail to bind port")
 }
 
-func NewRouter(key *utils.PrivateKey, logger *log.Logger, config utils.Config) (*Router, error) {
+func NewRouter(key utils.Signer, logger *log.Logger, config utils.Config) (*Router, error) {
 	exit := make(chan int)
+	factory, err := strategyFactory(config)
+	if err != nil {
+		return nil, err
+	}
 	listener, err := getOpenPortConn(config)
 	if err != nil {
 		return nil, err
 	}
 
-	logger.Info("Node ID: %s", key.Digest().String())
+	logger.Info("Node ID: %s", key.Public().Digest().String())
 	logger.Info("Node Socket: %v", listener.Addr())
 
 	r := Router{
-		listener: listener,
-		key:      key,
-		sessions: make(map[string]*session),
-		dht:      make(map[utils.Namespace]*dht.DHT),
+		listener:   listener,
+		key:        key,
+		sessions:   make(map[string]*session),
+		keys:       make(map[string]utils.PublicKey),
+		revoked:    make(map[string]utils.Revocation),
+		notRevoked: make(map[string]time.Time),
+		banned:     make(map[utils.Namespace]map[string]bool),
+		blocked:    make(map[string]bool),
+		strategies: make(map[utils.Namespace]Strategy),
+		factory:    factory,
+		config:     config,
+		ttl:        config.GroupTTL,
+		dht:        make(map[utils.Namespace]*dht.DHT),
 
 		logger: logger,
 		recv:   make(chan Message, 100),
@@ -72,7 +125,7 @@ func NewRouter(key *utils.PrivateKey, logger *log.Logger, config utils.Config) (
 	}
 
 	ns := [4]byte{1, 1, 1, 1}
-	r.dht[ns] = dht.NewDHT(10, utils.NewNodeID(ns, key.Digest()), listener.RawConn, logger)
+	r.dht[ns] = dht.NewDHT(10, key.Public().NodeID(ns), listener.RawConn, logger)
 
 	go r.run()
 	return &r, nil
@@ -93,11 +146,168 @@ func (p *Router) Join(group utils.NodeID) {
 	p.dhtMutex.Lock()
 	defer p.dhtMutex.Unlock()
 	if _, ok := p.dht[group.NS]; !ok {
-		p.dht[group.NS] = dht.NewDHT(10, group, p.listener.RawConn, p.logger)
+		d := dht.NewDHT(10, group, p.listener.RawConn, p.logger)
+		p.dht[group.NS] = d
+		p.strategies[group.NS] = p.factory(groupTransport{p, group.NS}, p.config)
+		// Nodes already known may have joined the group too.
+		for _, n := range p.dht[[4]byte{1, 1, 1, 1}].KnownNodes() {
+			if n.Addr != nil {
+				d.Discover(n.Addr)
+			}
+		}
+	}
+}
+
+// Leave stops taking part in the group of the namespace.
+func (p *Router) Leave(ns utils.Namespace) {
+	if ns == [4]byte{1, 1, 1, 1} {
+		return
+	}
+	p.dhtMutex.Lock()
+	st, ok := p.strategies[ns]
+	delete(p.dht, ns)
+	delete(p.strategies, ns)
+	p.dhtMutex.Unlock()
+	if ok {
+		st.Close()
+	}
+	p.SetBanned(ns, nil)
+}
+
+// SetBanned replaces the identities whose packets are neither delivered nor
+// forwarded within the group of the namespace.
+func (p *Router) SetBanned(ns utils.Namespace, ids []utils.NodeID) {
+	p.bannedMutex.Lock()
+	defer p.bannedMutex.Unlock()
+	if len(ids) == 0 {
+		delete(p.banned, ns)
+		return
+	}
+	m := make(map[string]bool)
+	for _, id := range ids {
+		m[id.Digest.String()] = true
+	}
+	p.banned[ns] = m
+}
+
+// IsBanned reports whether the identity is banned from the group of its namespace.
+func (p *Router) IsBanned(id utils.NodeID) bool {
+	return p.isBanned(id.NS, id.Digest)
+}
+
+func (p *Router) isBanned(ns utils.Namespace, d utils.PublicKeyDigest) bool {
+	p.bannedMutex.RLock()
+	defer p.bannedMutex.RUnlock()
+	return p.banned[ns][d.String()]
+}
+
+// SetBlocked replaces the identities that the node refuses to talk to.
+// Sessions with them are refused and closed, and their packets are dropped
+// even when they are relayed by other nodes.
+func (p *Router) SetBlocked(ids []utils.NodeID) {
+	m := make(map[string]bool)
+	for _, id := range ids {
+		m[id.Digest.String()] = true
+	}
+	p.blockedMutex.Lock()
+	p.blocked = m
+	p.blockedMutex.Unlock()
+
+	p.sessionMutex.RLock()
+	var closed []*session
+	for id, s := range p.sessions {
+		if m[id] {
+			closed = append(closed, s)
+		}
+	}
+	p.sessionMutex.RUnlock()
+	for _, s := range closed {
+		p.logger.Info("Close the session with blocked node: %s", s.ID().String())
+		s.conn.Close()
 	}
 }
 
+// IsBlocked reports whether the identity is blocked.
+func (p *Router) IsBlocked(id utils.NodeID) bool {
+	return p.isBlocked(id.Digest)
+}
+
+func (p *Router) isBlocked(d utils.PublicKeyDigest) bool {
+	p.blockedMutex.RLock()
+	defer p.blockedMutex.RUnlock()
+	return p.blocked[d.String()]
+}
+
+// isRefused reports whether the identity has been revoked or blocked.
+func (p *Router) isRefused(d utils.PublicKeyDigest) bool {
+	return p.isRevoked(d) || p.isBlocked(d)
+}
+
+// GroupNodes returns the known nodes of the group of the namespace.
+func (p *Router) GroupNodes(ns utils.Namespace) []utils.NodeInfo {
+	p.dhtMutex.RLock()
+	defer p.dhtMutex.RUnlock()
+	if d, ok := p.dht[ns]; ok {
+		return d.KnownNodes()
+	}
+	return nil
+}
+
+// Broadcast sends the payload to the group of the namespace with its
+// dissemination strategy. Each node receives it once.
+func (p *Router) Broadcast(ns utils.Namespace, payload []byte) error {
+	p.dhtMutex.RLock()
+	st, ok := p.strategies[ns]
+	p.dhtMutex.RUnlock()
+	if !ok {
+		return errors.New("not a member of the group")
+	}
+	if len(p.GroupNodes(ns)) == 0 {
+		return errors.New("no group member found")
+	}
+	pkt, err := p.makePacket(p.key.Public().NodeID(ns), "msg", payload)
+	if err != nil {
+		return err
+	}
+	return st.Broadcast(pkt)
+}
+
+// groupTransport is the Transport of the strategy of a group.
+type groupTransport struct {
+	r  *Router
+	ns utils.Namespace
+}
+
+func (t groupTransport) ID() utils.NodeID {
+	return t.r.key.Public().NodeID(t.ns)
+}
+
+func (t groupTransport) Nodes() []utils.NodeInfo {
+	var nodes []utils.NodeInfo
+	for _, n := range t.r.GroupNodes(t.ns) {
+		if !t.r.isBanned(t.ns, n.ID.Digest) {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+func (t groupTransport) Send(dst utils.NodeID, pkt internal.Packet) error {
+	s := t.r.getSession(dst)
+	if s == nil {
+		return errors.New("route not found: " + dst.String())
+	}
+	pkt.Dst = dst
+	return s.Write(pkt)
+}
+
 func (p *Router) SendMessage(dst utils.NodeID, payload []byte) error {
+	if p.isRevoked(dst.Digest) {
+		return errors.New("identity revoked: " + dst.String())
+	}
+	if p.isBlocked(dst.Digest) {
+		return errors.New("identity blocked: " + dst.String())
+	}
 	pkt, err := p.makePacket(dst, "msg", payload)
 	if err != nil {
 		return err
@@ -123,7 +333,7 @@ func (p *Router) run() {
 				p.logger.Error("%v", err)
 				return
 			}
-			s, err := newSesion(conn, p.key)
+			s, err := newSesion(conn, p.key, p.isRefused)
 			if err != nil {
 				conn.Close()
 				p.logger.Error("%v", err)
@@ -162,31 +372,37 @@ func (p *Router) run() {
 				if err != nil {
 					p.logger.Error("%v", err)
 					p.removeSession(s)
-					p.queuedPackets = append(p.queuedPackets, pkt)
+					p.queue(pkt)
 				}
 			} else {
 				p.logger.Error("Route not found: %v", pkt.Dst)
-				p.queuedPackets = append(p.queuedPackets, pkt)
+				p.queue(pkt)
 			}
 		case <-time.After(time.Second):
-			var rest []internal.Packet
-			for _, pkt := range p.queuedPackets {
+			var rest []queuedPacket
+			now := time.Now()
+			for _, q := range p.queuedPackets {
+				if now.After(q.expires) {
+					p.logger.Error("Drop packet to %v", q.pkt.Dst)
+					continue
+				}
 				p.dhtMutex.RLock()
 				for _, d := range p.dht {
-					d.FindNearestNode(pkt.Dst)
+					d.FindNearestNode(q.pkt.Dst)
 				}
 				p.dhtMutex.RUnlock()
-				s := p.getSession(pkt.Dst)
+				s := p.getSession(q.pkt.Dst)
 				if s != nil {
-					err := s.Write(pkt)
+					err := s.Write(q.pkt)
 					if err != nil {
+						// The session may have been dropped; retry with a new one.
 						p.logger.Error("%v", err)
 						p.removeSession(s)
-						p.queuedPackets = append(p.queuedPackets, pkt)
+						rest = append(rest, q)
 					}
 				} else {
-					p.logger.Error("Route not found: %v", pkt.Dst)
-					rest = append(rest, pkt)
+					p.logger.Error("Route not found: %v", q.pkt.Dst)
+					rest = append(rest, q)
 				}
 			}
 			p.queuedPackets = rest
@@ -197,54 +413,128 @@ func (p *Router) run() {
 	}
 }
 
+func (p *Router) queue(pkt internal.Packet) {
+	p.queuedPackets = append(p.queuedPackets, queuedPacket{pkt: pkt, expires: time.Now().Add(queueTimeout)})
+}
+
 func (p *Router) addSession(s *session) {
 	p.sessionMutex.Lock()
 	defer p.sessionMutex.Unlock()
-	id := s.ID().String()
+	id := s.ID().Digest.String()
+	p.keys[id] = *s.rkey
 	if _, ok := p.sessions[id]; !ok {
 		p.sessions[id] = s
+		p.logger.Info("Session established: %s (%v)", s.ID().String(), s.rkey.Type())
 	}
 }
 
 func (p *Router) removeSession(s *session) {
 	p.sessionMutex.Lock()
 	defer p.sessionMutex.Unlock()
-	id := s.ID().String()
-	delete(p.sessions, id)
+	s.conn.Close()
+	id := s.ID().Digest.String()
+	// Another session with the node may have replaced this one.
+	if p.sessions[id] == s {
+		delete(p.sessions, id)
+	}
 }
 
 func (p *Router) readSession(s *session) {
-	for {
-		pkt, err := s.Read()
-		if err != nil {
-			p.logger.Error("%v", err)
-			p.removeSession(s)
-			return
+	pkts := make(chan internal.Packet, maxHeldPackets)
+	go func() {
+		defer close(pkts)
+		for {
+			pkt, err := s.Read()
+			if err != nil {
+				p.logger.Error("%v", err)
+				return
+			}
+			pkts <- pkt
 		}
-		ns := [4]byte{1, 1, 1, 1}
-		if !bytes.Equal(pkt.Src.NS[:], ns[:]) {
-			p.dhtMutex.RLock()
-			if d, ok := p.dht[pkt.Src.NS]; ok {
-				pkt.TTL--
-				if pkt.TTL > 0 {
-					for _, n := range d.KnownNodes() {
-						s := p.getSession(n.ID)
-						if s != nil {
-							s.Write(pkt)
-						}
-					}
-				}
+	}()
+	defer func() {
+		p.removeSession(s)
+		for range pkts {
+		}
+	}()
+
+	// The local list is checked in the handshake, but the certificate may
+	// only be known to the DHT. Messages to this node are held until it has
+	// been looked up. Group packets are not held, since a delay makes the
+	// other members graft; the group strategies check their sources.
+	done := make(chan bool, 1)
+	go func() {
+		done <- p.lookupRevocation(s.rkey)
+	}()
+	var held []internal.Packet
+	in := pkts
+	for done != nil {
+		select {
+		case revoked := <-done:
+			if revoked {
+				p.logger.Error("Refuse revoked identity: %s", s.ID().String())
+				return
+			}
+			done = nil
+			for _, pkt := range held {
+				p.receivePacket(s, pkt)
+			}
+			held = nil
+		case pkt, ok := <-in:
+			if !ok {
+				return
+			}
+			ns := [4]byte{1, 1, 1, 1}
+			if !bytes.Equal(pkt.Src.NS[:], ns[:]) {
+				p.receivePacket(s, pkt)
+				continue
+			}
+			held = append(held, pkt)
+			if len(held) >= maxHeldPackets {
+				// Stop reading from the session rather than drop packets.
+				p.logger.Info("Session %s: waiting for the revocation lookup", s.ID().String())
+				in = nil
 			}
-			p.dhtMutex.RUnlock()
+		}
+	}
+	for pkt := range pkts {
+		p.receivePacket(s, pkt)
+	}
+}
+
+func (p *Router) receivePacket(s *session, pkt internal.Packet) {
+	if p.isRevoked(pkt.Src.Digest) {
+		return
+	}
+	ns := [4]byte{1, 1, 1, 1}
+	if !bytes.Equal(pkt.Src.NS[:], ns[:]) {
+		// Neither the source nor the relay may be banned from the group.
+		if p.isBanned(pkt.Src.NS, pkt.Src.Digest) || p.isBanned(pkt.Src.NS, s.ID().Digest) {
+			return
+		}
+		p.dhtMutex.RLock()
+		st, ok := p.strategies[pkt.Src.NS]
+		p.dhtMutex.RUnlock()
+		if !ok || (pkt.Type == "msg" && len(pkt.ID) == 0) {
+			return
 		}
 		if pkt.Type == "msg" {
+			atomic.AddUint64(&p.groupPackets, 1)
+		}
+		// Group packets from blocked nodes are still delivered so that
+		// the state of the group stays the same for every member.
+		if st.Receive(s.ID(), pkt) && pkt.Type == "msg" {
 			p.recv <- Message{ID: pkt.Src, Payload: pkt.Payload}
 		}
+		return
+	}
+	if pkt.Type == "msg" && !p.isBlocked(pkt.Src.Digest) {
+		p.recv <- Message{ID: pkt.Src, Payload: pkt.Payload}
 	}
 }
 
 func (p *Router) getSession(id utils.NodeID) *session {
-	idstr := id.String()
+	idstr := id.Digest.String()
 	p.sessionMutex.RLock()
 	if s, ok := p.sessions[idstr]; ok {
 		p.sessionMutex.RUnlock()
@@ -278,7 +568,7 @@ func (p *Router) getSession(id utils.NodeID) *session {
 		return nil
 	}
 
-	s, err := newSesion(conn, p.key)
+	s, err := newSesion(conn, p.key, p.isRefused)
 	if err != nil {
 		conn.Close()
 		p.logger.Error("%v", err)
@@ -292,13 +582,156 @@ func (p *Router) getSession(id utils.NodeID) *session {
 }
 
 func (p *Router) makePacket(dst utils.NodeID, typ string, payload []byte) (internal.Packet, error) {
-	return internal.Packet{
+	pkt := internal.Packet{
 		Dst:     dst,
-		Src:     utils.NewNodeID(dst.NS, p.key.Digest()),
+		Src:     p.key.Public().NodeID(dst.NS),
 		Type:    typ,
 		Payload: payload,
 		TTL:     3,
-	}, nil
+	}
+	// Packets within a group are flooded to the group.
+	if dst.NS != [4]byte{1, 1, 1, 1} {
+		pkt.ID = make([]byte, 16)
+		_, err := rand.Read(pkt.ID)
+		if err != nil {
+			return internal.Packet{}, err
+		}
+		pkt.TTL = p.ttl
+		if pkt.TTL == 0 {
+			pkt.TTL = utils.DefaultGroupTTL
+		}
+	}
+	return pkt, nil
+}
+
+// PublicKey returns the public key of the node, establishing a session if needed.
+// It returns nil if the node cannot be reached.
+func (p *Router) PublicKey(id utils.NodeID) *utils.PublicKey {
+	p.sessionMutex.RLock()
+	key, ok := p.keys[id.Digest.String()]
+	p.sessionMutex.RUnlock()
+	if ok {
+		return &key
+	}
+	s := p.getSession(id)
+	if s == nil {
+		return nil
+	}
+	return s.rkey
+}
+
+// Revoke refuses sessions and messages from the identity of the certificate.
+func (p *Router) Revoke(r *utils.Revocation) error {
+	if !r.Verify() {
+		return errors.New("invalid revocation certificate")
+	}
+	d := r.Digest()
+	p.revokedMutex.Lock()
+	_, ok := p.revoked[d.String()]
+	p.revoked[d.String()] = *r
+	p.revokedMutex.Unlock()
+	if ok {
+		return nil
+	}
+	p.logger.Info("Identity revoked: %s", r.Key.NodeID([4]byte{1, 1, 1, 1}).String())
+
+	p.sessionMutex.RLock()
+	s, ok := p.sessions[d.String()]
+	p.sessionMutex.RUnlock()
+	if ok {
+		s.conn.Close()
+	}
+	return nil
+}
+
+// IsRevoked reports whether the identity has been revoked.
+func (p *Router) IsRevoked(id utils.NodeID) bool {
+	return p.isRevoked(id.Digest)
+}
+
+func (p *Router) isRevoked(d utils.PublicKeyDigest) bool {
+	p.revokedMutex.RLock()
+	defer p.revokedMutex.RUnlock()
+	_, ok := p.revoked[d.String()]
+	return ok
+}
+
+// lookupRevocation finds a revocation certificate of the key in the DHT
+// and reports whether the key has been revoked.
+// Keys found not to be revoked are cached for revocationCacheTTL.
+func (p *Router) lookupRevocation(key *utils.PublicKey) bool {
+	d := key.Digest()
+	if p.isRevoked(d) {
+		return true
+	}
+	p.revokedMutex.RLock()
+	t, ok := p.notRevoked[d.String()]
+	p.revokedMutex.RUnlock()
+	if ok && time.Since(t) < revocationCacheTTL {
+		return false
+	}
+	data := p.LoadValue(utils.RevocationKey(key.NodeID([4]byte{1, 1, 1, 1})))
+	if data != nil {
+		var r utils.Revocation
+		// Anyone can store a value in the DHT, so the certificate is
+		// verified before its key is used.
+		if msgpack.Unmarshal([]byte(*data), &r) == nil && !r.Key.IsZero() && r.Verify() && r.Digest() == d && p.Revoke(&r) == nil {
+			return true
+		}
+	}
+	p.revokedMutex.Lock()
+	defer p.revokedMutex.Unlock()
+	if len(p.notRevoked) >= maxRevocationCache {
+		for k, t := range p.notRevoked {
+			if time.Since(t) >= revocationCacheTTL {
+				delete(p.notRevoked, k)
+			}
+		}
+	}
+	if len(p.notRevoked) < maxRevocationCache {
+		p.notRevoked[d.String()] = time.Now()
+	}
+	return false
+}
+
+// StoreMail stores the item in the mailbox of owner in the DHT of the default namespace.
+func (p *Router) StoreMail(owner utils.NodeID, item dht.MailItem) error {
+	p.dhtMutex.RLock()
+	d := p.dht[[4]byte{1, 1, 1, 1}]
+	p.dhtMutex.RUnlock()
+	return d.StoreMail(p.key, owner, item)
+}
+
+// LoadMail returns the items in the mailbox of this node.
+func (p *Router) LoadMail() []dht.MailItem {
+	p.dhtMutex.RLock()
+	d := p.dht[[4]byte{1, 1, 1, 1}]
+	p.dhtMutex.RUnlock()
+	return d.LoadMail(p.key.Public().NodeID([4]byte{1, 1, 1, 1}))
+}
+
+// DeleteMail deletes the items from the mailbox of this node.
+func (p *Router) DeleteMail(ids [][]byte) error {
+	p.dhtMutex.RLock()
+	d := p.dht[[4]byte{1, 1, 1, 1}]
+	p.dhtMutex.RUnlock()
+	return d.DeleteMail(p.key, ids)
+}
+
+// StoreValue stores the value in the DHT of the default namespace.
+func (p *Router) StoreValue(key string, value string) {
+	p.dhtMutex.RLock()
+	d := p.dht[[4]byte{1, 1, 1, 1}]
+	p.dhtMutex.RUnlock()
+	d.StoreValue(key, value)
+}
+
+// LoadValue finds the value in the DHT of the default namespace.
+func (p *Router) LoadValue(key string) *string {
+	p.dhtMutex.RLock()
+	d := p.dht[[4]byte{1, 1, 1, 1}]
+	p.dhtMutex.RUnlock()
+	return d.LoadValue(key)
 }
 
 func (p *Router) AddNode(info utils.NodeInfo) {
@@ -310,6 +743,8 @@ func (p *Router) AddNode(info utils.NodeInfo) {
 }
 
 func (p *Router) KnownNodes() []utils.NodeInfo {
+	p.dhtMutex.RLock()
+	defer p.dhtMutex.RUnlock()
 	var nodes []utils.NodeInfo
 	for _, d := range p.dht {
 		nodes = append(nodes, d.KnownNodes()...)
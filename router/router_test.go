@@ -3,10 +3,12 @@ package router
 import (
 	"bytes"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
 
 	"github.com/h2so5/murcott/log"
 )
@@ -39,19 +41,19 @@ func TestRouterMessageExchange(t *testing.T) {
 	if err != nil {
 		t.Errorf("router2: recvMessage() returns error")
 	}
-	if m.ID.Digest.Cmp(router1.key.Digest()) != 0 {
+	if m.ID.Digest.Cmp(router1.key.Public().Digest()) != 0 {
 		t.Errorf("router2: wrong source id")
 	}
 	if string(m.Payload) != msg {
 		t.Errorf("router2: wrong message body")
 	}
 
-	router2.SendMessage(utils.NewNodeID(namespace, router1.key.Digest()), []byte(msg))
+	router2.SendMessage(utils.NewNodeID(namespace, router1.key.Public().Digest()), []byte(msg))
 	m, err = router1.RecvMessage()
 	if err != nil {
 		t.Errorf("router1: recvMessage() returns error")
 	}
-	if m.ID.Digest.Cmp(router2.key.Digest()) != 0 {
+	if m.ID.Digest.Cmp(router2.key.Public().Digest()) != 0 {
 		t.Errorf("router1: wrong source id")
 	}
 	if string(m.Payload) != msg {
@@ -100,7 +102,7 @@ func TestRouterRouteExchange(t *testing.T) {
 	if err != nil {
 		t.Errorf("router1: recvMessage() returns error")
 	}
-	if m.ID.Digest.Cmp(router3.key.Digest()) != 0 {
+	if m.ID.Digest.Cmp(router3.key.Public().Digest()) != 0 {
 		t.Errorf("router1: wrong source id")
 	}
 	if string(m.Payload) != msg {
@@ -175,7 +177,7 @@ func TestRouterGroup(t *testing.T) {
 		if err != nil {
 			t.Errorf("router1: recvMessage() returns error")
 		}
-		if m.ID.Digest.Cmp(router3.key.Digest()) != 0 {
+		if m.ID.Digest.Cmp(router3.key.Public().Digest()) != 0 {
 			t.Errorf("router1: wrong source id")
 		}
 
@@ -193,7 +195,7 @@ func TestRouterGroup(t *testing.T) {
 		if err != nil {
 			t.Errorf("router1: recvMessage() returns error")
 		}
-		if m.ID.Digest.Cmp(router3.key.Digest()) != 0 {
+		if m.ID.Digest.Cmp(router3.key.Public().Digest()) != 0 {
 			t.Errorf("router1: wrong source id")
 		}
 
@@ -206,3 +208,446 @@ func TestRouterGroup(t *testing.T) {
 		}
 	}
 }
+
+// groupNetwork starts n routers in the group of the namespace.
+func groupNetwork(t *testing.T, n int, ns utils.Namespace, config utils.Config) []*Router {
+	logger := log.NewLogger()
+	var routers []*Router
+	for i := 0; i < n; i++ {
+		key := utils.GeneratePrivateKey()
+		r, err := NewRouter(key, logger, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Join(utils.NewNodeID(ns, key.Digest()))
+		routers = append(routers, r)
+	}
+	for _, r := range routers {
+		r.Discover(config.Bootstrap())
+	}
+	return routers
+}
+
+// broadcast sends a message from the first router and returns how many of
+// the others have received it and the number of packets it took.
+func broadcast(t *testing.T, routers []*Router, ns utils.Namespace) (int, uint64) {
+	var before uint64
+	for _, r := range routers {
+		before += atomic.LoadUint64(&r.groupPackets)
+	}
+	msg := "The quick brown fox jumps over the lazy dog"
+	if err := routers[0].Broadcast(ns, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	for t := time.Now(); time.Since(t) < 5*time.Second; time.Sleep(100 * time.Millisecond) {
+		reached := 0
+		for _, r := range routers {
+			if len(r.recv) > 0 {
+				reached++
+			}
+		}
+		if reached == len(routers)-1 {
+			break
+		}
+	}
+	// Wait for the duplicates on their way.
+	time.Sleep(500 * time.Millisecond)
+
+	reached := 0
+	var packets uint64
+	for i, r := range routers {
+		packets += atomic.LoadUint64(&r.groupPackets)
+		received := len(r.recv)
+		if i == 0 && received > 0 {
+			t.Errorf("message should not return to the sender")
+		}
+		if received > 1 {
+			t.Errorf("message should be delivered once: %d", received)
+		}
+		for len(r.recv) > 0 {
+			<-r.recv
+		}
+		reached += received
+	}
+	return reached, packets - before
+}
+
+func TestRouterGroupAmplification(t *testing.T) {
+	const n = 50
+	for i, fanout := range []int{0, 8} {
+		var config = utils.Config{
+			P: "9400-9500",
+			B: []string{
+				"localhost:9400-9500",
+			},
+			GroupTTL:    6,
+			GroupFanout: fanout,
+		}
+		ns := [4]byte{1, 1, 1, 5 + byte(i)}
+		routers := groupNetwork(t, n, ns, config)
+		time.Sleep(time.Second)
+
+		reached, packets := broadcast(t, routers, ns)
+		t.Logf("fanout %d: %d of %d nodes reached with %d packets (%.1f per node)",
+			fanout, reached, n-1, packets, float64(packets)/float64(n))
+
+		// Each node sends a packet at most once to each node it picks.
+		limit := uint64(n * (n - 1))
+		if fanout > 0 {
+			limit = uint64(n * fanout)
+		}
+		if packets > limit {
+			t.Errorf("fanout %d: too many packets: %d; expects at most %d", fanout, packets, limit)
+		}
+		if fanout == 0 && reached != n-1 {
+			t.Errorf("fanout %d: message should reach all nodes: %d of %d", fanout, reached, n-1)
+		}
+
+		for _, r := range routers {
+			r.Leave(ns)
+			r.Close()
+		}
+	}
+}
+
+func TestRouterPlumtree(t *testing.T) {
+	const n = 50
+	var config = utils.Config{
+		P: "9600-9700",
+		B: []string{
+			"localhost:9600-9700",
+		},
+		GroupStrategy: "plumtree",
+	}
+	ns := [4]byte{1, 1, 1, 7}
+	routers := groupNetwork(t, n, ns, config)
+	time.Sleep(2 * time.Second)
+
+	var packets uint64
+	for i := 0; i < 5; i++ {
+		var reached int
+		reached, packets = broadcast(t, routers, ns)
+		t.Logf("message %d: %d of %d nodes reached with %d packets", i, reached, n-1, packets)
+		if reached != n-1 {
+			t.Errorf("message should reach all nodes: %d of %d", reached, n-1)
+		}
+	}
+	// The eager links have converged to a spanning tree.
+	if packets > 2*(n-1) {
+		t.Errorf("too many packets: %d; expects at most %d", packets, 2*(n-1))
+	}
+
+	// The tree is repaired when members leave.
+	for _, r := range routers[n-10:] {
+		r.Leave(ns)
+	}
+	routers = routers[:n-10]
+	reached, packets := broadcast(t, routers, ns)
+	t.Logf("after churn: %d of %d nodes reached with %d packets", reached, len(routers)-1, packets)
+	if reached != len(routers)-1 {
+		t.Errorf("message should reach all nodes after churn: %d of %d", reached, len(routers)-1)
+	}
+
+	for _, r := range routers {
+		r.Leave(ns)
+		r.Close()
+	}
+}
+
+func TestRouterBan(t *testing.T) {
+	var config = utils.Config{
+		P: "9200-9300",
+		B: []string{
+			"localhost:9200-9300",
+		},
+	}
+
+	logger := log.NewLogger()
+	ns := [4]byte{1, 1, 1, 4}
+
+	var routers []*Router
+	for i := 0; i < 3; i++ {
+		key := utils.GeneratePrivateKey()
+		r, err := NewRouter(key, logger, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Join(utils.NewNodeID(ns, key.Digest()))
+		defer r.Close()
+		routers = append(routers, r)
+	}
+	for _, r := range routers {
+		r.Discover(utils.DefaultConfig.Bootstrap())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	banned := routers[2].key.Public().NodeID(ns)
+	routers[0].SetBanned(ns, []utils.NodeID{banned})
+	routers[1].SetBanned(ns, []utils.NodeID{banned})
+	if !routers[0].IsBanned(banned) {
+		t.Errorf("router3 should be banned")
+	}
+
+	msg := "The quick brown fox jumps over the lazy dog"
+	routers[2].SendMessage(routers[0].key.Public().NodeID(ns), []byte(msg))
+
+	recv := make(chan Message, 10)
+	for _, r := range routers[:2] {
+		go func(r *Router) {
+			for {
+				m, err := r.RecvMessage()
+				if err != nil {
+					return
+				}
+				recv <- m
+			}
+		}(r)
+	}
+	select {
+	case m := <-recv:
+		t.Errorf("message from a banned node should be dropped: %s", m.ID.String())
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	routers[0].SetBanned(ns, nil)
+	routers[2].SendMessage(routers[0].key.Public().NodeID(ns), []byte(msg))
+	select {
+	case m := <-recv:
+		if string(m.Payload) != msg {
+			t.Errorf("wrong message body")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("message should be received after the ban is lifted")
+	}
+}
+
+func TestRouterEd25519(t *testing.T) {
+	logger := log.NewLogger()
+	msg := "The quick brown fox jumps over the lazy dog"
+
+	key1 := utils.GenerateEd25519PrivateKey()
+	key2 := utils.GeneratePrivateKey()
+
+	router1, err := NewRouter(key1, logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router1.Close()
+	router1.Discover(utils.DefaultConfig.Bootstrap())
+
+	router2, err := NewRouter(key2, logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router2.Close()
+	router2.Discover(utils.DefaultConfig.Bootstrap())
+
+	time.Sleep(100 * time.Millisecond)
+	router1.SendMessage(key2.NodeID(namespace), []byte(msg))
+
+	m, err := router2.RecvMessage()
+	if err != nil {
+		t.Errorf("router2: recvMessage() returns error")
+	}
+	if m.ID.Digest.Cmp(key1.Digest()) != 0 {
+		t.Errorf("router2: wrong source id")
+	}
+	if string(m.Payload) != msg {
+		t.Errorf("router2: wrong message body")
+	}
+}
+
+func TestRouterRevocation(t *testing.T) {
+	logger := log.NewLogger()
+	msg := "The quick brown fox jumps over the lazy dog"
+
+	key1 := utils.GeneratePrivateKey()
+	key2 := utils.GeneratePrivateKey()
+	key3 := utils.GeneratePrivateKey()
+
+	router1, err := NewRouter(key1, logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router1.Close()
+	router1.Discover(utils.DefaultConfig.Bootstrap())
+
+	router2, err := NewRouter(key2, logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router2.Close()
+	router2.Discover(utils.DefaultConfig.Bootstrap())
+
+	router3, err := NewRouter(key3, logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router3.Close()
+	router3.Discover(utils.DefaultConfig.Bootstrap())
+
+	r, err := utils.NewRevocation(key1, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = router2.Revoke(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !router2.IsRevoked(key1.NodeID(namespace)) {
+		t.Errorf("router2: key1 should be revoked")
+	}
+	if router2.SendMessage(key1.NodeID(namespace), []byte(msg)) == nil {
+		t.Errorf("router2: SendMessage() to a revoked identity should fail")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	router1.SendMessage(key2.NodeID(namespace), []byte("revoked"))
+	router3.SendMessage(key2.NodeID(namespace), []byte(msg))
+
+	m, err := router2.RecvMessage()
+	if err != nil {
+		t.Errorf("router2: recvMessage() returns error")
+	}
+	if m.ID.Digest.Cmp(key3.Digest()) != 0 {
+		t.Errorf("router2: message from a revoked identity should be refused")
+	}
+	if string(m.Payload) != msg {
+		t.Errorf("router2: wrong message body")
+	}
+	router2.revokedMutex.RLock()
+	_, cached := router2.notRevoked[key3.Digest().String()]
+	router2.revokedMutex.RUnlock()
+	if !cached {
+		t.Errorf("router2: key3 should be cached as not revoked")
+	}
+
+	// A certificate only known to the DHT is found before the session is used.
+	key4 := utils.GeneratePrivateKey()
+	router4, err := NewRouter(key4, logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router4.Close()
+	router4.Discover(utils.DefaultConfig.Bootstrap())
+	r4, err := utils.NewRevocation(key4, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := msgpack.Marshal(r4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	router3.StoreValue(utils.RevocationKey(key4.NodeID(namespace)), string(data))
+	time.Sleep(100 * time.Millisecond)
+
+	router4.SendMessage(key2.NodeID(namespace), []byte("revoked"))
+	recv := make(chan Message, 1)
+	go func() {
+		if m, err := router2.RecvMessage(); err == nil {
+			recv <- m
+		}
+	}()
+	select {
+	case m := <-recv:
+		t.Errorf("router2: message from an identity revoked in the DHT should be refused: %s", m.Payload)
+	case <-time.After(time.Second):
+	}
+	if !router2.IsRevoked(key4.NodeID(namespace)) {
+		t.Errorf("router2: key4 should be revoked")
+	}
+
+	// A certificate without a key stored in the DHT is ignored.
+	key5 := utils.GeneratePrivateKey()
+	router5, err := NewRouter(key5, logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router5.Close()
+	router5.Discover(utils.DefaultConfig.Bootstrap())
+	data, err = msgpack.Marshal(map[string]interface{}{"key": map[string][]byte{}, "reason": "forged", "sign": map[string][]byte{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	router3.StoreValue(utils.RevocationKey(key5.NodeID(namespace)), string(data))
+	time.Sleep(100 * time.Millisecond)
+
+	router5.SendMessage(key2.NodeID(namespace), []byte(msg))
+	select {
+	case m := <-recv:
+		if m.ID.Digest.Cmp(key5.Digest()) != 0 {
+			t.Errorf("router2: wrong source id")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("router2: message should be received despite a certificate without a key")
+	}
+	if router2.IsRevoked(key5.NodeID(namespace)) {
+		t.Errorf("router2: key5 should not be revoked")
+	}
+}
+
+func TestRouterBlock(t *testing.T) {
+	logger := log.NewLogger()
+	msg := "The quick brown fox jumps over the lazy dog"
+
+	key1 := utils.GeneratePrivateKey()
+	key2 := utils.GeneratePrivateKey()
+
+	router1, err := NewRouter(key1, logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router1.Close()
+	router1.Discover(utils.DefaultConfig.Bootstrap())
+
+	router2, err := NewRouter(key2, logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router2.Close()
+	router2.Discover(utils.DefaultConfig.Bootstrap())
+
+	time.Sleep(100 * time.Millisecond)
+	router1.SendMessage(key2.NodeID(namespace), []byte(msg))
+	if _, err := router2.RecvMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	router2.SetBlocked([]utils.NodeID{key1.NodeID(namespace)})
+	if !router2.IsBlocked(key1.NodeID(namespace)) {
+		t.Errorf("router2: key1 should be blocked")
+	}
+	if router2.SendMessage(key1.NodeID(namespace), []byte(msg)) == nil {
+		t.Errorf("router2: SendMessage() to a blocked identity should fail")
+	}
+
+	recv := make(chan Message, 10)
+	go func() {
+		for {
+			m, err := router2.RecvMessage()
+			if err != nil {
+				return
+			}
+			recv <- m
+		}
+	}()
+	router1.SendMessage(key2.NodeID(namespace), []byte("blocked"))
+	select {
+	case <-recv:
+		t.Errorf("router2: message from a blocked identity should be refused")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	router2.SetBlocked(nil)
+	router1.SendMessage(key2.NodeID(namespace), []byte(msg))
+	select {
+	case m := <-recv:
+		if string(m.Payload) != msg {
+			t.Errorf("router2: wrong message body")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("router2: message should be received after the block is lifted")
+	}
+}
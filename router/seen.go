@@ -0,0 +1,41 @@
+package router
+
+import "time"
+
+// A group packet is forwarded and delivered only once while its ID is
+// remembered. It must be remembered longer than a packet can travel.
+const (
+	seenTimeout = 5 * time.Minute
+	maxSeen     = 10000
+)
+
+// seenCache remembers the IDs of the recent group packets of a namespace.
+type seenCache struct {
+	ids   map[string]time.Time
+	order []string
+}
+
+func newSeenCache() *seenCache {
+	return &seenCache{ids: make(map[string]time.Time)}
+}
+
+// add records the ID and reports whether it has not been seen yet.
+func (c *seenCache) add(id []byte, now time.Time) bool {
+	for len(c.order) > 0 && (len(c.order) >= maxSeen || now.Sub(c.ids[c.order[0]]) > seenTimeout) {
+		delete(c.ids, c.order[0])
+		c.order = c.order[1:]
+	}
+	k := string(id)
+	if _, ok := c.ids[k]; ok {
+		return false
+	}
+	c.ids[k] = now
+	c.order = append(c.order, k)
+	return true
+}
+
+// has reports whether the ID has been seen.
+func (c *seenCache) has(id []byte) bool {
+	_, ok := c.ids[string(id)]
+	return ok
+}
@@ -0,0 +1,27 @@
+package router
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSeenCache(t *testing.T) {
+	c := newSeenCache()
+	now := time.Now()
+	if !c.add([]byte("a"), now) {
+		t.Errorf("new ID should be added")
+	}
+	if c.add([]byte("a"), now) {
+		t.Errorf("seen ID should not be added")
+	}
+	if !c.add([]byte("a"), now.Add(seenTimeout+time.Second)) {
+		t.Errorf("expired ID should be added again")
+	}
+	for i := 0; i < maxSeen*2; i++ {
+		c.add([]byte(strconv.Itoa(i)), now)
+	}
+	if len(c.ids) > maxSeen || len(c.order) > maxSeen {
+		t.Errorf("cache should hold at most %d IDs: %d", maxSeen, len(c.ids))
+	}
+}
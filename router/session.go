@@ -7,6 +7,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/h2so5/murcott/internal"
@@ -19,15 +20,25 @@ type session struct {
 	r    io.Reader
 	w    io.Writer
 	rkey *utils.PublicKey
-	lkey *utils.PrivateKey
+	lkey utils.Signer
+
+	// wmutex serializes writes to the encrypted stream, since group
+	// packets are forwarded from the goroutines reading other sessions.
+	wmutex sync.Mutex
+
+	refused func(utils.PublicKeyDigest) bool
 }
 
-func newSesion(conn net.Conn, lkey *utils.PrivateKey) (*session, error) {
+// newSesion performs a handshake on conn.
+// If refused reports true for the key of the remote node, such as a revoked
+// or blocked one, the session is refused.
+func newSesion(conn net.Conn, lkey utils.Signer, refused func(utils.PublicKeyDigest) bool) (*session, error) {
 	s := session{
-		conn: conn,
-		r:    conn,
-		w:    conn,
-		lkey: lkey,
+		conn:    conn,
+		r:       conn,
+		w:       conn,
+		lkey:    lkey,
+		refused: refused,
 	}
 
 	err := s.sendPubkey()
@@ -55,7 +66,7 @@ func newSesion(conn net.Conn, lkey *utils.PrivateKey) (*session, error) {
 }
 
 func (s *session) ID() utils.NodeID {
-	return utils.NewNodeID([4]byte{1, 1, 1, 1}, s.rkey.Digest())
+	return s.rkey.NodeID([4]byte{1, 1, 1, 1})
 }
 
 func (s *session) Read() (internal.Packet, error) {
@@ -76,6 +87,8 @@ func (s *session) Write(p internal.Packet) error {
 	if err != nil {
 		return err
 	}
+	s.wmutex.Lock()
+	defer s.wmutex.Unlock()
 	d := msgpack.NewEncoder(s.w)
 	return d.Encode(p)
 }
@@ -92,13 +105,22 @@ func (s *session) verifyPubkey() error {
 	if packet.Type == "pubkey" {
 		var key utils.PublicKey
 		err := msgpack.Unmarshal(packet.Payload, &key)
-		if err == nil {
-			id := utils.NewNodeID([4]byte{1, 1, 1, 1}, key.Digest())
-			if id.Digest.Cmp(packet.Src.Digest) != 0 {
-				return errors.New("receive wrong public key")
-			}
-			s.rkey = &key
+		if err != nil {
+			return err
+		}
+		// The key type is advertised in the payload; keys of unknown types
+		// are decoded as zero values.
+		if key.IsZero() {
+			return errors.New("unsupported public key")
+		}
+		id := key.NodeID([4]byte{1, 1, 1, 1})
+		if id.Digest.Cmp(packet.Src.Digest) != 0 {
+			return errors.New("receive wrong public key")
+		}
+		if s.refused != nil && s.refused(id.Digest) {
+			return errors.New("refuse identity: " + id.String())
 		}
+		s.rkey = &key
 	} else {
 		return errors.New("receive wrong packet")
 	}
@@ -122,13 +144,13 @@ func (s *session) verifyCommonKey() ([]byte, error) {
 }
 
 func (s *session) sendPubkey() error {
-	data, err := msgpack.Marshal(s.lkey.PublicKey)
+	data, err := msgpack.Marshal(*s.lkey.Public())
 	if err != nil {
 		return err
 	}
 
 	pkt := internal.Packet{
-		Src:     utils.NewNodeID([4]byte{1, 1, 1, 1}, s.lkey.Digest()),
+		Src:     s.lkey.Public().NodeID([4]byte{1, 1, 1, 1}),
 		Type:    "pubkey",
 		Payload: data,
 	}
@@ -148,7 +170,7 @@ func (s *session) sendCommonKey() ([]byte, error) {
 	}
 
 	pkt := internal.Packet{
-		Src:     utils.NewNodeID([4]byte{1, 1, 1, 1}, s.lkey.Digest()),
+		Src:     s.lkey.Public().NodeID([4]byte{1, 1, 1, 1}),
 		Type:    "key",
 		Payload: key[:],
 	}
@@ -0,0 +1,143 @@
+package router
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/internal"
+	"github.com/h2so5/murcott/utils"
+)
+
+// Strategy disseminates the packets of a group. The router creates one for
+// each group it joins and passes it every packet of the group it receives.
+type Strategy interface {
+	// Broadcast sends a new packet to the group.
+	Broadcast(pkt internal.Packet) error
+	// Receive handles a packet of the group from the node the session is
+	// established with, and reports whether it should be delivered.
+	Receive(from utils.NodeID, pkt internal.Packet) bool
+	// Close stops the strategy when the router leaves the group.
+	Close()
+}
+
+// Transport gives a Strategy access to the members of its group.
+type Transport interface {
+	// ID returns the ID of this node in the group.
+	ID() utils.NodeID
+	// Nodes returns the known members of the group, except banned ones.
+	Nodes() []utils.NodeInfo
+	// Send sends the packet to the member, establishing a session if needed.
+	Send(dst utils.NodeID, pkt internal.Packet) error
+}
+
+// StrategyFactory creates a Strategy for a group.
+type StrategyFactory func(t Transport, config utils.Config) Strategy
+
+var strategies = map[string]StrategyFactory{
+	"flood":    newFlood,
+	"plumtree": newPlumtree,
+}
+var strategiesMutex sync.RWMutex
+
+// RegisterStrategy makes a dissemination strategy available under the name,
+// which is then selected by GroupStrategy in utils.Config.
+func RegisterStrategy(name string, factory StrategyFactory) {
+	strategiesMutex.Lock()
+	defer strategiesMutex.Unlock()
+	strategies[name] = factory
+}
+
+func strategyFactory(config utils.Config) (StrategyFactory, error) {
+	name := config.GroupStrategy
+	if name == "" {
+		name = utils.DefaultGroupStrategy
+	}
+	strategiesMutex.RLock()
+	defer strategiesMutex.RUnlock()
+	f, ok := strategies[name]
+	if !ok {
+		return nil, errors.New("unknown group strategy: " + name)
+	}
+	return f, nil
+}
+
+// flood forwards each new packet to the known members, or GroupFanout of
+// them chosen at random, until its TTL runs out.
+type flood struct {
+	t      Transport
+	ttl    uint8
+	fanout int
+
+	seen  *seenCache
+	mutex sync.Mutex
+}
+
+func newFlood(t Transport, config utils.Config) Strategy {
+	f := &flood{t: t, ttl: config.GroupTTL, fanout: config.GroupFanout, seen: newSeenCache()}
+	if f.ttl == 0 {
+		f.ttl = utils.DefaultGroupTTL
+	}
+	return f
+}
+
+func (f *flood) Broadcast(pkt internal.Packet) error {
+	f.markSeen(pkt.ID)
+	pkt.TTL = f.ttl
+	f.send(pkt)
+	return nil
+}
+
+func (f *flood) Receive(from utils.NodeID, pkt internal.Packet) bool {
+	if !f.markSeen(pkt.ID) {
+		return false
+	}
+	pkt.TTL--
+	if pkt.TTL > 0 {
+		f.send(pkt, from, pkt.Src)
+	}
+	return true
+}
+
+func (f *flood) Close() {
+}
+
+func (f *flood) markSeen(id []byte) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.seen.add(id, time.Now())
+}
+
+// send sends the packet to the picked members. Sessions may have to be
+// established, so it does not wait for them.
+func (f *flood) send(pkt internal.Packet, exclude ...utils.NodeID) {
+	for _, n := range pick(f.t.Nodes(), f.fanout, exclude...) {
+		go f.t.Send(n.ID, pkt)
+	}
+}
+
+// pick chooses up to n nodes at random, leaving out the excluded ones.
+// If n is not positive, all of them are chosen.
+func pick(nodes []utils.NodeInfo, n int, exclude ...utils.NodeID) []utils.NodeInfo {
+	var candidates []utils.NodeInfo
+	for _, node := range nodes {
+		ok := true
+		for _, e := range exclude {
+			if node.ID.Digest == e.Digest {
+				ok = false
+			}
+		}
+		if ok {
+			candidates = append(candidates, node)
+		}
+	}
+	if n <= 0 || len(candidates) <= n {
+		return candidates
+	}
+	var picked []utils.NodeInfo
+	for _, i := range rand.Perm(len(candidates))[:n] {
+		picked = append(picked, candidates[i])
+	}
+	return picked
+}
@@ -0,0 +1,198 @@
+package murcott
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"time"
+
+	"github.com/h2so5/murcott/client"
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/utils"
+	"github.com/vmihailenco/msgpack"
+)
+
+// boxKeyTimeout is how long a node is asked for its box key
+// before the DHT is searched instead.
+const boxKeyTimeout = 2 * time.Second
+
+// envelope is the content of a sealed message before it is encrypted to
+// the box key of the recipient. It is signed by the sender, so the recipient
+// knows who wrote the message whichever path it has taken.
+// Message is a client.RatchetMessage if the message belongs to a conversation.
+// Time is when the envelope was sealed; older envelopes than any mailbox
+// keeps are refused, so that a captured one cannot be replayed forever.
+type envelope struct {
+	Key     utils.PublicKey `msgpack:"key"`
+	Message []byte          `msgpack:"message"`
+	Ratchet bool            `msgpack:"ratchet"`
+	Time    int64           `msgpack:"time"`
+	S       utils.Signature `msgpack:"sign"`
+}
+
+func envelopeSignedData(dst utils.NodeID, message []byte, ratchet bool, t int64) []byte {
+	ary := []interface{}{
+		"chat",
+		dst.Digest[:],
+		message,
+		ratchet,
+		t,
+	}
+
+	data, _ := msgpack.Marshal(ary)
+	return data
+}
+
+// seal signs the message and encrypts it to the box key of dst.
+// If there is a conversation with dst, the message is encrypted with its
+// ratchet first.
+func (c *Client) seal(box *ecdh.PublicKey, dst utils.NodeID, msg client.ChatMessage) ([]byte, error) {
+	m, err := msgpack.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	ratchet := c.convs.Has(dst)
+	if ratchet {
+		rm, err := c.convs.Encrypt(dst, m)
+		if err != nil {
+			return nil, err
+		}
+		c.conversationChanged()
+		m, err = msgpack.Marshal(rm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	t := time.Now().Unix()
+	sign := c.key.Sign(envelopeSignedData(dst, m, ratchet, t))
+	if sign == nil {
+		return nil, errors.New("cannot sign message")
+	}
+	data, err := msgpack.Marshal(envelope{Key: *c.key.Public(), Message: m, Ratchet: ratchet, Time: t, S: *sign})
+	if err != nil {
+		return nil, err
+	}
+	return utils.SealBox(box, data)
+}
+
+// open decrypts a sealed message and returns it with the identity of its sender.
+func (c *Client) open(sealed []byte) (utils.NodeID, client.ChatMessage, error) {
+	data, err := utils.OpenBox(c.boxKey, sealed)
+	if err != nil {
+		return utils.NodeID{}, client.ChatMessage{}, err
+	}
+	var env envelope
+	err = msgpack.Unmarshal(data, &env)
+	if err != nil {
+		return utils.NodeID{}, client.ChatMessage{}, err
+	}
+	if env.Key.IsZero() || !env.Key.Verify(envelopeSignedData(c.id, env.Message, env.Ratchet, env.Time), &env.S) {
+		return utils.NodeID{}, client.ChatMessage{}, errors.New("wrong signature")
+	}
+	if d := time.Since(time.Unix(env.Time, 0)); d > dht.MaxMailExpiry || d < -maxClockSkew {
+		return utils.NodeID{}, client.ChatMessage{}, errors.New("envelope expired")
+	}
+	src := env.Key.NodeID(c.id.NS)
+	m := env.Message
+	if env.Ratchet {
+		var rm client.RatchetMessage
+		err = msgpack.Unmarshal(m, &rm)
+		if err != nil {
+			return utils.NodeID{}, client.ChatMessage{}, err
+		}
+		m, err = c.convs.Decrypt(c.id, src, c.boxKey, rm)
+		if err != nil {
+			return utils.NodeID{}, client.ChatMessage{}, err
+		}
+		c.conversationChanged()
+	}
+	var msg client.ChatMessage
+	err = msgpack.Unmarshal(m, &msg)
+	if err != nil {
+		return utils.NodeID{}, client.ChatMessage{}, err
+	}
+	return src, msg, nil
+}
+
+// boxKeyRecord returns the box key record of the client, signing it on first use.
+func (c *Client) boxKeyRecord() (*utils.BoxKeyRecord, error) {
+	c.boxMutex.Lock()
+	defer c.boxMutex.Unlock()
+	if c.boxRecord == nil {
+		r, err := utils.NewBoxKeyRecord(c.key, c.boxKey.PublicKey())
+		if err != nil {
+			return nil, err
+		}
+		c.boxRecord = r
+	}
+	return c.boxRecord, nil
+}
+
+// addBoxKey caches the box key record of id if it is valid and not older
+// than the cached one, and returns the box key.
+func (c *Client) addBoxKey(id utils.NodeID, r *utils.BoxKeyRecord) (*ecdh.PublicKey, error) {
+	if !r.Verify() || r.Key.Digest() != id.Digest {
+		return nil, errors.New("invalid box key record: " + id.String())
+	}
+	c.boxMutex.Lock()
+	defer c.boxMutex.Unlock()
+	key := id.Digest.String()
+	if old, ok := c.boxKeys[key]; ok && old.Time.After(r.Time) {
+		return old.BoxKey()
+	}
+	c.boxKeys[key] = *r
+	return r.BoxKey()
+}
+
+// boxKeyOf returns the box key of dst. It is taken from the cache, asked
+// from the node itself, or looked up in the DHT, in that order. Records are
+// signed by the identity key of dst, so relays cannot substitute their own.
+func (c *Client) boxKeyOf(dst utils.NodeID) (*ecdh.PublicKey, error) {
+	c.boxMutex.Lock()
+	r, ok := c.boxKeys[dst.Digest.String()]
+	c.boxMutex.Unlock()
+	if ok {
+		return r.BoxKey()
+	}
+
+	res := make(chan *utils.BoxKeyRecord, 1)
+	err := c.node.Send(dst, client.BoxKeyRequest{}, func(r interface{}) {
+		if k, ok := r.(client.BoxKeyResponse); ok {
+			res <- &k.Record
+		} else {
+			res <- nil
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-res:
+		if r != nil {
+			return c.addBoxKey(dst, r)
+		}
+	case <-time.After(boxKeyTimeout):
+	case <-c.exit:
+		return nil, errors.New("client closed")
+	}
+
+	if r := c.lookupBoxKey(dst); r != nil {
+		return c.addBoxKey(dst, r)
+	}
+	return nil, errors.New("box key not found: " + dst.String())
+}
+
+// lookupBoxKey finds a verified box key record of the identity in the DHT.
+func (c *Client) lookupBoxKey(id utils.NodeID) *utils.BoxKeyRecord {
+	data := c.node.LoadValue(utils.BoxKeyRecordKey(id))
+	if data == nil {
+		return nil
+	}
+	var r utils.BoxKeyRecord
+	if msgpack.Unmarshal([]byte(*data), &r) != nil {
+		return nil
+	}
+	if !r.Verify() || r.Key.Digest() != id.Digest {
+		return nil
+	}
+	return &r
+}
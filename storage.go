@@ -0,0 +1,154 @@
+package murcott
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/h2so5/murcott/client"
+	"github.com/h2so5/murcott/utils"
+)
+
+// SetStorage sets the storage in which the client keeps the messages it sends
+// and receives, the roster, the profiles and the statuses of sent messages,
+// and loads them from it. Call it before Run. The client does not close the storage.
+func (c *Client) SetStorage(s client.Storage) error {
+	entries, err := s.LoadRoster()
+	if err != nil {
+		return err
+	}
+	c.Roster.Load(entries)
+	p, err := s.LoadProfile(c.id)
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		c.profile = *p
+	}
+	err = c.msgStatuses.Load(s)
+	if err != nil {
+		return err
+	}
+	msgs, err := s.Messages(client.HistoryQuery{})
+	if err != nil {
+		return err
+	}
+	index := client.NewSearchIndex()
+	for i := range msgs {
+		index.Add(&msgs[i])
+	}
+	c.index = index
+	c.storage = s
+	return nil
+}
+
+// History returns the stored messages selected by the query, oldest first.
+func (c *Client) History(q client.HistoryQuery) ([]client.StoredMessage, error) {
+	if c.storage == nil {
+		return nil, errors.New("no storage")
+	}
+	return c.storage.Messages(q)
+}
+
+// receiveMessage stores the message and passes it to the handler unless it
+// has already been received.
+func (c *Client) receiveMessage(src utils.NodeID, msg client.ChatMessage) {
+	if c.isDuplicate(src, msg.ID) {
+		return
+	}
+	c.storeMessage(client.StoredMessage{Peer: src, Message: msg, Time: time.Now()})
+	if c.msgHandler != nil {
+		c.msgHandler(src, msg)
+	}
+}
+
+func (c *Client) storeMessage(m client.StoredMessage) {
+	if c.storage == nil {
+		return
+	}
+	err := c.storage.AddMessage(m)
+	if err != nil {
+		c.Logger.Error("storage: %v", err)
+		return
+	}
+	c.index.Add(&m)
+}
+
+// Search finds the stored messages that contain all the words and "quoted
+// phrases" of q.Text, newest first.
+func (c *Client) Search(q client.SearchQuery) ([]client.SearchResult, error) {
+	if c.storage == nil {
+		return nil, errors.New("no storage")
+	}
+	var results []client.SearchResult
+	for _, h := range c.index.Search(q) {
+		m, err := c.storage.Message(h.Peer, h.ID)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			results = append(results, client.SearchResult{Message: *m, Snippet: client.Snippet(&m.Message, q.Text)})
+		}
+	}
+	return results, nil
+}
+
+// ExportHistory writes the stored messages selected by the query in the format.
+func (c *Client) ExportHistory(w io.Writer, q client.HistoryQuery, format client.ExportFormat) error {
+	msgs, err := c.History(q)
+	if err != nil {
+		return err
+	}
+	return client.Export(w, c.id, msgs, format)
+}
+
+// ImportHistory stores the messages exported by ExportHistory in
+// client.ExportJSON, skipping the ones already stored, and returns how many
+// have been added.
+func (c *Client) ImportHistory(r io.Reader) (int, error) {
+	if c.storage == nil {
+		return 0, errors.New("no storage")
+	}
+	msgs, err := client.Import(r)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range msgs {
+		m := &msgs[i]
+		stored, err := c.storage.Message(m.Peer, m.Message.ID)
+		if err != nil {
+			return n, err
+		}
+		if stored != nil {
+			continue
+		}
+		err = c.storage.AddMessage(*m)
+		if err != nil {
+			return n, err
+		}
+		c.index.Add(m)
+		n++
+	}
+	return n, nil
+}
+
+func (c *Client) saveRoster(entries []client.RosterEntry) {
+	if c.storage == nil {
+		return
+	}
+	err := c.storage.SaveRoster(entries)
+	if err != nil {
+		c.Logger.Error("storage: %v", err)
+	}
+}
+
+func (c *Client) saveProfile(id utils.NodeID, p client.UserProfile) {
+	if c.storage == nil {
+		return
+	}
+	err := c.storage.SaveProfile(id, p)
+	if err != nil {
+		c.Logger.Error("storage: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package murcott
+
+import (
+	"errors"
+	"time"
+
+	"github.com/h2so5/murcott/client"
+	"github.com/h2so5/murcott/utils"
+)
+
+type subscriptionHandler func(id utils.NodeID, state client.Subscription, message string)
+
+// HandleSubscriptions registers the given function to be called when a
+// contact changes its subscription: SubscriptionRequested with the message
+// of a request, SubscriptionBoth when a request has been approved, and
+// SubscriptionNone when it has been denied or cancelled.
+func (c *Client) HandleSubscriptions(handler func(id utils.NodeID, state client.Subscription, message string)) {
+	c.subHandler = handler
+}
+
+// Subscribe asks dst to share presence with the client, adding it to the
+// roster. If dst has already asked, its request is approved.
+func (c *Client) Subscribe(dst utils.NodeID, message string) error {
+	if c.subRequests.Has(dst) {
+		return c.ApproveSubscription(dst)
+	}
+	c.Roster.Add(dst)
+	e, _ := c.Roster.Entry(dst)
+	if e.Subscription == client.SubscriptionBoth {
+		return nil
+	}
+	c.Roster.SetSubscription(dst, client.SubscriptionPending)
+	return c.node.Send(dst, client.SubscriptionRequest{Message: message}, nil)
+}
+
+// SubscriptionRequests returns the subscription requests waiting for an
+// answer, oldest first. They are kept in memory until they are answered.
+func (c *Client) SubscriptionRequests() []client.PendingSubscription {
+	return c.subRequests.Requests()
+}
+
+// ApproveSubscription approves the request of src, adds it to the roster and
+// starts sharing presence.
+func (c *Client) ApproveSubscription(src utils.NodeID) error {
+	if !c.subRequests.Remove(src) {
+		return errors.New("no subscription request from " + src.String())
+	}
+	c.Roster.Add(src)
+	c.Roster.SetSubscription(src, client.SubscriptionBoth)
+	err := c.node.Send(src, client.SubscriptionResponse{Approved: true}, nil)
+	if err != nil {
+		return err
+	}
+	return c.node.Send(src, client.UserPresence{Status: c.status, Ack: false}, nil)
+}
+
+// DenySubscription denies the request of src.
+func (c *Client) DenySubscription(src utils.NodeID) error {
+	if !c.subRequests.Remove(src) {
+		return errors.New("no subscription request from " + src.String())
+	}
+	return c.node.Send(src, client.SubscriptionResponse{Approved: false}, nil)
+}
+
+// Unsubscribe stops sharing presence with dst. It stays in the roster.
+func (c *Client) Unsubscribe(dst utils.NodeID) error {
+	e, ok := c.Roster.Entry(dst)
+	if !ok || e.Subscription == client.SubscriptionNone {
+		return nil
+	}
+	c.Roster.SetSubscription(dst, client.SubscriptionNone)
+	return c.node.Send(dst, client.SubscriptionResponse{Approved: false}, nil)
+}
+
+// isSubscribed reports whether src shares presence with the client.
+func (c *Client) isSubscribed(src utils.NodeID) bool {
+	e, ok := c.Roster.Entry(src)
+	return ok && e.Subscription == client.SubscriptionBoth
+}
+
+func (c *Client) receiveSubscriptionRequest(src utils.NodeID, r client.SubscriptionRequest) {
+	e, ok := c.Roster.Entry(src)
+	switch {
+	case ok && e.Subscription == client.SubscriptionBoth:
+		// The contact has lost its roster.
+		c.node.Send(src, client.SubscriptionResponse{Approved: true}, nil)
+		return
+	case ok && e.Subscription == client.SubscriptionPending:
+		// Both have asked.
+		c.Roster.SetSubscription(src, client.SubscriptionBoth)
+		c.node.Send(src, client.SubscriptionResponse{Approved: true}, nil)
+		c.subscriptionChanged(src, client.SubscriptionBoth, "")
+		return
+	}
+	// Requests are held like messages: strangers are refused by
+	// PolicyContactsOnly, and nothing is stored until approval.
+	if !c.isAllowed(src) && (c.policy != client.PolicyQuarantine || c.node.IsBlocked(src)) {
+		return
+	}
+	c.subRequests.Add(client.PendingSubscription{ID: src, Message: r.Message, Time: time.Now()})
+	c.subscriptionChanged(src, client.SubscriptionRequested, r.Message)
+}
+
+func (c *Client) receiveSubscriptionResponse(src utils.NodeID, r client.SubscriptionResponse) {
+	if !r.Approved && c.subRequests.Remove(src) {
+		// The request has been cancelled.
+		c.subscriptionChanged(src, client.SubscriptionNone, "")
+	}
+	e, ok := c.Roster.Entry(src)
+	if !ok {
+		return
+	}
+	switch {
+	case r.Approved && e.Subscription == client.SubscriptionPending:
+		c.Roster.SetSubscription(src, client.SubscriptionBoth)
+		c.subscriptionChanged(src, client.SubscriptionBoth, "")
+		c.node.Send(src, client.UserPresence{Status: c.status, Ack: false}, nil)
+	case !r.Approved && e.Subscription != client.SubscriptionNone:
+		c.Roster.SetSubscription(src, client.SubscriptionNone)
+		c.subscriptionChanged(src, client.SubscriptionNone, "")
+	}
+}
+
+func (c *Client) subscriptionChanged(id utils.NodeID, state client.Subscription, message string) {
+	if c.subHandler != nil {
+		c.subHandler(id, state, message)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// conversationFile holds the state of the conversations, which contains
+// message keys, encrypted like the identity file.
+type conversationFile struct {
+	path   string
+	cipher *utils.DataCipher
+	mutex  sync.Mutex
+}
+
+// conversationSecret derives the secret of the conversation file from the box
+// key of the identity. It does not change with the passphrase and is also
+// available when the key is held by an agent.
+func conversationSecret(signer utils.Signer) ([]byte, error) {
+	k, ok := signer.(utils.BoxKeyer)
+	if !ok {
+		return nil, errors.New("cannot derive the key of the conversations")
+	}
+	box, err := k.BoxKey()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append([]byte("tangor conversations\n"), box.Bytes()...))
+	return sum[:], nil
+}
+
+// openConversations reads the conversation file and returns its content, or
+// nil if it does not exist. A file written in plain text by an older version
+// is encrypted right away.
+func openConversations(path string, signer utils.Signer) (*conversationFile, []byte, error) {
+	secret, err := conversationSecret(signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	text, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		c, err := utils.NewDataCipher(secret)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &conversationFile{path: path, cipher: c}, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if utils.IsEncryptedData(text) {
+		data, c, err := utils.OpenData(text, secret)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &conversationFile{path: path, cipher: c}, data, nil
+	}
+	c, err := utils.NewDataCipher(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := &conversationFile{path: path, cipher: c}
+	err = f.save(text)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, text, nil
+}
+
+// save encrypts the state and replaces the file with it. The state is
+// written to a temporary file first so that a failure never leaves a
+// truncated file behind.
+func (f *conversationFile) save(data []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	text, err := f.cipher.Seal(data)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(f.path, text)
+}
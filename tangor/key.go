@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/h2so5/murcott"
+	"github.com/h2so5/murcott/agent"
+	"github.com/h2so5/murcott/utils"
+	"github.com/wsxiaoys/terminal/color"
+	"golang.org/x/term"
+)
+
+// passphraseEnv is the environment variable that holds the passphrase of the
+// identity file for scripts that run without a terminal.
+const passphraseEnv = "TANGOR_PASSPHRASE"
+
+func readPassphrase(prompt string) ([]byte, error) {
+	if pass, ok := os.LookupEnv(passphraseEnv); ok {
+		return []byte(pass), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("cannot read passphrase: stdin is not a terminal; set " + passphraseEnv)
+	}
+	fmt.Print(prompt)
+	pass, err := term.ReadPassword(fd)
+	fmt.Println()
+	return pass, err
+}
+
+func readNewPassphrase() ([]byte, error) {
+	pass, err := readPassphrase(" -> New passphrase (empty for no passphrase): ")
+	if err != nil {
+		return nil, err
+	}
+	again, err := readPassphrase(" -> Repeat passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pass, again) {
+		return nil, errors.New("passphrases do not match")
+	}
+	if len(pass) == 0 {
+		color.Printf(" -> @{Yk}WARNING:@{|} the private key will be stored unencrypted\n")
+	}
+	return pass, nil
+}
+
+func getKey(keyfile string, typ utils.KeyType) (*utils.PrivateKey, error) {
+	if _, err := os.Stat(keyfile); err != nil {
+		key, err := utils.GenerateKey(typ)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf(" -> Create a new %v private key: %s\n", typ, keyfile)
+		pass, err := readNewPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		err = utils.SavePrivateKey(keyfile, key, pass)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	text, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	if !utils.IsEncryptedKey(text) {
+		color.Printf(" -> @{Yk}WARNING:@{|} %s is not encrypted; run \"tangor passwd\" to set a passphrase\n", keyfile)
+	}
+
+	return utils.LoadPrivateKey(keyfile, func() ([]byte, error) {
+		return readPassphrase(" -> Passphrase for " + keyfile + ": ")
+	})
+}
+
+func changePassphrase(keyfile string, key *utils.PrivateKey) error {
+	pass, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+	err = utils.SavePrivateKey(keyfile, key, pass)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(" -> Passphrase changed: %s\n", keyfile)
+	return nil
+}
+
+func showBackup(key *utils.PrivateKey) error {
+	phrase, err := key.Mnemonic()
+	if err != nil {
+		return err
+	}
+	color.Printf(" -> @{Yk}WARNING:@{|} anyone who knows this phrase can use your identity\n\n")
+	words := strings.Fields(phrase)
+	for i := 0; i < len(words); i += 5 {
+		fmt.Printf("    %s\n", strings.Join(words[i:i+5], " "))
+	}
+	fmt.Println()
+	return nil
+}
+
+func restoreKey(keyfile string) error {
+	if _, err := os.Stat(keyfile); err == nil {
+		return errors.New(keyfile + " already exists; move it away first")
+	}
+	fmt.Print(" -> Backup phrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	key, err := utils.PrivateKeyFromMnemonic(line)
+	if err != nil {
+		return err
+	}
+	pass, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+	err = utils.SavePrivateKey(keyfile, key, pass)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(" -> Restore identity: %s\n", keyfile)
+	color.Printf("Your ID: @{Wk} %s @{|}\n\n", key.NodeID(utils.Namespace{1, 1, 1, 1}).String())
+	return nil
+}
+
+func generateRevocation(file string, key utils.Signer, reason string) error {
+	if _, err := os.Stat(file); err == nil {
+		return errors.New(file + " already exists")
+	}
+	if reason == "" {
+		reason = "unspecified"
+	}
+	r, err := utils.NewRevocation(key, reason)
+	if err != nil {
+		return err
+	}
+	text, err := r.MarshalText()
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file, text, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(" -> Revocation certificate: %s\n", file)
+	color.Printf(" -> @{Yk}WARNING:@{|} anyone who has this file can revoke your identity; keep it safe\n\n")
+	return nil
+}
+
+func publishRevocation(file string) error {
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var r utils.Revocation
+	err = r.UnmarshalText(text)
+	if err != nil {
+		return err
+	}
+	if !r.Verify() {
+		return errors.New("invalid revocation certificate")
+	}
+
+	// Publishing does not need the revoked key, so a temporary identity is used.
+	cli, err := murcott.NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+	if err != nil {
+		return err
+	}
+	s := Session{cli: cli}
+	s.bootstrap()
+	err = cli.PublishRevocation(&r)
+	if err != nil {
+		return err
+	}
+	time.Sleep(time.Second)
+	cli.Close()
+	color.Printf(" -> Revoked @{Wk} %s @{|}\n\n", r.Key.NodeID(utils.Namespace{1, 1, 1, 1}).String())
+	return nil
+}
+
+func upgradeKey(keyfile string, key *utils.PrivateKey) (*utils.PrivateKey, *utils.Succession, error) {
+	if key.Version() == utils.DefaultIDVersion {
+		fmt.Printf(" -> Identity already uses %v\n", key.Version())
+		return key, nil, nil
+	}
+	newkey, err := key.WithVersion(utils.DefaultIDVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	ns := utils.Namespace{1, 1, 1, 1}
+	succession, err := utils.NewSuccession(key, newkey.NodeID(ns))
+	if err != nil {
+		return nil, nil, err
+	}
+	pass, err := readNewPassphrase()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.Rename(keyfile, keyfile+".legacy")
+	if err != nil {
+		return nil, nil, err
+	}
+	err = utils.SavePrivateKey(keyfile, newkey, pass)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Printf(" -> Upgrade identity from %v to %v\n", key.Version(), newkey.Version())
+	fmt.Printf(" -> Old ID: %s (saved as %s)\n", key.NodeID(ns).String(), keyfile+".legacy")
+	fmt.Printf(" -> New ID: %s\n", newkey.NodeID(ns).String())
+	return newkey, succession, nil
+}
+
+func getAgentSigner(sock string) (utils.Signer, error) {
+	c, err := agent.Dial(sock)
+	if err != nil {
+		return nil, err
+	}
+	s, err := c.Signer()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	fmt.Printf(" -> Use the signing agent: %s\n", sock)
+	return s, nil
+}
+
+func runAgent(key *utils.PrivateKey, sock string) error {
+	l, err := agent.Listen(sock)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	fmt.Printf(" -> Signing agent is listening on %s\n", sock)
+	fmt.Printf(" -> Run tangor with %s=%s\n\n", agent.SocketEnv, sock)
+	return agent.NewAgent(key).Serve(l)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -11,11 +12,21 @@ import (
 	"time"
 
 	"github.com/h2so5/murcott"
+	"github.com/h2so5/murcott/agent"
 	"github.com/h2so5/murcott/client"
 	"github.com/h2so5/murcott/utils"
 	"github.com/wsxiaoys/terminal/color"
 )
 
+// inviteLifetime is how long an invitation created by /group invite is valid.
+const inviteLifetime = 24 * time.Hour
+
+// historySize is how many messages are shown when a chat starts.
+const historySize = 10
+
+// searchLimit is how many messages /search shows.
+const searchLimit = 20
+
 func main() {
 	path := os.Getenv("TANGORPATH")
 	if path == "" {
@@ -23,26 +34,141 @@ func main() {
 	}
 
 	keyfile := flag.String("i", path+"/id_dsa", "Identity file")
+	upgrade := flag.Bool("upgrade-id", false, "Upgrade the identity to the latest ID version")
+	keytype := flag.String("t", "ecdsa", "Type of a new identity key (ecdsa, ed25519)")
+	agentsock := flag.String("a", os.Getenv(agent.SocketEnv), "Use the signing agent listening on the socket")
+	noReceipts := flag.Bool("no-read-receipts", false, "Do not tell contacts that their messages have been read")
+	policyName := flag.String("policy", "open", "What to do with messages from strangers (open, contacts, quarantine)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [command]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  agent\tRun a signing agent holding the identity key\n")
+		fmt.Fprintf(os.Stderr, "  passwd\tChange the passphrase of the identity file\n")
+		fmt.Fprintf(os.Stderr, "  backup\tShow a backup phrase of the identity\n")
+		fmt.Fprintf(os.Stderr, "  restore\tRestore the identity from a backup phrase\n")
+		fmt.Fprintf(os.Stderr, "  revoke-cert [reason]\tGenerate a revocation certificate of the identity\n")
+		fmt.Fprintf(os.Stderr, "  revoke [file]\tPublish a revocation certificate\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment:\n")
+		fmt.Fprintf(os.Stderr, "  %s\tPassphrase of the identity file, read instead of the terminal\n", passphraseEnv)
+	}
 	flag.Parse()
 
 	fmt.Println()
 	color.Print("@{Gk} @{Yk}  tangor  @{Gk} @{|}\n")
 	fmt.Println()
 
-	key, err := getKey(*keyfile)
-	if err != nil {
-		color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
-		os.Exit(-1)
+	// Commands that do not need the identity key.
+	switch flag.Arg(0) {
+	case "restore":
+		err := restoreKey(*keyfile)
+		if err != nil {
+			exitWithError(err)
+		}
+		return
+	case "revoke":
+		file := flag.Arg(1)
+		if file == "" {
+			file = *keyfile + ".revoke"
+		}
+		err := publishRevocation(file)
+		if err != nil {
+			exitWithError(err)
+		}
+		return
 	}
 
-	id := utils.NewNodeID([4]byte{1, 1, 1, 1}, key.Digest())
+	// Commands that operate on the identity file never use the agent.
+	usesKeyFile := flag.Arg(0) == "agent" || flag.Arg(0) == "passwd" || flag.Arg(0) == "backup"
+
+	var signer utils.Signer
+	var succession *utils.Succession
+	if *agentsock != "" && !usesKeyFile {
+		s, err := getAgentSigner(*agentsock)
+		if err != nil {
+			exitWithError(err)
+		}
+		signer = s
+	} else {
+		typ, err := utils.ParseKeyType(*keytype)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		key, err := getKey(*keyfile, typ)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		if *upgrade {
+			key, succession, err = upgradeKey(*keyfile, key)
+			if err != nil {
+				exitWithError(err)
+			}
+		}
+		signer = key
+	}
+
+	id := signer.Public().NodeID([4]byte{1, 1, 1, 1})
 	color.Printf("Your ID: @{Wk} %s @{|}\n\n", id.String())
 
-	client, err := murcott.NewClient(key, utils.DefaultConfig)
+	switch flag.Arg(0) {
+	case "":
+	case "agent":
+		sock := *agentsock
+		if sock == "" {
+			sock = path + "/agent.sock"
+		}
+		err := runAgent(signer.(*utils.PrivateKey), sock)
+		if err != nil {
+			exitWithError(err)
+		}
+		return
+	case "passwd":
+		err := changePassphrase(*keyfile, signer.(*utils.PrivateKey))
+		if err != nil {
+			exitWithError(err)
+		}
+		return
+	case "backup":
+		err := showBackup(signer.(*utils.PrivateKey))
+		if err != nil {
+			exitWithError(err)
+		}
+		return
+	case "revoke-cert":
+		err := generateRevocation(*keyfile+".revoke", signer, strings.Join(flag.Args()[1:], " "))
+		if err != nil {
+			exitWithError(err)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	policy, err := client.ParseMessagePolicy(*policyName)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	// The storage is closed after the client, which saves the roster on Close.
+	storage, err := client.NewFileStorage(path + "/storage.dat")
+	if err != nil {
+		exitWithError(err)
+	}
+	defer storage.Close()
+
+	client, err := murcott.NewClient(signer, utils.DefaultConfig)
 	if err != nil {
 		panic(err)
 	}
 	defer client.Close()
+	err = client.SetStorage(storage)
+	if err != nil {
+		exitWithError(err)
+	}
 
 	// Load cache
 	data, err := ioutil.ReadFile(path + "/cache.dat")
@@ -50,6 +176,28 @@ func main() {
 		client.UnmarshalCache(data)
 	}
 
+	// Load conversations; message keys must never be reused, so the state
+	// is saved whenever it changes.
+	convs, data, err := openConversations(path+"/conversations.dat", signer)
+	if err != nil {
+		exitWithError(err)
+	}
+	if data != nil {
+		err = client.UnmarshalConversations(data)
+		if err != nil {
+			color.Printf(" -> @{Yk}WARNING:@{|} cannot load conversations: %v\n", err)
+		}
+	}
+	client.HandleConversationChanges(func(data []byte) {
+		err := convs.save(data)
+		if err != nil {
+			color.Printf(" -> @{Rk}ERROR:@{|} cannot save conversations: %v\n", err)
+		}
+	})
+
+	client.SetReadReceipts(!*noReceipts)
+	client.SetMessagePolicy(policy)
+
 	exit := make(chan int)
 	go func() {
 		for {
@@ -67,38 +215,22 @@ func main() {
 
 	s := Session{cli: client}
 	s.bootstrap()
-	s.commandLoop()
-	close(exit)
-}
-
-func getKey(keyfile string) (*utils.PrivateKey, error) {
-	_, err := os.Stat(filepath.Dir(keyfile))
-
-	if _, err := os.Stat(keyfile); err != nil {
-		err := os.MkdirAll(filepath.Dir(keyfile), 0755)
+	if succession != nil {
+		err := client.PublishSuccession(succession)
 		if err != nil {
-			return nil, err
-		}
-		key := utils.GeneratePrivateKey()
-		pem, err := key.MarshalText()
-		err = ioutil.WriteFile(keyfile, pem, 0644)
-		if err != nil {
-			return nil, err
+			color.Printf(" -> @{Yk}WARNING:@{|} cannot publish key succession: %v\n", err)
+		} else {
+			fmt.Println(" -> Published key succession to the network")
 		}
-		fmt.Printf(" -> Create a new private key: %s\n", keyfile)
-	}
-
-	pem, err := ioutil.ReadFile(keyfile)
-	if err != nil {
-		return nil, err
 	}
+	client.UpdateRoster()
+	s.commandLoop()
+	close(exit)
+}
 
-	var key utils.PrivateKey
-	err = key.UnmarshalText(pem)
-	if err != nil {
-		return nil, err
-	}
-	return &key, nil
+func exitWithError(err error) {
+	color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+	os.Exit(-1)
 }
 
 type Session struct {
@@ -128,20 +260,100 @@ func (s *Session) bootstrap() {
 
 func (s *Session) commandLoop() {
 	var chatID *utils.NodeID
+	var groupID *utils.NodeID
 
 	s.cli.HandleMessages(func(src utils.NodeID, msg client.ChatMessage) {
-		if chatID == nil {
+		if chatID == nil && groupID == nil {
 			chatID = &src
 			color.Printf("\n -> Start a chat with @{Wk} %s @{|}\n\n", src.String())
 		}
-		color.Printf("\r* @{Wk}%s@{|} %s\n", src.String()[:6], msg.Text())
+		color.Printf("\r* @{Wk}%s@{|} %s\n", s.name(src), msg.Text())
 		fmt.Print("* ")
+		// The message has been shown.
+		go s.cli.MarkRead(src, msg.ID)
+	})
+
+	s.cli.HandleTyping(func(src utils.NodeID, state client.TypingState) {
+		if state == client.Composing && chatID != nil && chatID.Digest.Cmp(src.Digest) == 0 {
+			color.Printf("\r -> %s is typing…\n", src.String()[:6])
+			fmt.Print("* ")
+		}
+	})
+
+	s.cli.HandleMessageStatuses(func(id string, dst utils.NodeID, status client.MessageStatus) {
+		if status == client.MessageRead {
+			color.Printf("\r -> Read by %s\n", dst.String()[:6])
+			fmt.Print("* ")
+		}
+	})
+
+	s.cli.HandleSuccessions(func(old utils.NodeID, next utils.NodeID) {
+		if chatID != nil && chatID.Digest == old.Digest {
+			chatID = &next
+		}
+		color.Printf("\r -> @{Wk} %s @{|} moved to @{Wk} %s @{|}\n", old.String(), next.String())
+	})
+
+	s.cli.HandleKeyChanges(func(prev utils.NodeID, id utils.NodeID, verified bool) {
+		if verified {
+			color.Printf("\r -> @{Rk}WARNING:@{|} the verified key of @{Wk} %s @{|} has changed\n", prev.String())
+		} else {
+			color.Printf("\r -> @{Yk}WARNING:@{|} the key of @{Wk} %s @{|} has changed\n", prev.String())
+		}
+		color.Printf(" -> Compare the safety number again with @{Kg}/fingerprint %s@{|}\n", id.String())
+	})
+
+	s.cli.HandleRevocations(func(id utils.NodeID, reason string) {
+		if chatID != nil && chatID.Digest == id.Digest {
+			chatID = nil
+		}
+		color.Printf("\r -> @{Yk}WARNING:@{|} @{Wk} %s @{|} has been revoked: %s\n", id.String(), reason)
+	})
+
+	s.cli.HandleOrderedGroupMessages(func(group utils.NodeID, src utils.NodeID, msg client.ChatMessage, order client.CausalOrder) {
+		name := group.String()[:6]
+		if g, ok := s.cli.Group(group); ok && g.Name != "" {
+			name = g.Name
+		}
+		// Messages are shown in causal order; show the claimed time of the
+		// ones that were delayed.
+		at := ""
+		if d := time.Since(msg.Time); d > time.Minute || d < -time.Minute {
+			at = msg.Time.Local().Format(" (15:04:05)")
+		}
+		color.Printf("\r# @{Kg}%s@{|} @{Wk}%s@{|}%s %s\n", name, src.String()[:6], at, msg.Text())
+		fmt.Print("* ")
+	})
+
+	s.cli.HandleMessageRequests(func(src utils.NodeID, msg client.ChatMessage) {
+		color.Printf("\r -> Message request from @{Wk} %s @{|}: %s\n", src.String(), msg.Text())
+		color.Printf(" -> Run @{Kg}/accept %s@{|}, @{Kg}/discard %s@{|} or @{Kg}/block %s@{|}\n", src.String(), src.String(), src.String())
+		fmt.Print("* ")
+	})
+
+	s.cli.HandleSubscriptions(func(id utils.NodeID, state client.Subscription, message string) {
+		switch state {
+		case client.SubscriptionRequested:
+			color.Printf("\r -> @{Wk} %s @{|} asks to share presence: %s\n", id.String(), message)
+			color.Printf(" -> Run @{Kg}/approve %s@{|} or @{Kg}/deny %s@{|}\n", id.String(), id.String())
+		case client.SubscriptionBoth:
+			color.Printf("\r -> @{Wk} %s @{|} shares presence with you\n", s.name(id))
+		case client.SubscriptionNone:
+			color.Printf("\r -> @{Wk} %s @{|} does not share presence with you\n", s.name(id))
+		}
+		fmt.Print("* ")
+	})
+
+	s.cli.HandleGroupUpdates(func(g client.Group) {
+		color.Printf("\r -> Group @{Wk} %s @{|} %s (%d members)\n", g.Name, g.Topic, len(g.Members))
 	})
 
 	bio := bufio.NewReader(os.Stdin)
 	for {
-		if chatID == nil {
+		if chatID == nil && groupID == nil {
 			fmt.Print("> ")
+		} else if groupID != nil {
+			fmt.Print("# ")
 		} else {
 			fmt.Print("* ")
 		}
@@ -162,36 +374,489 @@ func (s *Session) commandLoop() {
 				if err != nil {
 					color.Printf(" -> @{Rk}ERROR:@{|} invalid ID\n")
 				} else {
+					// Contacts can answer under any policy.
+					s.cli.Roster.Add(nid)
 					chatID = &nid
+					groupID = nil
 					color.Printf(" -> Start a chat with @{Wk} %s @{|}\n\n", nid.String())
+					s.showHistory(nid)
+				}
+			}
+		case "/contacts":
+			for _, e := range s.cli.Roster.Entries() {
+				color.Printf("  @{Wk}%s@{|} %s", e.ID.String(), e.Petname)
+				if len(e.Groups) > 0 {
+					fmt.Printf(" [%s]", strings.Join(e.Groups, ", "))
+				}
+				if e.Verified {
+					color.Printf(" @{Gk}verified@{|}")
 				}
+				if e.Blocked {
+					color.Printf(" @{Rk}blocked@{|}")
+				}
+				fmt.Printf(" (%v)\n", e.Subscription)
+			}
+		case "/subscribe":
+			id, err := targetID(c, chatID)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				continue
+			}
+			message := ""
+			if len(c) > 2 {
+				message = strings.Join(c[2:], " ")
+			}
+			err = s.cli.Subscribe(id, message)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+			} else {
+				color.Printf(" -> Asked @{Wk} %s @{|} to share presence\n", id.String())
+			}
+		case "/approve", "/deny", "/unsubscribe":
+			id, err := targetID(c, chatID)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				continue
+			}
+			switch c[0] {
+			case "/approve":
+				err = s.cli.ApproveSubscription(id)
+			case "/deny":
+				err = s.cli.DenySubscription(id)
+			default:
+				err = s.cli.Unsubscribe(id)
+			}
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+			}
+		case "/requests":
+			for _, m := range s.cli.MessageRequests() {
+				color.Printf("  @{Kg}%s@{|} @{Wk}%s@{|} %s\n", m.Time.Local().Format("01/02 15:04"), m.Peer.String(), m.Message.Text())
+			}
+			for _, r := range s.cli.SubscriptionRequests() {
+				color.Printf("  @{Kg}%s@{|} @{Wk}%s@{|} asks to share presence: %s\n", r.Time.Local().Format("01/02 15:04"), r.ID.String(), r.Message)
+			}
+		case "/accept", "/discard", "/block", "/unblock":
+			id, err := targetID(c, chatID)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				continue
+			}
+			switch c[0] {
+			case "/accept":
+				// The held messages are shown by the message handler.
+				err = s.cli.AcceptRequests(id)
+			case "/discard":
+				s.cli.DiscardRequests(id)
+			case "/block":
+				err = s.cli.Block(id)
+				if err == nil && chatID != nil && chatID.Digest.Cmp(id.Digest) == 0 {
+					chatID = nil
+				}
+			default:
+				err = s.cli.Unblock(id)
+			}
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+			}
+		case "/petname":
+			if len(c) < 2 {
+				color.Printf(" -> @{Rk}ERROR:@{|} /petname takes 1 or 2 arguments\n")
+				continue
+			}
+			id, err := utils.NewNodeIDFromString(c[1])
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} invalid ID\n")
+				continue
+			}
+			s.cli.Roster.Add(id)
+			s.cli.Roster.SetPetname(id, strings.Join(c[2:], " "))
+		case "/fingerprint":
+			id, err := targetID(c, chatID)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				continue
+			}
+			number, err := s.cli.SafetyNumber(id)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				continue
+			}
+			g := strings.Fields(number)
+			color.Printf(" -> Safety number with @{Wk} %s @{|}\n\n", id.String())
+			fmt.Printf("    %s\n    %s\n\n", strings.Join(g[:6], " "), strings.Join(g[6:], " "))
+			if e, ok := s.cli.Roster.Entry(id); ok && e.Verified {
+				color.Printf(" -> @{Gk}verified@{|}\n")
+			} else {
+				color.Printf(" -> Compare it with your contact and run @{Kg}/verify@{|} if it matches\n")
+			}
+		case "/verify":
+			id, err := targetID(c, chatID)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				continue
+			}
+			s.cli.Roster.Add(id)
+			err = s.cli.VerifyContact(id)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+			} else {
+				color.Printf(" -> @{Wk} %s @{|} is @{Gk}verified@{|}\n", id.String())
+			}
+		case "/secure":
+			id, err := targetID(c, chatID)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				continue
+			}
+			if s.cli.HasConversation(id) {
+				color.Printf(" -> Chat with @{Wk} %s @{|} is already forward-secret\n", id.String())
+				continue
+			}
+			err = s.cli.StartConversation(id)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+			} else {
+				color.Printf(" -> Started a forward-secret chat with @{Wk} %s @{|}\n", id.String())
+			}
+		case "/group":
+			if len(c) < 2 {
+				color.Printf(" -> @{Rk}ERROR:@{|} /group takes a subcommand\n")
+				continue
+			}
+			arg := strings.Join(c[2:], " ")
+			switch c[1] {
+			case "create":
+				g, err := s.cli.CreateGroup(arg, "")
+				if err != nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+					continue
+				}
+				groupID, chatID = &g.ID, nil
+				color.Printf(" -> Created a group @{Wk} %s @{|}\n", g.ID.String())
+				color.Printf(" -> Invite others with @{Kg}/group invite@{|}\n\n")
+			case "invite":
+				if groupID == nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} not in a group chat\n")
+					continue
+				}
+				invite, err := s.cli.CreateInvite(*groupID, inviteLifetime)
+				if err != nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+					continue
+				}
+				color.Printf(" -> Others can join the group for %v with\n", inviteLifetime)
+				color.Printf("    @{Kg}/group join %s@{|}\n\n", invite.String())
+			case "join":
+				invite, err := client.GroupInviteFromString(arg)
+				if err != nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} invalid invitation\n")
+					continue
+				}
+				err = s.cli.JoinGroup(invite)
+				if err != nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+					continue
+				}
+				id := invite.Group
+				groupID, chatID = &id, nil
+				color.Printf(" -> Joined the group @{Wk} %s @{|}\n\n", id.String())
+			case "kick", "ban", "unban", "role":
+				if groupID == nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} not in a group chat\n")
+					continue
+				}
+				if len(c) < 3 || (c[1] == "role") != (len(c) == 4) {
+					color.Printf(" -> @{Rk}ERROR:@{|} wrong number of arguments\n")
+					continue
+				}
+				id, err := utils.NewNodeIDFromString(c[2])
+				if err != nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} invalid ID\n")
+					continue
+				}
+				switch c[1] {
+				case "kick":
+					err = s.cli.Kick(*groupID, id)
+				case "ban":
+					err = s.cli.Ban(*groupID, id)
+				case "unban":
+					err = s.cli.Unban(*groupID, id)
+				case "role":
+					var role client.Role
+					role, err = client.ParseRole(c[3])
+					if err == nil {
+						err = s.cli.SetRole(*groupID, id, role)
+					}
+				}
+				if err != nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				}
+			case "leave":
+				if groupID == nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} not in a group chat\n")
+					continue
+				}
+				err := s.cli.LeaveGroup(*groupID)
+				if err != nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				} else {
+					color.Printf(" -> Left the group\n")
+				}
+				groupID = nil
+			case "topic":
+				if groupID == nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} not in a group chat\n")
+					continue
+				}
+				g, _ := s.cli.Group(*groupID)
+				err := s.cli.SetGroupInfo(g.ID, g.Name, arg)
+				if err != nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				}
+			case "info":
+				if groupID == nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} not in a group chat\n")
+					continue
+				}
+				g, _ := s.cli.Group(*groupID)
+				color.Printf(" -> @{Wk} %s @{|} %s\n", g.Name, g.ID.String())
+				if g.Topic != "" {
+					color.Printf("    %s\n", g.Topic)
+				}
+				for _, m := range g.Members {
+					fmt.Printf("    %s (%v)\n", m.String(), g.Role(m))
+				}
+				for _, m := range g.Banned {
+					fmt.Printf("    %s (banned)\n", m.String())
+				}
+			default:
+				color.Printf(" -> @{Rk}ERROR:@{|} unknown subcommand\n")
+			}
+		case "/search":
+			q, err := parseSearch(c[1:])
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				continue
+			}
+			results, err := s.cli.Search(q)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				continue
+			}
+			color.Printf(" -> %d messages found\n\n", len(results))
+			for _, r := range results {
+				from := r.Message.Peer.String()[:6]
+				if r.Message.Outgoing {
+					from = "you -> " + from
+				}
+				color.Printf("  @{Kg}%s@{|} @{Wk}%s@{|} %s\n", r.Message.Time.Local().Format("2006/01/02 15:04"), from, r.Snippet)
+			}
+			if len(results) > 0 {
+				fmt.Println()
+			}
+		case "/export":
+			if len(c) < 2 || len(c) > 3 {
+				color.Printf(" -> @{Rk}ERROR:@{|} /export takes 1 or 2 arguments\n")
+				continue
+			}
+			var q client.HistoryQuery
+			if len(c) == 3 {
+				id, err := utils.NewNodeIDFromString(c[2])
+				if err != nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} invalid ID\n")
+					continue
+				}
+				q.Peer = &id
 			}
+			err := s.exportHistory(c[1], q)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				continue
+			}
+			color.Printf(" -> Exported the history to %s\n", c[1])
+		case "/import":
+			if len(c) != 2 {
+				color.Printf(" -> @{Rk}ERROR:@{|} /import takes 1 argument\n")
+				continue
+			}
+			f, err := os.Open(c[1])
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				continue
+			}
+			n, err := s.cli.ImportHistory(f)
+			f.Close()
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+			}
+			color.Printf(" -> Imported %d messages\n", n)
 		case "/end":
 			if chatID != nil {
 				color.Printf(" -> End current chat\n")
 				chatID = nil
 			}
+			if groupID != nil {
+				color.Printf(" -> End current group chat\n")
+				groupID = nil
+			}
 		case "/exit", "/quit":
 			color.Printf(" -> See you@{Kg}.@{Kr}.@{Ky}.@{|}\n")
 			return
 		case "/help":
 			showHelp()
 		default:
-			if chatID == nil {
+			if groupID != nil {
+				err := s.cli.SendGroupMessage(*groupID, client.NewPlainChatMessage(string(line)))
+				if err != nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+				}
+			} else if chatID == nil {
 				color.Printf(" -> @{Rk}ERROR:@{|} unknown command\n")
 				showHelp()
 			} else {
-				s.cli.SendMessage(*chatID, client.NewPlainChatMessage(string(line)))
+				dst := *chatID
+				s.cli.DeliverMessage(dst, client.NewPlainChatMessage(string(line)), func(r client.DeliveryResult) {
+					switch r {
+					case client.Delivered:
+					case client.Stored:
+						color.Printf("\r -> %s is offline; message stored for later delivery\n", dst.String()[:6])
+					default:
+						color.Printf("\r -> @{Rk}ERROR:@{|} message to %s %v\n", dst.String()[:6], r)
+					}
+				})
 			}
 		}
 	}
 }
 
+// name returns the petname of the contact, or the beginning of its ID.
+func (s *Session) name(id utils.NodeID) string {
+	if e, ok := s.cli.Roster.Entry(id); ok && e.Petname != "" {
+		return e.Petname
+	}
+	return id.String()[:6]
+}
+
+// showHistory shows the last messages with the contact.
+func (s *Session) showHistory(id utils.NodeID) {
+	msgs, err := s.cli.History(client.HistoryQuery{Peer: &id, Limit: historySize})
+	if err != nil {
+		color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+		return
+	}
+	for _, m := range msgs {
+		from := s.name(id)
+		if m.Outgoing {
+			from = "you"
+		}
+		color.Printf("  @{Kg}%s@{|} @{Wk}%s@{|} %s\n", m.Time.Local().Format("01/02 15:04"), from, m.Message.Text())
+	}
+	if len(msgs) > 0 {
+		fmt.Println()
+	}
+}
+
+// exportHistory exports the history to the file. Files named *.html and
+// *.txt get a transcript; others get JSON lines, which can be imported.
+func (s *Session) exportHistory(path string, q client.HistoryQuery) error {
+	format := client.ExportJSON
+	switch filepath.Ext(path) {
+	case ".html", ".htm":
+		format = client.ExportHTML
+	case ".txt":
+		format = client.ExportText
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = s.cli.ExportHistory(f, q, format)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// parseSearch parses the arguments of /search. Words prefixed with with:,
+// since: and until: set the contact and the dates; the others are searched.
+func parseSearch(args []string) (client.SearchQuery, error) {
+	q := client.SearchQuery{Limit: searchLimit}
+	var words []string
+	for _, a := range args {
+		var err error
+		switch {
+		case strings.HasPrefix(a, "with:"):
+			var id utils.NodeID
+			id, err = utils.NewNodeIDFromString(strings.TrimPrefix(a, "with:"))
+			q.Peer = &id
+		case strings.HasPrefix(a, "since:"):
+			q.Since, err = time.ParseInLocation("2006-01-02", strings.TrimPrefix(a, "since:"), time.Local)
+		case strings.HasPrefix(a, "until:"):
+			// The day is included.
+			q.Until, err = time.ParseInLocation("2006-01-02", strings.TrimPrefix(a, "until:"), time.Local)
+			q.Until = q.Until.AddDate(0, 0, 1)
+		default:
+			words = append(words, a)
+		}
+		if err != nil {
+			return q, errors.New("invalid argument: " + a)
+		}
+	}
+	q.Text = strings.Join(words, " ")
+	if strings.TrimSpace(q.Text) == "" {
+		return q, errors.New("/search takes words to search")
+	}
+	return q, nil
+}
+
+// targetID returns the ID given as the argument of the command, or the current chat.
+func targetID(c []string, chatID *utils.NodeID) (utils.NodeID, error) {
+	if len(c) >= 2 {
+		id, err := utils.NewNodeIDFromString(c[1])
+		if err != nil {
+			return utils.NodeID{}, errors.New("invalid ID")
+		}
+		return id, nil
+	}
+	if chatID == nil {
+		return utils.NodeID{}, errors.New(c[0] + " takes 1 argument")
+	}
+	return *chatID, nil
+}
+
 func showHelp() {
 	fmt.Println()
 	color.Printf("  * HELP *\n")
 	color.Printf("  @{Kg}/chat [ID]@{|}\tStart a chat with [ID]\n")
 	color.Printf("  @{Kg}/end      @{|}\tEnd current chat\n")
+	color.Printf("  @{Kg}/group create [NAME]@{|}\tCreate a group chat\n")
+	color.Printf("  @{Kg}/group invite@{|}\tInvite others to current group chat\n")
+	color.Printf("  @{Kg}/group join [INVITE]@{|}\tJoin a group chat with [INVITE]\n")
+	color.Printf("  @{Kg}/group kick [ID]@{|}\tRemove [ID] from current group chat\n")
+	color.Printf("  @{Kg}/group ban [ID]@{|}\tRemove [ID] and refuse it from joining again\n")
+	color.Printf("  @{Kg}/group unban [ID]@{|}\tLift the ban of [ID]\n")
+	color.Printf("  @{Kg}/group role [ID] [ROLE]@{|}\tSet the role of [ID] to member, admin or owner\n")
+	color.Printf("  @{Kg}/group leave@{|}\tLeave current group chat\n")
+	color.Printf("  @{Kg}/group topic [TOPIC]@{|}\tSet the topic of current group chat\n")
+	color.Printf("  @{Kg}/group info@{|}\tShow current group chat\n")
+	color.Printf("  @{Kg}/search [WORDS]@{|}\tSearch the history; with:[ID], since:[DATE] and until:[DATE] narrow it\n")
+	color.Printf("  @{Kg}/export [FILE] [ID]@{|}\tExport the history with [ID] or everyone to [FILE] (.jsonl, .txt or .html)\n")
+	color.Printf("  @{Kg}/import [FILE]@{|}\tImport the history exported to a .jsonl [FILE]\n")
+	color.Printf("  @{Kg}/contacts @{|}\tShow the contacts\n")
+	color.Printf("  @{Kg}/subscribe [ID] [MESSAGE]@{|}\tAsk [ID] to share presence\n")
+	color.Printf("  @{Kg}/approve [ID]@{|}\tShare presence with [ID]\n")
+	color.Printf("  @{Kg}/deny [ID]@{|}\tRefuse to share presence with [ID]\n")
+	color.Printf("  @{Kg}/unsubscribe [ID]@{|}\tStop sharing presence with [ID]\n")
+	color.Printf("  @{Kg}/petname [ID] [NAME]@{|}\tName [ID]\n")
+	color.Printf("  @{Kg}/requests @{|}\tShow the messages from strangers and the subscription requests\n")
+	color.Printf("  @{Kg}/accept [ID]@{|}\tAccept the messages from [ID]\n")
+	color.Printf("  @{Kg}/discard [ID]@{|}\tDiscard the messages from [ID]\n")
+	color.Printf("  @{Kg}/block [ID]@{|}\tRefuse to talk to [ID]\n")
+	color.Printf("  @{Kg}/unblock [ID]@{|}\tLift the block of [ID]\n")
+	color.Printf("  @{Kg}/fingerprint [ID]@{|}\tShow the safety number with [ID]\n")
+	color.Printf("  @{Kg}/verify [ID]@{|}\tMark [ID] as verified\n")
+	color.Printf("  @{Kg}/secure [ID]@{|}\tStart a forward-secret chat with [ID]\n")
 	color.Printf("  @{Kg}/help     @{|}\tShow this message\n")
 	color.Printf("  @{Kg}/exit     @{|}\tExit this program\n")
 	fmt.Println()
@@ -0,0 +1,57 @@
+package murcott
+
+import (
+	"time"
+
+	"github.com/h2so5/murcott/client"
+	"github.com/h2so5/murcott/utils"
+)
+
+type typingHandler func(src utils.NodeID, state client.TypingState)
+
+// HandleTyping registers the given function as a handler of typing
+// notifications. Composing is passed when a contact starts typing, and
+// Paused when it stops, sends the message, or has not been heard from
+// for client.TypingTimeout.
+func (c *Client) HandleTyping(handler func(src utils.NodeID, state client.TypingState)) {
+	c.typingHandler = handler
+}
+
+// SetTyping tells dst whether the user is composing a message. It may be
+// called on every keystroke; notifications are coalesced.
+func (c *Client) SetTyping(dst utils.NodeID, state client.TypingState) error {
+	if !c.typing.Update(dst.Digest.String(), state, time.Now()) {
+		return nil
+	}
+	return c.node.Send(dst, client.TypingNotification{State: state}, nil)
+}
+
+func (c *Client) receiveTyping(src utils.NodeID, state client.TypingState) {
+	key := src.Digest.String()
+	c.typingMutex.Lock()
+	t, composing := c.typingTimers[key]
+	if composing {
+		t.Stop()
+		delete(c.typingTimers, key)
+	}
+	if state == client.Composing {
+		var timer *time.Timer
+		timer = time.AfterFunc(client.TypingTimeout, func() {
+			c.typingMutex.Lock()
+			expired := c.typingTimers[key] == timer
+			if expired {
+				delete(c.typingTimers, key)
+			}
+			c.typingMutex.Unlock()
+			if expired && c.typingHandler != nil {
+				c.typingHandler(src, client.Paused)
+			}
+		})
+		c.typingTimers[key] = timer
+	}
+	c.typingMutex.Unlock()
+
+	if composing != (state == client.Composing) && c.typingHandler != nil {
+		c.typingHandler(src, state)
+	}
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/crypto/hkdf"
+)
+
+// A box is data encrypted to an X25519 box key. It is sealed with an
+// ephemeral key, so only the holder of the box key can open it:
+//
+//	ephemeral public key (32 bytes) || AES-256-GCM ciphertext
+//
+// The AES key is derived with HKDF-SHA256 from the X25519 shared secret.
+const boxKeySize = 32
+
+// GenerateBoxKey generates a random X25519 box key.
+func GenerateBoxKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// material returns the 32-byte secret of the key.
+func (p *PrivateKey) material() ([]byte, error) {
+	switch p.typ {
+	case KeyTypeEd25519:
+		return p.ed.Seed(), nil
+	case KeyTypeECDSA:
+		d := p.d.Bytes()
+		if len(d) > 32 {
+			return nil, errors.New("invalid private key")
+		}
+		return append(make([]byte, 32-len(d)), d...), nil
+	}
+	return nil, errors.New("unknown key type")
+}
+
+// BoxKey derives the box key of the identity from the private key,
+// so that it does not have to be stored separately.
+func (p *PrivateKey) BoxKey() (*ecdh.PrivateKey, error) {
+	m, err := p.material()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, boxKeySize)
+	_, err = io.ReadFull(hkdf.New(sha256.New, m, nil, []byte("murcott box key")), b)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(b)
+}
+
+func boxCipher(shared, epub, pub []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, epub...), pub...)
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("murcott box")), key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealBox encrypts data to the box key.
+func SealBox(pub *ecdh.PublicKey, data []byte) ([]byte, error) {
+	eph, err := GenerateBoxKey()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	epub := eph.PublicKey().Bytes()
+	aead, err := boxCipher(shared, epub, pub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	// The AES key is used only once, so a zero nonce is safe.
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(epub, nonce, data, nil), nil
+}
+
+// OpenBox decrypts a box sealed with SealBox.
+func OpenBox(key *ecdh.PrivateKey, box []byte) ([]byte, error) {
+	if len(box) < boxKeySize {
+		return nil, errors.New("box too short")
+	}
+	epub, err := ecdh.X25519().NewPublicKey(box[:boxKeySize])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := key.ECDH(epub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := boxCipher(shared, box[:boxKeySize], key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Open(nil, nonce, box[boxKeySize:], nil)
+}
+
+// BoxKeyRecord publishes the box key of an identity.
+// It is signed by the identity key, so anyone who knows the NodeID can
+// check that the box key belongs to it.
+type BoxKeyRecord struct {
+	Key  PublicKey `msgpack:"key"`
+	Box  []byte    `msgpack:"box"`
+	Time time.Time `msgpack:"time"`
+	S    Signature `msgpack:"sign"`
+}
+
+// NewBoxKeyRecord generates a BoxKeyRecord of box signed by key.
+func NewBoxKeyRecord(key Signer, box *ecdh.PublicKey) (*BoxKeyRecord, error) {
+	r := &BoxKeyRecord{
+		Key:  *key.Public(),
+		Box:  box.Bytes(),
+		Time: time.Now(),
+	}
+	sign := key.Sign(r.serialize())
+	if sign == nil {
+		return nil, errors.New("cannot sign box key")
+	}
+	r.S = *sign
+	return r, nil
+}
+
+func (r *BoxKeyRecord) serialize() []byte {
+	ary := []interface{}{
+		"boxkey",
+		r.Key.NodeID(Namespace{}).Bytes(),
+		r.Box,
+		r.Time.Unix(),
+	}
+
+	data, _ := msgpack.Marshal(ary)
+	return data
+}
+
+// Verify reports whether the record is signed by its identity key.
+func (r *BoxKeyRecord) Verify() bool {
+	if r.Key.IsZero() {
+		return false
+	}
+	return r.Key.Verify(r.serialize(), &r.S)
+}
+
+// BoxKey returns the published box key.
+func (r *BoxKeyRecord) BoxKey() (*ecdh.PublicKey, error) {
+	return ecdh.X25519().NewPublicKey(r.Box)
+}
+
+// BoxKeyRecordKey returns the DHT key under which the box key record
+// of the identity is published.
+func BoxKeyRecordKey(id NodeID) string {
+	return "boxkey:" + id.Digest.String()
+}
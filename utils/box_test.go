@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestBox(t *testing.T) {
+	data := []byte("The quick brown fox jumps over the lazy dog")
+
+	for _, key := range []*PrivateKey{GeneratePrivateKey(), GenerateEd25519PrivateKey()} {
+		box, err := key.BoxKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		box2, _ := key.BoxKey()
+		if !box.Equal(box2) {
+			t.Errorf("BoxKey() should be deterministic")
+		}
+
+		sealed, err := SealBox(box.PublicKey(), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened, err := OpenBox(box, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(opened, data) {
+			t.Errorf("wrong data: %s; expects %s", opened, data)
+		}
+
+		other, _ := GenerateBoxKey()
+		if _, err := OpenBox(other, sealed); err == nil {
+			t.Errorf("box should not be opened with another key")
+		}
+		sealed[len(sealed)-1] ^= 1
+		if _, err := OpenBox(box, sealed); err == nil {
+			t.Errorf("modified box should not be opened")
+		}
+	}
+}
+
+func TestBoxKeyRecord(t *testing.T) {
+	key := GenerateEd25519PrivateKey()
+	box, _ := key.BoxKey()
+
+	r, err := NewBoxKeyRecord(key, box.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r2 BoxKeyRecord
+	err = msgpack.Unmarshal(data, &r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r2.Verify() {
+		t.Errorf("verification failed")
+	}
+	pub, err := r2.BoxKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(box.PublicKey()) {
+		t.Errorf("wrong box key")
+	}
+
+	other, _ := GenerateBoxKey()
+	r2.Box = other.PublicKey().Bytes()
+	if r2.Verify() {
+		t.Errorf("modified record should not be verified")
+	}
+}
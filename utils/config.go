@@ -9,8 +9,25 @@ import (
 type Config struct {
 	P string
 	B []string
+
+	// GroupTTL is how many hops a group packet travels.
+	// Zero means DefaultGroupTTL.
+	GroupTTL uint8
+	// GroupFanout is how many members of the group a node forwards a group
+	// packet to, chosen at random. Zero means all the members it knows.
+	// With the "plumtree" strategy, it is the size of the active view.
+	GroupFanout int
+	// GroupStrategy is the name of the strategy that disseminates group
+	// packets: "flood" or "plumtree". Empty means DefaultGroupStrategy.
+	GroupStrategy string
 }
 
+// DefaultGroupTTL is the number of hops a group packet travels by default.
+const DefaultGroupTTL = 3
+
+// DefaultGroupStrategy floods group packets.
+const DefaultGroupStrategy = "flood"
+
 func (c Config) Ports() []int {
 	var ports []int
 	var begin, end int
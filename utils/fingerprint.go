@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// fingerprintIterations slows down searching for a key with a given fingerprint.
+const fingerprintIterations = 1024
+
+// Fingerprint returns a fingerprint of the key as 30 decimal digits
+// in groups of five.
+func (p *PublicKey) Fingerprint() string {
+	return strings.Join(p.fingerprintGroups(), " ")
+}
+
+func (p *PublicKey) fingerprintGroups() []string {
+	der, err := x509.MarshalPKIXPublicKey(p.cryptoKey())
+	if err != nil {
+		return nil
+	}
+	h := sha512.Sum512(append([]byte("murcott fingerprint\n"), der...))
+	for i := 0; i < fingerprintIterations; i++ {
+		h = sha512.Sum512(append(h[:], der...))
+	}
+	groups := make([]string, 6)
+	for i := range groups {
+		var n uint64
+		for _, b := range h[i*5 : i*5+5] {
+			n = n<<8 | uint64(b)
+		}
+		groups[i] = fmt.Sprintf("%05d", n%100000)
+	}
+	return groups
+}
+
+// Equal reports whether p and q are the same key.
+func (p *PublicKey) Equal(q *PublicKey) bool {
+	return p.version == q.version && p.SameKey(q)
+}
+
+// SameKey reports whether p and q are the same key, possibly with different
+// IDVersions, which give it different digests.
+func (p *PublicKey) SameKey(q *PublicKey) bool {
+	if p.typ != q.typ {
+		return false
+	}
+	if p.typ == KeyTypeEd25519 {
+		return bytes.Equal(p.ed, q.ed)
+	}
+	if p.x == nil || q.x == nil {
+		return p.x == q.x
+	}
+	return p.x.Cmp(q.x) == 0 && p.y.Cmp(q.y) == 0
+}
+
+// SafetyNumber returns a number derived from the keys of two parties,
+// as 60 decimal digits in groups of five.
+// Both parties get the same number, so they can compare it in person or
+// over another channel to make sure that they have each other's keys.
+func SafetyNumber(a, b *PublicKey) string {
+	fa := a.fingerprintGroups()
+	fb := b.fingerprintGroups()
+	if strings.Join(fa, "") > strings.Join(fb, "") {
+		fa, fb = fb, fa
+	}
+	return strings.Join(append(fa, fb...), " ")
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyFingerprint(t *testing.T) {
+	key1 := GeneratePrivateKey()
+	key2 := GenerateEd25519PrivateKey()
+
+	f := key1.Fingerprint()
+	if len(strings.Fields(f)) != 6 || len(strings.Replace(f, " ", "", -1)) != 30 {
+		t.Errorf("wrong fingerprint format: %s", f)
+	}
+	if f != key1.Fingerprint() {
+		t.Errorf("Fingerprint() should be deterministic")
+	}
+	if f == key2.Fingerprint() {
+		t.Errorf("different keys should have different fingerprints")
+	}
+
+	n := SafetyNumber(key1.Public(), key2.Public())
+	if len(strings.Fields(n)) != 12 {
+		t.Errorf("wrong safety number format: %s", n)
+	}
+	if n != SafetyNumber(key2.Public(), key1.Public()) {
+		t.Errorf("SafetyNumber() should not depend on the order of keys")
+	}
+	if n == SafetyNumber(key1.Public(), GeneratePrivateKey().Public()) {
+		t.Errorf("different keys should have different safety numbers")
+	}
+
+	if !key1.Public().Equal(&key1.PublicKey) {
+		t.Errorf("key should be equal to itself")
+	}
+	if key1.Public().Equal(key2.Public()) {
+		t.Errorf("different keys should not be equal")
+	}
+}
@@ -2,12 +2,13 @@ package utils
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/sha1"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"math/big"
 	"reflect"
 
@@ -15,56 +16,170 @@ import (
 	"github.com/vmihailenco/msgpack"
 )
 
-// PublicKey represents an ECDSA public key.
+// KeyType identifies the signature algorithm of an identity key.
+type KeyType uint8
+
+const (
+	// KeyTypeECDSA is an ECDSA key on the P-256 curve.
+	KeyTypeECDSA KeyType = 0
+	// KeyTypeEd25519 is an Ed25519 key.
+	KeyTypeEd25519 KeyType = 1
+)
+
+func (t KeyType) String() string {
+	switch t {
+	case KeyTypeECDSA:
+		return "ecdsa"
+	case KeyTypeEd25519:
+		return "ed25519"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+// ParseKeyType parses the string representation of KeyType.
+func ParseKeyType(str string) (KeyType, error) {
+	for _, t := range []KeyType{KeyTypeECDSA, KeyTypeEd25519} {
+		if t.String() == str {
+			return t, nil
+		}
+	}
+	return 0, errors.New("unknown key type")
+}
+
+// PublicKey represents an ECDSA or Ed25519 public key.
 type PublicKey struct {
-	x, y *big.Int
+	typ     KeyType
+	x, y    *big.Int
+	ed      ed25519.PublicKey
+	version IDVersion
 }
 
-// PrivateKey represents an ECDSA private key.
+// PrivateKey represents an ECDSA or Ed25519 private key.
 type PrivateKey struct {
 	PublicKey
-	d *big.Int
+	d  *big.Int
+	ed ed25519.PrivateKey
 }
 
 type Signature struct {
-	r, s *big.Int
+	r, s    *big.Int
+	ed      []byte
+	version IDVersion
 }
 
+const pemVersionHeader = "ID-Version"
+
 func (p PublicKeyDigest) String() string {
 	var i big.Int
 	i.SetBytes(p[:])
 	return string(base58.EncodeBig(nil, &i))
 }
 
-// Digest returns a SHA-1 digest for the public key.
+// Digest returns a digest for the public key using the hash algorithm of its IDVersion.
+// A zero key, such as one missing from a decoded message, has a digest too.
 func (p *PublicKey) Digest() PublicKeyDigest {
-	return sha1.Sum(append(p.x.Bytes(), p.y.Bytes()...))
+	if p.typ == KeyTypeEd25519 {
+		return p.version.digest(p.ed)
+	}
+	var b []byte
+	for _, n := range []*big.Int{p.x, p.y} {
+		if n != nil {
+			b = append(b, n.Bytes()...)
+		}
+	}
+	return p.version.digest(b)
+}
+
+// Type returns the KeyType of the key.
+func (p *PublicKey) Type() KeyType {
+	return p.typ
+}
+
+// Version returns the IDVersion of the key.
+func (p *PublicKey) Version() IDVersion {
+	return p.version
 }
 
+// NodeID returns the identifier of the key in the given namespace.
+func (p *PublicKey) NodeID(ns Namespace) NodeID {
+	return NodeID{NS: ns, Digest: p.Digest(), Version: p.version}
+}
+
+func (p *PublicKey) cryptoKey() interface{} {
+	if p.typ == KeyTypeEd25519 {
+		return p.ed
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: p.x, Y: p.y}
+}
+
+func (p *PublicKey) setCryptoKey(k interface{}) error {
+	switch k := k.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return errors.New("unsupported curve")
+		}
+		p.typ = KeyTypeECDSA
+		p.x, p.y = k.X, k.Y
+	case ed25519.PublicKey:
+		p.typ = KeyTypeEd25519
+		p.ed = k
+	default:
+		return errors.New("unsupported public key type")
+	}
+	return nil
+}
+
+// MarshalText encodes the key as a PKIX "PUBLIC KEY" PEM block.
 func (p *PublicKey) MarshalText() (text []byte, err error) {
-	pub := ecdsa.PublicKey{Curve: elliptic.P256(), X: p.x, Y: p.y}
-	x, err := x509.MarshalPKIXPublicKey(&pub)
+	x, err := x509.MarshalPKIXPublicKey(p.cryptoKey())
 	if err != nil {
 		return nil, err
 	}
 	b := pem.Block{
-		Type:  "DSA PUBLIC KEY",
-		Bytes: x,
+		Type:    "PUBLIC KEY",
+		Headers: pemHeaders(p.version),
+		Bytes:   x,
 	}
 	return pem.EncodeToMemory(&b), nil
 }
 
+func pemHeaders(v IDVersion) map[string]string {
+	if v == IDVersionSHA1 {
+		return nil
+	}
+	return map[string]string{pemVersionHeader: v.String()}
+}
+
+func pemVersion(b *pem.Block) (IDVersion, error) {
+	if str, ok := b.Headers[pemVersionHeader]; ok {
+		return ParseIDVersion(str)
+	}
+	return IDVersionSHA1, nil
+}
+
+// UnmarshalText decodes a PKIX "PUBLIC KEY" PEM block.
+// Blocks written by older versions ("DSA PUBLIC KEY") are also accepted.
 func (p *PublicKey) UnmarshalText(text []byte) error {
 	for {
 		b, r := pem.Decode(text)
 		if b != nil {
-			if b.Type == "DSA PUBLIC KEY" {
+			if b.Type == "PUBLIC KEY" || b.Type == "DSA PUBLIC KEY" {
 				k, err := x509.ParsePKIXPublicKey(b.Bytes)
 				if err != nil {
 					return err
 				}
-				p.x = k.(*ecdsa.PublicKey).X
-				p.y = k.(*ecdsa.PublicKey).Y
+				v, err := pemVersion(b)
+				if err != nil {
+					return err
+				}
+				var key PublicKey
+				err = key.setCryptoKey(k)
+				if err != nil {
+					return err
+				}
+				key.version = v
+				*p = key
 				return nil
 			}
 		} else {
@@ -75,18 +190,58 @@ func (p *PublicKey) UnmarshalText(text []byte) error {
 	return errors.New("Public key block not found")
 }
 
-// GeneratePrivateKey generates new ECDSA key pair.
+// GeneratePrivateKey generates new ECDSA key pair with DefaultIDVersion.
 func GeneratePrivateKey() *PrivateKey {
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err == nil {
 		return &PrivateKey{
-			PublicKey: PublicKey{x: key.X, y: key.Y},
+			PublicKey: PublicKey{x: key.X, y: key.Y, version: DefaultIDVersion},
 			d:         key.D,
 		}
 	}
 	return nil
 }
 
+// GenerateEd25519PrivateKey generates new Ed25519 key pair with DefaultIDVersion.
+func GenerateEd25519PrivateKey() *PrivateKey {
+	pub, pri, err := ed25519.GenerateKey(rand.Reader)
+	if err == nil {
+		return &PrivateKey{
+			PublicKey: PublicKey{typ: KeyTypeEd25519, ed: pub, version: DefaultIDVersion},
+			ed:        pri,
+		}
+	}
+	return nil
+}
+
+// GenerateKey generates new key pair of the given type.
+func GenerateKey(typ KeyType) (*PrivateKey, error) {
+	var key *PrivateKey
+	switch typ {
+	case KeyTypeECDSA:
+		key = GeneratePrivateKey()
+	case KeyTypeEd25519:
+		key = GenerateEd25519PrivateKey()
+	default:
+		return nil, errors.New("unknown key type")
+	}
+	if key == nil {
+		return nil, errors.New("cannot generate key")
+	}
+	return key, nil
+}
+
+// WithVersion returns a copy of the key that uses the given IDVersion.
+// The key material is unchanged but the digest, and therefore the NodeID, differs.
+func (p *PrivateKey) WithVersion(v IDVersion) (*PrivateKey, error) {
+	if !v.valid() {
+		return nil, errors.New("unknown id version")
+	}
+	key := *p
+	key.version = v
+	return &key, nil
+}
+
 // PrivateKeyFromString generates PrivateKey from the given base58-encoded string.
 func PrivateKeyFromString(str string) *PrivateKey {
 	b, err := base58.DecodeToBig([]byte(str))
@@ -105,6 +260,7 @@ func PrivateKeyFromString(str string) *PrivateKey {
 }
 
 // String returns the private key as a base58-encoded byte array.
+// The result contains the raw key; use MarshalEncryptedText to store a key.
 func (p *PrivateKey) String() string {
 	data, _ := msgpack.Marshal(p)
 	return string(base58.EncodeBig(nil, big.NewInt(0).SetBytes(data)))
@@ -115,79 +271,188 @@ func (p *PrivateKey) verifyKey() bool {
 	return p.PublicKey.Verify(data, p.Sign(data))
 }
 
-func (p *PrivateKey) Sign(data []byte) *Signature {
-	key := ecdsa.PrivateKey{
+func (p *PrivateKey) cryptoKey() interface{} {
+	if p.typ == KeyTypeEd25519 {
+		return p.ed
+	}
+	return &ecdsa.PrivateKey{
 		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: p.x, Y: p.y},
 		D:         p.d,
 	}
-	hash := sha1.Sum(data)
-	r, s, err := ecdsa.Sign(rand.Reader, &key, hash[:])
+}
+
+func (p *PrivateKey) setCryptoKey(k interface{}) error {
+	switch k := k.(type) {
+	case *ecdsa.PrivateKey:
+		err := p.PublicKey.setCryptoKey(&k.PublicKey)
+		if err != nil {
+			return err
+		}
+		p.d = k.D
+	case ed25519.PrivateKey:
+		err := p.PublicKey.setCryptoKey(k.Public())
+		if err != nil {
+			return err
+		}
+		p.ed = k
+	default:
+		return errors.New("unsupported private key type")
+	}
+	return nil
+}
+
+func (p *PrivateKey) Sign(data []byte) *Signature {
+	if p.typ == KeyTypeEd25519 {
+		if len(p.ed) != ed25519.PrivateKeySize {
+			return nil
+		}
+		return &Signature{ed: ed25519.Sign(p.ed, data), version: p.version}
+	}
+	key := p.cryptoKey().(*ecdsa.PrivateKey)
+	hash := p.version.sum(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
 	if err == nil {
-		return &Signature{r: r, s: s}
+		return &Signature{r: r, s: s, version: p.version}
 	}
 	return nil
 }
 
+// MarshalText encodes the key as a PKCS#8 "PRIVATE KEY" PEM block.
 func (p *PrivateKey) MarshalText() (text []byte, err error) {
-	pri := ecdsa.PrivateKey{
-		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: p.x, Y: p.y},
-		D:         p.d,
-	}
-	x, err := x509.MarshalECPrivateKey(&pri)
+	x, err := x509.MarshalPKCS8PrivateKey(p.cryptoKey())
 	if err != nil {
 		return nil, err
 	}
 	b := pem.Block{
-		Type:  "DSA PRIVATE KEY",
-		Bytes: x,
+		Type:    "PRIVATE KEY",
+		Headers: pemHeaders(p.version),
+		Bytes:   x,
 	}
 	return pem.EncodeToMemory(&b), nil
 }
 
+// UnmarshalText decodes a PKCS#8 "PRIVATE KEY" PEM block.
+// SEC 1 EC keys, including the "DSA PRIVATE KEY" blocks written by older
+// versions, are also accepted.
 func (p *PrivateKey) UnmarshalText(text []byte) error {
 	for {
 		b, r := pem.Decode(text)
 		if b != nil {
-			if b.Type == "DSA PRIVATE KEY" {
-				k, err := x509.ParseECPrivateKey(b.Bytes)
-				if err != nil {
-					return err
-				}
-				p.d = k.D
-				p.PublicKey.x = k.PublicKey.X
-				p.PublicKey.y = k.PublicKey.Y
-				return nil
+			var k interface{}
+			var err error
+			switch b.Type {
+			case "PRIVATE KEY":
+				k, err = x509.ParsePKCS8PrivateKey(b.Bytes)
+			case "EC PRIVATE KEY", "DSA PRIVATE KEY":
+				k, err = x509.ParseECPrivateKey(b.Bytes)
+			default:
+				text = r
+				continue
 			}
+			if err != nil {
+				return err
+			}
+			v, err := pemVersion(b)
+			if err != nil {
+				return err
+			}
+			var key PrivateKey
+			err = key.setCryptoKey(k)
+			if err != nil {
+				return err
+			}
+			key.version = v
+			*p = key
+			return nil
 		} else {
 			break
 		}
-		text = r
 	}
 	return errors.New("Private key block not found")
 }
 
+// Verify reports whether sign is a valid signature of data.
+// The signature must have been made with the same IDVersion as the key.
 func (p *PublicKey) Verify(data []byte, sign *Signature) bool {
-	key := ecdsa.PublicKey{
-		Curve: elliptic.P256(),
-		X:     p.x,
-		Y:     p.y,
+	if sign == nil || sign.version != p.version || p.IsZero() {
+		return false
+	}
+	if p.typ == KeyTypeEd25519 {
+		if len(p.ed) != ed25519.PublicKeySize || sign.ed == nil {
+			return false
+		}
+		return ed25519.Verify(p.ed, data, sign.ed)
 	}
-	hash := sha1.Sum(data)
-	return ecdsa.Verify(&key, hash[:], sign.r, sign.s)
+	if sign.r == nil || sign.s == nil {
+		return false
+	}
+	key := p.cryptoKey().(*ecdsa.PublicKey)
+	hash := p.version.sum(data)
+	return ecdsa.Verify(key, hash, sign.r, sign.s)
 }
 
 func (p *PublicKey) IsZero() bool {
+	if p.typ == KeyTypeEd25519 {
+		return len(p.ed) == 0
+	}
 	return (p.x == nil || p.y == nil || p.x.Int64() == 0 || p.y.Int64() == 0)
 }
 
+// encodeVersion adds the version to a msgpack map.
+// Legacy values omit it so that they stay readable by older nodes.
+func encodeVersion(m map[string][]byte, v IDVersion) {
+	if v != IDVersionSHA1 {
+		m["v"] = []byte{byte(v)}
+	}
+}
+
+func decodeVersion(m map[interface{}]interface{}) (IDVersion, error) {
+	b, ok := m["v"].([]byte)
+	if !ok {
+		return IDVersionSHA1, nil
+	}
+	if len(b) != 1 || !IDVersion(b[0]).valid() {
+		return 0, errors.New("unknown id version")
+	}
+	return IDVersion(b[0]), nil
+}
+
+// encodeKeyType adds the key type to a msgpack map.
+// ECDSA keys omit it so that they stay readable by older nodes.
+func encodeKeyType(m map[string][]byte, t KeyType) {
+	if t != KeyTypeECDSA {
+		m["t"] = []byte{byte(t)}
+	}
+}
+
+func decodeKeyType(m map[interface{}]interface{}) (KeyType, error) {
+	b, ok := m["t"].([]byte)
+	if !ok {
+		return KeyTypeECDSA, nil
+	}
+	if len(b) != 1 || (KeyType(b[0]) != KeyTypeECDSA && KeyType(b[0]) != KeyTypeEd25519) {
+		return 0, errors.New("unknown key type")
+	}
+	return KeyType(b[0]), nil
+}
+
 func init() {
 	msgpack.Register(reflect.TypeOf(Signature{}),
 		func(e *msgpack.Encoder, v reflect.Value) error {
 			sign := v.Interface().(Signature)
-			return e.Encode(map[string][]byte{
-				"r": sign.r.Bytes(),
-				"s": sign.s.Bytes(),
-			})
+			var m map[string][]byte
+			if sign.ed != nil {
+				m = map[string][]byte{"e": sign.ed}
+			} else if sign.r == nil || sign.s == nil {
+				return e.Encode(map[string][]byte{})
+			} else {
+				m = map[string][]byte{
+					"r": sign.r.Bytes(),
+					"s": sign.s.Bytes(),
+				}
+			}
+			encodeVersion(m, sign.version)
+			return e.Encode(m)
 		},
 		func(d *msgpack.Decoder, v reflect.Value) error {
 			i, err := d.DecodeMap()
@@ -195,11 +460,20 @@ func init() {
 				return err
 			}
 			m := i.(map[interface{}]interface{})
+			ver, err := decodeVersion(m)
+			if err != nil {
+				return err
+			}
+			if ed, ok := m["e"].([]byte); ok {
+				v.Set(reflect.ValueOf(Signature{ed: ed, version: ver}))
+				return nil
+			}
 			if r, ok := m["r"].([]byte); ok {
 				if s, ok := m["s"].([]byte); ok {
 					v.Set(reflect.ValueOf(Signature{
-						r: big.NewInt(0).SetBytes(r),
-						s: big.NewInt(0).SetBytes(s),
+						r:       big.NewInt(0).SetBytes(r),
+						s:       big.NewInt(0).SetBytes(s),
+						version: ver,
 					}))
 				}
 			}
@@ -209,11 +483,19 @@ func init() {
 	msgpack.Register(reflect.TypeOf(PrivateKey{}),
 		func(e *msgpack.Encoder, v reflect.Value) error {
 			sign := v.Interface().(PrivateKey)
-			return e.Encode(map[string][]byte{
-				"x": sign.x.Bytes(),
-				"y": sign.y.Bytes(),
-				"d": sign.d.Bytes(),
-			})
+			var m map[string][]byte
+			if sign.typ == KeyTypeEd25519 {
+				m = map[string][]byte{"k": sign.ed.Seed()}
+			} else {
+				m = map[string][]byte{
+					"x": sign.x.Bytes(),
+					"y": sign.y.Bytes(),
+					"d": sign.d.Bytes(),
+				}
+			}
+			encodeKeyType(m, sign.typ)
+			encodeVersion(m, sign.version)
+			return e.Encode(m)
 		},
 		func(d *msgpack.Decoder, v reflect.Value) error {
 			i, err := d.DecodeMap()
@@ -221,13 +503,36 @@ func init() {
 				return err
 			}
 			m := i.(map[interface{}]interface{})
+			ver, err := decodeVersion(m)
+			if err != nil {
+				return err
+			}
+			typ, err := decodeKeyType(m)
+			if err != nil {
+				return err
+			}
+			if typ == KeyTypeEd25519 {
+				if seed, ok := m["k"].([]byte); ok && len(seed) == ed25519.SeedSize {
+					pri := ed25519.NewKeyFromSeed(seed)
+					v.Set(reflect.ValueOf(PrivateKey{
+						PublicKey: PublicKey{
+							typ:     typ,
+							ed:      pri.Public().(ed25519.PublicKey),
+							version: ver,
+						},
+						ed: pri,
+					}))
+				}
+				return nil
+			}
 			if x, ok := m["x"].([]byte); ok {
 				if y, ok := m["y"].([]byte); ok {
 					if d, ok := m["d"].([]byte); ok {
 						v.Set(reflect.ValueOf(PrivateKey{
 							PublicKey: PublicKey{
-								x: big.NewInt(0).SetBytes(x),
-								y: big.NewInt(0).SetBytes(y),
+								x:       big.NewInt(0).SetBytes(x),
+								y:       big.NewInt(0).SetBytes(y),
+								version: ver,
 							},
 							d: big.NewInt(0).SetBytes(d),
 						}))
@@ -240,10 +545,18 @@ func init() {
 	msgpack.Register(reflect.TypeOf(PublicKey{}),
 		func(e *msgpack.Encoder, v reflect.Value) error {
 			sign := v.Interface().(PublicKey)
-			return e.Encode(map[string][]byte{
-				"x": sign.x.Bytes(),
-				"y": sign.y.Bytes(),
-			})
+			var m map[string][]byte
+			if sign.typ == KeyTypeEd25519 {
+				m = map[string][]byte{"k": sign.ed}
+			} else {
+				m = map[string][]byte{
+					"x": sign.x.Bytes(),
+					"y": sign.y.Bytes(),
+				}
+			}
+			encodeKeyType(m, sign.typ)
+			encodeVersion(m, sign.version)
+			return e.Encode(m)
 		},
 		func(d *msgpack.Decoder, v reflect.Value) error {
 			i, err := d.DecodeMap()
@@ -251,11 +564,30 @@ func init() {
 				return err
 			}
 			m := i.(map[interface{}]interface{})
+			ver, err := decodeVersion(m)
+			if err != nil {
+				return err
+			}
+			typ, err := decodeKeyType(m)
+			if err != nil {
+				return err
+			}
+			if typ == KeyTypeEd25519 {
+				if k, ok := m["k"].([]byte); ok && len(k) == ed25519.PublicKeySize {
+					v.Set(reflect.ValueOf(PublicKey{
+						typ:     typ,
+						ed:      ed25519.PublicKey(k),
+						version: ver,
+					}))
+				}
+				return nil
+			}
 			if x, ok := m["x"].([]byte); ok {
 				if y, ok := m["y"].([]byte); ok {
 					v.Set(reflect.ValueOf(PublicKey{
-						x: big.NewInt(0).SetBytes(x),
-						y: big.NewInt(0).SetBytes(y),
+						x:       big.NewInt(0).SetBytes(x),
+						y:       big.NewInt(0).SetBytes(y),
+						version: ver,
 					}))
 				}
 			}
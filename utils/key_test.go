@@ -1,6 +1,12 @@
 package utils
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
 	"testing"
 
 	"github.com/vmihailenco/msgpack"
@@ -16,6 +22,27 @@ func TestKeySignature(t *testing.T) {
 	}
 }
 
+func TestKeyZero(t *testing.T) {
+	key := GeneratePrivateKey()
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	sign := key.Sign(data)
+
+	b, _ := msgpack.Marshal(map[string][]byte{})
+	var decoded PublicKey
+	msgpack.Unmarshal(b, &decoded)
+	for _, p := range []PublicKey{{}, decoded} {
+		if !p.IsZero() {
+			t.Errorf("key should be zero")
+		}
+		if p.Digest() == key.Digest() {
+			t.Errorf("zero key should not have the digest of the key")
+		}
+		if p.Verify(data, sign) {
+			t.Errorf("zero key should not verify signatures")
+		}
+	}
+}
+
 func TestKeyString(t *testing.T) {
 	key := GeneratePrivateKey()
 	data := "The quick brown fox jumps over the lazy dog"
@@ -99,3 +126,141 @@ func TestKeyPEM(t *testing.T) {
 		t.Errorf("cannot unmarshal PublicKey")
 	}
 }
+
+func TestKeyVersion(t *testing.T) {
+	key := GeneratePrivateKey()
+	legacy, err := key.WithVersion(IDVersionSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("The quick brown fox jumps over the lazy dog")
+
+	if key.Digest().Cmp(legacy.Digest()) == 0 {
+		t.Errorf("digests of different versions should differ")
+	}
+	if !legacy.Verify(data, legacy.Sign(data)) {
+		t.Errorf("varification failed")
+	}
+	if key.Verify(data, legacy.Sign(data)) {
+		t.Errorf("signature of a different version should be rejected")
+	}
+
+	mkey, err := key.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ukey PrivateKey
+	if err := ukey.UnmarshalText(mkey); err != nil {
+		t.Fatal(err)
+	}
+	if ukey.Version() != key.Version() || ukey.Digest().Cmp(key.Digest()) != 0 {
+		t.Errorf("PEM should keep the version")
+	}
+
+	mlegacy, err := legacy.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(mlegacy), pemVersionHeader) {
+		t.Errorf("legacy PEM should not have a version header")
+	}
+
+	mpub, err := msgpack.Marshal(key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upub PublicKey
+	if err := msgpack.Unmarshal(mpub, &upub); err != nil {
+		t.Fatal(err)
+	}
+	if !upub.Verify(data, key.Sign(data)) {
+		t.Errorf("varification failed")
+	}
+}
+
+func TestKeyEd25519(t *testing.T) {
+	key := GenerateEd25519PrivateKey()
+	data := []byte("The quick brown fox jumps over the lazy dog")
+
+	if key.Type() != KeyTypeEd25519 {
+		t.Errorf("wrong Type: %v; expects %v", key.Type(), KeyTypeEd25519)
+	}
+	if !key.Verify(data, key.Sign(data)) {
+		t.Errorf("varification failed")
+	}
+	if GeneratePrivateKey().Verify(data, key.Sign(data)) {
+		t.Errorf("signature of a different key should be rejected")
+	}
+
+	key2 := PrivateKeyFromString(key.String())
+	if key2 == nil || key2.Digest().Cmp(key.Digest()) != 0 {
+		t.Fatalf("failed to generate PrivateKey from string")
+	}
+
+	mpub, err := msgpack.Marshal(key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msign, err := msgpack.Marshal(key2.Sign(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upub PublicKey
+	if err := msgpack.Unmarshal(mpub, &upub); err != nil {
+		t.Fatal(err)
+	}
+	var usign Signature
+	if err := msgpack.Unmarshal(msign, &usign); err != nil {
+		t.Fatal(err)
+	}
+	if !upub.Verify(data, &usign) {
+		t.Errorf("varification failed")
+	}
+
+	mkey, err := key.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ukey PrivateKey
+	if err := ukey.UnmarshalText(mkey); err != nil {
+		t.Fatal(err)
+	}
+	if ukey.Type() != KeyTypeEd25519 || ukey.Digest().Cmp(key.Digest()) != 0 {
+		t.Errorf("PEM should keep the key")
+	}
+
+	mpem, err := key.PublicKey.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upub.UnmarshalText(mpem); err != nil {
+		t.Fatal(err)
+	}
+	if !upub.Verify(data, key.Sign(data)) {
+		t.Errorf("varification failed")
+	}
+}
+
+func TestKeyLegacyPEM(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := pem.EncodeToMemory(&pem.Block{Type: "DSA PRIVATE KEY", Bytes: x})
+
+	var ukey PrivateKey
+	if err := ukey.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if ukey.Type() != KeyTypeECDSA || ukey.Version() != IDVersionSHA1 {
+		t.Errorf("legacy key should be loaded as %v/%v", KeyTypeECDSA, IDVersionSHA1)
+	}
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	if !ukey.Verify(data, ukey.Sign(data)) {
+		t.Errorf("varification failed")
+	}
+}
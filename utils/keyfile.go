@@ -0,0 +1,294 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	encryptedKeyBlockType  = "MURCOTT ENCRYPTED PRIVATE KEY"
+	encryptedDataBlockType = "MURCOTT ENCRYPTED DATA"
+)
+
+// Parameters of the scrypt key derivation for newly encrypted keys.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Limits of the scrypt parameters read from key files, so that a crafted
+// file cannot make the derivation use gigabytes of memory or run for hours.
+const (
+	maxScryptN  = 1 << 20
+	maxScryptRP = 1 << 16
+)
+
+// ErrWrongPassphrase is returned when an encrypted key cannot be decrypted.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// MarshalEncryptedText encodes the key as a PEM block encrypted with the passphrase.
+//
+// The key is derived from the passphrase with scrypt and the PEM encoding of
+// the private key is sealed with AES-256-GCM. The KDF parameters, salt and
+// nonce are stored in the block headers and authenticated with the ciphertext.
+func (p *PrivateKey) MarshalEncryptedText(passphrase []byte) ([]byte, error) {
+	plain, err := p.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewDataCipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return c.seal(encryptedKeyBlockType, plain)
+}
+
+// UnmarshalEncryptedText decodes a PEM block written by MarshalEncryptedText.
+func (p *PrivateKey) UnmarshalEncryptedText(text []byte, passphrase []byte) error {
+	b := findEncryptedBlock(text, encryptedKeyBlockType)
+	if b == nil {
+		return errors.New("Encrypted private key block not found")
+	}
+	plain, _, err := openEncryptedBlock(b, passphrase)
+	if err != nil {
+		return err
+	}
+	return p.UnmarshalText(plain)
+}
+
+// DataCipher encrypts other files of an identity in the same way as its key
+// file. The key is derived once, so that files written often do not run
+// scrypt on every write; each write gets a new nonce.
+type DataCipher struct {
+	aead    cipher.AEAD
+	headers map[string]string
+}
+
+// NewDataCipher derives a key from the passphrase with a new salt.
+func NewDataCipher(passphrase []byte) (*DataCipher, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{
+		"KDF":        "scrypt",
+		"KDF-Params": fmt.Sprintf("N=%d,r=%d,p=%d", scryptN, scryptR, scryptP),
+		"Salt":       hex.EncodeToString(salt),
+		"Cipher":     "aes-256-gcm",
+	}
+	aead, err := newKeyFileCipher(passphrase, headers)
+	if err != nil {
+		return nil, err
+	}
+	return &DataCipher{aead: aead, headers: headers}, nil
+}
+
+// Seal encodes the data as a PEM block encrypted with the key of the cipher.
+func (c *DataCipher) Seal(plain []byte) ([]byte, error) {
+	return c.seal(encryptedDataBlockType, plain)
+}
+
+func (c *DataCipher) seal(typ string, plain []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string)
+	for k, v := range c.headers {
+		headers[k] = v
+	}
+	headers["Nonce"] = hex.EncodeToString(nonce)
+
+	b := pem.Block{
+		Type:    typ,
+		Headers: headers,
+		Bytes:   c.aead.Seal(nil, nonce, plain, keyFileAdditionalData(typ, headers)),
+	}
+	return pem.EncodeToMemory(&b), nil
+}
+
+// OpenData decodes a PEM block written by DataCipher.Seal. It also returns a
+// cipher with the key of the block, so that the data can be written again
+// without deriving the key another time.
+func OpenData(text []byte, passphrase []byte) ([]byte, *DataCipher, error) {
+	b := findEncryptedBlock(text, encryptedDataBlockType)
+	if b == nil {
+		return nil, nil, errors.New("Encrypted data block not found")
+	}
+	return openEncryptedBlock(b, passphrase)
+}
+
+func openEncryptedBlock(b *pem.Block, passphrase []byte) ([]byte, *DataCipher, error) {
+	if b.Headers["Cipher"] != "aes-256-gcm" {
+		return nil, nil, errors.New("unsupported cipher")
+	}
+	nonce, err := hex.DecodeString(b.Headers["Nonce"])
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newKeyFileCipher(passphrase, b.Headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, nil, errors.New("invalid nonce")
+	}
+	plain, err := aead.Open(nil, nonce, b.Bytes, keyFileAdditionalData(b.Type, b.Headers))
+	if err != nil {
+		return nil, nil, ErrWrongPassphrase
+	}
+	headers := make(map[string]string)
+	for _, k := range []string{"KDF", "KDF-Params", "Salt", "Cipher"} {
+		headers[k] = b.Headers[k]
+	}
+	return plain, &DataCipher{aead: aead, headers: headers}, nil
+}
+
+// IsEncryptedKey reports whether text contains an encrypted private key.
+func IsEncryptedKey(text []byte) bool {
+	return findEncryptedBlock(text, encryptedKeyBlockType) != nil
+}
+
+// IsEncryptedData reports whether text contains data sealed by DataCipher.
+func IsEncryptedData(text []byte) bool {
+	return findEncryptedBlock(text, encryptedDataBlockType) != nil
+}
+
+func findEncryptedBlock(text []byte, typ string) *pem.Block {
+	for {
+		b, r := pem.Decode(text)
+		if b == nil {
+			return nil
+		}
+		if b.Type == typ {
+			return b
+		}
+		text = r
+	}
+}
+
+func newKeyFileCipher(passphrase []byte, headers map[string]string) (cipher.AEAD, error) {
+	if headers["KDF"] != "scrypt" {
+		return nil, errors.New("unsupported key derivation function")
+	}
+	var n, r, p int
+	_, err := fmt.Sscanf(headers["KDF-Params"], "N=%d,r=%d,p=%d", &n, &r, &p)
+	if err != nil {
+		return nil, errors.New("invalid key derivation parameters")
+	}
+	if n <= 1 || n > maxScryptN || r <= 0 || p <= 0 || r > maxScryptRP || p > maxScryptRP || r*p > maxScryptRP {
+		return nil, errors.New("key derivation parameters out of range")
+	}
+	salt, err := hex.DecodeString(headers["Salt"])
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func keyFileAdditionalData(typ string, headers map[string]string) []byte {
+	return []byte(typ + "\n" +
+		headers["KDF"] + "\n" +
+		headers["KDF-Params"] + "\n" +
+		headers["Salt"] + "\n" +
+		headers["Cipher"])
+}
+
+// LoadPrivateKey reads a private key from the file.
+// If the key is encrypted, passphrase is called to obtain the passphrase.
+func LoadPrivateKey(path string, passphrase func() ([]byte, error)) (*PrivateKey, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var key PrivateKey
+	if IsEncryptedKey(text) {
+		if passphrase == nil {
+			return nil, errors.New("private key is encrypted")
+		}
+		pass, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		err = key.UnmarshalEncryptedText(text, pass)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = key.UnmarshalText(text)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+// SavePrivateKey writes the key to the file, readable only by the current user.
+// If passphrase is empty, the key is written unencrypted.
+func SavePrivateKey(path string, key *PrivateKey, passphrase []byte) error {
+	var text []byte
+	var err error
+	if len(passphrase) == 0 {
+		text, err = key.MarshalText()
+	} else {
+		text, err = key.MarshalEncryptedText(passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, text)
+}
+
+// WriteFileAtomic replaces the file with data, readable only by the current
+// user. The data is written to a new temporary file in the same directory
+// first, so that a failure never leaves a truncated file behind and a file
+// left over with a looser mode is never written to.
+func WriteFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = f.Chmod(0600)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
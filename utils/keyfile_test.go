@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyEncryptedText(t *testing.T) {
+	key := GenerateEd25519PrivateKey()
+	pass := []byte("correct horse battery staple")
+
+	text, err := key.MarshalEncryptedText(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedKey(text) {
+		t.Errorf("IsEncryptedKey() should return true")
+	}
+	plain, _ := key.MarshalText()
+	if IsEncryptedKey(plain) {
+		t.Errorf("IsEncryptedKey() should return false for a plain key")
+	}
+
+	var ukey PrivateKey
+	if err := ukey.UnmarshalEncryptedText(text, pass); err != nil {
+		t.Fatal(err)
+	}
+	if ukey.Digest().Cmp(key.Digest()) != 0 {
+		t.Errorf("decrypted key has wrong digest")
+	}
+
+	if err := ukey.UnmarshalEncryptedText(text, []byte("wrong")); err != ErrWrongPassphrase {
+		t.Errorf("wrong passphrase should return ErrWrongPassphrase: %v", err)
+	}
+
+	tampered := bytes.Replace(text, []byte("N=32768"), []byte("N=16384"), 1)
+	if err := ukey.UnmarshalEncryptedText(tampered, pass); err == nil {
+		t.Errorf("tampered headers should be rejected")
+	}
+
+	for _, params := range []string{"N=1073741824,r=8,p=1", "N=32768,r=65536,p=2", "N=32768,r=0,p=1"} {
+		crafted := bytes.Replace(text, []byte("N=32768,r=8,p=1"), []byte(params), 1)
+		if err := ukey.UnmarshalEncryptedText(crafted, pass); err == nil || err == ErrWrongPassphrase {
+			t.Errorf("%s should be rejected before the key is derived: %v", params, err)
+		}
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "murcott-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := GeneratePrivateKey()
+	pass := []byte("passphrase")
+	path := filepath.Join(dir, "id", "key")
+
+	if err := SavePrivateKey(path, key, pass); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("wrong file mode: %v; expects %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+
+	if _, err := LoadPrivateKey(path, nil); err == nil {
+		t.Errorf("encrypted key should not be loaded without passphrase")
+	}
+	ukey, err := LoadPrivateKey(path, func() ([]byte, error) { return pass, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ukey.Digest().Cmp(key.Digest()) != 0 {
+		t.Errorf("loaded key has wrong digest")
+	}
+
+	// A file left over where a temporary file used to be is not written to.
+	if err := ioutil.WriteFile(path+".tmp", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SavePrivateKey(path, key, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("unencrypted key should be readable only by the user: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(path + ".tmp"); len(data) != 0 {
+		t.Errorf("the key should not be written to an existing file")
+	}
+	ukey, err = LoadPrivateKey(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ukey.Digest().Cmp(key.Digest()) != 0 {
+		t.Errorf("loaded key has wrong digest")
+	}
+}
+
+func TestDataCipher(t *testing.T) {
+	pass := []byte("passphrase")
+	c, err := NewDataCipher(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	text, err := c.Seal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(text, data) {
+		t.Errorf("sealed data should not contain the plain text")
+	}
+	if _, _, err := OpenData(text, []byte("wrong")); err != ErrWrongPassphrase {
+		t.Errorf("OpenData() with a wrong passphrase returns %v; expects %v", err, ErrWrongPassphrase)
+	}
+	plain, c2, err := OpenData(text, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, data) {
+		t.Errorf("OpenData() returns %q; expects %q", plain, data)
+	}
+
+	// The returned cipher writes blocks that open with the same passphrase.
+	text2, err := c2.Seal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(text, text2) {
+		t.Errorf("each block should have a new nonce")
+	}
+	if plain, _, err := OpenData(text2, pass); err != nil || !bytes.Equal(plain, data) {
+		t.Errorf("OpenData() returns %q, %v; expects %q", plain, err, data)
+	}
+
+	key := GeneratePrivateKey()
+	ktext, err := key.MarshalEncryptedText(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := OpenData(ktext, pass); err == nil {
+		t.Errorf("a key block should not be opened as data")
+	}
+}
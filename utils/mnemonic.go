@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/tyler-smith/go-bip39/wordlists"
+)
+
+// A mnemonic encodes a header byte (key type and IDVersion), the 32-byte key
+// material and an 11-bit checksum as 25 words of the BIP-39 English word list.
+const (
+	mnemonicKeySize = 32
+	mnemonicWords   = 25
+	mnemonicBits    = 11
+)
+
+var wordIndex map[string]int
+var wordIndexOnce sync.Once
+
+func mnemonicWordIndex() map[string]int {
+	wordIndexOnce.Do(func() {
+		wordIndex = make(map[string]int, len(wordlists.English))
+		for i, w := range wordlists.English {
+			wordIndex[w] = i
+		}
+	})
+	return wordIndex
+}
+
+// Mnemonic returns the key as a phrase of 25 words that can be written down
+// as a backup. PrivateKeyFromMnemonic restores the same key, and therefore
+// the same NodeID, from the phrase.
+func (p *PrivateKey) Mnemonic() (string, error) {
+	m, err := p.material()
+	if err != nil {
+		return "", err
+	}
+	data := append([]byte{byte(p.typ)<<4 | byte(p.version)}, m...)
+
+	var n big.Int
+	n.SetBytes(data)
+	sum := sha256.Sum256(data)
+	n.Lsh(&n, mnemonicBits)
+	n.Or(&n, big.NewInt(int64(sum[0])<<3|int64(sum[1])>>5))
+
+	words := make([]string, mnemonicWords)
+	mask := big.NewInt(1<<mnemonicBits - 1)
+	for i := len(words) - 1; i >= 0; i-- {
+		var w big.Int
+		w.And(&n, mask)
+		words[i] = wordlists.English[w.Int64()]
+		n.Rsh(&n, mnemonicBits)
+	}
+	return strings.Join(words, " "), nil
+}
+
+// PrivateKeyFromMnemonic restores PrivateKey from the phrase returned by Mnemonic.
+func PrivateKeyFromMnemonic(phrase string) (*PrivateKey, error) {
+	words := strings.Fields(strings.ToLower(phrase))
+	if len(words) != mnemonicWords {
+		return nil, errors.New("wrong number of words")
+	}
+
+	index := mnemonicWordIndex()
+	var n big.Int
+	for _, w := range words {
+		i, ok := index[w]
+		if !ok {
+			return nil, errors.New("unknown word: " + w)
+		}
+		n.Lsh(&n, mnemonicBits)
+		n.Or(&n, big.NewInt(int64(i)))
+	}
+
+	checksum := new(big.Int).And(&n, big.NewInt(1<<mnemonicBits-1)).Int64()
+	n.Rsh(&n, mnemonicBits)
+	data := make([]byte, 1+mnemonicKeySize)
+	b := n.Bytes()
+	if len(b) > len(data) {
+		return nil, errors.New("invalid mnemonic")
+	}
+	copy(data[len(data)-len(b):], b)
+
+	sum := sha256.Sum256(data)
+	if checksum != int64(sum[0])<<3|int64(sum[1])>>5 {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	typ := KeyType(data[0] >> 4)
+	ver := IDVersion(data[0] & 0x0f)
+	if !ver.valid() {
+		return nil, errors.New("unknown id version")
+	}
+	material := data[1:]
+
+	key := &PrivateKey{}
+	switch typ {
+	case KeyTypeEd25519:
+		err := key.setCryptoKey(ed25519.NewKeyFromSeed(material))
+		if err != nil {
+			return nil, err
+		}
+	case KeyTypeECDSA:
+		curve := elliptic.P256()
+		d := new(big.Int).SetBytes(material)
+		if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+			return nil, errors.New("invalid private key")
+		}
+		x, y := curve.ScalarBaseMult(material)
+		err := key.setCryptoKey(&ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+			D:         d,
+		})
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unknown key type")
+	}
+	key.version = ver
+	return key, nil
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyMnemonic(t *testing.T) {
+	legacy, _ := GeneratePrivateKey().WithVersion(IDVersionSHA1)
+	keys := []*PrivateKey{
+		GeneratePrivateKey(),
+		GenerateEd25519PrivateKey(),
+		legacy,
+	}
+
+	for _, key := range keys {
+		phrase, err := key.Mnemonic()
+		if err != nil {
+			t.Fatal(err)
+		}
+		words := strings.Fields(phrase)
+		if len(words) != 25 {
+			t.Errorf("wrong number of words: %d; expects %d", len(words), 25)
+		}
+
+		phrase2, _ := key.Mnemonic()
+		if phrase != phrase2 {
+			t.Errorf("Mnemonic() should be deterministic")
+		}
+
+		ukey, err := PrivateKeyFromMnemonic(strings.ToUpper(phrase))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := key.NodeID([4]byte{1, 1, 1, 1})
+		uid := ukey.NodeID([4]byte{1, 1, 1, 1})
+		if id.String() != uid.String() {
+			t.Errorf("restored NodeID %s; expects %s", uid.String(), id.String())
+		}
+
+		data := []byte("The quick brown fox jumps over the lazy dog")
+		if !key.Verify(data, ukey.Sign(data)) {
+			t.Errorf("varification failed")
+		}
+
+		// The last word holds only the checksum.
+		last := words[len(words)-1]
+		words[len(words)-1] = "zoo"
+		if last == "zoo" {
+			words[len(words)-1] = "abandon"
+		}
+		if _, err := PrivateKeyFromMnemonic(strings.Join(words, " ")); err == nil {
+			t.Errorf("wrong checksum should be rejected")
+		}
+		if _, err := PrivateKeyFromMnemonic(strings.Join(words[1:], " ")); err == nil {
+			t.Errorf("missing word should be rejected")
+		}
+	}
+}
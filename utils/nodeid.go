@@ -2,13 +2,17 @@ package utils
 
 import (
 	"errors"
+	"fmt"
 	"math/big"
 	"reflect"
+	"strings"
 
 	"github.com/tv42/base58"
 	"github.com/vmihailenco/msgpack"
 )
 
+// NodeIDPrefix is the first byte of a legacy NodeID.
+// Newer IDVersions are encoded as NodeIDPrefix + version.
 const NodeIDPrefix = 144
 
 func init() {
@@ -36,11 +40,14 @@ type Namespace [4]byte
 
 // NodeID represents a 160-bit node identifier.
 type NodeID struct {
-	Digest PublicKeyDigest
-	NS     Namespace
+	Digest  PublicKeyDigest
+	NS      Namespace
+	Version IDVersion
 }
 
 // NewNodeID generates NodeID from the given namespace and publickey digest.
+// The returned NodeID has the legacy IDVersion; use PublicKey.NodeID to
+// keep the version of a key.
 func NewNodeID(ns Namespace, data PublicKeyDigest) NodeID {
 	return NodeID{NS: ns, Digest: data}
 }
@@ -51,9 +58,10 @@ func NewNodeIDFromBytes(b []byte) (NodeID, error) {
 	if len(b)-1 < len(ns) {
 		return NodeID{}, errors.New("too short bytes")
 	}
-	if b[0] != NodeIDPrefix {
+	if b[0] < NodeIDPrefix || !IDVersion(b[0]-NodeIDPrefix).valid() {
 		return NodeID{}, errors.New("invalid prefix")
 	}
+	ver := IDVersion(b[0] - NodeIDPrefix)
 	b = b[1:]
 	var digest PublicKeyDigest
 	if len(b) > len(ns)+len(digest) {
@@ -62,32 +70,61 @@ func NewNodeIDFromBytes(b []byte) (NodeID, error) {
 	copy(ns[:], b[:])
 	l := len(digest) - (len(b) - len(ns))
 	copy(digest[l:], b[len(ns):])
-	return NodeID{NS: ns, Digest: digest}, nil
+	return NodeID{NS: ns, Digest: digest, Version: ver}, nil
 }
 
 // NewNodeIDFromString generates NodeID from the given base58-encoded string.
+// Both legacy strings and strings with a version prefix ("v1.") are accepted.
 func NewNodeIDFromString(str string) (NodeID, error) {
+	ver := IDVersionSHA1
+	if z := strings.SplitN(str, ".", 2); len(z) == 2 {
+		var v uint8
+		if _, err := fmt.Sscanf(z[0], "v%d", &v); err != nil {
+			return NodeID{}, errors.New("invalid version prefix")
+		}
+		ver = IDVersion(v)
+		str = z[1]
+	}
 	i, err := base58.DecodeToBig([]byte(str))
 	if err != nil {
 		return NodeID{}, err
 	}
-	return NewNodeIDFromBytes(i.Bytes())
+	id, err := NewNodeIDFromBytes(i.Bytes())
+	if err != nil {
+		return NodeID{}, err
+	}
+	if id.Version != ver {
+		return NodeID{}, errors.New("version mismatch")
+	}
+	return id, nil
 }
 
 func NewRandomNodeID(ns Namespace) NodeID {
 	return NewNodeID(ns, GeneratePrivateKey().Digest())
 }
 
+// WithNS returns the identifier of the same key in the namespace, keeping its IDVersion.
+func (id NodeID) WithNS(ns Namespace) NodeID {
+	id.NS = ns
+	return id
+}
+
 // Bytes returns identifier as a big-endian byte array.
 func (id NodeID) Bytes() []byte {
-	return append([]byte{NodeIDPrefix}, append(id.NS[:], id.Digest[:]...)...)
+	prefix := NodeIDPrefix + byte(id.Version)
+	return append([]byte{prefix}, append(id.NS[:], id.Digest[:]...)...)
 }
 
 // String returns identifier as a base58-encoded byte array.
+// Non-legacy identifiers are prefixed with their version, e.g. "v1.".
 func (id NodeID) String() string {
 	var i big.Int
 	i.SetBytes(id.Bytes())
-	return string(base58.EncodeBig(nil, &i))
+	str := string(base58.EncodeBig(nil, &i))
+	if id.Version != IDVersionSHA1 {
+		str = fmt.Sprintf("v%d.", id.Version) + str
+	}
+	return str
 }
 
 func (d PublicKeyDigest) Xor(n PublicKeyDigest) PublicKeyDigest {
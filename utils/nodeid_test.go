@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/vmihailenco/msgpack"
@@ -41,3 +42,43 @@ func TestNodeIDNamespace(t *testing.T) {
 		t.Errorf("%v should not match %v", ns, n2)
 	}
 }
+
+func TestNodeIDVersion(t *testing.T) {
+	key := GeneratePrivateKey()
+	id := key.NodeID([4]byte{1, 1, 1, 1})
+	if id.Version != DefaultIDVersion {
+		t.Errorf("wrong Version: %d; expects %d", id.Version, DefaultIDVersion)
+	}
+
+	str := id.String()
+	if !strings.HasPrefix(str, "v1.") {
+		t.Errorf("%s should have a version prefix", str)
+	}
+	id2, err := NewNodeIDFromString(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id2.Version != id.Version || id.Digest.Cmp(id2.Digest) != 0 {
+		t.Errorf("failed to generate NodeID from string")
+	}
+
+	if _, err := NewNodeIDFromString(str[len("v1."):]); err == nil {
+		t.Errorf("NodeID without a matching version prefix should be rejected")
+	}
+
+	legacy := "ZXF3qv5dsuaXy2AAoj6nTdYVZQ4TdUtcUp"
+	id3, err := NewNodeIDFromString(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id3.Version != IDVersionSHA1 {
+		t.Errorf("wrong Version: %d; expects %d", id3.Version, IDVersionSHA1)
+	}
+	if id3.String() != legacy {
+		t.Errorf("wrong String(): %s; expects %s", id3.String(), legacy)
+	}
+
+	if g := id.WithNS([4]byte{1, 2, 3, 4}); g.Version != id.Version || !strings.HasPrefix(g.String(), "v1.") {
+		t.Errorf("WithNS() should keep the version: %s", g.String())
+	}
+}
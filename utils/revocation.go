@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"encoding/pem"
+	"errors"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+const revocationBlockType = "MURCOTT REVOCATION CERTIFICATE"
+
+// Revocation is a revocation certificate.
+// It is signed by the identity key and tells the network that the key must
+// not be trusted any more. A certificate can be generated in advance and
+// kept apart from the key, so that it can be published after the key is lost
+// or compromised.
+type Revocation struct {
+	Key    PublicKey `msgpack:"key"`
+	Reason string    `msgpack:"reason"`
+	Time   time.Time `msgpack:"time"`
+	S      Signature `msgpack:"sign"`
+}
+
+// NewRevocation generates a Revocation of the identity of key.
+func NewRevocation(key Signer, reason string) (*Revocation, error) {
+	r := &Revocation{
+		Key:    *key.Public(),
+		Reason: reason,
+		Time:   time.Now(),
+	}
+	sign := key.Sign(r.serialize())
+	if sign == nil {
+		return nil, errors.New("cannot sign revocation")
+	}
+	r.S = *sign
+	return r, nil
+}
+
+func (r *Revocation) serialize() []byte {
+	ary := []interface{}{
+		"revocation",
+		r.Key.NodeID(Namespace{}).Bytes(),
+		r.Reason,
+		r.Time.Unix(),
+	}
+
+	data, _ := msgpack.Marshal(ary)
+	return data
+}
+
+// Digest returns the digest of the revoked key.
+func (r *Revocation) Digest() PublicKeyDigest {
+	return r.Key.Digest()
+}
+
+// Verify reports whether the certificate is signed by the revoked key.
+func (r *Revocation) Verify() bool {
+	if r.Key.IsZero() {
+		return false
+	}
+	return r.Key.Verify(r.serialize(), &r.S)
+}
+
+// MarshalText encodes the certificate as a PEM block.
+func (r *Revocation) MarshalText() (text []byte, err error) {
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	b := pem.Block{Type: revocationBlockType, Bytes: data}
+	return pem.EncodeToMemory(&b), nil
+}
+
+// UnmarshalText decodes a PEM block written by MarshalText.
+func (r *Revocation) UnmarshalText(text []byte) error {
+	for {
+		b, rest := pem.Decode(text)
+		if b == nil {
+			return errors.New("Revocation certificate block not found")
+		}
+		if b.Type == revocationBlockType {
+			return msgpack.Unmarshal(b.Bytes, r)
+		}
+		text = rest
+	}
+}
+
+// RevocationKey returns the DHT key under which the revocation certificate
+// of the identity is published.
+func RevocationKey(id NodeID) string {
+	return "revocation:" + id.Digest.String()
+}
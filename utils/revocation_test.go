@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestRevocation(t *testing.T) {
+	key := GenerateEd25519PrivateKey()
+
+	r, err := NewRevocation(key, "key compromised")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Verify() {
+		t.Errorf("verification failed")
+	}
+	if r.Digest() != key.Digest() {
+		t.Errorf("Digest() should be %v; got %v", key.Digest(), r.Digest())
+	}
+
+	text, err := r.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r2 Revocation
+	err = r2.UnmarshalText(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r2.Verify() {
+		t.Errorf("verification failed after unmarshal")
+	}
+	if r2.Reason != r.Reason {
+		t.Errorf("Reason should be %q; got %q", r.Reason, r2.Reason)
+	}
+
+	r2.Reason = "superseded"
+	if r2.Verify() {
+		t.Errorf("modified certificate should not be verified")
+	}
+
+	r3 := *r
+	r3.Key = GeneratePrivateKey().PublicKey
+	if r3.Verify() {
+		t.Errorf("certificate with another key should not be verified")
+	}
+}
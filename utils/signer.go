@@ -0,0 +1,24 @@
+package utils
+
+import "crypto/ecdh"
+
+// Signer signs data on behalf of an identity.
+// PrivateKey is the in-memory implementation; others may keep the key
+// outside of the process.
+type Signer interface {
+	// Public returns the public key of the identity.
+	Public() *PublicKey
+	// Sign returns a signature of data, or nil if data cannot be signed.
+	Sign(data []byte) *Signature
+}
+
+// BoxKeyer is implemented by signers that can derive the box key of the
+// identity. The box key stays the same as long as the identity key does.
+type BoxKeyer interface {
+	BoxKey() (*ecdh.PrivateKey, error)
+}
+
+// Public returns the public key of the private key.
+func (p *PrivateKey) Public() *PublicKey {
+	return &p.PublicKey
+}
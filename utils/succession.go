@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// Succession is a key succession statement.
+// It is signed by the old identity key and tells contacts that the identity
+// has moved to the Next NodeID, e.g. after the key was rotated or upgraded.
+type Succession struct {
+	Old  PublicKey `msgpack:"old"`
+	Next NodeID    `msgpack:"next"`
+	Time time.Time `msgpack:"time"`
+	S    Signature `msgpack:"sign"`
+}
+
+// NewSuccession generates a Succession from the identity of old to next.
+func NewSuccession(old Signer, next NodeID) (*Succession, error) {
+	s := &Succession{
+		Old:  *old.Public(),
+		Next: next,
+		Time: time.Now(),
+	}
+	if s.Old.Digest() == next.Digest {
+		return nil, errors.New("next identity is the same as the old one")
+	}
+	sign := old.Sign(s.serialize())
+	if sign == nil {
+		return nil, errors.New("cannot sign succession")
+	}
+	s.S = *sign
+	return s, nil
+}
+
+func (s *Succession) serialize() []byte {
+	ary := []interface{}{
+		"succession",
+		s.Old.NodeID(s.Next.NS).Bytes(),
+		s.Next.Bytes(),
+		s.Time.Unix(),
+	}
+
+	data, _ := msgpack.Marshal(ary)
+	return data
+}
+
+// OldID returns the NodeID of the old identity in the namespace of Next.
+func (s *Succession) OldID() NodeID {
+	return s.Old.NodeID(s.Next.NS)
+}
+
+// Verify reports whether the statement is signed by the old key.
+func (s *Succession) Verify() bool {
+	if s.Old.IsZero() || s.Old.Digest() == s.Next.Digest {
+		return false
+	}
+	return s.Old.Verify(s.serialize(), &s.S)
+}
+
+// SuccessionKey returns the DHT key under which the succession statement
+// of the identity is published.
+func SuccessionKey(id NodeID) string {
+	return "succession:" + id.Digest.String()
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestSuccession(t *testing.T) {
+	ns := Namespace{1, 1, 1, 1}
+	old := GeneratePrivateKey()
+	next := GenerateEd25519PrivateKey().NodeID(ns)
+
+	s, err := NewSuccession(old, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Verify() {
+		t.Errorf("verification failed")
+	}
+	if s.OldID().Digest != old.Digest() {
+		t.Errorf("OldID() should be %v; got %v", old.NodeID(ns), s.OldID())
+	}
+
+	data, err := msgpack.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s2 Succession
+	err = msgpack.Unmarshal(data, &s2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s2.Verify() {
+		t.Errorf("verification failed after unmarshal")
+	}
+	if s2.Next.Digest != next.Digest {
+		t.Errorf("Next should be %v; got %v", next, s2.Next)
+	}
+
+	s2.Next = NewRandomNodeID(ns)
+	if s2.Verify() {
+		t.Errorf("modified statement should not be verified")
+	}
+
+	_, err = NewSuccession(old, old.NodeID(ns))
+	if err == nil {
+		t.Errorf("succession to the same identity should fail")
+	}
+}
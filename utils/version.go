@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// IDVersion identifies the hash algorithm used to derive NodeIDs from
+// public keys and to hash data before signing.
+//
+// Version 0 is the original scheme (SHA-1). Identities created with it keep
+// working: their NodeIDs and signatures are still decoded and verified.
+// Newer versions use SHA-256 truncated to the 160-bit digest length, so that
+// identities of every version share the same DHT key space.
+//
+// To migrate an existing identity, load the old key, call WithVersion and
+// save the result. The new key has the same key material but a different
+// NodeID, so contacts have to be told about the new identifier.
+type IDVersion uint8
+
+const (
+	// IDVersionSHA1 is the legacy scheme.
+	IDVersionSHA1 IDVersion = 0
+	// IDVersionSHA256 uses SHA-256 for digests and signatures.
+	IDVersionSHA256 IDVersion = 1
+)
+
+// DefaultIDVersion is used for newly generated keys.
+const DefaultIDVersion = IDVersionSHA256
+
+const maxIDVersion = IDVersionSHA256
+
+func (v IDVersion) valid() bool {
+	return v <= maxIDVersion
+}
+
+// Hash returns the hash function of the version.
+func (v IDVersion) Hash() crypto.Hash {
+	switch v {
+	case IDVersionSHA256:
+		return crypto.SHA256
+	default:
+		return crypto.SHA1
+	}
+}
+
+func (v IDVersion) sum(data []byte) []byte {
+	switch v {
+	case IDVersionSHA256:
+		h := sha256.Sum256(data)
+		return h[:]
+	default:
+		h := sha1.Sum(data)
+		return h[:]
+	}
+}
+
+// digest returns the first 160 bits of the hash of data.
+func (v IDVersion) digest(data []byte) PublicKeyDigest {
+	var d PublicKeyDigest
+	copy(d[:], v.sum(data))
+	return d
+}
+
+func (v IDVersion) String() string {
+	switch v {
+	case IDVersionSHA1:
+		return "sha1"
+	case IDVersionSHA256:
+		return "sha256"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(v))
+	}
+}
+
+// ParseIDVersion parses the string representation of IDVersion.
+func ParseIDVersion(str string) (IDVersion, error) {
+	for v := IDVersion(0); v <= maxIDVersion; v++ {
+		if v.String() == str {
+			return v, nil
+		}
+	}
+	return 0, errors.New("unknown id version")
+}